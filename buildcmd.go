@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/watchly/ngbuild/core"
+	"github.com/watchly/ngbuild/integrations/github"
+	"github.com/watchly/ngbuild/integrations/local"
+)
+
+// loadBuildConfig reads a BuildConfig from a json file, metadata can be given under "Metadata"
+func loadBuildConfig(path string) (*core.BuildConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		*core.BuildConfig
+		Metadata map[string]string
+	}{BuildConfig: core.NewBuildConfig()}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, err
+	}
+
+	for key, value := range file.Metadata {
+		file.BuildConfig.SetMetadata(key, value)
+	}
+	return file.BuildConfig, nil
+}
+
+// runBuildCommand is `ngbuild build <app> <group>`, it runs a single build and streams its output to the terminal,
+// returns the exit code of the build
+func runBuildCommand(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	configPath := flags.String("config", "", "json file describing the build, see core.BuildConfig")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ngbuild build [--config build.json] <app> <group>")
+		fmt.Fprintln(os.Stderr, "without --config the build is made from the apps defaults")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args) //nolint (errcheck)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	appName, group := flags.Arg(0), flags.Arg(1)
+
+	config := core.NewBuildConfig()
+	if *configPath != "" {
+		var err error
+		if config, err = loadBuildConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't load build config %s: %s\n", *configPath, err)
+			return 2
+		}
+	}
+
+	app, ok := loadCommandApp(appName)
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "Couldn't find app %s\n", appName)
+		return 2
+	}
+	defer app.Shutdown()
+
+	code, err := runBuild(app, group, config, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return code
+}
+
+// runReplayCommand is `ngbuild replay <app> <token>`, it runs the build token was made from again and streams its
+// output to the terminal, returns the exit code of the build
+func runReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ngbuild replay <app> <token>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args) //nolint (errcheck)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	appName, token := flags.Arg(0), flags.Arg(1)
+
+	app, ok := loadCommandApp(appName)
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "Couldn't find app %s\n", appName)
+		return 2
+	}
+	defer app.Shutdown()
+
+	code, err := streamBuild(app, func() (string, error) { return app.ReplayBuild(token) }, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return code
+}
+
+// loadCommandApp loads the app named appName for a build run from the command line. Only integrations that can
+// provide builds are attached, and github only as a provider, so nothing is posted to github or set up there and
+// there's no authenticating to wait for
+func loadCommandApp(appName string) (core.App, bool) {
+	core.SetIntegrations([]core.Integration{github.NewProvider(), local.New()})
+	core.GetApps()
+	return core.GetApp(appName)
+}
+
+// runBuild will run the build and copy its output to stdout/stderr until it has finished
+func runBuild(app core.App, group string, config *core.BuildConfig, stdout, stderr io.Writer) (int, error) {
+	return streamBuild(app, func() (string, error) { return app.NewBuild(group, config) }, stdout, stderr)
+}
+
+// streamBuild makes a build with submit, and copies its output to stdout/stderr until it has finished
+func streamBuild(app core.App, submit func() (string, error), stdout, stderr io.Writer) (int, error) {
+	// listen before the build exists so we can't miss its started event
+	started := make(chan string, 16)
+	startedHandler := core.OnBuildStarted(app, func(event core.BuildEvent) { started <- event.Token })
+	defer app.RemoveEventHandler(startedHandler)
+
+	token, err := submit()
+	if err != nil {
+		return 1, err
+	}
+
+	build, err := app.GetBuild(token)
+	if err != nil {
+		return 1, err
+	}
+
+	type result struct {
+		code int
+		err  error
+	}
+	finished := make(chan result, 1)
+	go func() {
+		code, err := build.Wait(context.Background())
+		finished <- result{code, err}
+	}()
+
+	var output sync.WaitGroup
+	streaming := false
+	stream := func() error {
+		if streaming {
+			return nil
+		}
+		streaming = true
+
+		for _, pipe := range []struct {
+			reader func() (io.Reader, error)
+			writer io.Writer
+		}{{build.Stdout, stdout}, {build.Stderr, stderr}} {
+			reader, err := pipe.reader()
+			if err != nil {
+				return err
+			}
+
+			output.Add(1)
+			go func(reader io.Reader, writer io.Writer) {
+				defer output.Done()
+				io.Copy(writer, reader) //nolint (errcheck)
+			}(reader, pipe.writer)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case startedToken := <-started:
+			if startedToken != token {
+				continue
+			}
+
+			if err := stream(); err != nil {
+				return 1, err
+			}
+		case res := <-finished:
+			// the started event may still be queued, builds that never started have no output
+			if err := stream(); err != nil && err != core.ErrProcessNotStarted {
+				return 1, err
+			}
+			output.Wait()
+			if res.err != nil {
+				return 1, res.err
+			}
+			if res.code != 0 {
+				if commandLine := build.CommandLine(); commandLine != "" {
+					return res.code, fmt.Errorf("Build failed, it %s", commandLine)
+				}
+				return res.code, errors.New("Build failed")
+			}
+			return 0, nil
+		}
+	}
+}
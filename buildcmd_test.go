@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/watchly/ngbuild/core"
+	"github.com/watchly/ngbuild/integrations/local"
+	"github.com/watchly/ngbuild/mocks"
+)
+
+// scriptIntegration provides builds by writing the given script as build.sh
+func scriptIntegration(script string) *mocks.Integration {
+	integration := &mocks.Integration{}
+	integration.On("Identifier").Return("script")
+	integration.On("IsProvider", mock.Anything).Return(true)
+	integration.On("ProvideFor", mock.Anything, mock.Anything, mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		dir := args.Get(2).(string)
+		ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte(script), 0755) //nolint (errcheck)
+	}).Return(nil)
+	return integration
+}
+
+func TestRunBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	app := core.NewTestApp("testapp", scriptIntegration("#!/bin/sh\necho out\necho err >&2\nexit 3\n"))
+	defer app.Shutdown()
+
+	config := core.NewBuildConfig()
+	config.Deadline = time.Second * 10
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code, err := runBuild(app, "group", config, stdout, stderr)
+	assert.Error(err)
+	assert.Equal(3, code)
+	assert.Equal("out\n", stdout.String())
+	assert.Equal("err\n", stderr.String())
+	assert.Len(app.GetBuildHistory("group"), 1)
+}
+
+func TestRunBuildLocal(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-local")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("#!/bin/sh\ncat message\n"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "message"), []byte("from a working copy\n"), 0644))
+
+	app := core.NewTestApp("testapp", local.New())
+	defer app.Shutdown()
+
+	config := core.NewBuildConfig()
+	config.HeadRepo = core.LocalRepoScheme + dir
+	config.Deadline = time.Second * 10
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code, err := runBuild(app, "group", config, stdout, stderr)
+	assert.NoError(err)
+	assert.Equal(0, code)
+	assert.Equal("from a working copy\n", stdout.String())
+}
+
+func TestLoadBuildConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	file, err := ioutil.TempFile("", "ngbuild-config")
+	require.NoError(err)
+	defer os.Remove(file.Name()) //nolint (errcheck)
+
+	_, err = file.WriteString(`{
+		"Title": "local build",
+		"BaseRepo": "git@github.com:watchly/ngbuild.git",
+		"BaseBranch": "master",
+		"BaseHash": "deadbeef",
+		"Metadata": { "github:BuildType": "commit" }
+	}`)
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	config, err := loadBuildConfig(file.Name())
+	require.NoError(err)
+	assert.Equal("local build", config.Title)
+	assert.Equal("deadbeef", config.BaseHash)
+	assert.Equal("commit", config.GetMetadata("github:BuildType"))
+}
@@ -1,11 +1,19 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
 )
 
 // getAppsLocation will check directories for a ngbuild.conf and an apps/ directory from there
@@ -18,20 +26,28 @@ func getAppsLocation() (string, error) {
 	return filepath.Join(dir, "apps"), nil
 }
 
-// GetApps will return App objects for all the apps we can find on this machine
-func GetApps() []App {
+var (
+	appsLock sync.Mutex
+	apps     = make(map[string]App)
+	// workspacesSwept is set once the first GetApps has swept old workspaces, hold appsLock to use it
+	workspacesSwept bool
+)
+
+// findAppDirs will return the names and directories of all the apps on disk, in the order they were found
+func findAppDirs() (names []string, dirs map[string]string) {
+	dirs = make(map[string]string)
+
 	appsLocation, err := getAppsLocation()
 	if err != nil {
-		return []App{}
+		return
 	}
 
 	perAppDirs, err := filepath.Glob(filepath.Join(appsLocation, "*"))
 	if err != nil {
 		logcritf("Couldn't glob %s: %s", appsLocation, err)
-		return []App{}
+		return
 	}
 
-	apps := []App{}
 	for _, appDir := range perAppDirs {
 		splitDirs := strings.Split(appDir, string(filepath.Separator))
 		if len(splitDirs) < 2 {
@@ -39,39 +55,159 @@ func GetApps() []App {
 			continue
 		}
 		name := splitDirs[len(splitDirs)-1]
-		enabledIntegrations := struct {
-			EnabledIntegrations []string `mapstructure:"enabledIntegrations"`
-		}{}
-		applyConfig(name, &enabledIntegrations) //nolint (errcheck)
-
-		integrations := GetIntegrations()
-		// christ this code, will remove all but the 'enabledIntegrations' from our integrations list
-		if len(enabledIntegrations.EnabledIntegrations) > 0 {
-			for finished := false; finished == false; {
-				finished = true
-				for i, integration := range integrations {
-					foundInEnabled := false
-					for _, enabledIntegration := range enabledIntegrations.EnabledIntegrations {
-						if enabledIntegration == integration.Identifier() {
-							foundInEnabled = true
-							break
-						}
-					}
-
-					if foundInEnabled == false {
-						integrations = append(integrations[:i], integrations[i+1:]...)
-						finished = false
-						break
-					}
-				}
+		names = append(names, name)
+		dirs[name] = appDir
+	}
+
+	return
+}
+
+// integrationsForApp will return the integrations the given app wants, if the app has `enabledIntegrations` set
+// only those are used, anything in `disabledIntegrations` is then removed from that
+func integrationsForApp(name string) []Integration {
+	cfg := struct {
+		EnabledIntegrations  []string `mapstructure:"enabledIntegrations"`
+		DisabledIntegrations []string `mapstructure:"disabledIntegrations"`
+	}{}
+	applyConfig(name, &cfg) //nolint (errcheck)
+
+	integrations := []Integration{}
+	for _, integration := range GetIntegrations(cfg.DisabledIntegrations...) {
+		if len(cfg.EnabledIntegrations) > 0 && getIndexOfString(cfg.EnabledIntegrations, integration.Identifier()) < 0 {
+			continue
+		}
+		integrations = append(integrations, integration)
+	}
+
+	return integrations
+}
+
+// GetApps will return App objects for all the apps we can find on this machine
+// apps are only constructed the first time they are found, every call after that will return the same App
+func GetApps() []App {
+	names, dirs := findAppDirs()
+
+	appsLock.Lock()
+	defer appsLock.Unlock()
+
+	foundApps := []App{}
+	for _, name := range names {
+		app, ok := apps[name]
+		if ok == false {
+			app = newApp(name, dirs[name], integrationsForApp(name))
+			apps[name] = app
+		}
+
+		foundApps = append(foundApps, app)
+	}
+
+	// workspaces are only left behind by previous runs of ngbuild, so there's nothing to sweep after startup
+	if workspacesSwept == false {
+		workspacesSwept = true
+		for _, app := range foundApps {
+			sweepAppWorkspaces(app, names)
+		}
+	}
+	atomic.StoreInt32(&appsLoaded, 1)
+
+	return foundApps
+}
+
+// sweepAppWorkspaces removes workspaces left behind in the apps buildLocation by previous runs of ngbuild. Only the
+// apps own workspaces are removed, apps can share a buildLocation, and never the workspace of a build it still has.
+// appNames are every app, so workspaces of apps whose names start with this ones aren't taken for its own
+func sweepAppWorkspaces(app App, appNames []string) {
+	var appConfig struct {
+		BuildLocation        string `mapstructure:"buildLocation"`
+		WorkspaceMaxAgeHours int    `mapstructure:"workspaceMaxAgeHours"`
+	}
+	if err := app.GlobalConfig(&appConfig); err != nil || appConfig.WorkspaceMaxAgeHours < 1 {
+		return
+	}
+
+	prefix := workspaceNamePrefix(app.Name())
+	var otherPrefixes []string
+	for _, name := range appNames {
+		if other := workspaceNamePrefix(name); other != prefix && strings.HasPrefix(other, prefix) {
+			otherPrefixes = append(otherPrefixes, other)
+		}
+	}
+	inUse := make(map[string]bool)
+	for _, build := range app.AllBuilds() {
+		if workspace := build.WorkspacePath(); workspace != "" {
+			inUse[filepath.Clean(workspace)] = true
+		}
+	}
+	keep := func(directory string) bool {
+		for _, other := range otherPrefixes {
+			if strings.HasPrefix(filepath.Base(directory), other) {
+				return true
 			}
 		}
-		app := newApp(name, appDir, integrations)
+		return inUse[filepath.Clean(directory)]
+	}
+
+	removed, err := sweepWorkspaces(appConfig.BuildLocation, prefix, time.Duration(appConfig.WorkspaceMaxAgeHours)*time.Hour, keep)
+	for _, directory := range removed {
+		app.Loginfof("removed old workspace %s", directory)
+	}
+	if err != nil {
+		app.Logwarnf("couldn't sweep old workspaces from %s: %s", appConfig.BuildLocation, err)
+	}
+}
+
+// ReloadApps will rescan the apps directory and re-read all config. New apps are constructed and attached to
+// their integrations, removed apps are detached and shutdown. Apps that are still around have their enabled
+// integrations brought up to date, their builds are left alone
+func ReloadApps() (added, removed []App) {
+	configCacheLock.Lock()
+	configCache = make(map[string]config)
+	configCacheLock.Unlock()
+	ConfigureLogging()
+
+	_, dirs := findAppDirs()
+
+	appsLock.Lock()
+	for name, existingApp := range apps {
+		a, ok := existingApp.(*app)
+		if ok == false {
+			continue
+		}
+
+		if _, stillExists := dirs[name]; stillExists == false {
+			for _, integration := range a.getIntegrations() {
+				integration.DetachFromApp(a) //nolint (errcheck)
+			}
+			a.Shutdown()
+			delete(apps, name)
+			removed = append(removed, a)
+			continue
+		}
+
+		a.setIntegrations(integrationsForApp(name))
+	}
+	previousApps := make(map[string]bool)
+	for name := range apps {
+		previousApps[name] = true
+	}
+	appsLock.Unlock()
 
-		apps = append(apps, app)
+	for _, app := range GetApps() {
+		if previousApps[app.Name()] == false {
+			added = append(added, app)
+		}
 	}
 
-	return apps
+	return
+}
+
+// GetApp will return the app with the given name, apps are found by GetApps
+func GetApp(name string) (App, bool) {
+	appsLock.Lock()
+	defer appsLock.Unlock()
+
+	app, ok := apps[name]
+	return app, ok
 }
 
 type app struct {
@@ -82,7 +218,15 @@ type app struct {
 	builds       map[string][]Build
 	integrations []Integration
 
+	// staticConfig is used instead of the config on disk when set, see NewTestApp
+	staticConfig config
+
 	bus *appbus
+
+	metrics *appMetrics
+
+	// newCommand is given to every build, tests set it to run builds without real processes
+	newCommand commandFactory
 }
 
 // NewApp will return a new app with the given name, the name should also be the directory name that the app will
@@ -94,7 +238,16 @@ func newApp(name, appLocation string, integrations []Integration) App {
 		builds:       make(map[string][]Build),
 		bus:          newAppBus(),
 		integrations: integrations,
+		metrics:      newAppMetrics(),
 	}
+	var appConfig struct {
+		ListenerTimeoutSeconds int `mapstructure:"listenerTimeoutSeconds"`
+	}
+	if err := app.GlobalConfig(&appConfig); err == nil && appConfig.ListenerTimeoutSeconds != 0 {
+		// negative timeouts never warn about slow listeners
+		app.bus.setListenerTimeout(time.Duration(appConfig.ListenerTimeoutSeconds) * time.Second)
+	}
+	OnBuildComplete(app, app.onBuildComplete)
 
 	for _, integration := range integrations {
 		integration.AttachToApp(app) //nolint (errcheck)
@@ -102,6 +255,33 @@ func newApp(name, appLocation string, integrations []Integration) App {
 	return app
 }
 
+func (a *app) getIntegrations() []Integration {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	return a.integrations
+}
+
+// setIntegrations will attach any integrations that are new to this app and detach any that are no longer wanted
+func (a *app) setIntegrations(integrations []Integration) {
+	a.m.Lock()
+	previousIntegrations := a.integrations
+	a.integrations = integrations
+	a.m.Unlock()
+
+	for _, integration := range previousIntegrations {
+		if getIndexOf(integrations, integration.Identifier()) < 0 {
+			integration.DetachFromApp(a) //nolint (errcheck)
+		}
+	}
+
+	for _, integration := range integrations {
+		if getIndexOf(previousIntegrations, integration.Identifier()) < 0 {
+			integration.AttachToApp(a) //nolint (errcheck)
+		}
+	}
+}
+
 // Name is the apps name
 func (a *app) Name() string {
 	if a == nil {
@@ -124,11 +304,9 @@ func (a *app) Shutdown() {
 	if a == nil {
 		return
 	}
-	for _, builds := range a.builds {
-		for _, build := range builds {
-			if build.HasStopped() == false {
-				build.Stop() //nolint (errcheck)
-			}
+	for _, build := range a.AllBuilds() {
+		if build.HasStopped() == false {
+			build.Stop() //nolint (errcheck)
 		}
 	}
 }
@@ -140,6 +318,13 @@ func (a *app) Config(integrationName string, conf interface{}) error {
 		return errors.New("a is nil")
 	}
 
+	if a.staticConfig != nil {
+		if integrationConfig := getIntegrationConfig(a.staticConfig, integrationName); integrationConfig != nil {
+			return mapstructure.Decode(integrationConfig, conf)
+		}
+		return nil
+	}
+
 	return applyIntegrationConfig(a.name, integrationName, conf)
 }
 
@@ -150,6 +335,13 @@ func (a *app) GlobalConfig(conf interface{}) error {
 		return errors.New("a is nil")
 	}
 
+	if a.staticConfig != nil {
+		if err := mapstructure.Decode(configDefaults, conf); err != nil {
+			return err
+		}
+		return mapstructure.Decode(a.staticConfig, conf)
+	}
+
 	return applyConfig(a.name, conf)
 }
 
@@ -173,6 +365,21 @@ func (a *app) Listen(expr string, listener func(map[string]string)) EventHandler
 	return handler
 }
 
+// ListenOnce is Listen for a listener that only wants the first matching event, it is removed once it has heard it
+func (a *app) ListenOnce(expr string, listener func(map[string]string)) EventHandler {
+	if a == nil {
+		return EventHandler(0)
+	}
+
+	handler, _ := a.bus.AddListenerOnce(expr, listener)
+	return handler
+}
+
+// ListenGlob is Listen with a glob pattern, see GlobEvent
+func (a *app) ListenGlob(pattern string, listener func(map[string]string)) EventHandler {
+	return a.Listen(GlobEvent(pattern), listener)
+}
+
 func (a *app) RemoveEventHandler(handler EventHandler) {
 	if a == nil {
 		return
@@ -185,45 +392,253 @@ func (a *app) NewBuild(group string, config *BuildConfig) (token string, err err
 	if a == nil {
 		return "", errors.New("a is nil")
 	}
+	a.applyDefaults(config)
+	serial := a.isSerialGroup(group)
+
+	// serialized before the build starts changing it, so replays start from the same place
+	serialized, marshalErr := config.Marshal()
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	token = a.newToken()
+	config.Integrations = a.integrations
+
+	build := newBuild(a, token, config)
+	build.metrics = a.metrics
+	build.newCommand = a.newCommand
+	if serial {
+		for _, other := range a.builds[group] {
+			if other.HasStopped() == false {
+				build.ahead = append(build.ahead, other)
+			}
+		}
+	}
+	a.builds[group] = append(a.builds[group], build)
+
+	// a build that couldn't start never existed as far as anyone else is concerned
+	if err := build.Start(); err != nil {
+		a.removeBuild(group, build)
+		return "", err
+	}
+
+	if marshalErr != nil {
+		a.Logwarnf("Couldn't serialize the config of build %s, it can't be replayed: %s", token, marshalErr)
+	} else {
+		a.storeBuildConfig(token, serialized)
+	}
+
+	return token, nil
+}
+
+// isSerialGroup is true if the groups builds have to run one at a time, the apps serialGroups are group names or
+// patterns like "deploy-*"
+func (a *app) isSerialGroup(group string) bool {
+	var appcfg struct {
+		SerialGroups []string `mapstructure:"serialGroups"`
+	}
+	a.GlobalConfig(&appcfg) //nolint (errcheck)
+
+	for _, pattern := range appcfg.SerialGroups {
+		if matched, err := path.Match(pattern, group); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultBuildConfig is the config builds of this app start from, see App.DefaultBuildConfig
+func (a *app) DefaultBuildConfig() *BuildConfig {
 	var appcfg struct {
-		BuildRunner string `mapstructure:"buildRunner"`
+		BuildRunner             string            `mapstructure:"buildRunner"`
+		MergeStrategy           string            `mapstructure:"mergeStrategy"`
+		DefaultDeadline         string            `mapstructure:"defaultDeadline"`
+		DefaultProvisionTimeout string            `mapstructure:"defaultProvisionTimeout"`
+		DefaultMetadata         map[string]string `mapstructure:"defaultMetadata"`
 	}
-	applyConfig(a.Name(), &appcfg) //nolint (errcheck)
+	a.GlobalConfig(&appcfg) //nolint (errcheck)
 
+	config := NewBuildConfig()
 	config.BuildRunner = "build.sh"
 	if appcfg.BuildRunner != "" {
 		config.BuildRunner = appcfg.BuildRunner
 	}
+	config.MergeStrategy = MergeStrategyMerge
+	if appcfg.MergeStrategy != "" {
+		config.MergeStrategy = appcfg.MergeStrategy
+	}
+	config.Deadline = a.configDuration("defaultDeadline", appcfg.DefaultDeadline, defaultDeadline)
+	config.ProvisionTimeout = a.configDuration("defaultProvisionTimeout", appcfg.DefaultProvisionTimeout, defaultProvisionTimeout)
+	for key, value := range appcfg.DefaultMetadata {
+		config.SetMetadata(key, value)
+	}
 
-	for {
-		token = generateToken()
-		if build, err := a.GetBuild(token); err == nil {
-			return "", err
-		} else if build != nil {
-			// token already exists
-			continue
+	return config
+}
+
+// configDuration parses value, a duration like "1h30m" from the app config, falling back when it's unset or unusable
+func (a *app) configDuration(key, value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Millisecond {
+		a.Logwarnf("%s %q isn't a usable duration, like \"1h30m\"", key, value)
+		return fallback
+	}
+	return duration
+}
+
+// applyDefaults fills in whatever config leaves unset from the apps DefaultBuildConfig, metadata is merged key by key
+func (a *app) applyDefaults(config *BuildConfig) {
+	defaults := a.DefaultBuildConfig()
+
+	if config.BuildRunner == "" {
+		config.BuildRunner = defaults.BuildRunner
+	}
+	if config.MergeStrategy == "" {
+		config.MergeStrategy = defaults.MergeStrategy
+	}
+	if config.Deadline < time.Millisecond {
+		config.Deadline = defaults.Deadline
+	}
+	if config.ProvisionTimeout < time.Millisecond {
+		config.ProvisionTimeout = defaults.ProvisionTimeout
+	}
+
+	defaults.m.RLock()
+	defer defaults.m.RUnlock()
+	for key, value := range defaults.metadata {
+		if config.GetMetadata(key) == "" {
+			config.SetMetadata(key, value)
 		}
+	}
+}
 
-		break
+// DryRunBuild will provision the build into a temporary directory and make sure the build runner is there
+// and executable, the build itself is never started and the directory is cleaned up afterwards
+func (a *app) DryRunBuild(group string, config *BuildConfig) error {
+	if a == nil {
+		return errors.New("a is nil")
 	}
 
-	a.m.Lock()
-	defer a.m.Unlock()
+	a.applyDefaults(config)
+	a.m.RLock()
 	config.Integrations = a.integrations
+	a.m.RUnlock()
 
-	build := newBuild(a, token, config)
-	a.builds[group] = append(a.builds[group], build)
+	problems := []string{}
+	if group == "" {
+		problems = append(problems, "Group is required")
+	}
+	if filepath.IsAbs(config.BuildRunner) || strings.HasPrefix(filepath.Clean(config.BuildRunner), "..") {
+		problems = append(problems, fmt.Sprintf("BuildRunner %s must be inside the build directory", config.BuildRunner))
+	}
 
-	errChan := make(chan error, 1)
-	go func() {
-		errChan <- build.Start()
-	}()
+	var appConfig struct {
+		BuildLocation    string `mapstructure:"buildLocation"`
+		ChmodBuildRunner bool   `mapstructure:"chmodBuildRunner"`
+		BuildInterpreter string `mapstructure:"buildInterpreter"`
+	}
+	a.GlobalConfig(&appConfig) //nolint (errcheck)
 
-	if err := <-errChan; err != nil {
-		return "", err
+	directory, err := provisionDirectory(appConfig.BuildLocation, a.Name(), group, "dryrun")
+	if err != nil {
+		return err
+	}
+	defer cleanupDirectory(directory) //nolint (errcheck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ProvisionTimeout)
+	defer cancel()
+
+	b := newBuild(a, "dryrun-"+tokenGenerator(), config)
+	if err := b.provisionBuildIntoDirectory(ctx, config, directory); err != nil {
+		problems = append(problems, fmt.Sprintf("Provisioning failed: %s", err))
+	} else if info, err := os.Stat(filepath.Join(directory, config.BuildRunner)); err != nil {
+		problems = append(problems, fmt.Sprintf("BuildRunner %s does not exist", config.BuildRunner))
+	} else if info.IsDir() || (info.Mode()&0111 == 0 && appConfig.ChmodBuildRunner == false && appConfig.BuildInterpreter == "") {
+		problems = append(problems, fmt.Sprintf("BuildRunner %s is not executable", config.BuildRunner))
 	}
 
-	return token, nil
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+// hold the a.m lock when you call this
+func (a *app) removeBuild(group string, build Build) {
+	builds := a.builds[group]
+	for i := range builds {
+		if builds[i] == build {
+			a.builds[group] = append(builds[:i:i], builds[i+1:]...)
+			break
+		}
+	}
+
+	if len(a.builds[group]) == 0 {
+		delete(a.builds, group)
+	}
+}
+
+// tokenGenerator is used by NewBuild to make build tokens, tests swap it out to force collisions
+var tokenGenerator = generateToken
+
+// newToken will return a token no other build in this app is using, hold the a.m lock when you call this
+func (a *app) newToken() string {
+	for {
+		token := tokenGenerator()
+		if a.hasBuild(token) == false {
+			return token
+		}
+		logwarnf("(%s): Generated build token %s is already in use, generating another", a.name, token)
+	}
+}
+
+// queuePosition will return the position of the given build among the builds that are queued, oldest first, and how
+// many builds are queued. 0, 0 if the build isn't queued
+func (a *app) queuePosition(token string) (position, length int) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	queued := []*build{}
+	for _, builds := range a.builds {
+		for _, b := range builds {
+			if b, ok := b.(*build); ok && b.isQueued() {
+				queued = append(queued, b)
+			}
+		}
+	}
+	sort.Sort(buildsByCreation(queued))
+
+	for i, b := range queued {
+		if b.Token() == token {
+			return i + 1, len(queued)
+		}
+	}
+	return 0, 0
+}
+
+type buildsByCreation []*build
+
+func (builds buildsByCreation) Len() int { return len(builds) }
+func (builds buildsByCreation) Less(i, j int) bool {
+	return builds[i].created.Before(builds[j].created)
+}
+func (builds buildsByCreation) Swap(i, j int) { builds[i], builds[j] = builds[j], builds[i] }
+
+// hold the a.m lock when you call this
+func (a *app) hasBuild(token string) bool {
+	for _, value := range a.builds {
+		for _, build := range value {
+			if build.Token() == token {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 func (a *app) GetBuild(token string) (Build, error) {
@@ -244,24 +659,59 @@ func (a *app) GetBuild(token string) (Build, error) {
 	return nil, errors.New("Couldn't find build")
 }
 
+// GetBuildHistory returns a copy of the groups builds, oldest first, it won't change as new builds are made
 func (a *app) GetBuildHistory(group string) []Build {
-	return a.builds[group]
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	return append([]Build{}, a.builds[group]...)
+}
+
+// ActiveBuilds returns the builds that have started and not yet stopped, in every group
+func (a *app) ActiveBuilds() []Build {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	active := []Build{}
+	for _, builds := range a.builds {
+		for _, build := range builds {
+			if build.HasStarted() && !build.HasStopped() {
+				active = append(active, build)
+			}
+		}
+	}
+	return active
+}
+
+// AllBuilds returns every build the app still has, in every group, in no particular order
+func (a *app) AllBuilds() []Build {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	all := []Build{}
+	for _, builds := range a.builds {
+		all = append(all, builds...)
+	}
+	return all
+}
+
+// Metrics returns a snapshot of the apps build counts and times
+func (a *app) Metrics() Metrics {
+	if a == nil {
+		return newAppMetrics().snapshot()
+	}
+
+	return a.metrics.snapshot()
 }
 
 func (a *app) Loginfof(str string, args ...interface{}) {
-	args = append([]interface{}{a.Name()}, args...)
-	log := loginfof("(%s):"+str, args...)
-	a.SendEvent(fmt.Sprintf("/log/app:%s/logtype:crit/%s", a.Name(), log))
+	a.SendEvent(logf("info", a.Name(), str, args...).event())
 }
 
 func (a *app) Logwarnf(str string, args ...interface{}) {
-	args = append([]interface{}{a.Name()}, args...)
-	log := logwarnf("(%s):"+str, args...)
-	a.SendEvent(fmt.Sprintf("/log/app:%s/logtype:warn/%s", a.Name(), log))
+	a.SendEvent(logf("warn", a.Name(), str, args...).event())
 }
 
 func (a *app) Logcritf(str string, args ...interface{}) {
-	args = append([]interface{}{a.Name()}, args...)
-	log := logcritf("(%s):"+str, args...)
-	a.SendEvent(fmt.Sprintf("/log/app:%s/logtype:info/%s", a.Name(), log))
+	a.SendEvent(logf("crit", a.Name(), str, args...).event())
 }
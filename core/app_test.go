@@ -0,0 +1,573 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestdataApps will point app discovery at testdata/ and forget any previously found apps
+func useTestdataApps() func() {
+	return useNGBuildDirectory("testdata")
+}
+
+// useNGBuildDirectory will point app discovery at the given directory and forget any previously found apps
+func useNGBuildDirectory(dir string) func() {
+	previousBaseDir := configBaseDir
+	previousDirectory, hadDirectory := os.LookupEnv("NGBUILD_DIRECTORY")
+
+	configBaseDir = dir
+	configCache = make(map[string]config)
+	os.Setenv("NGBUILD_DIRECTORY", dir) //nolint (errcheck)
+
+	appsLock.Lock()
+	apps = make(map[string]App)
+	workspacesSwept = false
+	appsLock.Unlock()
+
+	return func() {
+		configBaseDir = previousBaseDir
+		configCache = make(map[string]config)
+		if hadDirectory {
+			os.Setenv("NGBUILD_DIRECTORY", previousDirectory) //nolint (errcheck)
+		} else {
+			os.Unsetenv("NGBUILD_DIRECTORY") //nolint (errcheck)
+		}
+
+		appsLock.Lock()
+		apps = make(map[string]App)
+		workspacesSwept = false
+		appsLock.Unlock()
+	}
+}
+
+// useIntegrations will replace the global integrations with the given ones
+func useIntegrations(integrations ...Integration) func() {
+	previousIntegrations := GetIntegrations()
+	SetIntegrations(integrations)
+
+	return func() { SetIntegrations(previousIntegrations) }
+}
+
+func TestGetApp(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	defer useTestdataApps()()
+
+	_, ok := GetApp("testapp")
+	assert.False(ok, "apps aren't known until GetApps finds them")
+
+	found := GetApps()
+	require.Len(found, 1)
+	assert.Equal("testapp", found[0].Name())
+
+	app, ok := GetApp("testapp")
+	require.True(ok)
+	assert.True(app == found[0])
+
+	_, ok = GetApp("notanapp")
+	assert.False(ok)
+}
+
+func TestGetAppsAttachesOnce(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	defer useTestdataApps()()
+
+	integration := &MockIntegration{}
+	integration.On("Identifier").Return("mock")
+	integration.On("AttachToApp", mock.Anything).Return(nil)
+	defer useIntegrations(integration)()
+
+	first := GetApps()
+	second := GetApps()
+	require.Len(first, 1)
+	require.Len(second, 1)
+	assert.True(first[0] == second[0], "GetApps should return the same app every time")
+
+	integration.AssertNumberOfCalls(t, "AttachToApp", 1)
+}
+
+func TestGetAppsSweepsWorkspacesOnce(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-sweep")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	builds := filepath.Join(dir, "builds")
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"),
+		[]byte(`{"buildLocation": "`+builds+`", "workspaceMaxAgeHours": 1}`), 0644))
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "one"), 0755))
+	// one-two keeps its workspaces, so only one could sweep them
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "one-two"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "apps", "one-two", "config.json"),
+		[]byte(`{"workspaceMaxAgeHours": 0}`), 0644))
+	defer useNGBuildDirectory(dir)()
+	defer useIntegrations()()
+
+	yesterday := time.Now().Add(-time.Hour * 24)
+	oldWorkspace := func(app string) string {
+		workspace, err := provisionDirectory(builds, app, "master", "token")
+		require.NoError(err)
+		require.NoError(os.Chtimes(workspace, yesterday, yesterday))
+		return workspace
+	}
+	one := oldWorkspace("one")
+	prefixed := oldWorkspace("one-two")
+	other := oldWorkspace("other")
+
+	// only the apps own workspaces are swept, other apps could be sharing the buildLocation
+	loaded := GetApps()
+	require.Len(loaded, 2)
+	for _, loadedApp := range loaded {
+		defer loadedApp.(*app).Shutdown()
+	}
+	_, err = os.Stat(one)
+	assert.True(os.IsNotExist(err))
+	for _, workspace := range []string{prefixed, other} {
+		_, err = os.Stat(workspace)
+		assert.NoError(err)
+	}
+
+	// and nothing is swept after startup, that could be a build another ngbuild is running
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "other"), 0755))
+	added, _ := ReloadApps()
+	require.Len(added, 1)
+	defer added[0].(*app).Shutdown()
+	_, err = os.Stat(other)
+	assert.NoError(err)
+}
+
+func TestReloadApps(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-reload")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte("{}"), 0644))
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "one"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "two"), 0755))
+	defer useNGBuildDirectory(dir)()
+
+	integration := &MockIntegration{}
+	integration.On("Identifier").Return("mock")
+	integration.On("AttachToApp", mock.Anything).Return(nil)
+	integration.On("DetachFromApp", mock.Anything).Return(nil)
+	defer useIntegrations(integration)()
+
+	require.Len(GetApps(), 2)
+	two, ok := GetApp("two")
+	require.True(ok)
+
+	require.NoError(os.RemoveAll(filepath.Join(dir, "apps", "one")))
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "three"), 0755))
+
+	added, removed := ReloadApps()
+	require.Len(added, 1)
+	require.Len(removed, 1)
+	assert.Equal("three", added[0].Name())
+	assert.Equal("one", removed[0].Name())
+
+	_, ok = GetApp("one")
+	assert.False(ok)
+	reloadedTwo, ok := GetApp("two")
+	require.True(ok)
+	assert.True(two == reloadedTwo, "unchanged apps should be left alone")
+
+	integration.AssertNumberOfCalls(t, "AttachToApp", 3)
+	integration.AssertNumberOfCalls(t, "DetachFromApp", 1)
+}
+
+func TestIntegrationsForApp(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-integrations")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	appConfigs := map[string]string{
+		"slackonly":  `{"enabledIntegrations": ["slack"]}`,
+		"githubonly": `{"enabledIntegrations": ["github"]}`,
+		"noslack":    `{"disabledIntegrations": ["slack"]}`,
+		"everything": `{}`,
+	}
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte("{}"), 0644))
+	for name, appConfig := range appConfigs {
+		require.NoError(os.MkdirAll(filepath.Join(dir, "apps", name), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, "apps", name, "config.json"), []byte(appConfig), 0644))
+	}
+	defer useNGBuildDirectory(dir)()
+
+	slack := &MockIntegration{}
+	slack.On("Identifier").Return("slack")
+	github := &MockIntegration{}
+	github.On("Identifier").Return("github")
+	web := &MockIntegration{}
+	web.On("Identifier").Return("web")
+	defer useIntegrations(github, slack, web)()
+
+	identifiers := func(integrations []Integration) []string {
+		ret := []string{}
+		for _, integration := range integrations {
+			ret = append(ret, integration.Identifier())
+		}
+		return ret
+	}
+
+	assert.Equal([]string{"slack"}, identifiers(integrationsForApp("slackonly")))
+	assert.Equal([]string{"github"}, identifiers(integrationsForApp("githubonly")))
+	assert.Equal([]string{"github", "web"}, identifiers(integrationsForApp("noslack")))
+	assert.Equal([]string{"github", "slack", "web"}, identifiers(integrationsForApp("everything")))
+
+	// filtering for one app must never leak into the shared cache
+	assert.Equal([]string{"github", "slack", "web"}, identifiers(GetIntegrations()))
+	assert.Equal([]string{"github", "web"}, identifiers(GetIntegrations("slack")))
+	assert.Equal([]string{"github", "slack", "web"}, identifiers(GetIntegrations()))
+}
+
+func TestNewTokenCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("testapp").(*app)
+	a.builds["group"] = []Build{newBuild(a, "taken", NewBuildConfig())}
+
+	tokens := []string{"taken", "taken", "unique"}
+	calls := 0
+	previousGenerator := tokenGenerator
+	tokenGenerator = func(...string) string {
+		token := tokens[calls]
+		calls++
+		return token
+	}
+	defer func() { tokenGenerator = previousGenerator }()
+
+	assert.Equal("unique", a.newToken())
+	assert.Equal(3, calls)
+}
+
+func TestRemoveBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("testapp").(*app)
+	first := newBuild(a, "first", NewBuildConfig())
+	second := newBuild(a, "second", NewBuildConfig())
+	a.builds["group"] = []Build{first, second}
+
+	a.removeBuild("group", first)
+	assert.Equal([]Build{second}, a.GetBuildHistory("group"))
+	_, err := a.GetBuild("first")
+	assert.Error(err)
+
+	a.removeBuild("group", second)
+	assert.NotContains(a.builds, "group")
+}
+
+func TestDryRunBuild(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	app := NewTestApp("testapp", getSuccessfulIntegration())
+	config := NewBuildConfig()
+	config.BuildRunner = "success.sh"
+	assert.NoError(app.DryRunBuild("group", config))
+	assert.Empty(app.GetBuildHistory("group"), "dry runs aren't builds")
+
+	config = NewBuildConfig()
+	config.BuildRunner = "missing.sh"
+	err := app.DryRunBuild("", config)
+	require.Error(err)
+	validationErr, ok := err.(*ValidationError)
+	require.True(ok)
+	assert.Equal([]string{"Group is required", "BuildRunner missing.sh does not exist"}, validationErr.Problems)
+
+	config = NewBuildConfig()
+	config.BuildRunner = "../success.sh"
+	err = app.DryRunBuild("group", config)
+	require.Error(err)
+	assert.Contains(err.Error(), "must be inside the build directory")
+
+	app = NewTestApp("testapp", getFailedIntegration())
+	config = NewBuildConfig()
+	config.BuildRunner = "success.sh"
+	err = app.DryRunBuild("group", config)
+	require.Error(err)
+	assert.Contains(err.Error(), "Provisioning failed")
+}
+
+func TestDefaultBuildConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("defaults").(*app)
+	defaults := a.DefaultBuildConfig()
+	assert.Equal("build.sh", defaults.BuildRunner)
+	assert.Equal(MergeStrategyMerge, defaults.MergeStrategy)
+	assert.Equal(defaultDeadline, defaults.Deadline)
+	assert.Equal(defaultProvisionTimeout, defaults.ProvisionTimeout)
+
+	a.staticConfig = config{
+		"buildRunner":             "ci/run.sh",
+		"mergeStrategy":           MergeStrategyRebase,
+		"defaultDeadline":         "1h",
+		"defaultProvisionTimeout": "forever",
+		"defaultMetadata":         map[string]interface{}{"team": "builds", "env": "ci"},
+	}
+	defaults = a.DefaultBuildConfig()
+	assert.Equal("ci/run.sh", defaults.BuildRunner)
+	assert.Equal(MergeStrategyRebase, defaults.MergeStrategy)
+	assert.Equal(time.Hour, defaults.Deadline)
+	assert.Equal(defaultProvisionTimeout, defaults.ProvisionTimeout, "a bad duration is ignored")
+	assert.Equal("builds", defaults.GetMetadata("team"))
+
+	// the callers config wins over the apps defaults
+	config := NewBuildConfig()
+	config.BuildRunner = "other.sh"
+	config.Deadline = time.Minute
+	config.SetMetadata("env", "prod")
+	a.applyDefaults(config)
+	assert.Equal("other.sh", config.BuildRunner)
+	assert.Equal(MergeStrategyRebase, config.MergeStrategy)
+	assert.Equal(time.Minute, config.Deadline)
+	assert.Equal(defaultProvisionTimeout, config.ProvisionTimeout)
+	assert.Equal("prod", config.GetMetadata("env"))
+	assert.Equal("builds", config.GetMetadata("team"))
+}
+
+func TestQueuePosition(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("testapp").(*app)
+	first := newBuild(a, "first", NewBuildConfig())
+	second := newBuild(a, "second", NewBuildConfig())
+	provisioning := newBuild(a, "provisioning", NewBuildConfig())
+	running := newBuild(a, "running", NewBuildConfig())
+	second.created = first.created.Add(time.Second)
+	a.builds["one"] = []Build{second, provisioning}
+	a.builds["two"] = []Build{running, first}
+
+	// builds are only queued while they wait on their group or their provider, not while they're provisioning
+	first.state.SetBuildState(buildStateWaitingForProvisioning)
+	first.waitingOnGroup = 1
+	second.state.SetBuildState(buildStateWaitingForProvisioning)
+	done := WaitingToProvision(withProvisionWaiting(context.Background(), &second.waitingToProvision))
+	provisioning.state.SetBuildState(buildStateWaitingForProvisioning)
+	running.state.SetBuildState(buildStateStarted)
+
+	position, length := first.QueuePosition()
+	assert.Equal(1, position)
+	assert.Equal(2, length)
+
+	position, length = second.QueuePosition()
+	assert.Equal(2, position)
+	assert.Equal(2, length)
+
+	for _, b := range []*build{provisioning, running} {
+		position, length = b.QueuePosition()
+		assert.Equal(0, position)
+		assert.Equal(0, length)
+	}
+
+	first.waitingOnGroup = 0
+	position, length = second.QueuePosition()
+	assert.Equal(1, position)
+	assert.Equal(1, length)
+
+	done()
+	position, length = second.QueuePosition()
+	assert.Equal(0, position)
+	assert.Equal(0, length)
+}
+
+func TestSerialGroups(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-serial")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("serial", &scriptProvider{script: "#!/bin/sh\n"}).(*app)
+	a.staticConfig = config{
+		"buildLocation": filepath.Join(dir, "builds"),
+		"serialGroups":  []string{"deploy-*"},
+	}
+	defer a.Shutdown()
+
+	processes := make(chan *fakeProcess, 8)
+	a.newCommand = func(*exec.Cmd) commandRunner {
+		process := newFakeProcess(os.Getpid())
+		processes <- process
+		return process
+	}
+	nextProcess := func() *fakeProcess {
+		select {
+		case process := <-processes:
+			return process
+		case <-time.After(time.Second * 5):
+			t.Fatal("build never ran")
+			return nil
+		}
+	}
+	startBuild := func(group string) Build {
+		config := NewBuildConfig()
+		config.Deadline = time.Second * 10
+		token, err := a.NewBuild(group, config)
+		require.NoError(err)
+		build, err := a.GetBuild(token)
+		require.NoError(err)
+		return build
+	}
+	waitFor := func(condition func() bool) {
+		for start := time.Now(); condition() == false; time.Sleep(time.Millisecond * 10) {
+			if time.Since(start) > time.Second*5 {
+				t.Fatal("gave up waiting")
+			}
+		}
+	}
+
+	first := startBuild("deploy-prod")
+	firstProcess := nextProcess()
+	second := startBuild("deploy-prod")
+	third := startBuild("deploy-prod")
+	waitFor(second.WaitingOnGroup)
+	waitFor(third.WaitingOnGroup)
+
+	// other groups carry on as usual
+	other := startBuild("pr-1")
+	nextProcess().exit(nil)
+	_, err = other.Wait(context.Background())
+	assert.NoError(err)
+	assert.False(other.WaitingOnGroup())
+
+	assert.NoError(third.Stop())
+	code, err := third.Wait(context.Background())
+	assert.NoError(err)
+	assert.Equal(ExitCodeNone, code, "builds stopped while waiting never run")
+
+	assert.True(second.WaitingOnGroup())
+	assert.Empty(processes, "the second build waits for the first")
+	firstProcess.exit(nil)
+	_, err = first.Wait(context.Background())
+	assert.NoError(err)
+
+	nextProcess().exit(nil)
+	code, err = second.Wait(context.Background())
+	assert.NoError(err)
+	assert.Equal(0, code)
+	assert.False(second.WaitingOnGroup())
+	assert.Empty(processes, "the stopped build stays stopped")
+
+	// the stopped build isn't left running in the metrics
+	waitFor(func() bool { return a.Metrics().Completed == 4 })
+	assert.Equal(0, a.Metrics().Running)
+	assert.Equal(1, a.Metrics().Failed)
+}
+
+func TestActiveBuilds(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("testapp").(*app)
+	fresh := newBuild(a, "fresh", NewBuildConfig())
+	queued := newBuild(a, "queued", NewBuildConfig())
+	running := newBuild(a, "running", NewBuildConfig())
+	finished := newBuild(a, "finished", NewBuildConfig())
+	a.builds["one"] = []Build{fresh, queued}
+	a.builds["two"] = []Build{running, finished}
+
+	// queued builds have started as far as the app is concerned, they still need stopping on shutdown
+	queued.state.SetBuildState(buildStateWaitingForProvisioning)
+	running.state.SetBuildState(buildStateStarted)
+	finished.state.SetBuildState(buildStateFinished)
+
+	tokens := []string{}
+	for _, build := range a.ActiveBuilds() {
+		tokens = append(tokens, build.Token())
+	}
+	assert.Len(tokens, 2)
+	assert.Contains(tokens, "queued")
+	assert.Contains(tokens, "running")
+
+	assert.Len(a.AllBuilds(), 4)
+	assert.Len(NewTestApp("empty").AllBuilds(), 0)
+}
+
+// TestBuildHistoryDuringNewBuild is for the race detector, History used to look through the groups builds while
+// NewBuild appended to them
+func TestBuildHistoryDuringNewBuild(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-history")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("history", &scriptProvider{script: "#!/bin/sh\n"}).(*app)
+	a.staticConfig = config{
+		"buildLocation":     filepath.Join(dir, "builds"),
+		"artifactsLocation": filepath.Join(dir, "artifacts"),
+	}
+	defer a.Shutdown()
+
+	startBuild := func() Build {
+		config := NewBuildConfig()
+		config.Group = "group"
+		config.Deadline = time.Second * 10
+		token, err := a.NewBuild("group", config)
+		require.NoError(err)
+		build, err := a.GetBuild(token)
+		require.NoError(err)
+		return build
+	}
+
+	first := startBuild()
+	done := make(chan struct{})
+	histories := make(chan int)
+	go func() {
+		longest := 0
+		for {
+			history := first.History()
+			if assert.NotEmpty(history) {
+				assert.Equal(first, history[0])
+			}
+			if len(history) > longest {
+				longest = len(history)
+			}
+
+			select {
+			case <-done:
+				histories <- longest
+				return
+			default:
+			}
+		}
+	}()
+
+	builds := []Build{first}
+	for i := 0; i < 20; i++ {
+		builds = append(builds, startBuild())
+	}
+	close(done)
+	assert.Equal(1, <-histories, "later builds aren't part of the first builds history")
+
+	last := builds[len(builds)-1]
+	assert.Equal(builds, last.History())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, build := range builds {
+		_, err := build.Wait(ctx)
+		require.NoError(err)
+	}
+}
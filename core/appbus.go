@@ -5,17 +5,48 @@ import (
 	"regexp"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// busDrainTimeout is how long a closing bus spends firing the events that were waiting
+var busDrainTimeout = time.Second * 5
+
+// listenerQueueSize is how many events a listener can fall behind by before the bus waits for it to catch up
+const listenerQueueSize = 128
+
+// defaultListenerTimeout is how long a listener can spend on an event before it's warned about, apps can change it
+// with listenerTimeoutSeconds
+const defaultListenerTimeout = time.Second * 10
+
+// busEvent is an event waiting in a listeners queue, with what the listeners expression matched in it
+type busEvent struct {
+	event  string
+	values map[string]string
+}
+
 type appbuslistener struct {
 	fn      func(map[string]string)
 	handler EventHandler
+
+	// removed is set once the listener has been removed, events that are already queued for it are skipped.
+	// once listeners are removed before they are fired, so only the first event gets them
+	removed *uint32
+	once    bool
+
+	// queue has the events waiting for the listener, its own goroutine hands them over one at a time and in order
+	// so a slow listener only holds up itself. stop is closed when the listener is removed. once listeners have
+	// neither, they get their one event in a goroutine of its own
+	queue chan busEvent
+	stop  chan struct{}
 }
 
 type appbus struct {
 	m         sync.RWMutex
 	listeners map[*regexp.Regexp][]appbuslistener
 
+	// listenerTimeout is how long a listener can spend on an event before it's warned about, 0 never warns
+	listenerTimeout time.Duration
+
 	events     chan string
 	Done       chan struct{}
 	closed     uint64
@@ -24,15 +55,38 @@ type appbus struct {
 
 func newAppBus() *appbus {
 	bus := &appbus{
-		listeners: make(map[*regexp.Regexp][]appbuslistener),
-		events:    make(chan string, 128),
-		Done:      make(chan struct{}, 1),
+		listeners:       make(map[*regexp.Regexp][]appbuslistener),
+		listenerTimeout: defaultListenerTimeout,
+		events:          make(chan string, 128),
+		Done:            make(chan struct{}, 1),
 	}
 	go bus.coreloop()
 	return bus
 }
 
+// ExactEvent anchors expr so it only matches whole events, listener expressions otherwise match anywhere in an event,
+// so `app:foo` would also hear `app:foobar`
+func ExactEvent(expr string) string {
+	return `\A(?:` + expr + `)\z`
+}
+
+// AddListener calls listener with the named groups of every event expr matches, expr matches anywhere in an event
+// unless it is anchored, see AddListenerExact
 func (bus *appbus) AddListener(expr string, listener func(map[string]string)) (EventHandler, error) {
+	return bus.addListener(expr, appbuslistener{
+		fn:      listener,
+		removed: new(uint32),
+		queue:   make(chan busEvent, listenerQueueSize),
+		stop:    make(chan struct{}),
+	})
+}
+
+// AddListenerOnce is AddListener for a listener that is removed after the first event it hears
+func (bus *appbus) AddListenerOnce(expr string, listener func(map[string]string)) (EventHandler, error) {
+	return bus.addListener(expr, appbuslistener{fn: listener, removed: new(uint32), once: true})
+}
+
+func (bus *appbus) addListener(expr string, listener appbuslistener) (EventHandler, error) {
 	if bus == nil {
 		logcritf("Listener added to nil bus: %s", expr)
 		return EventHandler(0), errors.New("bus is nil")
@@ -54,26 +108,30 @@ func (bus *appbus) AddListener(expr string, listener func(map[string]string)) (E
 		}
 	}
 
-	if foundKey != nil {
-		handler := atomic.AddUint64(&bus.handlerctr, 1)
-		listeners := append(bus.listeners[foundKey], appbuslistener{listener, EventHandler(handler)})
-		bus.listeners[foundKey] = listeners
-		return EventHandler(handler), nil
+	if foundKey == nil {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logcritf("Couldn't compile listener expression `%s`: %s", expr, err)
+			return 0, err
+		}
+		foundKey = re
 	}
 
-	re, err := regexp.Compile(expr)
-	if err != nil {
-		logcritf("Couldn't compile listener expression `%s`: %s", expr, err)
-		return 0, err
+	listener.handler = EventHandler(atomic.AddUint64(&bus.handlerctr, 1))
+	bus.listeners[foundKey] = append(bus.listeners[foundKey], listener)
+	if listener.queue != nil {
+		go bus.runListener(listener)
 	}
 
-	handler := atomic.AddUint64(&bus.handlerctr, 1)
-	listeners := append(bus.listeners[re], appbuslistener{listener, EventHandler(handler)})
-	bus.listeners[re] = listeners
+	return listener.handler, nil
+}
 
-	return EventHandler(handler), nil
+// AddListenerExact is AddListener for events that expr matches the whole of
+func (bus *appbus) AddListenerExact(expr string, listener func(map[string]string)) (EventHandler, error) {
+	return bus.AddListener(ExactEvent(expr), listener)
 }
 
+// RemoveHandler stops the handlers listener hearing any more events, listeners can remove themselves
 func (bus *appbus) RemoveHandler(handler EventHandler) {
 	if bus == nil {
 		return
@@ -84,19 +142,29 @@ func (bus *appbus) RemoveHandler(handler EventHandler) {
 	// this is slow but is mostly here for completion purposes. if this gets used more than i think, we might have to redo
 	for key, listeners := range bus.listeners {
 		for i, listener := range listeners {
-			if listener.handler == handler {
-				bus.listeners[key] = append(listeners[:i], listeners[i+1:]...)
+			if listener.handler != handler {
+				continue
 			}
-		}
 
-		if len(bus.listeners[key]) < 1 {
-			delete(bus.listeners, key)
-			break
+			atomic.StoreUint32(listener.removed, 1)
+			if listener.stop != nil {
+				close(listener.stop)
+			}
+			bus.listeners[key] = append(listeners[:i:i], listeners[i+1:]...)
+			if len(bus.listeners[key]) < 1 {
+				delete(bus.listeners, key)
+			}
+			return
 		}
-
 	}
 }
 
+func (bus *appbus) setListenerTimeout(timeout time.Duration) {
+	bus.m.Lock()
+	defer bus.m.Unlock()
+	bus.listenerTimeout = timeout
+}
+
 func (bus *appbus) Emit(action string) {
 	if bus == nil || atomic.LoadUint64(&bus.closed) > 0 {
 		return
@@ -112,25 +180,135 @@ coreloop:
 			bus.fireEvent(event)
 		case <-bus.Done:
 			atomic.StoreUint64(&bus.closed, 1)
+			bus.drain(time.Now().Add(busDrainTimeout))
+			bus.closeQueues()
 			break coreloop
 		}
 	}
 }
 
+// drain fires the events that were emitted before the bus closed, so listeners still hear about builds that
+// completed as the bus was closing, it gives up on whatever is left at deadline
+func (bus *appbus) drain(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		select {
+		case event := <-bus.events:
+			bus.fireEvent(event)
+		default:
+			return
+		}
+	}
+
+	if dropped := len(bus.events); dropped > 0 {
+		logwarnf("Dropped %d events that were still waiting when the bus closed", dropped)
+	}
+}
+
+// closeQueues closes the queue of every listener once nothing more will be fired, their goroutines hand over what
+// is left in them and then stop
+func (bus *appbus) closeQueues() {
+	bus.m.Lock()
+	defer bus.m.Unlock()
+
+	for _, listeners := range bus.listeners {
+		for _, listener := range listeners {
+			if listener.queue != nil {
+				close(listener.queue)
+			}
+		}
+	}
+}
+
+// fireEvent queues event for the listeners that match it, without holding the lock so listeners can add and remove
+// listeners, themselves included
 func (bus *appbus) fireEvent(event string) {
-	bus.m.RLock()
-	defer bus.m.RUnlock()
+	type match struct {
+		listener appbuslistener
+		values   map[string]string
+	}
 
-	// we could make this smoother by unlocking earlier and copying the slices of listeners that need to be fired
-	// but it would make Remove strange, events would be fired after Remove()
+	var matched []match
+	bus.m.RLock()
 	for re, listeners := range bus.listeners {
-		matches, err := RegexpNamedGroupsMatch(re, event)
+		values, err := RegexpNamedGroupsMatch(re, event)
 		if err != nil {
 			continue
 		}
 
 		for _, listener := range listeners {
-			listener.fn(matches)
+			// listeners each handle the event in their own goroutine, so they each get their own values
+			copied := make(map[string]string, len(values))
+			for name, value := range values {
+				copied[name] = value
+			}
+			matched = append(matched, match{listener, copied})
 		}
 	}
+	bus.m.RUnlock()
+
+	for _, m := range matched {
+		if m.listener.once {
+			if atomic.CompareAndSwapUint32(m.listener.removed, 0, 1) == false {
+				continue
+			}
+			bus.RemoveHandler(m.listener.handler)
+			go bus.callListener(m.listener, busEvent{event, m.values})
+			continue
+		}
+
+		if atomic.LoadUint32(m.listener.removed) > 0 {
+			// removed while this event was being fired
+			continue
+		}
+		bus.queueEvent(m.listener, busEvent{event, m.values})
+	}
+}
+
+// queueEvent adds e to the listeners queue, if the listener is too far behind for there to be room the bus waits
+// for it rather than lose the event
+func (bus *appbus) queueEvent(listener appbuslistener, e busEvent) {
+	select {
+	case listener.queue <- e:
+		return
+	default:
+	}
+
+	logwarnf("Slow listener %d is %d events behind, waiting for it to catch up before firing %s", listener.handler, listenerQueueSize, e.event)
+	select {
+	case listener.queue <- e:
+	case <-listener.stop:
+	}
+}
+
+// runListener hands the events in the listeners queue to it in order, until it is removed or the bus closes
+func (bus *appbus) runListener(listener appbuslistener) {
+	for {
+		select {
+		case e, ok := <-listener.queue:
+			if ok == false {
+				return
+			}
+			if atomic.LoadUint32(listener.removed) > 0 {
+				continue
+			}
+			bus.callListener(listener, e)
+		case <-listener.stop:
+			return
+		}
+	}
+}
+
+// callListener calls the listener with e, warning about it if it takes longer than the listener timeout
+func (bus *appbus) callListener(listener appbuslistener, e busEvent) {
+	bus.m.RLock()
+	timeout := bus.listenerTimeout
+	bus.m.RUnlock()
+
+	if timeout > 0 {
+		slow := time.AfterFunc(timeout, func() {
+			logwarnf("Slow listener %d is still handling %s after %s", listener.handler, e.event, timeout)
+		})
+		defer slow.Stop()
+	}
+	listener.fn(e.values)
 }
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -89,3 +90,215 @@ func TestAppBusManyListeners(t *testing.T) {
 	wg2.Wait()
 	bus.Done <- struct{}{}
 }
+
+func TestAppBusExact(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bus := newAppBus()
+	defer func() { bus.Done <- struct{}{} }()
+
+	exact := make(chan string, 8)
+	substring := make(chan string, 8)
+	_, err := bus.AddListenerExact(`app:foo`, func(map[string]string) { exact <- "heard" })
+	require.NoError(err)
+	_, err = bus.AddListener(`app:foo`, func(map[string]string) { substring <- "heard" })
+	require.NoError(err)
+
+	// each listener hears its events in order, so once the last app:foo has been heard
+	// every event before it has been too
+	bus.Emit("app:foobar")
+	bus.Emit("myapp:foo")
+	bus.Emit("app:foo")
+	bus.Emit("app:foo")
+	receive(t, exact, 2)
+	assert.Len(exact, 0, "app:foo shouldn't match app:foobar or myapp:foo exactly")
+	receive(t, substring, 4)
+
+	// alternatives are anchored as a whole
+	alternatives := make(chan string, 8)
+	_, err = bus.AddListenerExact(`app:a|app:b`, func(map[string]string) { alternatives <- "heard" })
+	require.NoError(err)
+	bus.Emit("app:ab")
+	bus.Emit("xapp:b")
+	bus.Emit("app:b")
+	bus.Emit("app:a")
+	receive(t, alternatives, 2)
+	assert.Len(alternatives, 0)
+}
+
+// receive waits for count values on ch, failing the test if they don't arrive
+func receive(t *testing.T, ch chan string, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only heard %d of %d events", i, count)
+		}
+	}
+}
+
+func TestAppBusDrainsOnDone(t *testing.T) {
+	require := require.New(t)
+
+	// the loop may see Done before the event, so try it enough times for that to happen
+	for i := 0; i < 20; i++ {
+		bus := newAppBus()
+		heard := make(chan string, 1)
+		_, err := bus.AddListener(`/complete/(?P<token>\w+)`, func(names map[string]string) { heard <- names["token"] })
+		require.NoError(err)
+
+		bus.Emit("/complete/last")
+		bus.Done <- struct{}{}
+
+		select {
+		case token := <-heard:
+			require.Equal("last", token)
+		case <-time.After(time.Second * 5):
+			t.Fatal("events emitted before the bus closed should still be fired")
+		}
+	}
+}
+
+func TestListenOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("once").(*app)
+	defer func() { a.bus.Done <- struct{}{} }()
+
+	heard := make(chan string, 2)
+	a.ListenOnce(`/complete/(?P<token>\w+)`, func(names map[string]string) { heard <- names["token"] })
+	done := make(chan struct{}, 1)
+	a.Listen(`done`, func(map[string]string) { done <- struct{}{} })
+
+	a.SendEvent("/complete/first")
+	a.SendEvent("/complete/second")
+	a.SendEvent("done")
+	<-done
+	assert.Equal("first", <-heard)
+	assert.Len(heard, 0, "once listeners only hear one event")
+
+	// and are removed after it
+	for i := 0; i < 100; i++ {
+		a.bus.m.RLock()
+		remaining := len(a.bus.listeners)
+		a.bus.m.RUnlock()
+		if remaining == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("once listener wasn't removed")
+}
+
+func TestAppBusRemoveDuringDispatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bus := newAppBus()
+	defer func() { bus.Done <- struct{}{} }()
+
+	heard := make(chan string, 4)
+	var self EventHandler
+	self, err := bus.AddListener(`test`, func(map[string]string) {
+		heard <- "self"
+		bus.RemoveHandler(self)
+	})
+	require.NoError(err)
+
+	bus.Emit("test")
+	bus.Emit("test")
+	receive(t, heard, 1)
+
+	// listeners removed by another listener don't hear later events
+	later := make(chan string, 4)
+	var second EventHandler
+	_, err = bus.AddListener(`other`, func(map[string]string) {
+		bus.RemoveHandler(second)
+		heard <- "other"
+	})
+	require.NoError(err)
+	second, err = bus.AddListener(`later`, func(map[string]string) { later <- "later" })
+	require.NoError(err)
+
+	bus.Emit("other")
+	receive(t, heard, 1)
+	bus.Emit("later")
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Len(heard, 0, "removed listeners shouldn't hear queued events")
+	assert.Len(later, 0)
+	bus.m.RLock()
+	assert.Len(bus.listeners, 1)
+	bus.m.RUnlock()
+}
+
+func TestAppBusSlowListener(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bus := newAppBus()
+	bus.setListenerTimeout(time.Millisecond * 50)
+	defer func() { bus.Done <- struct{}{} }()
+
+	release := make(chan struct{})
+	slow := make(chan string, 4)
+	_, err := bus.AddListener(`test:(?P<n>\d)`, func(values map[string]string) {
+		<-release
+		slow <- values["n"]
+	})
+	require.NoError(err)
+
+	fast := make(chan string, 4)
+	_, err = bus.AddListener(`test:(?P<n>\d)`, func(values map[string]string) { fast <- values["n"] })
+	require.NoError(err)
+
+	bus.Emit("test:1")
+	bus.Emit("test:2")
+	for _, n := range []string{"1", "2"} {
+		select {
+		case heard := <-fast:
+			assert.Equal(n, heard)
+		case <-time.After(time.Second * 5):
+			t.Fatal("a slow listener held up the others")
+		}
+	}
+
+	// the slow listener wasn't waited for, and it still gets every event in order
+	close(release)
+	assert.Equal("1", <-slow)
+	assert.Equal("2", <-slow)
+}
+
+func TestAppBusListenerFallsBehind(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	bus := newAppBus()
+	defer func() { bus.Done <- struct{}{} }()
+
+	// more events than the listeners queue has room for, the bus waits for it rather than lose any
+	events := listenerQueueSize + 16
+	release := make(chan struct{})
+	heard := make(chan int, events)
+	_, err := bus.AddListener(`test:(?P<n>\d+)`, func(values map[string]string) {
+		<-release
+		n, _ := strconv.Atoi(values["n"])
+		heard <- n
+	})
+	require.NoError(err)
+
+	for n := 0; n < events; n++ {
+		bus.Emit(fmt.Sprintf("test:%d", n))
+	}
+	close(release)
+
+	for n := 0; n < events; n++ {
+		select {
+		case got := <-heard:
+			assert.Equal(n, got)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("the listener only heard %d of %d events", n, events)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// artifactsDirectory is where the apps artifacts are stored under artifactsLocation, it's a directory of ngbuilds
+// own so the janitor never cleans up anything else that's in there
+func artifactsDirectory(location, appName string) string {
+	return filepath.Join(location, "ngbuildartifacts", appName)
+}
+
+// artifactLimits stop a build filling the disk with artifacts, 0 is unlimited
+type artifactLimits struct {
+	// Bytes is how much all of a builds artifacts can add up to
+	Bytes int64
+	// Files is how many artifact files a build can have
+	Files int
+}
+
+// collectArtifacts copies the files in workspace that match each artifacts glob patterns into destination/name,
+// keeping their paths in the workspace. Files that would go over limits are skipped, as are patterns that point
+// outside the workspace. It returns where each artifact was copied to and the workspace paths that were skipped
+func collectArtifacts(workspace, destination string, patterns map[string][]string, limits artifactLimits) (artifacts map[string][]string, skipped []string, err error) {
+	artifacts = make(map[string][]string)
+	var copiedBytes int64
+	copiedFiles := 0
+
+	// sorted so the same artifacts are skipped every time
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, pattern := range patterns[name] {
+			if relative, err := filepath.Rel(workspace, filepath.Join(workspace, pattern)); err != nil || strings.HasPrefix(relative, "..") {
+				skipped = append(skipped, pattern)
+				continue
+			}
+
+			matches, err := filepath.Glob(filepath.Join(workspace, pattern))
+			if err != nil {
+				return artifacts, skipped, fmt.Errorf("artifact %s has a bad pattern %q: %s", name, pattern, err)
+			}
+
+			for _, match := range matches {
+				relative, err := filepath.Rel(workspace, match)
+				if err != nil {
+					skipped = append(skipped, match)
+					continue
+				}
+
+				info, err := os.Stat(match)
+				if err != nil || info.Mode().IsRegular() == false {
+					continue
+				}
+
+				if (limits.Files > 0 && copiedFiles >= limits.Files) || (limits.Bytes > 0 && copiedBytes+info.Size() > limits.Bytes) {
+					skipped = append(skipped, relative)
+					continue
+				}
+
+				target := filepath.Join(destination, name, relative)
+				remaining := int64(-1)
+				if limits.Bytes > 0 {
+					remaining = limits.Bytes - copiedBytes
+				}
+				written, err := copyArtifact(match, target, remaining)
+				if err != nil {
+					os.Remove(target) //nolint (errcheck)
+					skipped = append(skipped, relative)
+					continue
+				}
+
+				copiedBytes += written
+				copiedFiles++
+				artifacts[name] = append(artifacts[name], target)
+			}
+		}
+	}
+	return artifacts, skipped, nil
+}
+
+// errArtifactTooBig is from copyArtifact when a file grows past what's left of the limit while it's being copied
+var errArtifactTooBig = errors.New("artifact is bigger than the space left for artifacts")
+
+// copyArtifact copies source to target, failing rather than writing more than limit bytes, a negative limit is
+// unlimited
+func copyArtifact(source, target string, limit int64) (int64, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close() //nolint (errcheck)
+
+	if err := os.MkdirAll(filepath.Dir(target), 0766); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return 0, err
+	}
+
+	var reader io.Reader = in
+	if limit >= 0 {
+		// one byte over tells us the file grew
+		reader = io.LimitReader(in, limit+1)
+	}
+	written, err := io.Copy(out, reader)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit >= 0 && written > limit {
+		err = errArtifactTooBig
+	}
+	return written, err
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	workspace, err := ioutil.TempDir("", "ngbuild-workspace")
+	require.NoError(err)
+	defer os.RemoveAll(workspace) //nolint (errcheck)
+	write := func(path string, size int) {
+		require.NoError(os.MkdirAll(filepath.Dir(filepath.Join(workspace, path)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(workspace, path), make([]byte, size), 0644))
+	}
+	write("coverage/a.out", 100)
+	write("coverage/b.out", 100)
+	write("coverage/huge.out", 1024*1024)
+	write("logs/build.log", 10)
+
+	collect := func(patterns map[string][]string, limits artifactLimits) (map[string][]string, []string, string) {
+		destination, err := ioutil.TempDir("", "ngbuild-artifacts")
+		require.NoError(err)
+		artifacts, skipped, err := collectArtifacts(workspace, destination, patterns, limits)
+		require.NoError(err)
+		sort.Strings(skipped)
+		return artifacts, skipped, destination
+	}
+
+	artifacts, skipped, destination := collect(map[string][]string{"coverage": {"coverage/*.out"}, "logs": {"logs/*"}}, artifactLimits{})
+	defer os.RemoveAll(destination) //nolint (errcheck)
+	assert.Empty(skipped, "nothing is skipped without limits")
+	assert.Len(artifacts["coverage"], 3)
+	assert.Equal([]string{filepath.Join(destination, "logs", "logs", "build.log")}, artifacts["logs"])
+
+	// the huge file would take it over the limit so it is skipped, the rest still fit
+	artifacts, skipped, destination = collect(map[string][]string{"coverage": {"coverage/*.out"}, "logs": {"logs/*"}}, artifactLimits{Bytes: 1024})
+	defer os.RemoveAll(destination) //nolint (errcheck)
+	assert.Equal([]string{filepath.Join("coverage", "huge.out")}, skipped)
+	assert.Len(artifacts["coverage"], 2)
+	assert.Len(artifacts["logs"], 1)
+	_, err = os.Stat(filepath.Join(destination, "coverage", "coverage", "huge.out"))
+	assert.True(os.IsNotExist(err), "skipped artifacts aren't written at all")
+
+	artifacts, skipped, destination = collect(map[string][]string{"coverage": {"coverage/*.out"}}, artifactLimits{Files: 2})
+	defer os.RemoveAll(destination) //nolint (errcheck)
+	assert.Len(artifacts["coverage"], 2)
+	assert.Len(skipped, 1)
+
+	artifacts, skipped, destination = collect(map[string][]string{"escape": {"../*"}}, artifactLimits{})
+	defer os.RemoveAll(destination) //nolint (errcheck)
+	assert.Empty(artifacts["escape"], "artifacts have to be in the workspace")
+	assert.Equal([]string{"../*"}, skipped)
+}
+
+func TestCopyArtifactLimit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-artifacts")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "source"), make([]byte, 4096), 0644))
+
+	// as if the file grew after it was checked
+	written, err := copyArtifact(filepath.Join(dir, "source"), filepath.Join(dir, "target"), 1024)
+	assert.Equal(errArtifactTooBig, err)
+	assert.Equal(int64(1025), written, "the copy stops at the limit")
+
+	written, err = copyArtifact(filepath.Join(dir, "source"), filepath.Join(dir, "copied", "target"), -1)
+	assert.NoError(err)
+	assert.Equal(int64(4096), written)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -81,36 +85,95 @@ func (ref *refcount) Get() uint64 {
 	return atomic.LoadUint64((*uint64)(ref))
 }
 
+const defaultProvisionTimeout = time.Minute * 10
+
+// processCheckInterval is how often a running build checks its process hasn't exited behind its output pipes
+var processCheckInterval = time.Second * 5
+
+// defaultDeadline is the deadline of builds when neither the build nor the apps defaultDeadline set one
+const defaultDeadline = time.Minute * 30
+
 type build struct {
 	m sync.RWMutex
 
-	config *BuildConfig
-	token  string
+	config  *BuildConfig
+	token   string
+	created time.Time
 
 	parentApp App
 
 	ref refcount
 
-	cmd            *exec.Cmd
+	cmd            commandRunner
 	stdoutpipe     *stdpipes
 	stderrpipe     *stdpipes
 	buildStartTime time.Time
 	buildEndTime   time.Time
 
-	buildDirectory string
-	state          buildState
-	exitCode       int
+	provisionStartTime time.Time
+	provisionEndTime   time.Time
+	provider           string
+
+	// failureReason is one of the FailureReason constants, empty for builds that failed for reasons of their own
+	failureReason string
+
+	buildDirectory      string
+	commandLine         string
+	keepFailedWorkspace bool
+	state               buildState
+	exitCode            int
 
 	artifacts map[string][]string
+	// skippedArtifacts is how many artifacts weren't stored, they were over the apps limits
+	skippedArtifacts int
+
+	// ctx is cancelled when the build is stopped, anything the build is waiting on should use it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// finished is closed once the build has an exit code, use finishedChan rather than this directly
+	finished chan struct{}
+
+	// metrics are the parent apps, set by app.NewBuild
+	metrics *appMetrics
+
+	// newCommand makes the build runner process, execCommand when it isn't set. Set by app.NewBuild
+	newCommand commandFactory
+
+	// ahead are the builds this one waits for before it is provisioned, set by app.NewBuild for serial groups
+	ahead []Build
+	// waitingOnGroup is 1 while the build is waiting for the builds ahead of it
+	waitingOnGroup uint32
+
+	// waitingToProvision is 1 while the provider has the build waiting, see WaitingToProvision
+	waitingToProvision uint32
+
+	// completeSent is 1 once the complete event has been sent, see sendCompleteEvent
+	completeSent uint32
 }
 
 func newBuild(app App, token string, config *BuildConfig) *build {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &build{
 		parentApp: app,
 		token:     token,
 		config:    config,
+		created:   time.Now().UTC(),
 		artifacts: make(map[string][]string),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// context returns the builds context, or a background context if the build wasn't made with newBuild
+func (b *build) context() context.Context {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if b.ctx == nil {
+		return context.Background()
 	}
+
+	return b.ctx
 }
 
 func (b *build) HasStarted() bool {
@@ -149,19 +212,22 @@ func checkConfig(config *BuildConfig) error { //nolint (deadcode)
 	}
 
 	if config.HeadRepo == "" {
-		return errors.New("URL is required")
+		return errors.New("HeadRepo is required")
 	}
 
-	if config.HeadHash == "" {
-		return errors.New("URL is required")
-	}
+	// a local directory is whatever is in it right now, there is nothing to hash or merge
+	if strings.HasPrefix(config.HeadRepo, LocalRepoScheme) == false {
+		if config.HeadHash == "" {
+			return errors.New("HeadHash is required")
+		}
 
-	if config.BaseRepo == "" {
-		return errors.New("MergeRepo is required")
-	}
+		if config.BaseRepo == "" {
+			return errors.New("BaseRepo is required")
+		}
 
-	if config.BaseHash == "" {
-		return errors.New("MergeHash is required")
+		if config.BaseHash == "" {
+			return errors.New("BaseHash is required")
+		}
 	}
 
 	if config.Group == "" {
@@ -186,26 +252,87 @@ func (b *build) logcritf(str string, args ...interface{}) {
 	b.parentApp.Logcritf(fmt.Sprintf("(%s): %s", b.Token(), str), args...)
 }
 
-// provisionDirectory will return an empty unique directory to work in
-func provisionDirectory(basedir string) (string, error) {
+// workspacePrefix starts the name of every directory made by provisionDirectory
+const workspacePrefix = "ngbuild-workspace-"
+
+var reWorkspaceUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// provisionDirectory will return an empty unique directory to work in, a new workspace under basedir. names are added
+// to the directory name so you can tell which app/group/build a workspace belongs to,
+// ngbuild-workspace-myapp-master-token-123456 for example
+func provisionDirectory(basedir string, names ...string) (string, error) {
 	if basedir == "" {
 		basedir = os.TempDir()
 	}
 
 	os.MkdirAll(basedir, 0766) //nolint (errcheck)
-	return ioutil.TempDir(basedir, "ngbuild-workspace-")
+	return ioutil.TempDir(basedir, workspaceNamePrefix(names...))
+}
+
+// workspaceNamePrefix is what the names of workspaces provisionDirectory makes for names start with
+func workspaceNamePrefix(names ...string) string {
+	prefix := workspacePrefix
+	for _, name := range names {
+		if name = reWorkspaceUnsafe.ReplaceAllString(name, "_"); name != "" {
+			prefix += name + "-"
+		}
+	}
+	return prefix
 }
 
-func cleanupDirectory(directory string) error { // nolint (deadcode)
+// cleanupDirectory removes a workspace made by provisionDirectory, it won't touch anything else
+func cleanupDirectory(directory string) error {
+	if strings.HasPrefix(filepath.Base(directory), workspacePrefix) == false {
+		return fmt.Errorf("%s is not a build workspace", directory)
+	}
 	return os.RemoveAll(directory)
 }
 
-func (b *build) provisionBuildIntoDirectory(config *BuildConfig, workdir string) error {
+// sweepWorkspaces removes workspaces under basedir whose names start with prefix that haven't been touched for
+// maxAge, these are left behind when ngbuild crashes or is killed mid build. Workspaces keep is true for are left alone
+func sweepWorkspaces(basedir, prefix string, maxAge time.Duration, keep func(directory string) bool) (removed []string, err error) {
+	if basedir == "" {
+		basedir = os.TempDir()
+	}
+
+	entries, err := ioutil.ReadDir(basedir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() == false || strings.HasPrefix(entry.Name(), prefix) == false {
+			continue
+		}
+		if time.Since(entry.ModTime()) < maxAge {
+			continue
+		}
+
+		directory := filepath.Join(basedir, entry.Name())
+		if keep != nil && keep(directory) {
+			continue
+		}
+		if err := cleanupDirectory(directory); err != nil {
+			return removed, err
+		}
+		removed = append(removed, directory)
+	}
+
+	return removed, nil
+}
+
+func (b *build) provisionBuildIntoDirectory(ctx context.Context, config *BuildConfig, workdir string) error {
 	provisioned := false
+	var attempted []string
 	for _, integration := range config.Integrations {
 		if integration.IsProvider(config.HeadRepo) && integration.IsProvider(config.BaseRepo) {
-			if err := integration.ProvideFor(config, workdir); err != nil {
+			attempted = append(attempted, integration.Identifier())
+			b.setProvider(config, integration.Identifier())
+			if err := integration.ProvideFor(ctx, config, workdir); err != nil {
 				b.logcritf("(%s) Error providing for build: %s", integration.Identifier(), err)
+				if ctx.Err() != nil {
+					break
+				}
 				continue
 			}
 
@@ -214,24 +341,52 @@ func (b *build) provisionBuildIntoDirectory(config *BuildConfig, workdir string)
 		}
 	}
 
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("Provisioning timed out after %s", config.ProvisionTimeout)
+	case context.Canceled:
+		return errors.New("Provisioning was cancelled as the build was stopped")
+	}
+
 	if provisioned == false {
-		return errors.New("Could not provision with any loaded integration")
+		if len(attempted) == 0 {
+			return errors.New("Could not provision with any loaded integration, none are providers for this build")
+		}
+		return fmt.Errorf("Could not provision with any loaded integration, tried: %s", strings.Join(attempted, ", "))
 	}
 
 	return nil
 }
 
 func (b *build) runBuildSync(config BuildConfig) error {
-	defer func() { b.state = buildStateFinished }()
+	defer b.state.SetBuildState(buildStateFinished)
 
 	b.loginfof("provisioning")
 	var appConfig struct {
 		BuildLocation string `mapstructure:"buildLocation"`
+		// ChmodBuildRunner will make the build runner executable if the repo doesn't have it marked as such
+		ChmodBuildRunner bool `mapstructure:"chmodBuildRunner"`
+		// BuildInterpreter runs the build runner through something like /bin/sh rather than executing it directly
+		BuildInterpreter string `mapstructure:"buildInterpreter"`
+		// BuildRunnerArgs are passed to every build runner for this app, before the builds own BuildRunnerArgs
+		BuildRunnerArgs []string `mapstructure:"buildRunnerArgs"`
+		// KeepFailedWorkspaces stops the workspace of a failed build from being removed so it can be poked at
+		KeepFailedWorkspaces bool `mapstructure:"keepFailedWorkspaces"`
+		// MaxOutputBytes is how much stdout and stderr can each grow to before we stop keeping it, 0 is unlimited
+		MaxOutputBytes int `mapstructure:"maxOutputBytes"`
+		// StopOnMaxOutput will stop the build when it goes over MaxOutputBytes rather than just dropping output
+		StopOnMaxOutput bool `mapstructure:"stopOnMaxOutput"`
+		// BuildSecrets are set in the environment of every build, their values are redacted from the output
+		BuildSecrets map[string]string `mapstructure:"buildSecrets"`
+		// HeartbeatSeconds is how often a heartbeat event is sent while the build runs, 0 sends none
+		HeartbeatSeconds int `mapstructure:"heartbeatSeconds"`
 	}
 	b.parentApp.GlobalConfig(&appConfig) //nolint (errcheck)
 
-	provisionedDirectory, err := provisionDirectory(appConfig.BuildLocation)
+	provisionedDirectory, err := provisionDirectory(appConfig.BuildLocation, b.parentApp.Name(), config.Group, b.Token())
 	if err != nil {
+		b.setFailureReason(&config, FailureReasonProvisionFailed, fmt.Sprintf("couldn't create workspace: %s", err))
+		b.buildFinished(ExitCodeNone)
 		return err
 	}
 
@@ -239,63 +394,168 @@ func (b *build) runBuildSync(config BuildConfig) error {
 
 	b.buildStartTime = time.Now().UTC()
 	b.buildDirectory = provisionedDirectory
-
-	cmd := exec.Command(filepath.Join(provisionedDirectory, config.BuildRunner))
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	b.keepFailedWorkspace = appConfig.KeepFailedWorkspaces
+
+	args := expandRunnerArgs(&config, append(append([]string{}, appConfig.BuildRunnerArgs...), config.BuildRunnerArgs...))
+	cmd, command := buildCommand(provisionedDirectory, config.BuildRunner, appConfig.BuildInterpreter, args...)
+	secrets := buildSecrets(&config, appConfig.BuildSecrets)
+	config.SetMetadata(MetadataCommand, newRedactor(secrets).RedactString(command))
+	env := append([]string{"TERM=xterm-256color"}, secretsEnv(appConfig.BuildSecrets)...)
+	cmd.Env = append(os.Environ(), env...)
 	cmd.Dir = provisionedDirectory
+	b.commandLine = newRedactor(secrets).RedactString(commandLine(cmd, env))
+	config.SetMetadata(MetadataCommandLine, b.commandLine)
 
 	// gets child processes killed, probably linux only
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	b.cmd = cmd
+	newCommand := b.newCommand
+	if newCommand == nil {
+		newCommand = execCommand
+	}
+	runner := newCommand(cmd)
+	b.cmd = runner
+
+	outputLimit := uint64(0)
+	if appConfig.MaxOutputBytes > 0 {
+		outputLimit = uint64(appConfig.MaxOutputBytes)
+	}
+	// stderr is there from the start so provisioning can show how it's going, the runners is relayed in after
+	stderrRelay := newOutputRelay()
+	b.stderrpipe = newRedactedStdpipes(stderrRelay, outputLimit, secrets)
+
+	b.m.Unlock()
+
+	relaying := false
+	defer func() {
+		if relaying == false {
+			stderrRelay.finish()
+		}
+	}()
+
+	if config.ProvisionTimeout < time.Millisecond {
+		config.ProvisionTimeout = defaultProvisionTimeout
+	}
+
+	b.m.Lock()
+	b.provisionStartTime = time.Now().UTC()
+	b.m.Unlock()
+
+	ctx := withProvisionWaiting(WithProvisionOutput(b.context(), stderrRelay), &b.waitingToProvision)
+	ctx, cancel := context.WithTimeout(ctx, config.ProvisionTimeout)
+	err = b.provisionBuildIntoDirectory(ctx, &config, provisionedDirectory)
+	provisionTimedOut := ctx.Err() == context.DeadlineExceeded
+	cancel()
 
+	b.m.Lock()
+	b.provisionEndTime = time.Now().UTC()
 	b.m.Unlock()
+	b.loginfof("provisioning took %s", b.ProvisionTime())
 
-	err = b.provisionBuildIntoDirectory(&config, provisionedDirectory)
 	if err != nil {
-		b.buildFinished(501)
+		if provisionTimedOut {
+			b.setFailureReason(&config, FailureReasonProvisionTimeout, fmt.Sprintf("provisioning timed out after %s", config.ProvisionTimeout))
+		} else {
+			b.setFailureReason(&config, FailureReasonProvisionFailed, fmt.Sprintf("provisioning failed: %s", err))
+		}
+		b.buildFinished(ExitCodeNone)
 		return err
 	}
 
-	b.loginfof("running build: %s", filepath.Join(provisionedDirectory, config.BuildRunner))
+	if reason, err := checkBuildRunner(provisionedDirectory, config.BuildRunner, appConfig.BuildInterpreter, appConfig.ChmodBuildRunner); err != nil {
+		b.logcritf("%s", err)
+		b.setFailureReason(&config, reason, err.Error())
 
-	stdout, err := cmd.StdoutPipe()
+		// the same codes a shell would give
+		if reason == FailureReasonRunnerMissing {
+			b.buildFinished(127)
+		} else {
+			b.buildFinished(126)
+		}
+		return err
+	}
+
+	b.loginfof("running build: %s", config.GetMetadata(MetadataCommand))
+
+	stdout, err := runner.StdoutPipe()
 	if err != nil {
+		b.setFailureReason(&config, FailureReasonRunFailed, fmt.Sprintf("couldn't get stdout of build runner: %s", err))
+		b.buildFinished(ExitCodeNone)
 		return err
 	}
 
-	stderr, err := cmd.StderrPipe()
+	stderr, err := runner.StderrPipe()
 	if err != nil {
+		b.setFailureReason(&config, FailureReasonRunFailed, fmt.Sprintf("couldn't get stderr of build runner: %s", err))
+		b.buildFinished(ExitCodeNone)
 		return err
 	}
 
-	b.stdoutpipe = newStdpipes(stdout)
-	b.stderrpipe = newStdpipes(stderr)
+	b.m.Lock()
+	b.stdoutpipe = newRedactedStdpipes(stdout, outputLimit, secrets)
+	b.m.Unlock()
+	stderrRelay.relay(stderr)
+	relaying = true
+	stdoutOverLimit, stderrOverLimit := b.stdoutpipe.OverLimit, b.stderrpipe.OverLimit
 
-	err = cmd.Start()
+	err = runner.Start()
 	b.parentApp.SendEvent(fmt.Sprintf("/build/app:%s/started/token:%s", b.parentApp.Name(), b.Token()))
 
 	if err != nil {
-		cmd.Process.Kill() //nolint (errcheck)
+		b.setFailureReason(&config, FailureReasonRunFailed, fmt.Sprintf("couldn't start build runner: %s", err))
+		b.buildFinished(ExitCodeNone)
 		return err
 	}
-	b.loginfof("Command started, pid=%d", cmd.Process.Pid)
-	b.state = buildStateStarted
+	b.loginfof("Command started, pid=%d", runner.Pid())
+	b.state.SetBuildState(buildStateStarted)
 
+	// the pipes close their Done channels, so each is only listened to until it closes
 	pipesClosed := 0
+	stdoutDone, stderrDone := b.stdoutpipe.Done, b.stderrpipe.Done
 	endBuild := func() error {
 		b.loginfof("Build exited, waiting...")
-		err = cmd.Wait() // stdout/err have finished, just need to wait for the process to exit
+		err = runner.Wait() // stdout/err have finished, just need to wait for the process to exit
 		if err != nil {
-			b.logwarnf("Build exited with non zero error code")
-			b.buildFinished(1)
+			code, signal, exited := exitStatus(err)
+			if exited {
+				if signal != 0 {
+					b.setFailureReason(&config, FailureReasonKilled, fmt.Sprintf("build runner was killed by %s", signal))
+				}
+			} else {
+				b.setFailureReason(&config, FailureReasonRunFailed, fmt.Sprintf("couldn't wait for build runner: %s", err))
+			}
+			b.logwarnf("Build exited with non zero error code: %d", code)
+			b.buildFinished(code)
 			return err
 		}
 		return nil
 	}
+	outputLimitReached := func(pipe string) {
+		b.logwarnf("Build %s went over the output limit of %d bytes", pipe, outputLimit)
+		if appConfig.StopOnMaxOutput == false {
+			return
+		}
+
+		b.setFailureReason(&config, FailureReasonOutputLimit, fmt.Sprintf("build exceeded output limit of %d bytes", outputLimit))
+		if err := b.Stop(); err != nil {
+			b.logcritf("Couldn't stop build: %s", err)
+		}
+	}
+
+	// a nil channel never fires, so builds without heartbeats just never get one
+	var heartbeat <-chan time.Time
+	if appConfig.HeartbeatSeconds > 0 {
+		ticker := time.NewTicker(time.Duration(appConfig.HeartbeatSeconds) * time.Second)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	// made once, otherwise every heartbeat or pid check would push the deadline back
+	deadline := time.After(config.Deadline)
+
 runSyncLoop:
 	for {
 		select {
-		case <-b.stdoutpipe.Done:
+		case <-stdoutDone:
+			stdoutDone = nil
 			pipesClosed++
 			if pipesClosed > 1 {
 				if err := endBuild(); err != nil {
@@ -303,7 +563,8 @@ runSyncLoop:
 				}
 				break runSyncLoop
 			}
-		case <-b.stderrpipe.Done:
+		case <-stderrDone:
+			stderrDone = nil
 			pipesClosed++
 			if pipesClosed > 1 {
 				if err := endBuild(); err != nil {
@@ -312,21 +573,33 @@ runSyncLoop:
 				break runSyncLoop
 			}
 
-		case <-time.After(config.Deadline):
+		case <-stdoutOverLimit:
+			stdoutOverLimit = nil
+			outputLimitReached("stdout")
+		case <-stderrOverLimit:
+			stderrOverLimit = nil
+			outputLimitReached("stderr")
+
+		case <-heartbeat:
+			b.parentApp.SendEvent(b.heartbeatEvent())
+
+		case <-deadline:
 			b.logwarnf("Cancelling build as deadline reached")
+			b.setFailureReason(&config, FailureReasonDeadline, fmt.Sprintf("build didn't finish within its deadline of %s", config.Deadline))
 			err := b.Stop()
 			if err != nil {
 				b.logcritf("Couldn't stop build: %s", err)
-				b.buildFinished(500)
+				b.setFailureReason(&config, FailureReasonStopFailed, fmt.Sprintf("couldn't stop build: %s", err))
+				b.buildFinished(ExitCodeNone)
 				return err
 			}
-		case <-time.After(time.Second * 5):
+		case <-time.After(processCheckInterval):
 			// every so often we need to check that the pid is still going, to avoid situations where
 			// the stderr/out pipes are still open, but the pid has died
 			// this is primaraly a problem with nodejs as it allows nodejs programs
 			// to not flush their stdout/err before exiting, leaving stdout/err open forever
-			if hasPIDExited(cmd.Process.Pid) {
-				b.logcritf("Process exited but stdpipes are still open(zombied): %d", cmd.Process.Pid)
+			if hasPIDExited(runner.Pid()) {
+				b.logcritf("Process exited but stdpipes are still open(zombied): %d", runner.Pid())
 				b.stdoutpipe.Close()
 				b.stderrpipe.Close()
 			}
@@ -346,6 +619,47 @@ func (b *build) buildFinished(code int) {
 	b.buildEndTime = time.Now().UTC()
 	b.exitCode = code
 	b.cmd = nil
+	b.closeFinished()
+}
+
+// hold the b.m lock when you call this
+func (b *build) finishedChan() chan struct{} {
+	if b.finished == nil {
+		b.finished = make(chan struct{})
+	}
+	return b.finished
+}
+
+// closeFinished wakes up anything in Wait, it's safe to call more than once
+// hold the b.m lock when you call this
+func (b *build) closeFinished() {
+	finished := b.finishedChan()
+	select {
+	case <-finished:
+	default:
+		close(finished)
+	}
+}
+
+// Wait will block until the build has finished or ctx is done, builds that are never started will block until ctx is done
+func (b *build) Wait(ctx context.Context) (int, error) {
+	if b == nil {
+		return 0, errors.New("b is nil")
+	}
+
+	b.m.Lock()
+	finished := b.finishedChan()
+	b.m.Unlock()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.exitCode, nil
 }
 
 // Start will start the given build, it will error with ErrAlreadyStarted if the build is already running
@@ -360,50 +674,314 @@ func (b *build) Start() error {
 		return ErrProcessAlreadyStarted
 	}
 
-	b.state = buildStateWaitingForProvisioning
+	b.state.SetBuildState(buildStateWaitingForProvisioning)
+	b.metrics.buildStarted(b.config.Group)
 	b.parentApp.SendEvent(fmt.Sprintf("/build/app:%s/provisioning/token:%s", b.parentApp.Name(), b.Token()))
 
 	var config BuildConfig
 	config = *b.config
 
-	if config.Deadline < time.Millisecond {
-		b.logwarnf("deadline not set in config, defaulting to 30 minutes")
-		config.Deadline = time.Minute * 30
-	}
+	config.Deadline = b.deadline(config.Deadline)
 
 	go func() {
+		if b.waitForGroup(config.Group) == false {
+			b.loginfof("stopped while waiting for the builds ahead of it")
+			b.metrics.buildCompleted(config.Group, true, 0)
+			return
+		}
+
 		err := b.runBuildSync(config)
 		if err != nil {
 			b.logwarnf("Build exited with error: %s", err)
 		}
 
-		// move artifacts over to perminent storage
-		var cfg struct {
-			ArtifactsLocation string `mapstructure:"artifactsLocation"`
+		b.storeArtifacts(&config)
+
+		b.m.RLock()
+		completeEvent := b.completeEvent()
+		var buildTime time.Duration
+		if b.buildStartTime.IsZero() == false {
+			buildTime = b.buildEndTime.Sub(b.buildStartTime)
 		}
-		perminentStorageDir := "/tmp/ngbuildartifacts/"
+		failed := b.exitCode != 0 || b.failureReason != ""
+		b.m.RUnlock()
+		b.metrics.buildCompleted(config.Group, failed, buildTime)
+		b.sendCompleteEvent(completeEvent)
+	}()
+
+	return nil
+}
+
+// storeArtifacts moves the apps artifacts out of the workspace and over to permanent storage. The apps
+// maxArtifactBytes and maxArtifactFiles limit how much is kept, anything past them is skipped
+func (b *build) storeArtifacts(config *BuildConfig) {
+	var cfg struct {
+		ArtifactsLocation string              `mapstructure:"artifactsLocation"`
+		Artifacts         map[string][]string `mapstructure:"artifacts"`
+		MaxArtifactBytes  int64               `mapstructure:"maxArtifactBytes"`
+		MaxArtifactFiles  int                 `mapstructure:"maxArtifactFiles"`
+	}
+	perminentStorageDir := os.TempDir()
+
+	if err := b.parentApp.GlobalConfig(&cfg); err == nil {
+		perminentStorageDir = cfg.ArtifactsLocation
+	}
+
+	workspace := b.WorkspacePath()
+	if len(cfg.Artifacts) == 0 || workspace == "" {
+		return
+	}
+
+	// artifacts are kept per app so the janitor can clean them up by each apps retentionDays
+	artifactDir := filepath.Join(artifactsDirectory(perminentStorageDir, b.parentApp.Name()), b.Token())
+	if err := os.MkdirAll(artifactDir, 0766); err != nil {
+		b.logcritf("Couldn't create artifact directory %s: %s", artifactDir, err)
+		return
+	}
+
+	artifacts, skipped, err := collectArtifacts(workspace, artifactDir, cfg.Artifacts,
+		artifactLimits{Bytes: cfg.MaxArtifactBytes, Files: cfg.MaxArtifactFiles})
+	if err != nil {
+		b.logcritf("Couldn't store artifacts: %s", err)
+	}
+	if len(skipped) > 0 {
+		b.logwarnf("Skipped %d artifacts that were over the limits or couldn't be copied: %s", len(skipped), strings.Join(skipped, ", "))
+		config.SetMetadata(MetadataSkippedArtifacts, strings.Join(skipped, ", "))
+	}
+
+	b.m.Lock()
+	b.artifacts = artifacts
+	b.skippedArtifacts = len(skipped)
+	b.m.Unlock()
+}
 
-		if err := b.parentApp.GlobalConfig(&cfg); err == nil {
-			perminentStorageDir = cfg.ArtifactsLocation
+// waitForGroup waits for the builds ahead of this one in its group to finish, it returns false if the build was
+// stopped while it waited. Stop has already finished the build and sent its complete event by then
+func (b *build) waitForGroup(group string) bool {
+	b.m.Lock()
+	ahead := b.ahead
+	b.ahead = nil
+	b.m.Unlock()
+	if len(ahead) == 0 {
+		return true
+	}
+
+	atomic.StoreUint32(&b.waitingOnGroup, 1)
+	defer atomic.StoreUint32(&b.waitingOnGroup, 0)
+	b.loginfof("waiting for %d builds ahead of it in group %s", len(ahead), group)
+
+	ctx := b.context()
+	for _, other := range ahead {
+		if _, err := other.Wait(ctx); err != nil && ctx.Err() != nil {
+			return false
 		}
+	}
+	return true
+}
 
-		artifactDir := filepath.Join(perminentStorageDir, b.Token())
-		if err := os.MkdirAll(artifactDir, 0766); err != nil {
-			b.logcritf("Couldn't create artifact directory %s: %s", artifactDir, err)
-		} else {
-			b.loginfof("this message stops a linter error")
-			// TODO, all this stuff, needs things defined in config
-			/*
-				for _, artifact := range b.parentApp.GetArtifactList() {
-					// copy file to artifacts directory
-				}
-			*/
+// WaitingOnGroup is true while the build is waiting for the builds ahead of it in a serial group to finish
+func (b *build) WaitingOnGroup() bool {
+	if b == nil {
+		return false
+	}
+
+	return atomic.LoadUint32(&b.waitingOnGroup) > 0
+}
+
+// deadline returns the deadline the build should use, which is the builds own, then the apps defaultDeadline,
+// a duration like "1h30m", then defaultDeadline
+func (b *build) deadline(deadline time.Duration) time.Duration {
+	if deadline >= time.Millisecond {
+		b.loginfof("deadline is %s", deadline)
+		return deadline
+	}
+
+	var appConfig struct {
+		DefaultDeadline string `mapstructure:"defaultDeadline"`
+	}
+	b.parentApp.GlobalConfig(&appConfig) //nolint (errcheck)
+
+	if appConfig.DefaultDeadline != "" {
+		appDeadline, err := time.ParseDuration(appConfig.DefaultDeadline)
+		if err == nil && appDeadline >= time.Millisecond {
+			b.loginfof("deadline not set in config, using the apps defaultDeadline of %s", appDeadline)
+			return appDeadline
 		}
+		b.logwarnf("defaultDeadline %q isn't a usable duration, like \"1h30m\"", appConfig.DefaultDeadline)
+	}
 
-		b.parentApp.SendEvent(fmt.Sprintf("/build/app:%s/complete/token:%s", b.parentApp.Name(), b.Token()))
-	}()
+	b.loginfof("deadline not set in config, defaulting to %s", defaultDeadline)
+	return defaultDeadline
+}
 
-	return nil
+// sendCompleteEvent sends event on the app bus, unless the complete event has already been sent. A build that is
+// stopped before it runs completes from Stop, and then again once runBuildSync gives up
+func (b *build) sendCompleteEvent(event string) {
+	if atomic.CompareAndSwapUint32(&b.completeSent, 0, 1) {
+		b.parentApp.SendEvent(event)
+	}
+}
+
+// completeEvent is the event sent on the app bus when the build has finished, it carries the provision time in ms
+// hold the b.m lock when you call this
+func (b *build) completeEvent() string {
+	event := fmt.Sprintf("/build/app:%s/complete/token:%s/provisiontime:%d",
+		b.parentApp.Name(), b.Token(), b.provisionTime()/time.Millisecond)
+	if b.failureReason != "" {
+		event += "/reason:" + b.failureReason
+	}
+	if b.skippedArtifacts > 0 {
+		event += fmt.Sprintf("/skippedartifacts:%d", b.skippedArtifacts)
+	}
+	return event
+}
+
+// heartbeatEvent is sent on the app bus every so often while the build runs, it carries how long the build has been
+// running in ms and how many bytes of output it has written
+func (b *build) heartbeatEvent() string {
+	stats := b.OutputStats()
+	return fmt.Sprintf("/build/app:%s/heartbeat/token:%s/elapsed:%d/outputbytes:%d",
+		b.parentApp.Name(), b.Token(), stats.Duration/time.Millisecond, stats.StdoutBytes+stats.StderrBytes)
+}
+
+// setFailureReason records why the build failed, the first reason sticks, the build is stopped because of the
+// deadline rather than because Stop was called, for example
+func (b *build) setFailureReason(config *BuildConfig, reason, description string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.setFailureReasonLocked(config, reason, description)
+}
+
+// hold the b.m lock when you call this
+func (b *build) setFailureReasonLocked(config *BuildConfig, reason, description string) {
+	if b.failureReason != "" {
+		return
+	}
+
+	b.failureReason = reason
+	config.SetMetadata(MetadataFailureReason, description)
+}
+
+// FailureReason is one of the FailureReason constants, or empty if the build runner failed by itself
+func (b *build) FailureReason() string {
+	if b == nil {
+		return ""
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.failureReason
+}
+
+// Outcome buckets how the build turned out, it is OutcomePending until the build has stopped
+func (b *build) Outcome() Outcome {
+	if b == nil {
+		return OutcomePending
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return outcomeOf(b.state.HasStopped(), b.exitCode, b.failureReason)
+}
+
+var reRunnerArgMetadata = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// expandRunnerArgs replaces {{key}} in args with the configs metadata for key
+func expandRunnerArgs(config *BuildConfig, args []string) []string {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = reRunnerArgMetadata.ReplaceAllStringFunc(arg, func(match string) string {
+			return config.GetMetadata(reRunnerArgMetadata.FindStringSubmatch(match)[1])
+		})
+	}
+	return expanded
+}
+
+// buildSecrets is everything that should be redacted from a builds output, the globally registered secrets,
+// the values of the apps buildSecrets and the builds own
+func buildSecrets(config *BuildConfig, env map[string]string) []string {
+	secrets := append(registeredSecrets(), config.Secrets...)
+	for _, value := range env {
+		secrets = append(secrets, value)
+	}
+	return secrets
+}
+
+// secretsEnv turns the apps buildSecrets into environment variables, sorted so builds see the same env each time
+func secretsEnv(env map[string]string) []string {
+	vars := make([]string, 0, len(env))
+	for name, value := range env {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// buildCommand returns the command that runs the build runner, and how that command would look typed into a shell
+// in the build directory. interpreter can have arguments, "/bin/bash -e" for example. args are given to the runner
+// as they are, nothing is run through a shell
+func buildCommand(directory, runner, interpreter string, args ...string) (*exec.Cmd, string) {
+	path := filepath.Join(directory, runner)
+	interpreterArgs := strings.Fields(interpreter)
+
+	var cmd *exec.Cmd
+	command := []string{"./" + runner}
+	if len(interpreterArgs) == 0 {
+		cmd = exec.Command(path, args...)
+	} else {
+		cmdArgs := append(append(append([]string{}, interpreterArgs[1:]...), path), args...)
+		cmd = exec.Command(interpreterArgs[0], cmdArgs...)
+		command = append(append([]string{}, interpreterArgs...), runner)
+	}
+
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+	return cmd, strings.Join(command, " ")
+}
+
+// shellQuote quotes arg if it would be split up or expanded by a shell
+func shellQuote(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
+
+// commandLine is what cmd runs, with env in front, and where, ran `TERM=xterm /builds/abc/build.sh` in /builds/abc
+func commandLine(cmd *exec.Cmd, env []string) string {
+	words := make([]string, 0, len(env)+len(cmd.Args))
+	for _, variable := range env {
+		words = append(words, shellQuote(variable))
+	}
+	words = append(words, shellQuote(cmd.Path))
+	for _, arg := range cmd.Args[1:] {
+		words = append(words, shellQuote(arg))
+	}
+	return fmt.Sprintf("ran `%s` in %s", strings.Join(words, " "), cmd.Dir)
+}
+
+// checkBuildRunner makes sure the build runner exists and can be executed, if chmod is set a runner that isn't
+// executable will be made executable rather than failing. Runners run through an interpreter only have to exist
+func checkBuildRunner(directory, runner, interpreter string, chmod bool) (reason string, err error) {
+	path := filepath.Join(directory, runner)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return FailureReasonRunnerMissing, fmt.Errorf("build runner %s not found in repo", runner)
+	}
+
+	if info.Mode()&0111 != 0 || strings.TrimSpace(interpreter) != "" {
+		return "", nil
+	}
+
+	if chmod == false {
+		return FailureReasonRunnerNotExecutable, fmt.Errorf("build runner %s is not executable", runner)
+	}
+
+	if err := os.Chmod(path, info.Mode()|0111); err != nil {
+		return FailureReasonRunnerNotExecutable, fmt.Errorf("build runner %s is not executable and couldn't be made executable: %s", runner, err)
+	}
+	return "", nil
 }
 
 // Stop will stop the given build, it will error with ErrAlreadyStopped if the build has finished
@@ -422,24 +1000,27 @@ func (b *build) Stop() error {
 
 	b.m.Lock()
 	defer b.m.Unlock()
-	if b.cmd == nil || b.cmd.Process == nil {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	if b.config != nil {
+		b.setFailureReasonLocked(b.config, FailureReasonStopped, "build was stopped")
+	}
+
+	if b.cmd == nil || b.cmd.Pid() == 0 {
 		b.logcritf("unknown process asked to stop")
 		b.state.SetBuildState(buildStateFinished)
-		b.exitCode = 505
-		b.parentApp.SendEvent(fmt.Sprintf("/build/app:%s/complete/token:%s", b.parentApp.Name(), b.Token()))
+		b.exitCode = ExitCodeNone
+		b.closeFinished()
+		b.sendCompleteEvent(b.completeEvent())
 		if b.stdoutpipe != nil {
-			b.stdoutpipe.Done <- struct{}{}
+			b.stdoutpipe.finish()
 		}
 		if b.stderrpipe != nil {
-			b.stderrpipe.Done <- struct{}{}
+			b.stderrpipe.finish()
 		}
 	} else {
-		pgid, err := syscall.Getpgid(b.cmd.Process.Pid)
-		if err != nil {
-			return err
-		}
-
-		if err := syscall.Kill(-pgid, 15); err != nil {
+		if err := b.cmd.Kill(); err != nil {
 			return err
 		}
 	}
@@ -467,18 +1048,80 @@ func (b *build) Unref() {
 	if b.ref.Get() < 1 {
 		b.m.Lock()
 		defer b.m.Unlock()
-		if b.buildDirectory != "" {
-			os.RemoveAll(b.buildDirectory) //nolint (errcheck)
-			b.buildDirectory = ""
+		if b.buildDirectory == "" {
+			return
+		}
+
+		// kept workspaces are removed by sweepWorkspaces once they are old enough
+		if b.keepFailedWorkspace && b.state.HasStopped() && b.exitCode != 0 {
+			b.logwarnf("keeping workspace %s of failed build", b.buildDirectory)
+			return
 		}
+
+		cleanupDirectory(b.buildDirectory) //nolint (errcheck)
+		b.buildDirectory = ""
+	}
+}
+
+// WorkspacePath returns where the build is being run, it's empty once the workspace has been removed
+func (b *build) WorkspacePath() string {
+	if b == nil {
+		return ""
 	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.buildDirectory
+}
+
+// CommandLine returns exactly what was run for the build and where, it's empty until the build runs
+func (b *build) CommandLine() string {
+	if b == nil {
+		return ""
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.commandLine
 }
 
 // NewBuild will construct a new Build using this build as a base,
 // it is essentally a retry system
 func (b *build) NewBuild() (token string, err error) {
-	config := *b.config
-	return b.parentApp.NewBuild(b.Group(), &config)
+	return b.parentApp.ReplayBuild(b.token)
+}
+
+// NewFailedBuilds replays the latest build of each label that failed for the same commit as this build
+func (b *build) NewFailedBuilds(label string) (tokens []string, err error) {
+	own := b.Config()
+	latest := make(map[string]Build)
+	var labels []string
+	for _, groupBuild := range b.parentApp.GetBuildHistory(b.Group()) {
+		config := groupBuild.Config()
+		if config.HeadHash != own.HeadHash || config.BaseHash != own.BaseHash {
+			continue
+		}
+
+		value := config.GetMetadata(label)
+		if _, ok := latest[value]; ok == false {
+			labels = append(labels, value)
+		}
+		latest[value] = groupBuild
+	}
+
+	for _, value := range labels {
+		if code, err := latest[value].ExitCode(); err != nil || code == 0 {
+			continue
+		}
+
+		token, err := latest[value].NewBuild()
+		if err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
 }
 
 func (b *build) Group() string {
@@ -541,9 +1184,74 @@ func (b *build) Artifact(name string) []string {
 		return nil
 	}
 
+	b.m.RLock()
+	defer b.m.RUnlock()
 	return b.artifacts[name]
 }
 
+// buildQueue is implemented by apps that can say where a build is in their queue
+type buildQueue interface {
+	queuePosition(token string) (position, length int)
+}
+
+// isQueued is true while the build is waiting on the builds ahead of it in its group, or on its provider, builds
+// that are being provisioned aren't queued
+func (b *build) isQueued() bool {
+	return b.WaitingOnGroup() || atomic.LoadUint32(&b.waitingToProvision) > 0
+}
+
+// ProvisionTime will return how long provisioning took, will return 0 if provisioning hasn't finished
+func (b *build) ProvisionTime() time.Duration {
+	if b == nil {
+		return time.Duration(0)
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.provisionTime()
+}
+
+// hold the b.m lock when you call this
+func (b *build) provisionTime() time.Duration {
+	if b.provisionEndTime.IsZero() {
+		return time.Duration(0)
+	}
+
+	return b.provisionEndTime.Sub(b.provisionStartTime)
+}
+
+// Provider returns the Identifier of the integration that provisioned the build, if provisioning failed it
+// is the last integration that was tried
+func (b *build) Provider() string {
+	if b == nil {
+		return ""
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.provider
+}
+
+func (b *build) setProvider(config *BuildConfig, provider string) {
+	b.m.Lock()
+	b.provider = provider
+	b.m.Unlock()
+
+	config.SetMetadata(MetadataProvider, provider)
+}
+
+// QueuePosition will return where this build is in the queue of builds waiting to be provisioned, see isQueued
+func (b *build) QueuePosition() (position, length int) {
+	if b == nil || b.isQueued() == false {
+		return 0, 0
+	}
+
+	if queue, ok := b.parentApp.(buildQueue); ok {
+		return queue.queuePosition(b.Token())
+	}
+	return 0, 0
+}
+
 // BuildTime will return how long the build took, will return 0 if build hasn't started yet
 func (b *build) BuildTime() time.Duration {
 	if b == nil || b.state.HasStopped() == false {
@@ -553,12 +1261,49 @@ func (b *build) BuildTime() time.Duration {
 	return b.buildEndTime.Sub(b.buildStartTime)
 }
 
+// OutputStats returns the number of bytes written to stdout/stderr, Duration is how long the build has been running
+// for, or how long it took once it has finished
+func (b *build) OutputStats() OutputStats {
+	if b == nil {
+		return OutputStats{}
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	stats := OutputStats{}
+	for _, pipe := range []struct {
+		pipe  *stdpipes
+		bytes *uint64
+	}{{b.stdoutpipe, &stats.StdoutBytes}, {b.stderrpipe, &stats.StderrBytes}} {
+		if pipe.pipe == nil {
+			continue
+		}
+
+		*pipe.bytes = pipe.pipe.BytesRead()
+		if peak := pipe.pipe.PeakRate(); peak > stats.PeakBytesPerSecond {
+			stats.PeakBytesPerSecond = peak
+		}
+	}
+
+	switch {
+	case b.buildStartTime.IsZero():
+	case b.buildEndTime.IsZero():
+		stats.Duration = time.Since(b.buildStartTime)
+	default:
+		stats.Duration = b.buildEndTime.Sub(b.buildStartTime)
+	}
+
+	return stats
+}
+
 // History will return an array of previous Build's in this builds group
 func (b *build) History() []Build {
 	if b == nil {
 		return nil
 	}
 
+	// the history is a snapshot, so new builds in the group can't change it while we look through it
 	history := b.parentApp.GetBuildHistory(b.Group())
 	for i, build := range history {
 		if build.Token() == b.Token() {
@@ -1,13 +1,20 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -32,6 +39,20 @@ func (_m *MockIntegration) AttachToApp(_a0 App) error {
 	return r0
 }
 
+// DetachFromApp provides a mock function with given fields: _a0
+func (_m *MockIntegration) DetachFromApp(_a0 App) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(App) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Identifier provides a mock function with given fields:
 func (_m *MockIntegration) Identifier() string {
 	ret := _m.Called()
@@ -60,13 +81,27 @@ func (_m *MockIntegration) IsProvider(_a0 string) bool {
 	return r0
 }
 
-// ProvideFor provides a mock function with given fields: c, directory
-func (_m *MockIntegration) ProvideFor(c *BuildConfig, directory string) error {
-	ret := _m.Called(c, directory)
+// ProvideFor provides a mock function with given fields: ctx, c, directory
+func (_m *MockIntegration) ProvideFor(ctx context.Context, c *BuildConfig, directory string) error {
+	ret := _m.Called(ctx, c, directory)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*BuildConfig, string) error); ok {
-		r0 = rf(c, directory)
+	if rf, ok := ret.Get(0).(func(context.Context, *BuildConfig, string) error); ok {
+		r0 = rf(ctx, c, directory)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Ready provides a mock function with given fields:
+func (_m *MockIntegration) Ready() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -84,6 +119,38 @@ type mockApp struct {
 	mock.Mock
 }
 
+// ActiveBuilds provides a mock function with given fields:
+func (_m *mockApp) ActiveBuilds() []Build {
+	ret := _m.Called()
+
+	var r0 []Build
+	if rf, ok := ret.Get(0).(func() []Build); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Build)
+		}
+	}
+
+	return r0
+}
+
+// AllBuilds provides a mock function with given fields:
+func (_m *mockApp) AllBuilds() []Build {
+	ret := _m.Called()
+
+	var r0 []Build
+	if rf, ok := ret.Get(0).(func() []Build); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Build)
+		}
+	}
+
+	return r0
+}
+
 // AppLocation provides a mock function with given fields:
 func (_m *mockApp) AppLocation() string {
 	ret := _m.Called()
@@ -112,6 +179,36 @@ func (_m *mockApp) Config(namespace string, conf interface{}) error {
 	return r0
 }
 
+// DefaultBuildConfig provides a mock function with given fields:
+func (_m *mockApp) DefaultBuildConfig() *BuildConfig {
+	ret := _m.Called()
+
+	var r0 *BuildConfig
+	if rf, ok := ret.Get(0).(func() *BuildConfig); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*BuildConfig)
+		}
+	}
+
+	return r0
+}
+
+// DryRunBuild provides a mock function with given fields: group, config
+func (_m *mockApp) DryRunBuild(group string, config *BuildConfig) error {
+	ret := _m.Called(group, config)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, *BuildConfig) error); ok {
+		r0 = rf(group, config)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // GetBuild provides a mock function with given fields: token
 func (_m *mockApp) GetBuild(token string) (Build, error) {
 	ret := _m.Called(token)
@@ -179,6 +276,34 @@ func (_m *mockApp) Listen(event string, listener func(map[string]string)) EventH
 	return r0
 }
 
+// ListenGlob provides a mock function with given fields: pattern, listener
+func (_m *mockApp) ListenGlob(pattern string, listener func(map[string]string)) EventHandler {
+	ret := _m.Called(pattern, listener)
+
+	var r0 EventHandler
+	if rf, ok := ret.Get(0).(func(string, func(map[string]string)) EventHandler); ok {
+		r0 = rf(pattern, listener)
+	} else {
+		r0 = ret.Get(0).(EventHandler)
+	}
+
+	return r0
+}
+
+// ListenOnce provides a mock function with given fields: event, listener
+func (_m *mockApp) ListenOnce(event string, listener func(map[string]string)) EventHandler {
+	ret := _m.Called(event, listener)
+
+	var r0 EventHandler
+	if rf, ok := ret.Get(0).(func(string, func(map[string]string)) EventHandler); ok {
+		r0 = rf(event, listener)
+	} else {
+		r0 = ret.Get(0).(EventHandler)
+	}
+
+	return r0
+}
+
 // Logcritf provides a mock function with given fields: _a0, _a1
 func (_m *mockApp) Logcritf(_a0 string, _a1 ...interface{}) {
 	_m.Called(_a0, _a1)
@@ -194,6 +319,20 @@ func (_m *mockApp) Logwarnf(_a0 string, _a1 ...interface{}) {
 	_m.Called(_a0, _a1)
 }
 
+// Metrics provides a mock function with given fields:
+func (_m *mockApp) Metrics() Metrics {
+	ret := _m.Called()
+
+	var r0 Metrics
+	if rf, ok := ret.Get(0).(func() Metrics); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(Metrics)
+	}
+
+	return r0
+}
+
 // Name provides a mock function with given fields:
 func (_m *mockApp) Name() string {
 	ret := _m.Called()
@@ -229,6 +368,27 @@ func (_m *mockApp) NewBuild(group string, config *BuildConfig) (string, error) {
 	return r0, r1
 }
 
+// ReplayBuild provides a mock function with given fields: token
+func (_m *mockApp) ReplayBuild(token string) (string, error) {
+	ret := _m.Called(token)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(token)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(token)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // RemoveEventHandler provides a mock function with given fields: _a0
 func (_m *mockApp) RemoveEventHandler(_a0 EventHandler) {
 	_m.Called(_a0)
@@ -248,10 +408,10 @@ func getSuccessfulIntegration() *MockIntegration {
 	i := &MockIntegration{}
 	i.On("Identifier").Return("Success")
 	i.On("IsProvider", mock.Anything).Return(true)
-	i.On("ProvideFor", mock.AnythingOfType("*core.BuildConfig"), mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
-		dir := args.Get(1).(string)
+	i.On("ProvideFor", mock.Anything, mock.AnythingOfType("*core.BuildConfig"), mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		dir := args.Get(2).(string)
 		//FIXME - this is lazy, stops tests running on windows, is bad in general, i'm so tired
-		cmd := exec.Command("cp", "testdata/failure.sh", "testdata/success.sh", "testdata/fiveminutes.sh", dir)
+		cmd := exec.Command("cp", "testdata/failure.sh", "testdata/success.sh", "testdata/fiveminutes.sh", "testdata/noisy.sh", "testdata/secrets.sh", dir)
 		cmd.Run() //nolint (errcheck)
 	}).Return(nil)
 	return i
@@ -259,13 +419,18 @@ func getSuccessfulIntegration() *MockIntegration {
 
 func getFailedIntegration() *MockIntegration {
 	i := &MockIntegration{}
-	i.On("Identifier").Return("Success")
+	i.On("Identifier").Return("Failure")
 	i.On("IsProvider", mock.Anything).Return(true)
-	i.On("ProvideFor", mock.Anything, mock.Anything).Return(errors.New("testmarker"))
+	i.On("ProvideFor", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("testmarker"))
 	return i
 }
 
 func getMockApp() App {
+	return getMockAppWithConfig(nil)
+}
+
+// getMockAppWithConfig returns a mock app whose GlobalConfig is the given config
+func getMockAppWithConfig(config map[string]interface{}) App {
 	app := &mockApp{}
 	app.On("SendEvent", mock.AnythingOfType("string")).Return()
 	app.On("Name").Return("MockApp")
@@ -284,7 +449,9 @@ func getMockApp() App {
 		fmts := args.Get(1).([]interface{})
 		fmt.Printf(str+"\n", fmts...)
 	}).Return()
-	app.On("GlobalConfig", mock.Anything).Return(nil)
+	app.On("GlobalConfig", mock.Anything).Run(func(args mock.Arguments) {
+		mapstructure.Decode(config, args.Get(0)) //nolint (errcheck)
+	}).Return(nil)
 
 	return app
 }
@@ -301,12 +468,22 @@ func TestProvisionBuildIntoDirectory(t *testing.T) {
 	integrationFailure := getFailedIntegration()
 
 	config := BuildConfig{
+		m:            &sync.RWMutex{},
 		BaseRepo:     "testmarker-baserepo",
 		HeadRepo:     "testmarker-mergerepo",
 		Integrations: []Integration{integrationFailure, integrationSuccess},
 	}
 
-	assert.NoError(b.provisionBuildIntoDirectory(&config, dir))
+	assert.NoError(b.provisionBuildIntoDirectory(context.Background(), &config, dir))
+	assert.Equal("Success", b.Provider())
+	assert.Equal("Success", config.GetMetadata(MetadataProvider))
+
+	config.Integrations = []Integration{integrationFailure}
+	err = b.provisionBuildIntoDirectory(context.Background(), &config, dir)
+	assert.EqualError(err, "Could not provision with any loaded integration, tried: Failure")
+	assert.Equal("Failure", b.Provider())
+	assert.Equal("Failure", config.GetMetadata(MetadataProvider))
+
 	assert.NoError(cleanupDirectory(dir))
 }
 
@@ -317,6 +494,7 @@ func TestRunBuildSync(t *testing.T) {
 	app := getMockApp()
 	b := build{token: "testtoken", parentApp: app}
 	b.config = &BuildConfig{
+		m:            &sync.RWMutex{},
 		Integrations: []Integration{getSuccessfulIntegration()},
 		BuildRunner:  "success.sh",
 		Deadline:     time.Second * 5,
@@ -340,6 +518,7 @@ func TestRunBuildSync(t *testing.T) {
 	assert.Empty(b.buildDirectory)
 
 	require.True(b.state.HasStopped())
+	assert.Equal(OutcomeSucceeded, b.Outcome())
 }
 
 func TestRunBuildSyncFailure(t *testing.T) {
@@ -349,6 +528,7 @@ func TestRunBuildSyncFailure(t *testing.T) {
 	app := getMockApp()
 	b := build{token: "testtoken", parentApp: app}
 	b.config = &BuildConfig{
+		m:            &sync.RWMutex{},
 		Integrations: []Integration{getSuccessfulIntegration()},
 		BuildRunner:  "failure.sh",
 		Deadline:     time.Second * 5,
@@ -371,6 +551,7 @@ func TestRunBuildSyncFailure(t *testing.T) {
 	b.Unref()
 	assert.Empty(b.buildDirectory)
 	require.True(b.state.HasStopped())
+	assert.Equal(OutcomeFailed, b.Outcome())
 }
 
 func TestRunBuildSyncDeadline(t *testing.T) {
@@ -379,6 +560,7 @@ func TestRunBuildSyncDeadline(t *testing.T) {
 	app := getMockApp()
 	b := build{token: "testtoken", parentApp: app}
 	b.config = &BuildConfig{
+		m:            &sync.RWMutex{},
 		Integrations: []Integration{getSuccessfulIntegration()},
 		BuildRunner:  "fiveminutes.sh",
 		Deadline:     time.Second,
@@ -395,4 +577,534 @@ func TestRunBuildSyncDeadline(t *testing.T) {
 	b.Unref()
 	assert.Empty(b.buildDirectory)
 	require.True(b.state.HasStopped())
+
+	code, err := b.ExitCode()
+	require.NoError(err)
+	assert.Equal(ExitCodeNone, code, "killed by the deadline, so there's no real exit code")
+	assert.Equal(FailureReasonDeadline, b.FailureReason())
+	assert.Equal(OutcomeTimedOut, b.Outcome())
+}
+
+func TestRunBuildSyncProvisionTimeout(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+	app := getMockApp()
+
+	hung := &MockIntegration{}
+	hung.On("Identifier").Return("Hung")
+	hung.On("IsProvider", mock.Anything).Return(true)
+	hung.On("ProvideFor", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(errors.New("cancelled"))
+
+	b := build{token: "testtoken", parentApp: app}
+	b.config = &BuildConfig{
+		m:                &sync.RWMutex{},
+		Integrations:     []Integration{hung, getSuccessfulIntegration()},
+		BuildRunner:      "success.sh",
+		Deadline:         time.Second * 5,
+		ProvisionTimeout: time.Millisecond * 100,
+	}
+	b.Ref()
+
+	start := time.Now()
+	err := b.runBuildSync(*b.config)
+	require.Error(err)
+	assert.Contains(err.Error(), "timed out")
+	assert.True(time.Since(start) < time.Second*5, "provisioning should fail before the deadline")
+	assert.Equal(ExitCodeNone, b.exitCode)
+	assert.Equal(FailureReasonProvisionTimeout, b.FailureReason())
+	assert.True(b.ProvisionTime() >= time.Millisecond*100, "provision time should be recorded when provisioning fails")
+	b.Unref()
+	require.True(b.state.HasStopped())
+	assert.Equal(OutcomeProvisionFailed, b.Outcome())
+}
+
+func TestStopCancelsProvisioning(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+	app := getMockApp()
+
+	hung := &MockIntegration{}
+	hung.On("Identifier").Return("Hung")
+	hung.On("IsProvider", mock.Anything).Return(true)
+	hung.On("ProvideFor", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(errors.New("cancelled"))
+
+	b := newBuild(app, "testtoken", &BuildConfig{
+		m:            &sync.RWMutex{},
+		Integrations: []Integration{hung},
+		BuildRunner:  "success.sh",
+		Deadline:     time.Second * 5,
+	})
+	b.state = buildStateWaitingForProvisioning
+	b.Ref()
+
+	errs := make(chan error)
+	go func() { errs <- b.runBuildSync(*b.config) }()
+
+	time.Sleep(time.Millisecond * 100)
+	require.NoError(b.Stop())
+
+	select {
+	case err := <-errs:
+		require.Error(err)
+		assert.Contains(err.Error(), "cancelled")
+	case <-time.After(time.Second * 5):
+		t.Fatal("provisioning wasn't cancelled by Stop")
+	}
+	assert.Equal(FailureReasonStopped, b.FailureReason())
+	assert.Equal("build was stopped", b.config.GetMetadata(MetadataFailureReason))
+	assert.Equal(OutcomeCancelled, b.Outcome())
+	b.Unref()
+}
+
+func TestStopWhileProvisioningCompletesOnce(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+	app := getMockApp().(*mockApp)
+
+	hung := &MockIntegration{}
+	hung.On("Identifier").Return("Hung")
+	hung.On("IsProvider", mock.Anything).Return(true)
+	hung.On("ProvideFor", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(errors.New("cancelled"))
+
+	b := newBuild(app, "testtoken", &BuildConfig{
+		m:            &sync.RWMutex{},
+		Integrations: []Integration{hung},
+		BuildRunner:  "success.sh",
+		Deadline:     time.Second * 5,
+	})
+	b.metrics = newAppMetrics()
+	require.NoError(b.Start())
+
+	time.Sleep(time.Millisecond * 100)
+	require.NoError(b.Stop())
+
+	deadline := time.Now().Add(time.Second * 5)
+	for b.metrics.snapshot().Completed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the build never completed after being stopped")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	completed := 0
+	for _, call := range app.Calls {
+		if call.Method == "SendEvent" && strings.Contains(call.Arguments.String(0), "/complete/") {
+			completed++
+		}
+	}
+	assert.Equal(1, completed)
+	assert.Equal(1, b.metrics.snapshot().Completed)
+}
+
+func TestCompleteEvent(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b := build{token: "testtoken", parentApp: getMockApp()}
+	b.provisionStartTime = time.Now()
+	b.provisionEndTime = b.provisionStartTime.Add(time.Millisecond * 1500)
+	assert.Equal(time.Millisecond*1500, b.ProvisionTime())
+
+	data, err := RegexpNamedGroupsMatch(regexp.MustCompile(SignalBuildComplete), b.completeEvent())
+	require.NoError(err)
+	assert.Equal("MockApp", data["app"])
+	assert.Equal("testtoken", data["token"])
+	assert.Equal("1500", data["provisiontime"])
+
+	// the provision time is optional
+	data, err = RegexpNamedGroupsMatch(regexp.MustCompile(SignalBuildComplete), "/build/app:MockApp/complete/token:testtoken")
+	require.NoError(err)
+	assert.Equal("testtoken", data["token"])
+
+	b.failureReason = FailureReasonDeadline
+	b.skippedArtifacts = 3
+	data, err = RegexpNamedGroupsMatch(regexp.MustCompile(SignalBuildComplete), b.completeEvent())
+	require.NoError(err)
+	assert.Equal(FailureReasonDeadline, data["reason"])
+	assert.Equal("3", data["skippedartifacts"])
+}
+
+func TestBuildWait(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b := newBuild(getMockApp(), "testtoken", &BuildConfig{
+		m:            &sync.RWMutex{},
+		Integrations: []Integration{getSuccessfulIntegration()},
+		BuildRunner:  "failure.sh",
+		Deadline:     time.Second * 5,
+	})
+	b.Ref()
+	defer b.Unref()
+
+	// nothing is running yet so this can only time out
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	_, err := b.Wait(ctx)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+
+	go b.runBuildSync(*b.config) //nolint (errcheck)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	code, err := b.Wait(ctx)
+	require.NoError(err)
+	assert.Equal(1, code)
+
+	// waiting again on a finished build returns straight away
+	code, err = b.Wait(context.Background())
+	require.NoError(err)
+	assert.Equal(1, code)
+}
+
+func TestCheckBuildRunner(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := provisionDirectory("")
+	require.NoError(err)
+	defer cleanupDirectory(dir) //nolint (errcheck)
+
+	reason, err := checkBuildRunner(dir, "build.sh", "", true)
+	assert.Equal(FailureReasonRunnerMissing, reason)
+	assert.EqualError(err, "build runner build.sh not found in repo")
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("#!/bin/sh\n"), 0644))
+	reason, err = checkBuildRunner(dir, "build.sh", "", false)
+	assert.Equal(FailureReasonRunnerNotExecutable, reason)
+	assert.EqualError(err, "build runner build.sh is not executable")
+
+	reason, err = checkBuildRunner(dir, "build.sh", "", true)
+	assert.NoError(err)
+	assert.Empty(reason)
+	info, err := os.Stat(filepath.Join(dir, "build.sh"))
+	require.NoError(err)
+	assert.NotEqual(0, info.Mode()&0111)
+}
+
+func TestRunBuildSyncMissingRunner(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	config := NewBuildConfig()
+	config.Integrations = []Integration{getSuccessfulIntegration()}
+	config.BuildRunner = "missing.sh"
+	config.Deadline = time.Second * 5
+
+	// the build runs with a copy of its config, metadata set while running should still end up on the original
+	b := newBuild(getMockApp(), "testtoken", config)
+	b.Ref()
+	defer b.Unref()
+
+	assert.EqualError(b.runBuildSync(*b.config), "build runner missing.sh not found in repo")
+	code, err := b.Wait(context.Background())
+	require.NoError(err)
+	assert.Equal(127, code)
+	assert.Equal("build runner missing.sh not found in repo", b.config.GetMetadata(MetadataFailureReason))
+
+	b.m.RLock()
+	event := b.completeEvent()
+	b.m.RUnlock()
+	data, err := RegexpNamedGroupsMatch(regexp.MustCompile(SignalBuildComplete), event)
+	require.NoError(err)
+	assert.Equal(FailureReasonRunnerMissing, data["reason"])
+}
+
+func TestBuildCommand(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := provisionDirectory("")
+	require.NoError(err)
+	defer cleanupDirectory(dir) //nolint (errcheck)
+
+	// no shebang and not executable, only works through an interpreter
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("echo testmarker\n"), 0644))
+
+	cmd, command := buildCommand(dir, "build.sh", "")
+	assert.Equal("./build.sh", command)
+	assert.Equal([]string{filepath.Join(dir, "build.sh")}, cmd.Args)
+	_, err = checkBuildRunner(dir, "build.sh", "", false)
+	assert.Error(err)
+
+	cmd, command = buildCommand(dir, "build.sh", "/bin/sh -e")
+	assert.Equal("/bin/sh -e build.sh", command)
+	_, err = checkBuildRunner(dir, "build.sh", "/bin/sh -e", false)
+	assert.NoError(err)
+
+	output, err := cmd.Output()
+	require.NoError(err)
+	assert.Equal("testmarker\n", string(output))
+}
+
+func TestProvisionDirectoryNames(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	basedir, err := ioutil.TempDir("", "ngbuild-test")
+	require.NoError(err)
+	defer os.RemoveAll(basedir) //nolint (errcheck)
+
+	dir, err := provisionDirectory(basedir, "myapp", "feature/some thing", "token")
+	require.NoError(err)
+	assert.Equal(basedir, filepath.Dir(dir))
+	assert.True(strings.HasPrefix(filepath.Base(dir), "ngbuild-workspace-myapp-feature_some_thing-token-"), filepath.Base(dir))
+
+	assert.Error(cleanupDirectory(basedir), "only workspaces should ever be removed")
+	assert.NoError(cleanupDirectory(dir))
+	_, err = os.Stat(dir)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestSweepWorkspaces(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	basedir, err := ioutil.TempDir("", "ngbuild-test")
+	require.NoError(err)
+	defer os.RemoveAll(basedir) //nolint (errcheck)
+
+	old, err := provisionDirectory(basedir, "myapp", "master", "old")
+	require.NoError(err)
+	yesterday := time.Now().Add(-time.Hour * 25)
+	require.NoError(os.Chtimes(old, yesterday, yesterday))
+
+	fresh, err := provisionDirectory(basedir, "myapp", "master", "fresh")
+	require.NoError(err)
+
+	// not a workspace, old or not it stays
+	other := filepath.Join(basedir, "something-else")
+	require.NoError(os.Mkdir(other, 0755))
+	require.NoError(os.Chtimes(other, yesterday, yesterday))
+
+	// other apps workspaces, and the ones we're told to keep, stay too
+	otherApp, err := provisionDirectory(basedir, "otherapp", "master", "old")
+	require.NoError(err)
+	require.NoError(os.Chtimes(otherApp, yesterday, yesterday))
+	kept, err := provisionDirectory(basedir, "myapp", "master", "kept")
+	require.NoError(err)
+	require.NoError(os.Chtimes(kept, yesterday, yesterday))
+
+	removed, err := sweepWorkspaces(basedir, workspaceNamePrefix("myapp"), time.Hour*24, func(directory string) bool {
+		return directory == kept
+	})
+	require.NoError(err)
+	assert.Equal([]string{old}, removed)
+
+	for _, dir := range []string{fresh, other, otherApp, kept} {
+		_, err := os.Stat(dir)
+		assert.NoError(err)
+	}
+}
+
+func TestKeepFailedWorkspace(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, test := range []struct {
+		keep     bool
+		exitCode int
+		kept     bool
+	}{
+		{keep: false, exitCode: 1, kept: false},
+		{keep: true, exitCode: 0, kept: false},
+		{keep: true, exitCode: 1, kept: true},
+	} {
+		dir, err := provisionDirectory("")
+		require.NoError(err)
+
+		b := build{token: "testtoken", parentApp: getMockApp(), buildDirectory: dir, keepFailedWorkspace: test.keep}
+		b.exitCode = test.exitCode
+		b.state.SetBuildState(buildStateFinished)
+		b.Ref()
+		assert.Equal(dir, b.WorkspacePath())
+		b.Unref()
+
+		_, err = os.Stat(dir)
+		if test.kept {
+			assert.NoError(err)
+			assert.Equal(dir, b.WorkspacePath())
+		} else {
+			assert.True(os.IsNotExist(err))
+			assert.Empty(b.WorkspacePath())
+		}
+		cleanupDirectory(dir) //nolint (errcheck)
+	}
+}
+
+func TestRunBuildSyncOutputLimit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	config := NewBuildConfig()
+	config.Integrations = []Integration{getSuccessfulIntegration()}
+	config.BuildRunner = "noisy.sh"
+	config.Deadline = time.Second * 30
+
+	b := newBuild(getMockAppWithConfig(map[string]interface{}{
+		"maxOutputBytes":  1024 * 64,
+		"stopOnMaxOutput": true,
+	}), "testtoken", config)
+	b.Ref()
+	defer b.Unref()
+
+	errs := make(chan error, 1)
+	go func() { errs <- b.runBuildSync(*b.config) }()
+
+	select {
+	case err := <-errs:
+		assert.Error(err)
+	case <-time.After(time.Second * 20):
+		t.Fatal("build wasn't stopped when it went over the output limit")
+	}
+
+	code, err := b.Wait(context.Background())
+	require.NoError(err)
+	assert.NotEqual(0, code)
+	assert.Equal("build exceeded output limit of 65536 bytes", config.GetMetadata(MetadataFailureReason))
+	assert.Equal(OutcomeOutputLimit, b.Outcome())
+
+	assert.Equal(uint64(1024*64), b.stdoutpipe.CacheSize())
+	assert.True(b.stdoutpipe.BytesRead() > b.stdoutpipe.CacheSize())
+	stdout, err := b.Stdout()
+	require.NoError(err)
+	output, err := ioutil.ReadAll(stdout)
+	require.NoError(err)
+	assert.Len(output, 1024*64)
+}
+
+func TestRunBuildSyncSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	config := NewBuildConfig()
+	config.Integrations = []Integration{getSuccessfulIntegration()}
+	config.BuildRunner = "secrets.sh"
+	config.Secrets = []string{"hunter22"}
+	config.Deadline = time.Second * 5
+
+	b := newBuild(getMockAppWithConfig(map[string]interface{}{
+		"buildSecrets": map[string]string{"NGBUILD_TEST_TOKEN": "c0ffeec0ffee"},
+	}), "testtoken", config)
+	b.Ref()
+	defer b.Unref()
+
+	require.NoError(b.runBuildSync(*b.config))
+	code, err := b.Wait(context.Background())
+	require.NoError(err)
+	assert.Equal(0, code)
+
+	stdout, err := b.Stdout()
+	require.NoError(err)
+	output, err := ioutil.ReadAll(stdout)
+	require.NoError(err)
+	assert.Equal("token is ****\n", string(output), "secrets are in the env but not the output")
+
+	stderr, err := b.Stderr()
+	require.NoError(err)
+	output, err = ioutil.ReadAll(stderr)
+	require.NoError(err)
+	assert.Equal("password is ****\n", string(output))
+
+	dir := b.WorkspacePath()
+	expected := fmt.Sprintf("ran `TERM=xterm-256color NGBUILD_TEST_TOKEN=**** %s` in %s", filepath.Join(dir, "secrets.sh"), dir)
+	assert.Equal(expected, b.CommandLine(), "the env we set is there, secrets aren't")
+	assert.Equal(expected, b.config.GetMetadata(MetadataCommandLine))
+}
+
+func TestCommandLine(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd, _ := buildCommand("/builds/abc", "build.sh", "/bin/sh -e", "one", "two words")
+	cmd.Dir = "/builds/abc"
+	assert.Equal("ran `/bin/sh -e /builds/abc/build.sh one \"two words\"` in /builds/abc", commandLine(cmd, nil))
+
+	cmd, _ = buildCommand("/builds/abc", "build.sh", "")
+	cmd.Dir = "/builds/abc"
+	assert.Equal("ran `TERM=xterm \"NAME=a b\" /builds/abc/build.sh` in /builds/abc", commandLine(cmd, []string{"TERM=xterm", "NAME=a b"}))
+}
+
+func TestOutputStats(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b := build{token: "testtoken", parentApp: getMockApp()}
+	assert.Equal(OutputStats{}, b.OutputStats(), "builds that haven't run have no stats")
+
+	b.config = &BuildConfig{
+		m:            &sync.RWMutex{},
+		Integrations: []Integration{getSuccessfulIntegration()},
+		BuildRunner:  "success.sh",
+		Deadline:     time.Second * 5,
+	}
+	b.Ref()
+	defer b.Unref()
+	require.NoError(b.runBuildSync(*b.config))
+
+	stats := b.OutputStats()
+	assert.Equal(uint64(len("testmarker\n")), stats.StdoutBytes)
+	assert.Equal(uint64(len("testmarker\n")), stats.StderrBytes)
+	assert.True(stats.PeakBytesPerSecond >= uint64(len("testmarker\n")))
+	assert.Equal(b.BuildTime(), stats.Duration)
+}
+
+func TestBuildRunnerArgs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	config := NewBuildConfig()
+	config.SetMetadata("github:HeadHash", "abc123")
+	args := expandRunnerArgs(config, []string{"--commit={{github:HeadHash}}", "{{ missing }}", "$(rm -rf /)"})
+	assert.Equal([]string{"--commit=abc123", "", "$(rm -rf /)"}, args)
+
+	dir, err := provisionDirectory("")
+	require.NoError(err)
+	defer cleanupDirectory(dir) //nolint (errcheck)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done\n"), 0755))
+
+	cmd, command := buildCommand(dir, "build.sh", "", args...)
+	assert.Equal(`./build.sh --commit=abc123 "" "$(rm -rf /)"`, command)
+	output, err := cmd.Output()
+	require.NoError(err)
+	assert.Equal("--commit=abc123\n\n$(rm -rf /)\n", string(output), "args are passed as they are, not through a shell")
+
+	cmd, command = buildCommand(dir, "build.sh", "/bin/sh -e", "one")
+	assert.Equal("/bin/sh -e build.sh one", command)
+	assert.Equal([]string{"/bin/sh", "-e", filepath.Join(dir, "build.sh"), "one"}, cmd.Args)
+}
+
+func TestCheckConfigLocal(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewBuildConfig()
+	config.Title = "local"
+	config.URL = "file:///src/ngbuild"
+	config.HeadRepo = "git@github.com:watchly/ngbuild.git"
+	config.Group = "group"
+	config.BuildRunner = "build.sh"
+	assert.Error(checkConfig(config), "git builds need hashes")
+
+	config.HeadRepo = LocalRepoScheme + "/src/ngbuild"
+	assert.NoError(checkConfig(config), "local builds don't")
+}
+
+func TestBuildDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	b := build{token: "testtoken", parentApp: getMockApp()}
+	assert.Equal(defaultDeadline, b.deadline(0))
+	assert.Equal(time.Minute, b.deadline(time.Minute), "the builds own deadline wins")
+
+	b.parentApp = getMockAppWithConfig(map[string]interface{}{"defaultDeadline": "2h30m"})
+	assert.Equal(150*time.Minute, b.deadline(0))
+	assert.Equal(time.Minute, b.deadline(time.Minute))
+
+	b.parentApp = getMockAppWithConfig(map[string]interface{}{"defaultDeadline": "forever"})
+	assert.Equal(defaultDeadline, b.deadline(0), "a bad defaultDeadline is ignored")
 }
@@ -71,3 +71,20 @@ func UnmarshalBuildConfig(filename string) (*BuildConfig, error) {
 	}
 	return conf, nil
 }
+
+// copy returns a copy of conf that can be changed without changing conf
+func (conf *BuildConfig) copy() *BuildConfig {
+	conf.m.RLock()
+	defer conf.m.RUnlock()
+
+	copied := *conf
+	copied.m = &sync.RWMutex{}
+	copied.metadata = make(map[string]string, len(conf.metadata))
+	for key, value := range conf.metadata {
+		copied.metadata[key] = value
+	}
+	copied.Integrations = append([]Integration(nil), conf.Integrations...)
+	copied.BuildRunnerArgs = append([]string(nil), conf.BuildRunnerArgs...)
+	copied.Secrets = append([]string(nil), conf.Secrets...)
+	return &copied
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"io"
+	"os/exec"
+	"syscall"
+)
+
+// commandRunner is the build runner process, it is an *exec.Cmd outside of tests
+type commandRunner interface {
+	StdoutPipe() (io.ReadCloser, error)
+	StderrPipe() (io.ReadCloser, error)
+	Start() error
+	// Wait returns the same errors as exec.Cmd.Wait, see exitStatus for getting the exit code out of them
+	Wait() error
+	// Kill stops the process and all of its children
+	Kill() error
+	// Pid is 0 until the process has started
+	Pid() int
+}
+
+// commandFactory makes the commandRunner that runs cmd, cmd is set up but not started
+type commandFactory func(cmd *exec.Cmd) commandRunner
+
+// execCommand is the commandFactory builds use unless they are given another
+func execCommand(cmd *exec.Cmd) commandRunner {
+	return &execRunner{cmd}
+}
+
+type execRunner struct {
+	*exec.Cmd
+}
+
+func (r *execRunner) Pid() int {
+	if r.Process == nil {
+		return 0
+	}
+	return r.Process.Pid
+}
+
+// Kill sends SIGTERM to the process group, the build runner is started in its own group so this gets its
+// children too
+func (r *execRunner) Kill() error {
+	pgid, err := syscall.Getpgid(r.Pid())
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgid, syscall.SIGTERM)
+}
+
+// exitStatus gets the exit code out of the error from commandRunner.Wait, ok is false for errors that aren't about
+// how the process exited. signal is set when the process was killed by one
+func exitStatus(err error) (code int, signal syscall.Signal, ok bool) {
+	exitErr, ok := err.(interface {
+		Sys() interface{}
+	})
+	if ok == false {
+		return ExitCodeNone, 0, false
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if ok == false {
+		// we know it exited, just not how
+		return ExitCodeNone, 0, true
+	}
+	if status.Signaled() {
+		return status.ExitStatus(), status.Signal(), true
+	}
+	return status.ExitStatus(), 0, true
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeExit is what fakeProcess.Wait returns for processes that didn't exit cleanly, like an *exec.ExitError
+type fakeExit syscall.WaitStatus
+
+func (e fakeExit) Error() string    { return "fake exit" }
+func (e fakeExit) Sys() interface{} { return syscall.WaitStatus(e) }
+
+// fakeOutput is a stdout or stderr that stays open until the fake process closes it, like a real pipe whose
+// writer is still around, closing the read end doesn't change that
+type fakeOutput struct {
+	closed chan struct{}
+}
+
+func (o *fakeOutput) Read([]byte) (int, error) {
+	<-o.closed
+	return 0, io.EOF
+}
+
+func (o *fakeOutput) Close() error { return nil }
+
+// fakeProcess is a build runner that never runs, it exits when told to or when it is killed
+type fakeProcess struct {
+	pid    int
+	output *fakeOutput
+
+	once   sync.Once
+	exited chan struct{}
+	err    error
+	killed bool
+}
+
+func newFakeProcess(pid int) *fakeProcess {
+	return &fakeProcess{pid: pid, output: &fakeOutput{closed: make(chan struct{})}, exited: make(chan struct{})}
+}
+
+func (p *fakeProcess) StdoutPipe() (io.ReadCloser, error) { return p.output, nil }
+func (p *fakeProcess) StderrPipe() (io.ReadCloser, error) { return p.output, nil }
+func (p *fakeProcess) Start() error                       { return nil }
+func (p *fakeProcess) Pid() int                           { return p.pid }
+
+func (p *fakeProcess) Wait() error {
+	<-p.exited
+	return p.err
+}
+
+// exit closes the processes output and has Wait return err
+func (p *fakeProcess) exit(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.output.closed)
+		close(p.exited)
+	})
+}
+
+func (p *fakeProcess) Kill() error {
+	p.killed = true
+	p.exit(fakeExit(syscall.SIGTERM))
+	return nil
+}
+
+// runFakeBuild runs a build of a, with process as its build runner
+func runFakeBuild(t *testing.T, a *app, process *fakeProcess, deadline time.Duration) (Build, int) {
+	var made *exec.Cmd
+	a.newCommand = func(cmd *exec.Cmd) commandRunner {
+		made = cmd
+		return process
+	}
+
+	config := NewBuildConfig()
+	config.Group = "group"
+	config.Deadline = deadline
+	token, err := a.NewBuild("group", config)
+	require.NoError(t, err)
+	build, err := a.GetBuild(token)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	code, err := build.Wait(ctx)
+	require.NoError(t, err)
+	if made == nil {
+		t.Fatal("the build didn't make its command through newCommand")
+	}
+	assert.NotEmpty(t, made.Dir, "the command is set up before it is handed over")
+	return build, code
+}
+
+func TestBuildWithFakeProcess(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-command")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("command", &scriptProvider{script: "#!/bin/sh\nexit 1\n"}).(*app)
+	a.staticConfig = config{"buildLocation": filepath.Join(dir, "builds")}
+	defer a.Shutdown()
+
+	process := newFakeProcess(os.Getpid())
+	process.exit(fakeExit(3 << 8))
+	build, code := runFakeBuild(t, a, process, time.Second*10)
+	assert.Equal(3, code)
+	assert.Empty(build.FailureReason(), "the build runner failed by itself")
+
+	process = newFakeProcess(os.Getpid())
+	build, _ = runFakeBuild(t, a, process, time.Millisecond*50)
+	assert.True(process.killed, "builds past their deadline are killed")
+	assert.Equal(FailureReasonDeadline, build.FailureReason())
+
+	defer func(interval time.Duration) { processCheckInterval = interval }(processCheckInterval)
+	processCheckInterval = time.Millisecond * 10
+
+	// the process is long gone but its output was never closed
+	process = newFakeProcess(1 << 30)
+	close(process.exited)
+	defer close(process.output.closed)
+	_, code = runFakeBuild(t, a, process, time.Second*10)
+	assert.Equal(0, code)
+	assert.False(process.killed)
+}
+
+func TestExitStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	code, signal, ok := exitStatus(fakeExit(3 << 8))
+	assert.True(ok)
+	assert.Equal(3, code)
+	assert.Equal(syscall.Signal(0), signal)
+
+	_, signal, ok = exitStatus(fakeExit(syscall.SIGKILL))
+	assert.True(ok)
+	assert.Equal(syscall.SIGKILL, signal)
+
+	code, _, ok = exitStatus(os.ErrNotExist)
+	assert.False(ok)
+	assert.Equal(ExitCodeNone, code)
+
+	err := exec.Command("/bin/sh", "-c", "exit 4").Run()
+	code, _, ok = exitStatus(err)
+	assert.True(ok, "real exit errors work the same")
+	assert.Equal(4, code)
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -26,26 +27,36 @@ var (
 		"buildLocation":     os.TempDir(),
 		"artifactsLocation": os.TempDir(),
 		"cacheDirectory":    expandHome("~/.cache/ngbuild/"),
+
+		"workspaceMaxAgeHours": 24,
 	}
 )
 
 func loadConfig(path string) (config, error) {
 	configCacheLock.RLock()
-	var err error
-	if configBaseDir == "" {
-		configBaseDir, err = getNGBuildDirectory()
-		if err != nil {
-			configBaseDir = ""
-		}
+	baseDir := configBaseDir
+	c, ok := configCache[path]
+	configCacheLock.RUnlock()
+	if ok {
+		return c, nil
 	}
 
-	if c, ok := configCache[path]; ok {
-		configCacheLock.RUnlock()
-		return c, nil
+	if baseDir == "" {
+		configCacheLock.Lock()
+		if configBaseDir == "" {
+			if dir, err := getNGBuildDirectory(); err == nil {
+				configBaseDir = dir
+			}
+		}
+		baseDir = configBaseDir
+		configCacheLock.Unlock()
 	}
-	configCacheLock.RUnlock()
 
-	raw, err := ioutil.ReadFile(filepath.Join(configBaseDir, path))
+	filename := path
+	if filepath.IsAbs(filename) == false {
+		filename = filepath.Join(baseDir, path)
+	}
+	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -53,22 +64,122 @@ func loadConfig(path string) (config, error) {
 	var conf interface{}
 	err = json.Unmarshal(raw, &conf)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s isn't valid json: %s", filename, err)
+	}
+	object, ok := conf.(map[string]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("%s should be a json object", filename)
+	}
+
+	// secrets are resolved once the profile has picked which ones to use
+	resolved, err := resolveSecrets(map[string]interface{}(withProfile(filename, object)))
+	if err != nil {
+		return nil, fmt.Errorf("%s has a secret that couldn't be resolved, %s", filename, err)
 	}
 
 	configCacheLock.Lock()
 	defer configCacheLock.Unlock()
-	configCache[path] = (config)(conf.(map[string]interface{}))
+	configCache[path] = (config)(resolved.(map[string]interface{}))
 
 	return configCache[path], nil
 }
 
+// profileEnv picks the profile from every configs "profiles" to use over the rest of it, "production" for example
+const profileEnv = "NGBUILD_PROFILE"
+
+// withProfile merges the NGBUILD_PROFILE profile of conf over the rest of it. Configs with profiles that don't have
+// that one are warned about and used as they are, configs without profiles are just used as they are
+func withProfile(filename string, conf map[string]interface{}) config {
+	name := os.Getenv(profileEnv)
+	profiles, ok := conf["profiles"].(map[string]interface{})
+	if ok == false || name == "" {
+		return (config)(conf)
+	}
+
+	profile, ok := profiles[name].(map[string]interface{})
+	if ok == false {
+		logwarnf("%s has no %q profile, using it without one", filename, name)
+		return (config)(conf)
+	}
+
+	base := make(map[string]interface{}, len(conf))
+	for key, value := range conf {
+		if key != "profiles" {
+			base[key] = value
+		}
+	}
+	return (config)(mergeConfig(base, profile))
+}
+
+// mergeConfig returns base with override on top of it, objects in both are merged, anything else is replaced
+func mergeConfig(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseObject, baseIsObject := merged[key].(map[string]interface{})
+		overrideObject, overrideIsObject := value.(map[string]interface{})
+		if baseIsObject && overrideIsObject {
+			merged[key] = mergeConfig(baseObject, overrideObject)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
 func loadMasterConfig() (config, error) {
 	return loadConfig("ngbuild.json")
 }
 
+// baseConfigsEnv lists base configs to apply before ngbuild.json, separated like PATH
+const baseConfigsEnv = "NGBUILD_BASE_CONFIGS"
+
+// loadMasterConfigs returns the master configs in the order they should be applied, later ones override earlier ones.
+// That's the configs in NGBUILD_BASE_CONFIGS, then those in the "includes" of ngbuild.json, then ngbuild.json itself.
+// Relative paths are relative to the ngbuild directory, includes aren't followed any further than that
+func loadMasterConfigs() ([]config, error) {
+	master, err := loadMasterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	if env := os.Getenv(baseConfigsEnv); env != "" {
+		paths = append(paths, filepath.SplitList(env)...)
+	}
+	if includes, ok := master["includes"].([]interface{}); ok {
+		for _, include := range includes {
+			if path, ok := include.(string); ok {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	configs := make([]config, 0, len(paths)+1)
+	for _, path := range paths {
+		base, err := loadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, base)
+	}
+	return append(configs, master), nil
+}
+
+// loadAppConfig returns nil without an error when the app has no config.json, everything comes from the master config
 func loadAppConfig(appname string) (config, error) {
-	return loadConfig(filepath.Join("apps", appname, "config.json"))
+	return loadOptionalConfig(filepath.Join("apps", appname, "config.json"))
+}
+
+// loadOptionalConfig is loadConfig for configs that don't have to exist, it returns nil if path doesn't
+func loadOptionalConfig(path string) (config, error) {
+	conf, err := loadConfig(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return conf, err
 }
 
 // for the given config, apply it's data onto the given structure s
@@ -77,18 +188,20 @@ func applyConfig(appname string, s interface{}) error {
 		return err
 	}
 
-	master, err := loadMasterConfig()
+	masters, err := loadMasterConfigs()
 	if err != nil {
 		return err
 	}
 
-	if err = mapstructure.Decode(master, s); err != nil {
-		return err
+	for _, master := range masters {
+		if err = mapstructure.Decode(master, s); err != nil {
+			return err
+		}
 	}
 
 	if appname != "" {
 		appconfig, err := loadAppConfig(appname)
-		if err != nil {
+		if err != nil || appconfig == nil {
 			return err
 		}
 
@@ -111,20 +224,44 @@ func getIntegrationConfig(conf config, integrationName string) config {
 	}
 }
 
-// Like applyConfig, but will look for configs in /integrations/integrationName/
+// Like applyConfig, but for the config of integrationName. That can be in integrations/integrationName.json, and in
+// apps/appname/integrations/integrationName.json, as well as under Integrations in ngbuild.json and the apps
+// config.json. Those files are applied first, so what's under Integrations overrides them
 func applyIntegrationConfig(appname, integrationName string, s interface{}) error {
-	master, err := loadMasterConfig()
+	masterFile, err := loadOptionalConfig(filepath.Join("integrations", integrationName+".json"))
 	if err != nil {
 		return err
 	}
-
-	if masterIntegration := getIntegrationConfig(master, integrationName); masterIntegration != nil {
-		if err = mapstructure.Decode(masterIntegration, s); err != nil {
+	if masterFile != nil {
+		if err = mapstructure.Decode(masterFile, s); err != nil {
 			return err
 		}
 	}
 
+	masters, err := loadMasterConfigs()
+	if err != nil {
+		return err
+	}
+
+	for _, master := range masters {
+		if masterIntegration := getIntegrationConfig(master, integrationName); masterIntegration != nil {
+			if err = mapstructure.Decode(masterIntegration, s); err != nil {
+				return err
+			}
+		}
+	}
+
 	if appname != "" {
+		appFile, err := loadOptionalConfig(filepath.Join("apps", appname, "integrations", integrationName+".json"))
+		if err != nil {
+			return err
+		}
+		if appFile != nil {
+			if err = mapstructure.Decode(appFile, s); err != nil {
+				return err
+			}
+		}
+
 		appconfig, err := loadAppConfig(appname)
 		if err != nil {
 			return err
@@ -1,6 +1,9 @@
 package core
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,3 +45,213 @@ func TestApplyConfig(t *testing.T) {
 
 	configBaseDir = previousBaseDir
 }
+
+func TestApplyConfigBaseConfigs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-baseconfigs")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	write := func(path, contents string) {
+		require.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+	// from the machine, to the team, to the workspace, each sets one less thing than the last
+	machine := filepath.Join(dir, "etc", "machine.json")
+	write(machine, `{"First": "machine", "Second": "machine", "Third": "machine", "Fourth": "machine",
+		"Integrations": {"testintegration": {"Foo": "machine", "Baz": "machine"}}}`)
+	write(filepath.Join(dir, "team.json"), `{"First": "team", "Second": "team", "Third": "team",
+		"Integrations": {"testintegration": {"Foo": "team"}}}`)
+	write(filepath.Join(dir, "ngbuild.json"), `{"includes": ["team.json"], "First": "workspace", "Second": "workspace"}`)
+	write(filepath.Join(dir, "apps", "testapp", "config.json"), `{"First": "app"}`)
+
+	previousBaseDir := configBaseDir
+	defer func() {
+		configBaseDir = previousBaseDir
+		configCache = make(map[string]config)
+	}()
+	configBaseDir = dir
+	configCache = make(map[string]config)
+	defer os.Unsetenv(baseConfigsEnv)  //nolint (errcheck)
+	os.Setenv(baseConfigsEnv, machine) //nolint (errcheck)
+
+	type levels struct {
+		First, Second, Third, Fourth string
+	}
+	var conf levels
+	require.NoError(applyConfig("testapp", &conf))
+	assert.Equal(levels{"app", "workspace", "team", "machine"}, conf)
+
+	conf = levels{}
+	require.NoError(applyConfig("", &conf))
+	assert.Equal(levels{"workspace", "workspace", "team", "machine"}, conf)
+
+	var integration struct {
+		Foo, Baz string
+	}
+	require.NoError(applyIntegrationConfig("testapp", "testintegration", &integration))
+	assert.Equal("team", integration.Foo)
+	assert.Equal("machine", integration.Baz)
+
+	// without any base configs it's just ngbuild.json, as it always was
+	os.Unsetenv(baseConfigsEnv) //nolint (errcheck)
+	write(filepath.Join(dir, "ngbuild.json"), `{"First": "workspace"}`)
+	configCache = make(map[string]config)
+	conf = levels{}
+	require.NoError(applyConfig("", &conf))
+	assert.Equal(levels{First: "workspace"}, conf)
+
+	// missing base configs are an error rather than silently ignored
+	os.Setenv(baseConfigsEnv, filepath.Join(dir, "missing.json")) //nolint (errcheck)
+	assert.Error(applyConfig("", &conf))
+}
+
+func TestApplyIntegrationConfigFiles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-integrationfiles")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	write := func(path, contents string) {
+		require.NoError(os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, path), []byte(contents), 0644))
+	}
+	write("integrations/testintegration.json", `{"First": "master file", "Second": "master file", "Third": "master file", "Fourth": "master file"}`)
+	write("ngbuild.json", `{"Integrations": {"testintegration": {"First": "master", "Second": "master", "Third": "master"}}}`)
+	write("apps/testapp/integrations/testintegration.json", `{"First": "app file", "Second": "app file"}`)
+	write("apps/testapp/config.json", `{"Integrations": {"testintegration": {"First": "app"}}}`)
+	write("apps/nofiles/config.json", `{}`)
+
+	previousBaseDir := configBaseDir
+	defer func() {
+		configBaseDir = previousBaseDir
+		configCache = make(map[string]config)
+	}()
+	configBaseDir = dir
+	configCache = make(map[string]config)
+
+	type levels struct {
+		First, Second, Third, Fourth string
+	}
+	var conf levels
+	require.NoError(applyIntegrationConfig("testapp", "testintegration", &conf))
+	assert.Equal(levels{"app", "app file", "master", "master file"}, conf)
+
+	// apps don't need their own files
+	conf = levels{}
+	require.NoError(applyIntegrationConfig("nofiles", "testintegration", &conf))
+	assert.Equal(levels{"master", "master", "master", "master file"}, conf)
+
+	// nor integrations any at all
+	conf = levels{}
+	require.NoError(applyIntegrationConfig("testapp", "otherintegration", &conf))
+	assert.Equal(levels{}, conf)
+
+	// but broken files aren't ignored
+	write("integrations/broken.json", `{"First": `)
+	assert.Error(applyIntegrationConfig("testapp", "broken", &conf))
+}
+
+func TestApplyConfigAppFiles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-appfiles")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	write := func(path, contents string) {
+		require.NoError(os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, path), []byte(contents), 0644))
+	}
+	write("ngbuild.json", `{"Foo": "master", "Integrations": {"testintegration": {"Foo": "master"}}}`)
+	require.NoError(os.MkdirAll(filepath.Join(dir, "apps", "noconfig"), 0755))
+	write("apps/malformed/config.json", `{"Foo": "app",`)
+	write("apps/notanobject/config.json", `["Foo"]`)
+
+	previousBaseDir := configBaseDir
+	defer func() {
+		configBaseDir = previousBaseDir
+		configCache = make(map[string]config)
+	}()
+	configBaseDir = dir
+	configCache = make(map[string]config)
+
+	var conf struct {
+		Foo string
+	}
+
+	// apps without a config.json get the master config
+	require.NoError(applyConfig("noconfig", &conf))
+	assert.Equal("master", conf.Foo)
+	conf.Foo = ""
+	require.NoError(applyIntegrationConfig("noconfig", "testintegration", &conf))
+	assert.Equal("master", conf.Foo)
+
+	// but a config.json that can't be read is a problem
+	for _, app := range []string{"malformed", "notanobject"} {
+		err := applyConfig(app, &conf)
+		if assert.Error(err, app) {
+			assert.Contains(err.Error(), filepath.Join("apps", app, "config.json"))
+		}
+		assert.Error(applyIntegrationConfig(app, "testintegration", &conf), app)
+	}
+}
+
+func TestApplyConfigProfiles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-profiles")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	write := func(path, contents string) {
+		require.NoError(os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, path), []byte(contents), 0644))
+	}
+	write("ngbuild.json", `{
+		"Foo": "base", "Bar": "base",
+		"Integrations": {"testintegration": {"Foo": "base", "Bar": "base"}},
+		"profiles": {"production": {"Foo": "production", "Integrations": {"testintegration": {"Foo": "production"}}}}
+	}`)
+	write("apps/profiled/config.json", `{"Bar": "app", "profiles": {"production": {"Bar": "app production"}}}`)
+
+	previousBaseDir := configBaseDir
+	defer func() {
+		configBaseDir = previousBaseDir
+		configCache = make(map[string]config)
+		os.Unsetenv(profileEnv) //nolint (errcheck)
+	}()
+	configBaseDir = dir
+
+	type conf struct {
+		Foo string
+		Bar string
+	}
+	apply := func(profile string) (conf, conf) {
+		os.Setenv(profileEnv, profile) //nolint (errcheck)
+		configCache = make(map[string]config)
+
+		var app, integration conf
+		require.NoError(applyConfig("profiled", &app))
+		require.NoError(applyIntegrationConfig("profiled", "testintegration", &integration))
+		return app, integration
+	}
+
+	app, integration := apply("")
+	assert.Equal(conf{"base", "app"}, app, "without a profile only the base config is used")
+	assert.Equal(conf{"base", "base"}, integration)
+
+	app, integration = apply("production")
+	assert.Equal(conf{"production", "app production"}, app)
+	assert.Equal(conf{"production", "base"}, integration, "profiles are merged into the base config, not swapped for it")
+
+	app, integration = apply("staging")
+	assert.Equal(conf{"base", "app"}, app, "unknown profiles fall back to the base config")
+	assert.Equal(conf{"base", "base"}, integration)
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// SecretResolver returns the secret a config value refers to, it's given what's after the "${scheme:"
+type SecretResolver func(reference string) (string, error)
+
+var (
+	secretResolversLock sync.RWMutex
+	secretResolvers     = map[string]SecretResolver{
+		"file": resolveFileSecret,
+		"env":  resolveEnvSecret,
+	}
+
+	// reSecretReference matches "${scheme:reference}", only that, so file:// urls and the like are left alone
+	reSecretReference = regexp.MustCompile(`^\$\{(\w+):(.*)\}$`)
+	reEnvName         = regexp.MustCompile(`^\w+$`)
+)
+
+// RegisterSecretResolver has config values that are "${scheme:reference}" resolved by resolver when configs are
+// loaded, "${vault:secret/ci/github#token}" for example. It replaces any resolver scheme already had, configs that
+// have already been loaded keep what they resolved to until ReloadApps
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolversLock.Lock()
+	defer secretResolversLock.Unlock()
+
+	secretResolvers[scheme] = resolver
+}
+
+// resolveFileSecret is the contents of the file at path, without surrounding whitespace
+func resolveFileSecret(path string) (string, error) {
+	raw, err := ioutil.ReadFile(expandHome(path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// resolveEnvSecret is the value of the environment variable name, which has to be set
+func resolveEnvSecret(name string) (string, error) {
+	secret, ok := os.LookupEnv(name)
+	if ok == false {
+		return "", fmt.Errorf("%s isn't set", name)
+	}
+	return secret, nil
+}
+
+// bareSecretReference splits "file:/path" and "env:NAME", the file and env secrets can be written without the
+// "${}". file urls, "file:///srv/repos/app.git", are left alone so they can still be used as repos
+func bareSecretReference(value string) (scheme, reference string, ok bool) {
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		reference = strings.TrimPrefix(value, "file:")
+		return "file", reference, reference != "" && strings.HasPrefix(reference, "//") == false
+	case strings.HasPrefix(value, "env:"):
+		reference = strings.TrimPrefix(value, "env:")
+		return "env", reference, reEnvName.MatchString(reference)
+	}
+	return "", "", false
+}
+
+// resolveSecret returns the secret value refers to, values that aren't "${scheme:reference}" with a registered
+// scheme, or a bare "file:/path" or "env:NAME", are returned as they are. Secrets are registered with
+// RegisterSecret, so they never show in build output
+func resolveSecret(value string) (string, error) {
+	var scheme, reference string
+	if match := reSecretReference.FindStringSubmatch(value); match != nil {
+		scheme, reference = match[1], match[2]
+	} else if bareScheme, bareReference, ok := bareSecretReference(value); ok {
+		scheme, reference = bareScheme, bareReference
+	} else {
+		return value, nil
+	}
+
+	secretResolversLock.RLock()
+	resolver, ok := secretResolvers[scheme]
+	secretResolversLock.RUnlock()
+	if ok == false {
+		return value, nil
+	}
+
+	secret, err := resolver(reference)
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve %s secret: %s", scheme, err)
+	}
+	RegisterSecret(secret)
+	return secret, nil
+}
+
+// resolveSecrets returns value with every string in it resolved by resolveSecret, however deep it is in objects
+// and arrays
+func resolveSecrets(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case string:
+		return resolveSecret(typed)
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(typed))
+		for key, child := range typed {
+			var err error
+			if resolved[key], err = resolveSecrets(child); err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(typed))
+		for i, child := range typed {
+			var err error
+			if resolved[i], err = resolveSecrets(child); err != nil {
+				return nil, fmt.Errorf("%d: %s", i, err)
+			}
+		}
+		return resolved, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-secrets")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	secretPath := filepath.Join(dir, "github")
+	require.NoError(ioutil.WriteFile(secretPath, []byte("  hunter2\n"), 0600))
+
+	secret, err := resolveSecret("${file:" + secretPath + "}")
+	require.NoError(err)
+	assert.Equal("hunter2", secret)
+	assert.Contains(registeredSecrets(), "hunter2", "resolved secrets are redacted from build output")
+
+	// file and env secrets can be written without the ${}
+	secret, err = resolveSecret("file:" + secretPath)
+	require.NoError(err)
+	assert.Equal("hunter2", secret)
+	os.Setenv("NGBUILD_TEST_SECRET", "swordfish") //nolint (errcheck)
+	defer os.Unsetenv("NGBUILD_TEST_SECRET")      //nolint (errcheck)
+	for _, value := range []string{"env:NGBUILD_TEST_SECRET", "${env:NGBUILD_TEST_SECRET}"} {
+		secret, err = resolveSecret(value)
+		require.NoError(err)
+		assert.Equal("swordfish", secret)
+	}
+
+	for _, value := range []string{"plain", "https://ngbuild.io", "${vault:secret/ci/github#token}", "", "file",
+		"file:", "env:", "env:not a name", "file://" + dir, "file:///srv/repos/app.git"} {
+		unchanged, err := resolveSecret(value)
+		require.NoError(err)
+		assert.Equal(value, unchanged, "values without a registered scheme are left alone")
+	}
+
+	_, err = resolveSecret("${file:" + filepath.Join(dir, "missing") + "}")
+	assert.Error(err)
+	_, err = resolveSecret("file:" + filepath.Join(dir, "missing"))
+	assert.Error(err)
+	_, err = resolveSecret("env:NGBUILD_TEST_UNSET")
+	require.Error(err)
+	assert.Equal("couldn't resolve env secret: NGBUILD_TEST_UNSET isn't set", err.Error())
+
+	RegisterSecretResolver("vault", func(reference string) (string, error) {
+		return fmt.Sprintf("vault has %s", reference), nil
+	})
+	defer func() {
+		secretResolversLock.Lock()
+		delete(secretResolvers, "vault")
+		secretResolversLock.Unlock()
+	}()
+	secret, err = resolveSecret("${vault:secret/ci/github#token}")
+	require.NoError(err)
+	assert.Equal("vault has secret/ci/github#token", secret)
+}
+
+func TestApplyConfigSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-configsecrets")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	defer useNGBuildDirectory(dir)()
+
+	secretPath := filepath.Join(dir, "github")
+	require.NoError(ioutil.WriteFile(secretPath, []byte("hunter2\n"), 0600))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte(`{
+		"tokens": ["${file:`+secretPath+`}", "public", "file://`+dir+`"],
+		"Integrations": {"github": {"clientSecret": "file:`+secretPath+`"}}
+	}`), 0644))
+
+	var integration struct {
+		ClientSecret string `mapstructure:"clientSecret"`
+	}
+	require.NoError(applyIntegrationConfig("", "github", &integration))
+	assert.Equal("hunter2", integration.ClientSecret)
+
+	var global struct {
+		Tokens []string `mapstructure:"tokens"`
+	}
+	require.NoError(applyConfig("", &global))
+	assert.Equal([]string{"hunter2", "public", "file://" + dir}, global.Tokens, "secrets are resolved wherever they are")
+
+	// a secret that can't be found stops the config loading
+	require.NoError(os.Remove(secretPath))
+	configCache = make(map[string]config)
+	err = applyConfig("", &global)
+	require.Error(err)
+	assert.Contains(err.Error(), "couldn't resolve file secret")
+}
@@ -5,8 +5,75 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
+// appendSyncInterval is how often an AppendWriter will sync to disk while it's being written to
+const appendSyncInterval = time.Second * 5
+
+// AppendWriter keeps a file open and appends everything written to it, it syncs every so often rather than on
+// every write so chatty writers don't hammer the disk
+type AppendWriter struct {
+	m        sync.Mutex
+	file     *os.File
+	lastSync time.Time
+}
+
+// NewAppendWriter opens path for appending, creating it if it doesn't exist
+func NewAppendWriter(path string) (*AppendWriter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AppendWriter{file: file, lastSync: time.Now()}, nil
+}
+
+// Write will write all of p to the end of the file
+func (w *AppendWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := writeAll(w.file, p); err != nil {
+		return 0, err
+	}
+
+	if time.Since(w.lastSync) >= appendSyncInterval {
+		w.lastSync = time.Now()
+		if err := w.file.Sync(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close syncs and closes the file
+func (w *AppendWriter) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close() //nolint (errcheck)
+		return err
+	}
+	return w.file.Close()
+}
+
+// AppendToFile copies everything from reader onto the end of the file at path until reader returns io.EOF
+func AppendToFile(path string, reader io.Reader) error {
+	writer, err := NewAppendWriter(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close() //nolint (errcheck)
+		return err
+	}
+	return writer.Close()
+}
+
 // writeAll will write the entire buffer to file or die trying
 // i have no idea why go doesn't have this, it has ReadAll
 func writeAll(f io.Writer, buf []byte) error {
@@ -21,11 +88,39 @@ func writeAll(f io.Writer, buf []byte) error {
 	return nil
 }
 
+// WriteFileAtomic is ioutil.WriteFile, but the data is written to a temporary file that is then moved over path,
+// so path either has the old data or the new data and never half of the new data
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	// the temporary file has to be on the same filesystem for the rename to be atomic
+	dir, name := filepath.Split(path)
+	tmpFile, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) //nolint (errcheck)
+
+	err = writeAll(tmpFile, data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
 // CopyFile doesn't care if the file already exists, it just overwrites it.
 // It does however, try to be at least a little bit atomic
 func CopyFile(src, dst string) error {
 	_, name := filepath.Split(src)
-	tmpFile, err := ioutil.TempFile(os.TempDir(), name)
+	tmpFile, err := ioutil.TempFile(filepath.Dir(dst), name)
 	defer tmpFile.Close() //nolint (errcheck)
 	if err != nil {
 		return err
@@ -3,6 +3,8 @@ package core
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,3 +37,53 @@ func TestCopyFile(t *testing.T) {
 
 	assert.EqualValues(testData, copiedFile)
 }
+
+func TestAppendToFile(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile(os.TempDir(), "testappendtofile")
+	require.NoError(err)
+	defer os.Remove(file.Name()) //nolint (errcheck)
+	require.NoError(writeAll(file, []byte("existing\n")))
+	require.NoError(file.Close())
+
+	require.NoError(AppendToFile(file.Name(), strings.NewReader("appended\n")))
+
+	writer, err := NewAppendWriter(file.Name())
+	require.NoError(err)
+	n, err := writer.Write([]byte("written\n"))
+	require.NoError(err)
+	assert.Equal(len("written\n"), n)
+	require.NoError(writer.Close())
+
+	contents, err := ioutil.ReadFile(file.Name())
+	require.NoError(err)
+	assert.Equal("existing\nappended\nwritten\n", string(contents))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "testwritefileatomic")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	path := filepath.Join(dir, "file")
+	require.NoError(WriteFileAtomic(path, []byte("first"), 0600))
+	require.NoError(WriteFileAtomic(path, []byte("second"), 0600))
+
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	assert.Equal("second", string(contents))
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	assert.Len(files, 1)
+}
@@ -1,15 +1,19 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,19 +25,96 @@ var (
 	ErrProcessNotStarted      = errors.New("Error: process not started yet")
 	ErrProcessAlreadyFinished = errors.New("Error: process already finished")
 	ErrProcessAlreadyStarted  = errors.New("Error: process already started")
+	// ErrBuildNotFound is returned by ReplayBuild when there's nothing to replay the build from
+	ErrBuildNotFound = errors.New("Error: build not found")
 )
 
+// ValidationError lists everything that is wrong with a build, as found by DryRunBuild
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "Build is invalid: " + strings.Join(e.Problems, ", ")
+}
+
 // AppBus signal
 const (
 	appnameRE = `app:(?P<app>\w+)`
 	tokenRE   = `token:(?P<token>[a-zA-Z0-9_=+-]+)`
 
 	SignalBuildProvisioning = `\/build\/` + appnameRE + `\/provisioning\/` + tokenRE + `$`
-	SignalBuildComplete     = `\/build\/` + appnameRE + `\/complete\/` + tokenRE + `$`
+	SignalBuildComplete     = `\/build\/` + appnameRE + `\/complete\/` + tokenRE + `(?:\/provisiontime:(?P<provisiontime>[0-9]+))?(?:\/reason:(?P<reason>\w+))?(?:\/skippedartifacts:(?P<skippedartifacts>[0-9]+))?$`
 	SignalBuildStarted      = `\/build\/` + appnameRE + `\/started\/` + tokenRE + `$`
-	EventCoreLog            = `\/log\/` + appnameRE + `\/logtype:(?P<logtype>\w+)\/(?P<logmessage>.*)`
+	SignalBuildHeartbeat    = `\/build\/` + appnameRE + `\/heartbeat\/` + tokenRE + `\/elapsed:(?P<elapsed>[0-9]+)\/outputbytes:(?P<outputbytes>[0-9]+)$`
+	EventCoreLog            = `\/log\/` + appnameRE + `\/logtype:(?P<logtype>\w+)(?:\/time:(?P<logtime>[0-9]+))?\/(?P<logmessage>.*)`
+)
+
+// BuildConfig metadata keys set by core
+const (
+	// MetadataProvider holds the Identifier of the integration that provisioned the build
+	MetadataProvider = "ngbuild:Provider"
+	// MetadataFailureReason holds a human readable explanation when a build failed for a known reason
+	MetadataFailureReason = "ngbuild:FailureReason"
+	// MetadataCommand holds how the build runner was invoked, "./build.sh" or "/bin/sh build.sh" for example
+	MetadataCommand = "ngbuild:Command"
+	// MetadataCommandLine holds exactly what was run and where, see Build.CommandLine
+	MetadataCommandLine = "ngbuild:CommandLine"
+	// MetadataSkippedArtifacts lists the artifacts that weren't stored as they were over the apps limits
+	MetadataSkippedArtifacts = "ngbuild:SkippedArtifacts"
+)
+
+// Reasons a build can fail with, these are sent as reason:$reason on the build complete event
+const (
+	FailureReasonRunnerMissing       = "runnermissing"
+	FailureReasonRunnerNotExecutable = "runnernotexecutable"
+	FailureReasonOutputLimit         = "outputlimit"
+	FailureReasonDeadline            = "deadline"
+	// FailureReasonStopped is for builds that were asked to stop, by a newer commit or a person
+	FailureReasonStopped = "stopped"
+	// FailureReasonKilled is for build runners killed by a signal nobody here sent
+	FailureReasonKilled = "killed"
+
+	// the rest are problems with ngbuild or integrations, not the build itself
+	FailureReasonProvisionFailed  = "provisionfailed"
+	FailureReasonProvisionTimeout = "provisiontimeout"
+	FailureReasonRunFailed        = "runfailed"
+	FailureReasonStopFailed       = "stopfailed"
 )
 
+// LocalRepoScheme is the prefix of HeadRepo for builds of a directory that's already on disk, they don't need
+// hashes or a base repo
+const LocalRepoScheme = "file://"
+
+// Ways a change can be combined with its base before it is built, set as BuildConfig.MergeStrategy
+const (
+	// MergeStrategyMerge merges the base into the head, like github's merge button
+	MergeStrategyMerge = "merge"
+	// MergeStrategySquash applies the changes as one uncommitted change on top of the base
+	MergeStrategySquash = "squash"
+	// MergeStrategyRebase replays the heads commits on top of the base
+	MergeStrategyRebase = "rebase"
+	// MergeStrategyHeadOnly builds the head as it is, without the base
+	MergeStrategyHeadOnly = "head-only"
+	// MergeStrategyProvider uses the merge the provider has already made if it can, github's pull/N/merge for
+	// example, so builds match what it shows. Otherwise it falls back to MergeStrategyMerge
+	MergeStrategyProvider = "provider"
+)
+
+// ExitCodeNone is the exit code of builds that don't have a real one, either the build runner never ran or it
+// didn't exit by itself. The builds FailureReason says what happened
+const ExitCodeNone = -1
+
+// IsInfrastructureFailure is true for failure reasons that aren't the builds fault, so shouldn't be reported
+// as a failed build
+func IsInfrastructureFailure(reason string) bool {
+	switch reason {
+	case FailureReasonProvisionFailed, FailureReasonProvisionTimeout, FailureReasonRunFailed, FailureReasonStopFailed:
+		return true
+	}
+	return false
+}
+
 type (
 	// EventHandler can be used to cancel an event added with Listen
 	EventHandler uint32
@@ -56,16 +137,42 @@ type (
 		SendEvent(event string)
 
 		// Listen will provide a channel to select on for a given regular expression
-		// returned map is the captured groups and values
+		// returned map is the captured groups and values. The expression matches anywhere in an event unless it
+		// is anchored, wrap it in ExactEvent to only match whole events
 		// the returned EventHandler can be used to cancel a listener
 		Listen(event string, listener func(map[string]string)) EventHandler
+		// ListenOnce is Listen for the first matching event only, the listener is removed after it has been called
+		ListenOnce(event string, listener func(map[string]string)) EventHandler
+		// ListenGlob is Listen with a glob pattern rather than a regular expression, /build/app:*/complete/token:*
+		// for example, name:* parts are captured as name. See GlobEvent
+		ListenGlob(pattern string, listener func(map[string]string)) EventHandler
 
 		RemoveEventHandler(EventHandler)
 
 		// NewBuild will be used by github and the like to create new builds for this app whenever they deem so
+		// a returned token always refers to a build that has at least begun provisioning, if the build
+		// couldn't be started it is forgotten and the error is returned instead
 		NewBuild(group string, config *BuildConfig) (token string, err error)
+		// DefaultBuildConfig is what NewBuild fills in whatever a builds config leaves unset from. It is made
+		// from the app config, buildRunner, mergeStrategy, defaultDeadline, defaultProvisionTimeout and
+		// defaultMetadata, and falls back to hardcoded defaults for anything the app config doesn't set. So the
+		// callers config wins over the app defaults, which win over the hardcoded ones
+		DefaultBuildConfig() *BuildConfig
+		// DryRunBuild will provision the build and check it could run, without running it, any problems
+		// found are returned as a *ValidationError
+		DryRunBuild(group string, config *BuildConfig) error
 		GetBuild(token string) (Build, error)
+		// ReplayBuild makes a new build from the config the build token was made from, it works after the build
+		// has been forgotten, returns the new builds token
+		ReplayBuild(token string) (newToken string, err error)
+		// GetBuildHistory returns a snapshot of the groups builds, oldest first
 		GetBuildHistory(group string) []Build
+		// ActiveBuilds returns the builds that have started and not yet stopped, across all groups
+		ActiveBuilds() []Build
+		// AllBuilds returns every build the app knows about, across all groups
+		AllBuilds() []Build
+		// Metrics returns a snapshot of how many builds have started, completed and failed, and how long they took
+		Metrics() Metrics
 
 		// logging functions, logs sent here will go to stdout and on the app bus as log messages
 		Loginfof(string, ...interface{})
@@ -99,7 +206,22 @@ type (
 
 		// Should be an executable of some sort, if not set, set by app.NewBuild
 		BuildRunner string
-		Deadline    time.Duration
+		// BuildRunnerArgs are passed to the BuildRunner after any buildRunnerArgs from the app config,
+		// {{metadata:Key}} in an arg is replaced with that metadata, {{github:HeadHash}} for example
+		BuildRunnerArgs []string
+		// Secrets are replaced with **** wherever the builds output ends up, on top of any registered with
+		// RegisterSecret or set in the apps buildSecrets. They are never marshalled
+		Secrets []string `json:"-"`
+		// Deadline is how long the build can run for, if not set, set by app.NewBuild from the apps
+		// defaultDeadline, or 30 minutes
+		Deadline time.Duration
+		// ProvisionTimeout is how long integrations have to provide for a build before it fails,
+		// this is separate from Deadline, which only starts once the build is running. If not set, set by
+		// app.NewBuild from the apps defaultProvisionTimeout, or 10 minutes
+		ProvisionTimeout time.Duration
+		// MergeStrategy is how providers combine the head and base of a change, one of the MergeStrategy
+		// constants. If not set, set by app.NewBuild from the apps mergeStrategy, or MergeStrategyMerge
+		MergeStrategy string
 	}
 
 	// Build interface
@@ -118,9 +240,12 @@ type (
 		HasStarted() bool
 		HasStopped() bool
 
-		// NewBuild() Will be used by slack and the like, /rebuild <token> or buttons or whatever will just lookup the build
-		// and call NewBuild() to run the exact same build again
+		// NewBuild() runs the exact same build again, it is App.ReplayBuild with this builds token
 		NewBuild() (token string, err error)
+		// NewFailedBuilds replays the builds of this builds commit that failed, it looks at the latest build for
+		// each value of the label metadata in the group and only replays the ones that finished with a non zero
+		// exit code, so builds that passed are left alone
+		NewFailedBuilds(label string) (tokens []string, err error)
 
 		// Stdout/Stderr give you what you would expect, io.Reader's that will let you access the entire stdout/err output
 		Stdout() (io.Reader, error)
@@ -128,19 +253,60 @@ type (
 
 		// ExitCode returns 0, ErrProcessNotFinished
 		ExitCode() (int, error)
+		// FailureReason is one of the FailureReason constants when the build failed for a reason we know about,
+		// empty when it passed or the build runner failed by itself
+		FailureReason() string
+		// Outcome buckets how the build turned out, for reporting that needs more than pass or fail
+		Outcome() Outcome
+		// Wait blocks until the build has finished and returns its exit code, or ctx.Err() if ctx is done first
+		Wait(ctx context.Context) (int, error)
 
 		// Artifact will return a series of filepaths, artifacts are part of the app config in a map[string][]string format
-		// that is, a given named artifact can have many paths associated with it
+		// of glob patterns in the workspace, that is, a given named artifact can have many paths associated with it.
+		// They are stored once the build has run, up to the apps maxArtifactBytes and maxArtifactFiles
 		// this should be used by say, code coverage tools to generate coverage reports by grabbing artifacts listed here
 		Artifact(name string) []string
 
 		BuildTime() time.Duration
+		// ProvisionTime is how long integrations took to provide for the build, 0 until provisioning has finished
+		ProvisionTime() time.Duration
+
+		// Provider returns the Identifier of the integration that provisioned this build
+		Provider() string
+
+		// QueuePosition returns where this build is in its apps queue of builds waiting to be provisioned, and how
+		// long that queue is. Builds are queued while they wait on their group or their provider, it returns 0, 0
+		// once the build is being provisioned
+		QueuePosition() (position, length int)
+		// WaitingOnGroup is true while the build waits for earlier builds in its group to finish, builds only do
+		// that in groups the app has in serialGroups
+		WaitingOnGroup() bool
 
+		// History returns the builds in this builds group up to and including this one, oldest first
 		History() []Build
 
 		Config() *BuildConfig
 
 		WebStatusURL() string
+
+		// OutputStats says how much output the build has produced so far
+		OutputStats() OutputStats
+
+		// WorkspacePath is the directory the build is run in, failed builds can keep theirs around if configured to
+		WorkspacePath() string
+
+		// CommandLine is exactly what was run for the build, the runners full path and args with the env ngbuild
+		// added in front and the directory it ran in after, secrets are redacted. It is empty until the build runs
+		CommandLine() string
+	}
+
+	// OutputStats is how much a build has written to stdout/stderr
+	OutputStats struct {
+		StdoutBytes uint64 `json:"stdoutBytes"`
+		StderrBytes uint64 `json:"stderrBytes"`
+		// PeakBytesPerSecond is the fastest either stdout or stderr was written to
+		PeakBytesPerSecond uint64        `json:"peakBytesPerSecond"`
+		Duration           time.Duration `json:"duration"`
 	}
 
 	// Integration is an interface that integrations should provide
@@ -155,11 +321,19 @@ type (
 
 		// ProvideFor will be called on the integration when it is expected to provide for a build
 		// generally this means checkout git repositories into the given directory
-		ProvideFor(c *BuildConfig, directory string) error
+		ProvideFor(ctx context.Context, c *BuildConfig, directory string) error
 
 		// AttachToApp will order the ingeration to do whatever it does, with the given app.
 		AttachToApp(App) error
 
+		// DetachFromApp is called when an app is going away or no longer has this integration enabled,
+		// the integration should stop doing whatever it does with the given app
+		DetachFromApp(App) error
+
+		// Ready should return nil once the integration is able to do its job, otherwise an error saying what it's
+		// waiting on, it is what /readyz reports
+		Ready() error
+
 		// Shutdown will be called whenever we are closing, anything the integration needs to do, it has to do syncronously
 		Shutdown()
 	}
@@ -170,7 +344,8 @@ var integrations = []Integration{}
 // NewBuildConfig ...
 func NewBuildConfig() *BuildConfig {
 	return &BuildConfig{
-		m: &sync.RWMutex{},
+		m:        &sync.RWMutex{},
+		metadata: make(map[string]string),
 	}
 }
 
@@ -234,7 +409,11 @@ func StoreCache(key, data string) {
 	cache[key] = data
 	cacheLock.Unlock()
 
-	// sync cache to disk from here out
+	syncCache()
+}
+
+// syncCache writes the cache to disk, unless a sync is already happening
+func syncCache() {
 	if atomic.LoadUint64(&cacheSyncCheck) > 0 {
 		return
 	}
@@ -250,11 +429,43 @@ func StoreCache(key, data string) {
 	defer cacheLock.RUnlock()
 	if data, err := json.Marshal(cache); err != nil {
 		logcritf("Unable to serialize cache to disk: %s", err)
-	} else if err := ioutil.WriteFile(filepath.Join(cacheDirectory, "ngbuild.cache"), data, 0644); err != nil {
+	} else if err := writeCacheFile(cacheDirectory, data); err != nil {
 		logcritf("Unable to serialize cache to disk: %s", err)
 	}
+}
 
-	return
+// writeCacheFile backs up the current cache file to ngbuild.cache.bak and then replaces it with data
+func writeCacheFile(cacheDirectory string, data []byte) error {
+	path := filepath.Join(cacheDirectory, "ngbuild.cache")
+	if exists, _ := Exists(path); exists {
+		if err := CopyFile(path, path+".bak"); err != nil {
+			return err
+		}
+	}
+
+	return WriteFileAtomic(path, data, 0644)
+}
+
+// readCacheFile reads ngbuild.cache, falling back to the backup made by writeCacheFile if it's unreadable
+func readCacheFile(cacheDirectory string) (map[string]string, error) {
+	path := filepath.Join(cacheDirectory, "ngbuild.cache")
+
+	var err error
+	for _, filename := range []string{path, path + ".bak"} {
+		var data []byte
+		if data, err = ioutil.ReadFile(filename); err != nil {
+			continue
+		}
+
+		loaded := make(map[string]string)
+		if err = json.Unmarshal(data, &loaded); err != nil {
+			logwarnf("Cache file %s is corrupt: %s", filename, err)
+			continue
+		}
+		return loaded, nil
+	}
+
+	return nil, err
 }
 
 func initCache() {
@@ -271,10 +482,12 @@ func initCache() {
 
 	cacheDirectory := CacheDirectory()
 
-	if data, err := ioutil.ReadFile(filepath.Join(cacheDirectory, "ngbuild.cache")); err != nil {
-		logcritf("Unable to read cached data: %s", err)
-	} else if err := json.Unmarshal(data, &cache); err != nil {
+	if loaded, err := readCacheFile(cacheDirectory); err != nil {
 		logcritf("Unable to read cached data: %s", err)
+	} else {
+		for key, value := range loaded {
+			cache[key] = value
+		}
 	}
 }
 
@@ -289,17 +502,89 @@ func GetCache(key string) string {
 	return cache[key]
 }
 
+type httpServerConfig struct {
+	HTTPListenAddr string `mapstructure:"httpListenAddr"`
+	HTTPListenPort string `mapstructure:"httpListenPort"`
+	Hostname       string `mapstructure:"hostname"`
+
+	// ExternalURL is the url the outside world reaches us on, when we are behind a proxy it is
+	// probably not hostname:httpListenPort
+	ExternalURL string `mapstructure:"externalURL"`
+
+	// BasePath is the path everything is served under, for running behind a proxy at example.com/ci/
+	BasePath string `mapstructure:"basePath"`
+
+	// if both of these are set the http server will serve https itself
+	TLSCertFile string `mapstructure:"tlsCertFile"`
+	TLSKeyFile  string `mapstructure:"tlsKeyFile"`
+}
+
+// defaultHTTPListenPort is the port we listen on when httpListenPort isn't set
+const defaultHTTPListenPort = 80
+
+// getHTTPServerConfig returns the http server config with httpListenPort normalised, an invalid port is left as it
+// is for StartHTTPServer to complain about
+func getHTTPServerConfig() httpServerConfig {
+	cfg := httpServerConfig{}
+	applyConfig("", &cfg) //nolint (errcheck)
+	if port, err := cfg.listenPort(); err == nil {
+		cfg.HTTPListenPort = port
+	}
+	return cfg
+}
+
+// listenPort checks httpListenPort is a port number, defaulting it to 80 when it isn't set
+func (cfg httpServerConfig) listenPort() (string, error) {
+	port := strings.TrimSpace(cfg.HTTPListenPort)
+	if port == "" {
+		return strconv.Itoa(defaultHTTPListenPort), nil
+	}
+
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return "", fmt.Errorf("httpListenPort %q isn't a port number between 1 and 65535", cfg.HTTPListenPort)
+	}
+	return strconv.Itoa(number), nil
+}
+
+func (cfg httpServerConfig) useTLS() bool {
+	return cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+}
+
+// basePath will return the configured basePath as /path, or an empty string when we are served from the root
+func (cfg httpServerConfig) basePath() string {
+	basePath := strings.Trim(cfg.BasePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// listenAddress is httpListenAddr:httpListenPort, with no httpListenAddr we listen on every interface
+func (cfg httpServerConfig) listenAddress() string {
+	return net.JoinHostPort(cfg.HTTPListenAddr, cfg.HTTPListenPort)
+}
+
 // StartHTTPServer will start the core http server that can be used by integrations
 func StartHTTPServer() chan struct{} {
 	httpDone := make(chan struct{}, 1)
 	go func() {
-		cfg := struct {
-			HTTPListenPort string `mapstructure:"httpListenPort"`
-		}{}
-		applyConfig("", &cfg) //nolint (errcheck)
+		cfg := getHTTPServerConfig()
+		if _, err := cfg.listenPort(); err != nil {
+			logcritf("Not starting the http server, %s", err)
+			httpDone <- struct{}{}
+			return
+		}
 
-		loginfof("Starting http listen server on :%s", cfg.HTTPListenPort)
-		if err := http.ListenAndServe(":"+cfg.HTTPListenPort, nil); err != nil {
+		var err error
+		if cfg.useTLS() {
+			loginfof("Starting https listen server on %s", cfg.listenAddress())
+			err = http.ListenAndServeTLS(cfg.listenAddress(), cfg.TLSCertFile, cfg.TLSKeyFile, Handler())
+		} else {
+			loginfof("Starting http listen server on %s", cfg.listenAddress())
+			err = http.ListenAndServe(cfg.listenAddress(), Handler())
+		}
+		if err != nil {
 			fmt.Println(err.Error())
 		}
 		httpDone <- struct{}{}
@@ -309,35 +594,40 @@ func StartHTTPServer() chan struct{} {
 
 // GetHTTPServerURL will return the base url that the http server is listening on
 func GetHTTPServerURL() string {
-	cfg := struct {
-		HTTPListenPort string `mapstructure:"httpListenPort"`
-		Hostname       string `mapstructure:"hostname"`
-	}{}
-	applyConfig("", &cfg) // nolint (errcheck)
+	cfg := getHTTPServerConfig()
 
-	if cfg.HTTPListenPort == "80" {
-		return fmt.Sprintf("http://%s", cfg.Hostname)
-	} else if cfg.HTTPListenPort == "443" {
-		return fmt.Sprintf("https://%s", cfg.Hostname)
-	} else {
-		return fmt.Sprintf("http://%s:%s", cfg.Hostname, cfg.HTTPListenPort)
+	if cfg.ExternalURL != "" {
+		// this is what the outside world sees, so it already includes any basePath
+		// callers add their own paths, which start with a /
+		return strings.TrimSuffix(cfg.ExternalURL, "/")
+	}
+
+	// the port is left out when it's the schemes own
+	scheme, schemePort := "http", "80"
+	if cfg.useTLS() {
+		scheme, schemePort = "https", "443"
 	}
+
+	if cfg.HTTPListenPort == schemePort {
+		return fmt.Sprintf("%s://%s%s", scheme, cfg.Hostname, cfg.basePath())
+	}
+	return fmt.Sprintf("%s://%s:%s%s", scheme, cfg.Hostname, cfg.HTTPListenPort, cfg.basePath())
+}
+
+// BasePath will return the path the http server is serving everything under, either empty or /path.
+// Urls that are relative to the server, rather than from GetHTTPServerURL, need to start with this
+func BasePath() string {
+	return getHTTPServerConfig().basePath()
 }
 
 func loginfof(str string, args ...interface{}) (ret string) {
-	ret = fmt.Sprintf("info: "+str+"\n", args...)
-	fmt.Print(ret)
-	return ret
+	return logf("info", "", str, args...).String()
 }
 
 func logwarnf(str string, args ...interface{}) (ret string) {
-	ret = fmt.Sprintf("warn: "+str+"\n", args...)
-	fmt.Print(ret)
-	return ret
+	return logf("warn", "", str, args...).String()
 }
 
 func logcritf(str string, args ...interface{}) (ret string) {
-	ret = fmt.Sprintf("crit: "+str+"\n", args...)
-	fmt.Print(ret)
-	return ret
+	return logf("crit", "", str, args...).String()
 }
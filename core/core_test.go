@@ -0,0 +1,38 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheFileFallback(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "testcachefile")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	require.NoError(writeCacheFile(dir, []byte(`{"github:token":"first"}`)))
+	require.NoError(writeCacheFile(dir, []byte(`{"github:token":"second"}`)))
+
+	loaded, err := readCacheFile(dir)
+	require.NoError(err)
+	assert.Equal("second", loaded["github:token"])
+
+	// a cache file that got cut off mid write falls back to the backup from before the last write
+	path := filepath.Join(dir, "ngbuild.cache")
+	require.NoError(ioutil.WriteFile(path, []byte(`{"github:tok`), 0644))
+	loaded, err = readCacheFile(dir)
+	require.NoError(err)
+	assert.Equal("first", loaded["github:token"])
+
+	require.NoError(ioutil.WriteFile(path+".bak", []byte(`{"github:tok`), 0644))
+	_, err = readCacheFile(dir)
+	assert.Error(err)
+}
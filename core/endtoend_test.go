@@ -0,0 +1,134 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptProvider is about the smallest provider there can be, it writes script into the workspace as the build runner
+type scriptProvider struct {
+	script string
+}
+
+func (p *scriptProvider) Identifier() string      { return "script" }
+func (p *scriptProvider) IsProvider(string) bool  { return true }
+func (p *scriptProvider) AttachToApp(App) error   { return nil }
+func (p *scriptProvider) DetachFromApp(App) error { return nil }
+func (p *scriptProvider) Ready() error            { return nil }
+func (p *scriptProvider) Shutdown()               {}
+
+func (p *scriptProvider) ProvideFor(ctx context.Context, config *BuildConfig, directory string) error {
+	return ioutil.WriteFile(filepath.Join(directory, config.BuildRunner), []byte(p.script), 0755)
+}
+
+// TestEndToEnd runs a real build through an app, from NewBuild to the complete event
+func TestEndToEnd(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-endtoend")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("endtoend", &scriptProvider{script: "#!/bin/sh\necho built $1\n"}).(*app)
+	a.staticConfig = config{
+		"buildLocation":     filepath.Join(dir, "builds"),
+		"artifactsLocation": filepath.Join(dir, "artifacts"),
+		"buildRunnerArgs":   []string{"{{endtoend:Thing}}"},
+	}
+	defer a.Shutdown()
+
+	completed := make(chan map[string]string, 1)
+	a.Listen(SignalBuildComplete, func(values map[string]string) {
+		completed <- values
+	})
+
+	config := NewBuildConfig()
+	config.Title = "end to end"
+	config.Deadline = time.Second * 10
+	config.SetMetadata("endtoend:Thing", "everything")
+
+	token, err := a.NewBuild("group", config)
+	require.NoError(err)
+	build, err := a.GetBuild(token)
+	require.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	code, err := build.Wait(ctx)
+	require.NoError(err)
+	assert.Equal(0, code)
+	assert.Empty(build.FailureReason())
+	assert.Equal("script", build.Provider())
+
+	stdout, err := build.Stdout()
+	require.NoError(err)
+	output, err := ioutil.ReadAll(stdout)
+	require.NoError(err)
+	assert.Equal("built everything\n", string(output))
+
+	select {
+	case values := <-completed:
+		assert.Equal("endtoend", values["app"])
+		assert.Equal(token, values["token"])
+		assert.Empty(values["reason"])
+	case <-time.After(time.Second * 10):
+		t.Fatal("build never completed")
+	}
+
+	assert.Equal([]Build{build}, a.GetBuildHistory("group"))
+	assert.Empty(a.ActiveBuilds())
+}
+
+func TestEndToEndHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-heartbeat")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("heartbeat", &scriptProvider{script: "#!/bin/sh\necho started\nsleep 2\n"}).(*app)
+	a.staticConfig = config{
+		"buildLocation":     filepath.Join(dir, "builds"),
+		"artifactsLocation": filepath.Join(dir, "artifacts"),
+		"heartbeatSeconds":  1,
+	}
+	defer a.Shutdown()
+
+	heartbeats := make(chan map[string]string, 10)
+	a.Listen(SignalBuildHeartbeat, func(values map[string]string) {
+		heartbeats <- values
+	})
+
+	config := NewBuildConfig()
+	config.Group = "group"
+	config.Deadline = time.Second * 10
+	token, err := a.NewBuild("group", config)
+	require.NoError(err)
+	build, err := a.GetBuild(token)
+	require.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err = build.Wait(ctx)
+	require.NoError(err)
+
+	select {
+	case values := <-heartbeats:
+		assert.Equal(token, values["token"])
+		elapsed, _ := strconv.Atoi(values["elapsed"])
+		assert.True(elapsed >= 900, "the first heartbeat is after a second, got %dms", elapsed)
+		assert.Equal("8", values["outputbytes"])
+	case <-time.After(time.Second * 5):
+		t.Fatal("no heartbeat was sent")
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"strconv"
+	"time"
+)
+
+// BuildEvent is a build event from the app bus, parsed from the named groups of its signal
+type BuildEvent struct {
+	App   string
+	Token string
+}
+
+// BuildCompleteEvent is sent when a build has finished
+type BuildCompleteEvent struct {
+	BuildEvent
+	ProvisionTime time.Duration
+	// FailureReason is one of the FailureReason constants, empty if the build passed or failed by itself
+	FailureReason string
+	// SkippedArtifacts is how many of the builds artifacts weren't stored as they were over the apps limits
+	SkippedArtifacts int
+	// CommandLine is the builds CommandLine, it comes from the build rather than the signal as it's full of /
+	CommandLine string
+}
+
+// BuildHeartbeatEvent is sent every so often while a build runs, if the app has heartbeatSeconds set
+type BuildHeartbeatEvent struct {
+	BuildEvent
+	Elapsed     time.Duration
+	OutputBytes uint64
+}
+
+func buildEventOf(values map[string]string) BuildEvent {
+	return BuildEvent{App: values["app"], Token: values["token"]}
+}
+
+// milliseconds parses the ms counts build events carry, anything that isn't one is 0
+func milliseconds(value string) time.Duration {
+	ms, _ := strconv.ParseInt(value, 10, 64)
+	return time.Duration(ms) * time.Millisecond
+}
+
+// OnBuildProvisioning calls listener whenever one of the apps builds starts being provisioned
+func OnBuildProvisioning(app App, listener func(BuildEvent)) EventHandler {
+	return app.Listen(SignalBuildProvisioning, func(values map[string]string) {
+		listener(buildEventOf(values))
+	})
+}
+
+// OnBuildStarted calls listener whenever one of the apps builds starts running
+func OnBuildStarted(app App, listener func(BuildEvent)) EventHandler {
+	return app.Listen(SignalBuildStarted, func(values map[string]string) {
+		listener(buildEventOf(values))
+	})
+}
+
+// OnBuildComplete calls listener whenever one of the apps builds finishes, whether it ran or not
+func OnBuildComplete(app App, listener func(BuildCompleteEvent)) EventHandler {
+	return app.Listen(SignalBuildComplete, func(values map[string]string) {
+		event := BuildCompleteEvent{
+			BuildEvent:    buildEventOf(values),
+			ProvisionTime: milliseconds(values["provisiontime"]),
+			FailureReason: values["reason"],
+		}
+		event.SkippedArtifacts, _ = strconv.Atoi(values["skippedartifacts"])
+		if build, err := app.GetBuild(event.Token); err == nil {
+			event.CommandLine = build.CommandLine()
+		}
+		listener(event)
+	})
+}
+
+// OnBuildHeartbeat calls listener with each heartbeat of the apps running builds
+func OnBuildHeartbeat(app App, listener func(BuildHeartbeatEvent)) EventHandler {
+	return app.Listen(SignalBuildHeartbeat, func(values map[string]string) {
+		outputBytes, _ := strconv.ParseUint(values["outputbytes"], 10, 64)
+		listener(BuildHeartbeatEvent{
+			BuildEvent:  buildEventOf(values),
+			Elapsed:     milliseconds(values["elapsed"]),
+			OutputBytes: outputBytes,
+		})
+	})
+}
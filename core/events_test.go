@@ -0,0 +1,44 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedBuildEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("events")
+	defer a.Shutdown()
+
+	provisioning := make(chan BuildEvent, 1)
+	started := make(chan BuildEvent, 1)
+	completed := make(chan BuildCompleteEvent, 2)
+	heartbeats := make(chan BuildHeartbeatEvent, 1)
+	OnBuildProvisioning(a, func(event BuildEvent) { provisioning <- event })
+	OnBuildStarted(a, func(event BuildEvent) { started <- event })
+	OnBuildComplete(a, func(event BuildCompleteEvent) { completed <- event })
+	OnBuildHeartbeat(a, func(event BuildHeartbeatEvent) { heartbeats <- event })
+
+	a.SendEvent("/build/app:events/provisioning/token:first")
+	a.SendEvent("/build/app:events/started/token:first")
+	a.SendEvent("/build/app:events/heartbeat/token:first/elapsed:1500/outputbytes:42")
+	a.SendEvent("/build/app:events/complete/token:first/provisiontime:250/reason:deadline")
+	a.SendEvent("/build/app:events/complete/token:second")
+
+	assert.Equal(BuildEvent{App: "events", Token: "first"}, <-provisioning)
+	assert.Equal(BuildEvent{App: "events", Token: "first"}, <-started)
+	assert.Equal(BuildHeartbeatEvent{
+		BuildEvent:  BuildEvent{App: "events", Token: "first"},
+		Elapsed:     time.Millisecond * 1500,
+		OutputBytes: 42,
+	}, <-heartbeats)
+	assert.Equal(BuildCompleteEvent{
+		BuildEvent:    BuildEvent{App: "events", Token: "first"},
+		ProvisionTime: time.Millisecond * 250,
+		FailureReason: FailureReasonDeadline,
+	}, <-completed)
+	assert.Equal(BuildCompleteEvent{BuildEvent: BuildEvent{App: "events", Token: "second"}}, <-completed)
+}
@@ -1,9 +1,11 @@
 package core
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -15,13 +17,21 @@ var (
 	ctr  uint64
 )
 
-// generateToken will generate a token that is about as unique as you can hope for
+// reGeneratedToken matches what generateToken makes without a prefix
+var reGeneratedToken = regexp.MustCompile(`\A[A-Za-z0-9_-]{16}\z`)
+
+// generateToken will generate a token that is about as unique as you can hope for, the random jitter makes it
+// unguessable too so it can be used for things like OAuth states
 func generateToken(prefix ...string) string {
 	hasher := sha256.New()
 
+	jitter := make([]byte, 16)
+	rand.Read(jitter) //nolint (errcheck)
+
 	hasher.Write([]byte(salt))                                             //nolint (errcheck)
 	binary.Write(hasher, binary.LittleEndian, time.Now().UTC().UnixNano()) //nolint (errcheck)
 	binary.Write(hasher, binary.LittleEndian, atomic.AddUint64(&ctr, 1))   //nolint (errcheck)
+	hasher.Write(jitter)                                                   //nolint (errcheck)
 
 	return strings.Join(prefix, "-") + base64.URLEncoding.EncodeToString(hasher.Sum(nil))[:16]
 }
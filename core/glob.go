@@ -0,0 +1,30 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+)
+
+// globNamedRE finds the name:* parts of glob patterns, which capture what they match as name
+var globNamedRE = regexp.MustCompile(`(\w+):\*`)
+
+// GlobEvent turns a glob pattern like /build/app:*/complete/token:* into an event expression for Listen.
+// name:* matches anything up to the next / and captures it as name, * on its own matches the same without capturing
+// it, everything else is matched literally. Patterns match whole events, or events with more segments after them,
+// so the example also hears complete events that say how long provisioning took
+func GlobEvent(pattern string) string {
+	literal := func(part string) string {
+		return strings.Replace(regexp.QuoteMeta(part), `\*`, `[^/]*`, -1)
+	}
+
+	expr := ""
+	last := 0
+	for _, match := range globNamedRE.FindAllStringSubmatchIndex(pattern, -1) {
+		name := pattern[match[2]:match[3]]
+		expr += literal(pattern[last:match[0]]) + name + `:(?P<` + name + `>[^/]*)`
+		last = match[1]
+	}
+	expr += literal(pattern[last:])
+
+	return ExactEvent(expr + `(?:/.*)?`)
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		pattern string
+		event   string
+		result  map[string]string
+	}{
+		{"/build/app:*/complete/token:*", "/build/app:ngbuild/complete/token:abc123", map[string]string{"app": "ngbuild", "token": "abc123"}},
+		{"/build/app:*/complete/token:*", "/build/app:ngbuild/complete/token:abc123/provisiontime:5/reason:deadline", map[string]string{"app": "ngbuild", "token": "abc123"}},
+		{"/build/app:*/complete/token:*", "/build/app:ngbuild/started/token:abc123", nil},
+		{"/build/app:*/complete/token:*", "/prefix/build/app:ngbuild/complete/token:abc123", nil},
+		{"/build/app:*/complete/token:*", "/build/app:ngbuild/complete/token:abc123x", map[string]string{"app": "ngbuild", "token": "abc123x"}},
+		{"/build/*/*/token:*", "/build/app:ngbuild/started/token:abc123", map[string]string{"token": "abc123"}},
+		{"/build/app:ngbuild/*", "/build/app:ngbuild/started/token:abc123", map[string]string{}},
+		{"/build/app:ngbuild/*", "/build/app:ngbuilder/started/token:abc123", nil},
+		// anything that isn't a wildcard is matched literally
+		{"/log/app:*/logtype:(crit)", "/log/app:ngbuild/logtype:(crit)", map[string]string{"app": "ngbuild"}},
+		{"/log/app:*/logtype:(crit)", "/log/app:ngbuild/logtype:crit", nil},
+		{"app:foo", "app:foobar", nil},
+	}
+
+	for _, test := range tests {
+		pattern := regexp.MustCompile(GlobEvent(test.pattern))
+		match, err := RegexpNamedGroupsMatch(pattern, test.event)
+		if test.result == nil {
+			assert.Error(err, "%s shouldn't match %s", test.pattern, test.event)
+			continue
+		}
+		assert.NoError(err, "%s should match %s", test.pattern, test.event)
+		assert.Equal(test.result, match, test.pattern)
+	}
+}
+
+func TestListenGlob(t *testing.T) {
+	require := require.New(t)
+
+	a := NewTestApp("glob")
+	defer a.Shutdown()
+
+	heard := make(chan map[string]string, 1)
+	a.ListenGlob("/build/app:*/started/token:*", func(values map[string]string) { heard <- values })
+	a.SendEvent("/build/app:glob/complete/token:first")
+	a.SendEvent("/build/app:glob/started/token:second")
+
+	values := <-heard
+	require.Equal("glob", values["app"])
+	require.Equal("second", values["token"])
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// appsLoaded is set once GetApps has found our apps and attached their integrations
+var appsLoaded int32
+
+func init() {
+	HandleFunc("/healthz", handleHealthz)
+	HandleFunc("/readyz", handleReadyz)
+}
+
+// Ready will return nil once every app has been loaded and every integration says it is ready,
+// otherwise the error says what we are waiting on
+func Ready() error {
+	if atomic.LoadInt32(&appsLoaded) == 0 {
+		return errors.New("apps haven't been loaded yet")
+	}
+
+	problems := []string{}
+	for _, integration := range GetIntegrations() {
+		if err := integration.Ready(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", integration.Identifier(), err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// handleHealthz is the liveness probe, if we can answer at all we are alive
+func handleHealthz(resp http.ResponseWriter, req *http.Request) {
+	resp.Write([]byte("ok\n")) //nolint (errcheck)
+}
+
+// handleReadyz is the readiness probe, webhooks shouldn't be sent our way until this is 200
+func handleReadyz(resp http.ResponseWriter, req *http.Request) {
+	if err := Ready(); err != nil {
+		http.Error(resp, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	resp.Write([]byte("ok\n")) //nolint (errcheck)
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthz(t *testing.T) {
+	assert := assert.New(t)
+
+	resp := httptest.NewRecorder()
+	Mux().ServeHTTP(resp, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(http.StatusOK, resp.Code)
+}
+
+func TestReadyz(t *testing.T) {
+	assert := assert.New(t)
+
+	readyz := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		Mux().ServeHTTP(resp, httptest.NewRequest("GET", "/readyz", nil))
+		return resp
+	}
+
+	previousAppsLoaded := atomic.LoadInt32(&appsLoaded)
+	defer atomic.StoreInt32(&appsLoaded, previousAppsLoaded)
+
+	integration := &MockIntegration{}
+	integration.On("Identifier").Return("mock")
+	readyCall := integration.On("Ready").Return(errors.New("waiting on something"))
+	defer useIntegrations(minimalIntegration{}, integration)()
+
+	atomic.StoreInt32(&appsLoaded, 0)
+	resp := readyz()
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.Contains(resp.Body.String(), "apps haven't been loaded")
+
+	atomic.StoreInt32(&appsLoaded, 1)
+	resp = readyz()
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.Contains(resp.Body.String(), "mock: waiting on something")
+
+	readyCall.Return(nil)
+	assert.Equal(http.StatusOK, readyz().Code)
+}
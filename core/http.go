@@ -0,0 +1,50 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+var (
+	httpMuxLock  sync.Mutex
+	httpMux      = http.NewServeMux()
+	httpPatterns = make(map[string]bool)
+)
+
+// HandleFunc will register the given handler on the core http server, integrations should use this rather than
+// http.HandleFunc. Registering a pattern that is already registered is logged and ignored instead of panicking
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	httpMuxLock.Lock()
+	defer httpMuxLock.Unlock()
+
+	if httpPatterns[pattern] {
+		logwarnf("http handler for %s is already registered, ignoring", pattern)
+		return
+	}
+
+	httpPatterns[pattern] = true
+	httpMux.HandleFunc(pattern, handler)
+}
+
+// Mux will return the http.ServeMux that HandleFunc registers on
+func Mux() *http.ServeMux {
+	return httpMux
+}
+
+// Handler will return Mux() served under the configured basePath, this is what StartHTTPServer serves.
+// Handlers are registered without the basePath and see request paths with it stripped
+func Handler() http.Handler {
+	basePath := BasePath()
+	if basePath == "" {
+		return Mux()
+	}
+
+	return http.StripPrefix(basePath, Mux())
+}
+
+// NewTestHTTPServer will start a httptest.Server serving Handler(), so handlers can be tested through real http
+// requests without starting the core http server. Close it when you're done
+func NewTestHTTPServer() *httptest.Server {
+	return httptest.NewServer(Handler())
+}
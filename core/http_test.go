@@ -0,0 +1,141 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleFuncDuplicate(t *testing.T) {
+	assert := assert.New(t)
+
+	HandleFunc("/test/duplicate", func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("first")) //nolint (errcheck)
+	})
+	assert.NotPanics(func() {
+		HandleFunc("/test/duplicate", func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte("second")) //nolint (errcheck)
+		})
+	})
+
+	resp := httptest.NewRecorder()
+	Mux().ServeHTTP(resp, httptest.NewRequest("GET", "/test/duplicate", nil))
+	assert.Equal("first", resp.Body.String())
+}
+
+func TestTestHTTPServer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	HandleFunc("/test/server", func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("testmarker")) //nolint (errcheck)
+	})
+
+	server := NewTestHTTPServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/test/server")
+	require.NoError(err)
+	defer resp.Body.Close() //nolint (errcheck)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	assert.Equal("testmarker", string(body))
+}
+
+// useMasterConfig will write the given json as ngbuild.json in a temporary ngbuild directory
+func useMasterConfig(t *testing.T, masterConfig string) func() {
+	dir, err := ioutil.TempDir("", "ngbuild-config")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte(masterConfig), 0644))
+
+	restore := useNGBuildDirectory(dir)
+	return func() {
+		restore()
+		os.RemoveAll(dir) //nolint (errcheck)
+	}
+}
+
+func TestGetHTTPServerURL(t *testing.T) {
+	assert := assert.New(t)
+
+	for masterConfig, expected := range map[string]string{
+		`{"hostname": "ngbuild.io", "httpListenPort": "8080"}`:                                                     "http://ngbuild.io:8080",
+		`{"hostname": "ngbuild.io", "httpListenPort": "80"}`:                                                       "http://ngbuild.io",
+		`{"hostname": "ngbuild.io", "httpListenPort": "443"}`:                                                      "http://ngbuild.io:443",
+		`{"hostname": "ngbuild.io", "httpListenPort": "443", "tlsCertFile": "cert.pem", "tlsKeyFile": "key.pem"}`:  "https://ngbuild.io",
+		`{"hostname": "ngbuild.io"}`:                                                                               "http://ngbuild.io",
+		`{"hostname": "ngbuild.io", "httpListenPort": " 08080 "}`:                                                  "http://ngbuild.io:8080",
+		`{"hostname": "ngbuild.io", "httpListenPort": "8443", "tlsCertFile": "cert.pem", "tlsKeyFile": "key.pem"}`: "https://ngbuild.io:8443",
+		`{"hostname": "ngbuild.io", "httpListenPort": "8443", "tlsCertFile": "cert.pem"}`:                          "http://ngbuild.io:8443",
+		`{"hostname": "ngbuild.io", "httpListenPort": "8080", "externalURL": "https://ci.ngbuild.io"}`:             "https://ci.ngbuild.io",
+		`{"hostname": "ngbuild.io", "httpListenPort": "8080", "externalURL": "https://ngbuild.io/ci/"}`:            "https://ngbuild.io/ci",
+	} {
+		restore := useMasterConfig(t, masterConfig)
+		assert.Equal(expected, GetHTTPServerURL(), masterConfig)
+		restore()
+	}
+}
+
+func TestHTTPListenAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(":8080", httpServerConfig{HTTPListenPort: "8080"}.listenAddress())
+	assert.Equal("127.0.0.1:8080", httpServerConfig{HTTPListenAddr: "127.0.0.1", HTTPListenPort: "8080"}.listenAddress())
+	assert.Equal("[::1]:8080", httpServerConfig{HTTPListenAddr: "::1", HTTPListenPort: "8080"}.listenAddress())
+}
+
+func TestHTTPListenPort(t *testing.T) {
+	assert := assert.New(t)
+
+	for port, expected := range map[string]string{"": "80", "8080": "8080", " 443": "443", "65535": "65535"} {
+		normalised, err := httpServerConfig{HTTPListenPort: port}.listenPort()
+		assert.NoError(err, port)
+		assert.Equal(expected, normalised, port)
+	}
+
+	for _, port := range []string{"http", "0", "-80", "65536", ":8080"} {
+		_, err := httpServerConfig{HTTPListenPort: port}.listenPort()
+		assert.Error(err, port)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", httpServerConfig{}.basePath())
+	assert.Equal("", httpServerConfig{BasePath: "/"}.basePath())
+	assert.Equal("/ci", httpServerConfig{BasePath: "ci"}.basePath())
+	assert.Equal("/ci", httpServerConfig{BasePath: "/ci/"}.basePath())
+	assert.Equal("/ngbuild/ci", httpServerConfig{BasePath: "/ngbuild/ci"}.basePath())
+
+	defer useMasterConfig(t, `{"hostname": "ngbuild.io", "httpListenPort": "8080", "basePath": "/ci/"}`)()
+	assert.Equal("/ci", BasePath())
+	assert.Equal("http://ngbuild.io:8080/ci", GetHTTPServerURL())
+}
+
+func TestHandlerBasePath(t *testing.T) {
+	assert := assert.New(t)
+
+	HandleFunc("/test/basepath", func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(req.URL.Path)) //nolint (errcheck)
+	})
+
+	defer useMasterConfig(t, `{"basePath": "/ci"}`)()
+	handler := Handler()
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/ci/test/basepath", nil))
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("/test/basepath", resp.Body.String(), "handlers shouldn't see the base path")
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", "/test/basepath", nil))
+	assert.Equal(http.StatusNotFound, resp.Code)
+}
@@ -1,16 +1,45 @@
 package core
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"sync"
+)
 
-var globalIntegrationsCacheOnce sync.Once
+// BaseIntegration can be embedded in an integration to get default implementations of the parts of the
+// Integration interface that not every integration cares about, an integration that isn't a provider only
+// has to implement Identifier and AttachToApp
+type BaseIntegration struct{}
+
+// IsProvider returns false, integrations that can provision builds should override this
+func (BaseIntegration) IsProvider(string) bool { return false }
+
+// ProvideFor will always error
+func (BaseIntegration) ProvideFor(context.Context, *BuildConfig, string) error {
+	return errors.New("Integration can not provide")
+}
+
+// DetachFromApp does nothing
+func (BaseIntegration) DetachFromApp(App) error { return nil }
+
+// Ready always returns nil
+func (BaseIntegration) Ready() error { return nil }
+
+// Shutdown does nothing
+func (BaseIntegration) Shutdown() {}
+
+var globalIntegrationsCacheLock sync.RWMutex
 var globalIntegrationsCache []Integration
 
-// SetIntegrations will set the integrations
+// SetIntegrations will set the integrations, calling it again will replace the previous set
 func SetIntegrations(integrations []Integration) {
-	globalIntegrationsCacheOnce.Do(func() {
-		globalIntegrationsCache = integrations
-	})
+	globalIntegrationsCacheLock.Lock()
+	defer globalIntegrationsCacheLock.Unlock()
 
+	if globalIntegrationsCache != nil {
+		loginfof("Replacing %d integrations with %d integrations", len(globalIntegrationsCache), len(integrations))
+	}
+	globalIntegrationsCache = integrations
 }
 
 func getIndexOf(slice []Integration, search string) int {
@@ -23,18 +52,28 @@ func getIndexOf(slice []Integration, search string) int {
 	return -1
 }
 
+func getIndexOfString(slice []string, search string) int {
+	for i, val := range slice {
+		if val == search {
+			return i
+		}
+	}
+
+	return -1
+}
+
 // GetIntegrations will return a list of cached Integration variables
-// anything passed in to disabledIntegrations will be removed from the cache
+// anything passed in to disabledIntegrations will be left out, the cache itself is never modified
 func GetIntegrations(disabledIntegrations ...string) []Integration {
+	globalIntegrationsCacheLock.RLock()
+	defer globalIntegrationsCacheLock.RUnlock()
 
-	integrations := globalIntegrationsCache[:]
-	for _, disabledIntegration := range disabledIntegrations {
-		indexOfDisabledIntegration := getIndexOf(integrations, disabledIntegration)
-		if indexOfDisabledIntegration < 0 {
+	integrations := []Integration{}
+	for _, integration := range globalIntegrationsCache {
+		if getIndexOfString(disabledIntegrations, integration.Identifier()) >= 0 {
 			continue
 		}
-
-		integrations = append(integrations[:indexOfDisabledIntegration], integrations[indexOfDisabledIntegration+1:]...)
+		integrations = append(integrations, integration)
 	}
 
 	return integrations
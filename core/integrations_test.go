@@ -0,0 +1,39 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type minimalIntegration struct {
+	BaseIntegration
+}
+
+func (minimalIntegration) Identifier() string    { return "minimal" }
+func (minimalIntegration) AttachToApp(App) error { return nil }
+
+func TestBaseIntegration(t *testing.T) {
+	assert := assert.New(t)
+
+	var integration Integration = minimalIntegration{}
+	assert.False(integration.IsProvider("git@github.com:watchly/ngbuild.git"))
+	assert.Error(integration.ProvideFor(context.Background(), NewBuildConfig(), ""))
+	assert.NoError(integration.DetachFromApp(nil))
+	assert.NoError(integration.Ready())
+	assert.NotPanics(integration.Shutdown)
+}
+
+func TestSetIntegrationsReplaces(t *testing.T) {
+	assert := assert.New(t)
+
+	defer useIntegrations(minimalIntegration{})()
+	assert.Len(GetIntegrations(), 1)
+
+	SetIntegrations([]Integration{minimalIntegration{}, minimalIntegration{}})
+	assert.Len(GetIntegrations(), 2)
+
+	SetIntegrations(nil)
+	assert.Empty(GetIntegrations())
+}
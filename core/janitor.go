@@ -0,0 +1,209 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// janitorInterval is how often the janitor looks for old build results
+var janitorInterval = time.Hour
+
+// JanitorStats is what the janitor did the last time it ran, and when it'll run next
+type JanitorStats struct {
+	LastRun  time.Time     `json:"lastRun"`
+	NextRun  time.Time     `json:"nextRun"`
+	Duration time.Duration `json:"duration"`
+	Removed  int           `json:"removed"`
+	Errors   int           `json:"errors"`
+}
+
+var (
+	janitorLock  sync.RWMutex
+	janitorStats JanitorStats
+	janitorOnce  sync.Once
+)
+
+// StartJanitor starts removing artifacts, integration caches and build history that are older than each apps
+// retentionDays, apps without retentionDays keep everything forever
+func StartJanitor() {
+	janitorOnce.Do(func() {
+		go func() {
+			for {
+				runJanitor(GetApps(), CacheDirectory())
+
+				janitorLock.Lock()
+				janitorStats.NextRun = time.Now().Add(janitorInterval)
+				janitorLock.Unlock()
+
+				time.Sleep(janitorInterval)
+			}
+		}()
+	})
+}
+
+// GetJanitorStats returns what the janitor did the last time it ran, it's empty if it hasn't ran yet
+func GetJanitorStats() JanitorStats {
+	janitorLock.RLock()
+	defer janitorLock.RUnlock()
+	return janitorStats
+}
+
+func runJanitor(apps []App, cacheDirectory string) JanitorStats {
+	start := time.Now()
+	stats := JanitorStats{LastRun: start.UTC()}
+	for _, existing := range apps {
+		a, ok := existing.(*app)
+		if ok == false {
+			continue
+		}
+
+		removed, errors := a.removeOldResults(start, cacheDirectory)
+		stats.Removed += removed
+		stats.Errors += errors
+	}
+	stats.Duration = time.Since(start)
+
+	janitorLock.Lock()
+	stats.NextRun = janitorStats.NextRun
+	janitorStats = stats
+	janitorLock.Unlock()
+
+	return stats
+}
+
+// removeOldResults removes everything the app has kept about builds that were made before now - retentionDays.
+// Integrations keep their per build caches in cacheDirectory/<integration>/<app>/<token>, so those are cleaned up
+// along with the artifacts. Builds that are still running or referenced are left alone, as is anything that isn't
+// named after a build
+func (a *app) removeOldResults(now time.Time, cacheDirectory string) (removed, errors int) {
+	var appConfig struct {
+		RetentionDays     int    `mapstructure:"retentionDays"`
+		ArtifactsLocation string `mapstructure:"artifactsLocation"`
+	}
+	if err := a.GlobalConfig(&appConfig); err != nil || appConfig.RetentionDays < 1 {
+		return 0, 0
+	}
+	cutoff := now.Add(-time.Duration(appConfig.RetentionDays) * 24 * time.Hour)
+
+	inUse := a.buildsInUse()
+	isToken := a.isBuildToken()
+
+	directories := []string{artifactsDirectory(appConfig.ArtifactsLocation, a.Name())}
+	if caches, err := filepath.Glob(filepath.Join(cacheDirectory, "*", a.Name())); err == nil {
+		directories = append(directories, caches...)
+	}
+
+	for _, directory := range directories {
+		paths, err := removeOldEntries(directory, cutoff, inUse, isToken)
+		for _, path := range paths {
+			a.Loginfof("janitor removed %s", path)
+		}
+		removed += len(paths)
+		if err != nil && os.IsNotExist(err) == false {
+			a.Logwarnf("janitor couldn't clean up %s: %s", directory, err)
+			errors++
+		}
+	}
+
+	for _, token := range a.forgetOldBuilds(cutoff) {
+		a.Loginfof("janitor forgot build %s", token)
+		removed++
+	}
+
+	return removed, errors
+}
+
+// buildsInUse returns the tokens of builds that haven't stopped or still have references
+func (a *app) buildsInUse() map[string]bool {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	inUse := make(map[string]bool)
+	for _, builds := range a.builds {
+		for _, existing := range builds {
+			if b, ok := existing.(*build); ok == false || b.inUse() {
+				inUse[existing.Token()] = true
+			}
+		}
+	}
+
+	return inUse
+}
+
+// isBuildToken returns a func that's true for the names of the apps builds, and for names that look like tokens
+// so builds from before ngbuild was restarted are still cleaned up
+func (a *app) isBuildToken() func(name string) bool {
+	known := make(map[string]bool)
+	for _, existing := range a.AllBuilds() {
+		known[existing.Token()] = true
+	}
+
+	return func(name string) bool {
+		return known[name] || reGeneratedToken.MatchString(name)
+	}
+}
+
+// forgetOldBuilds removes builds from the apps history that stopped before cutoff and have no references
+func (a *app) forgetOldBuilds(cutoff time.Time) (tokens []string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for group, builds := range a.builds {
+		for _, existing := range builds {
+			if b, ok := existing.(*build); ok && b.isOld(cutoff) {
+				a.removeBuild(group, existing)
+				tokens = append(tokens, existing.Token())
+			}
+		}
+	}
+
+	return tokens
+}
+
+// inUse is true while the build is running or something still holds a reference to it
+func (b *build) inUse() bool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.state.HasStopped() == false || b.ref.Get() > 0
+}
+
+// isOld is true when the build isn't in use and stopped before cutoff
+func (b *build) isOld(cutoff time.Time) bool {
+	if b.inUse() {
+		return false
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+	stopped := b.buildEndTime
+	if stopped.IsZero() {
+		stopped = b.created
+	}
+	return stopped.Before(cutoff)
+}
+
+// removeOldEntries removes the entries in directory that isToken is true for and haven't been modified since
+// cutoff, except for anything named in keep
+func removeOldEntries(directory string, cutoff time.Time, keep map[string]bool, isToken func(string) bool) (removed []string, err error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if keep[entry.Name()] || isToken(entry.Name()) == false || entry.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(directory, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
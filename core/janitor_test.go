@@ -0,0 +1,100 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveOldResults(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-janitor")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("janitor").(*app)
+	a.staticConfig = config{
+		"retentionDays":     1,
+		"artifactsLocation": filepath.Join(dir, "artifacts"),
+	}
+	cacheDirectory := filepath.Join(dir, "cache")
+
+	old := time.Now().Add(-time.Hour * 25)
+	newFinishedBuild := func(token string, ended time.Time) *build {
+		b := newBuild(a, token, NewBuildConfig())
+		b.state.SetBuildState(buildStateFinished)
+		b.buildEndTime = ended
+		for _, d := range []string{
+			filepath.Join(dir, "artifacts", "ngbuildartifacts", "janitor", token),
+			filepath.Join(cacheDirectory, "web", "janitor", token),
+		} {
+			require.NoError(os.MkdirAll(d, 0755))
+			require.NoError(os.Chtimes(d, ended, ended))
+		}
+		return b
+	}
+
+	expired := newFinishedBuild("expired", old)
+	fresh := newFinishedBuild("fresh", time.Now())
+	referenced := newFinishedBuild("referenced", old)
+	referenced.Ref()
+	running := newFinishedBuild("running", old)
+	running.state.SetBuildState(buildStateStarted)
+	a.builds["group"] = []Build{expired, fresh, referenced, running}
+
+	// left behind by a previous run of ngbuild, nothing knows about it any more
+	forgotten := filepath.Join(dir, "artifacts", "ngbuildartifacts", "janitor", generateToken())
+	require.NoError(os.MkdirAll(forgotten, 0755))
+	require.NoError(os.Chtimes(forgotten, old, old))
+
+	// not ngbuilds, so it's left alone however old it is
+	unrelated := filepath.Join(dir, "artifacts", "ngbuildartifacts", "janitor", "notes.txt")
+	require.NoError(ioutil.WriteFile(unrelated, []byte("mine"), 0644))
+	require.NoError(os.Chtimes(unrelated, old, old))
+
+	stats := runJanitor([]App{a}, cacheDirectory)
+	assert.Equal(4, stats.Removed)
+	assert.Equal(0, stats.Errors)
+	assert.False(stats.LastRun.IsZero())
+	assert.Equal(stats.LastRun, GetJanitorStats().LastRun)
+
+	assert.Equal([]Build{fresh, referenced, running}, a.GetBuildHistory("group"))
+	_, err = os.Stat(unrelated)
+	assert.NoError(err)
+	for _, token := range []string{"fresh", "referenced", "running"} {
+		_, err := os.Stat(filepath.Join(dir, "artifacts", "ngbuildartifacts", "janitor", token))
+		assert.NoError(err)
+		_, err = os.Stat(filepath.Join(cacheDirectory, "web", "janitor", token))
+		assert.NoError(err)
+	}
+	for _, path := range []string{
+		forgotten,
+		filepath.Join(dir, "artifacts", "ngbuildartifacts", "janitor", "expired"),
+		filepath.Join(cacheDirectory, "web", "janitor", "expired"),
+	} {
+		_, err := os.Stat(path)
+		assert.True(os.IsNotExist(err), path)
+	}
+}
+
+func TestRemoveOldResultsKeepsForever(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewTestApp("janitor").(*app)
+	b := newBuild(a, "expired", NewBuildConfig())
+	b.state.SetBuildState(buildStateFinished)
+	b.buildEndTime = time.Now().Add(-time.Hour * 24 * 365)
+	a.builds["group"] = []Build{b}
+
+	removed, errors := a.removeOldResults(time.Now(), os.TempDir())
+	assert.Equal(0, removed)
+	assert.Equal(0, errors)
+	assert.Len(a.GetBuildHistory("group"), 1)
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Log formats, see SetLogFormat
+const (
+	// LogFormatText is "info: message", for people
+	LogFormatText = "text"
+	// LogFormatJSON is a LogEntry as json per line, for log collectors
+	LogFormatJSON = "json"
+)
+
+var logJSON int32
+
+// LogEntry is one line of the log, it's what the json log format writes and what /log/ events carry
+type LogEntry struct {
+	Level string    `json:"level"`
+	Time  time.Time `json:"timestamp"`
+	// App is empty for ngbuilds own logs
+	App     string `json:"app,omitempty"`
+	Message string `json:"message"`
+}
+
+// String formats the entry in the current log format, ending with a newline
+func (e LogEntry) String() string {
+	if atomic.LoadInt32(&logJSON) == 1 {
+		raw, err := json.Marshal(e)
+		if err == nil {
+			return string(raw) + "\n"
+		}
+	}
+
+	if e.App != "" {
+		return fmt.Sprintf("%s: (%s):%s\n", e.Level, e.App, e.Message)
+	}
+	return fmt.Sprintf("%s: %s\n", e.Level, e.Message)
+}
+
+// event is the /log/ event for the entry, see EventCoreLog
+func (e LogEntry) event() string {
+	return fmt.Sprintf("/log/app:%s/logtype:%s/time:%d/%s", e.App, e.Level, e.Time.UnixNano(), e.Message)
+}
+
+// LogEntryFromEvent returns the LogEntry in the data of an EventCoreLog event, events without a time are given now
+func LogEntryFromEvent(data map[string]string) LogEntry {
+	entry := LogEntry{Level: data["logtype"], Time: time.Now(), App: data["app"], Message: data["logmessage"]}
+	if nanoseconds, err := strconv.ParseInt(data["logtime"], 10, 64); err == nil {
+		entry.Time = time.Unix(0, nanoseconds)
+	}
+	return entry
+}
+
+// SetLogFormat changes how everything is logged from now on, format is LogFormatText or LogFormatJSON
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+		atomic.StoreInt32(&logJSON, 0)
+	case LogFormatJSON:
+		atomic.StoreInt32(&logJSON, 1)
+	default:
+		return fmt.Errorf("log format %q isn't %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// ConfigureLogging sets the log format from logFormat in the master config, it's text if that isn't set
+func ConfigureLogging() {
+	cfg := struct {
+		LogFormat string `mapstructure:"logFormat"`
+	}{LogFormat: LogFormatText}
+	applyConfig("", &cfg) //nolint (errcheck)
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = LogFormatText
+	}
+
+	if err := SetLogFormat(cfg.LogFormat); err != nil {
+		SetLogFormat(LogFormatText) //nolint (errcheck)
+		logwarnf("%s, logging as %s", err, LogFormatText)
+	}
+}
+
+// logf prints the entry for level and app and returns it
+func logf(level, app, str string, args ...interface{}) LogEntry {
+	entry := LogEntry{Level: level, Time: time.Now(), App: app, Message: fmt.Sprintf(str, args...)}
+	fmt.Print(entry.String())
+	return entry
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFormats(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	defer SetLogFormat(LogFormatText) //nolint (errcheck)
+
+	logged := time.Date(2016, 10, 16, 12, 30, 0, 0, time.UTC)
+	entry := LogEntry{Level: "warn", Time: logged, App: "testapp", Message: "something's up"}
+
+	require.NoError(SetLogFormat(LogFormatText))
+	assert.Equal("warn: (testapp):something's up\n", entry.String())
+	assert.Equal("info: started\n", LogEntry{Level: "info", Time: logged, Message: "started"}.String())
+
+	require.NoError(SetLogFormat(LogFormatJSON))
+	line := entry.String()
+	assert.Equal(`{"level":"warn","timestamp":"2016-10-16T12:30:00Z","app":"testapp","message":"something's up"}`+"\n", line)
+	var decoded LogEntry
+	require.NoError(json.Unmarshal([]byte(line), &decoded))
+	assert.Equal(entry, decoded)
+	assert.NotContains(LogEntry{Level: "info", Time: logged, Message: "started"}.String(), `"app"`)
+
+	assert.Error(SetLogFormat("xml"))
+	assert.Equal(line, entry.String(), "a bad format leaves the format alone")
+}
+
+func TestLogEvent(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	entry := LogEntry{Level: "crit", Time: time.Unix(0, 1476621000123456789), App: "testapp", Message: "it broke: /a/b"}
+	data, err := RegexpNamedGroupsMatch(regexp.MustCompile(EventCoreLog), entry.event())
+	require.NoError(err)
+	assert.Equal("testapp", data["app"])
+	assert.Equal("crit", data["logtype"])
+	assert.Equal(entry, LogEntryFromEvent(data))
+
+	// events from before they had a time
+	data, err = RegexpNamedGroupsMatch(regexp.MustCompile(EventCoreLog), "/log/app:testapp/logtype:info/hello")
+	require.NoError(err)
+	old := LogEntryFromEvent(data)
+	assert.Equal("hello", old.Message)
+	assert.WithinDuration(time.Now(), old.Time, time.Minute)
+}
+
+func TestConfigureLogging(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	defer SetLogFormat(LogFormatText) //nolint (errcheck)
+
+	dir, err := ioutil.TempDir("", "ngbuild-logging")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	defer useNGBuildDirectory(dir)()
+
+	entry := LogEntry{Level: "info", Time: time.Now(), Message: "hello"}
+	format := func(logFormat string) string {
+		configCache = make(map[string]config)
+		raw, _ := json.Marshal(map[string]string{"logFormat": logFormat})
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), raw, 0664))
+		ConfigureLogging()
+		return entry.String()
+	}
+
+	assert.Equal("info: hello\n", format("text"))
+	assert.Contains(format("json"), `"message":"hello"`)
+	assert.Equal("info: hello\n", format("xml"), "bad formats fall back to text")
+	assert.Equal("info: hello\n", format(""), "empty is text")
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMetricsBuildTimes is how many of the latest build times are kept to work out the median build time
+const maxMetricsBuildTimes = 1000
+
+// Metrics is a snapshot of an apps builds since ngbuild started, see App.Metrics
+type Metrics struct {
+	Started   int `json:"started"`
+	Completed int `json:"completed"`
+	// Failed builds are the completed ones that didn't exit 0, for whatever reason
+	Failed int `json:"failed"`
+	// Running builds have started and not completed, including those still being provisioned
+	Running int `json:"running"`
+
+	// AverageBuildTime is over every build that ran, MedianBuildTime only the last maxMetricsBuildTimes of them
+	AverageBuildTime time.Duration `json:"averageBuildTime"`
+	MedianBuildTime  time.Duration `json:"medianBuildTime"`
+
+	Groups map[string]GroupMetrics `json:"groups"`
+}
+
+// GroupMetrics are the build counts for one group of an app
+type GroupMetrics struct {
+	Started   int `json:"started"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// appMetrics is updated by an apps builds as they start and complete, a nil appMetrics records nothing
+type appMetrics struct {
+	m sync.Mutex
+
+	started   int
+	completed int
+	failed    int
+	groups    map[string]GroupMetrics
+
+	totalBuildTime time.Duration
+	timedBuilds    int
+	buildTimes     []time.Duration
+	nextBuildTime  int
+}
+
+func newAppMetrics() *appMetrics {
+	return &appMetrics{groups: make(map[string]GroupMetrics)}
+}
+
+func (am *appMetrics) buildStarted(group string) {
+	if am == nil {
+		return
+	}
+
+	am.m.Lock()
+	defer am.m.Unlock()
+	am.started++
+	groupMetrics := am.groups[group]
+	groupMetrics.Started++
+	am.groups[group] = groupMetrics
+}
+
+// buildCompleted records a build completing, buildTime is 0 for builds that never ran
+func (am *appMetrics) buildCompleted(group string, failed bool, buildTime time.Duration) {
+	if am == nil {
+		return
+	}
+
+	am.m.Lock()
+	defer am.m.Unlock()
+	am.completed++
+	groupMetrics := am.groups[group]
+	groupMetrics.Completed++
+	if failed {
+		am.failed++
+		groupMetrics.Failed++
+	}
+	am.groups[group] = groupMetrics
+
+	if buildTime <= 0 {
+		return
+	}
+	am.totalBuildTime += buildTime
+	am.timedBuilds++
+	if len(am.buildTimes) < maxMetricsBuildTimes {
+		am.buildTimes = append(am.buildTimes, buildTime)
+		return
+	}
+	am.buildTimes[am.nextBuildTime] = buildTime
+	am.nextBuildTime = (am.nextBuildTime + 1) % maxMetricsBuildTimes
+}
+
+func (am *appMetrics) snapshot() Metrics {
+	metrics := Metrics{Groups: make(map[string]GroupMetrics)}
+	if am == nil {
+		return metrics
+	}
+
+	am.m.Lock()
+	defer am.m.Unlock()
+	metrics.Started = am.started
+	metrics.Completed = am.completed
+	metrics.Failed = am.failed
+	metrics.Running = am.started - am.completed
+	for group, groupMetrics := range am.groups {
+		metrics.Groups[group] = groupMetrics
+	}
+
+	if am.timedBuilds > 0 {
+		metrics.AverageBuildTime = am.totalBuildTime / time.Duration(am.timedBuilds)
+
+		sorted := append([]time.Duration{}, am.buildTimes...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		middle := len(sorted) / 2
+		metrics.MedianBuildTime = sorted[middle]
+		if len(sorted)%2 == 0 {
+			metrics.MedianBuildTime = (sorted[middle-1] + sorted[middle]) / 2
+		}
+	}
+	return metrics
+}
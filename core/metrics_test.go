@@ -0,0 +1,98 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	var nilMetrics *appMetrics
+	nilMetrics.buildStarted("group")
+	assert.Equal(Metrics{Groups: map[string]GroupMetrics{}}, nilMetrics.snapshot())
+
+	am := newAppMetrics()
+	for i := 0; i < 4; i++ {
+		am.buildStarted("master")
+	}
+	am.buildStarted("pull")
+	am.buildCompleted("master", false, time.Second)
+	am.buildCompleted("master", true, 2*time.Second)
+	am.buildCompleted("master", false, 6*time.Second)
+	// builds that never ran don't count towards build times
+	am.buildCompleted("pull", true, 0)
+
+	metrics := am.snapshot()
+	assert.Equal(5, metrics.Started)
+	assert.Equal(4, metrics.Completed)
+	assert.Equal(2, metrics.Failed)
+	assert.Equal(1, metrics.Running)
+	assert.Equal(3*time.Second, metrics.AverageBuildTime)
+	assert.Equal(2*time.Second, metrics.MedianBuildTime)
+	assert.Equal(map[string]GroupMetrics{
+		"master": {Started: 4, Completed: 3, Failed: 1},
+		"pull":   {Started: 1, Completed: 1, Failed: 1},
+	}, metrics.Groups)
+
+	am.buildCompleted("master", false, 3*time.Second)
+	assert.Equal(2500*time.Millisecond, am.snapshot().MedianBuildTime)
+
+	// the median is only of the latest builds
+	for i := 0; i < maxMetricsBuildTimes; i++ {
+		am.buildCompleted("other", false, time.Minute)
+	}
+	assert.Equal(time.Minute, am.snapshot().MedianBuildTime)
+}
+
+func TestAppMetricsFromBuilds(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-metrics")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	a := NewTestApp("metrics", &scriptProvider{script: "#!/bin/sh\nexit $1\n"}).(*app)
+	a.staticConfig = config{
+		"buildLocation":     filepath.Join(dir, "builds"),
+		"artifactsLocation": filepath.Join(dir, "artifacts"),
+	}
+	defer a.Shutdown()
+
+	completed := make(chan map[string]string, 2)
+	a.Listen(SignalBuildComplete, func(values map[string]string) {
+		completed <- values
+	})
+
+	for _, code := range []string{"0", "1"} {
+		config := NewBuildConfig()
+		config.Deadline = time.Second * 10
+		config.Group = "group" + code
+		config.BuildRunnerArgs = []string{code}
+		_, err := a.NewBuild(config.Group, config)
+		require.NoError(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-completed:
+		case <-time.After(time.Second * 10):
+			t.Fatal("builds didn't complete")
+		}
+	}
+
+	metrics := a.Metrics()
+	assert.Equal(2, metrics.Started)
+	assert.Equal(2, metrics.Completed)
+	assert.Equal(1, metrics.Failed)
+	assert.Equal(0, metrics.Running)
+	assert.True(metrics.AverageBuildTime > 0)
+	assert.Equal(GroupMetrics{Started: 1, Completed: 1, Failed: 1}, metrics.Groups["group1"])
+}
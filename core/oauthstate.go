@@ -0,0 +1,91 @@
+package core
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// oauthStateTTL is how long someone has to finish authenticating once they've been sent off to an OAuth provider
+const oauthStateTTL = 10 * time.Minute
+
+// states only live in memory, they're no use after a restart and minting them shouldn't write to disk
+var (
+	oauthStatesLock sync.Mutex
+	oauthStates     = make(map[string]time.Time)
+)
+
+func oauthStateKey(integration, state string) string {
+	return integration + ":" + state
+}
+
+// oauthStateCookie is the cookie that ties an integrations state to the browser it was given to
+func oauthStateCookie(integration string) string {
+	return "ngbuild-oauth-" + integration
+}
+
+// NewOAuthState returns a fresh state for an OAuth auth URL, the callback should check it with CheckOAuthState.
+// Use StartOAuth instead when the state is handed out over http
+func NewOAuthState(integration string) string {
+	now := time.Now()
+	state := generateToken()
+
+	oauthStatesLock.Lock()
+	defer oauthStatesLock.Unlock()
+	pruneOAuthStates(now)
+	oauthStates[oauthStateKey(integration, state)] = now.Add(oauthStateTTL)
+	return state
+}
+
+// CheckOAuthState is true if state was made by NewOAuthState for integration and hasn't expired. A state is only
+// good for one check, so callbacks can't be replayed
+func CheckOAuthState(integration, state string) bool {
+	if state == "" {
+		return false
+	}
+
+	oauthStatesLock.Lock()
+	defer oauthStatesLock.Unlock()
+	expires, ok := oauthStates[oauthStateKey(integration, state)]
+	delete(oauthStates, oauthStateKey(integration, state))
+	return ok && time.Now().Before(expires)
+}
+
+// StartOAuth returns a fresh state for an OAuth auth URL and sets a cookie on resp that ties it to whoever is being
+// sent off with it, so a state can't be used to finish authenticating from anywhere else. The callback should
+// check it with CheckOAuthCallback
+func StartOAuth(resp http.ResponseWriter, integration string) string {
+	state := NewOAuthState(integration)
+	http.SetCookie(resp, &http.Cookie{
+		Name:     oauthStateCookie(integration),
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oauthStateTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return state
+}
+
+// CheckOAuthCallback is CheckOAuthState for the state in reqs query, which also has to be the state StartOAuth
+// gave the same browser in its cookie. The cookie is cleared either way
+func CheckOAuthCallback(resp http.ResponseWriter, req *http.Request, integration string) bool {
+	http.SetCookie(resp, &http.Cookie{Name: oauthStateCookie(integration), Path: "/", MaxAge: -1})
+
+	state := req.URL.Query().Get("state")
+	cookie, err := req.Cookie(oauthStateCookie(integration))
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return false
+	}
+	return CheckOAuthState(integration, state)
+}
+
+// pruneOAuthStates removes states that expired without ever being checked, hold oauthStatesLock when you call this
+func pruneOAuthStates(now time.Time) {
+	for key, expires := range oauthStates {
+		if now.Before(expires) == false {
+			delete(oauthStates, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthState(t *testing.T) {
+	assert := assert.New(t)
+
+	first := NewOAuthState("github")
+	second := NewOAuthState("github")
+	assert.NotEqual(first, second, "every auth url gets its own state")
+
+	assert.False(CheckOAuthState("slack", first), "states belong to one integration")
+	assert.True(CheckOAuthState("github", first))
+	assert.False(CheckOAuthState("github", first), "states can't be replayed")
+	assert.True(CheckOAuthState("github", second))
+
+	assert.False(CheckOAuthState("github", ""))
+	assert.False(CheckOAuthState("github", "madeup"))
+
+	// expired states don't work, and are cleaned up when new states are made
+	expired := NewOAuthState("github")
+	oauthStatesLock.Lock()
+	oauthStates[oauthStateKey("github", expired)] = time.Now().Add(-time.Minute)
+	oauthStatesLock.Unlock()
+	assert.False(CheckOAuthState("github", expired))
+
+	expired = NewOAuthState("github")
+	oauthStatesLock.Lock()
+	oauthStates[oauthStateKey("github", expired)] = time.Now().Add(-time.Minute)
+	oauthStatesLock.Unlock()
+	NewOAuthState("github")
+	oauthStatesLock.Lock()
+	assert.NotContains(oauthStates, oauthStateKey("github", expired))
+	oauthStatesLock.Unlock()
+}
+
+func TestOAuthCallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	started := httptest.NewRecorder()
+	state := StartOAuth(started, "github")
+	cookies := started.Result().Cookies()
+	require.Len(cookies, 1)
+	assert.True(cookies[0].HttpOnly)
+
+	callback := func(state string, cookies ...*http.Cookie) bool {
+		req := httptest.NewRequest("GET", "/cb/auth/github?code=abc&state="+state, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return CheckOAuthCallback(httptest.NewRecorder(), req, "github")
+	}
+
+	assert.False(callback(state), "the state alone isn't enough, it has to come from the browser it was given to")
+	assert.False(callback(state, &http.Cookie{Name: oauthStateCookie("github"), Value: "someoneelses"}))
+	assert.True(callback(state, cookies[0]))
+	assert.False(callback(state, cookies[0]), "states can't be replayed")
+
+	// a cookie for a state that was never made is no good either
+	assert.False(callback("madeup", &http.Cookie{Name: oauthStateCookie("github"), Value: "madeup"}))
+}
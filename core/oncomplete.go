@@ -0,0 +1,73 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// onCompleteTimeout is how long we'll wait on an apps onCompleteURL before giving up
+const onCompleteTimeout = 10 * time.Second
+
+var onCompleteClient = &http.Client{Timeout: onCompleteTimeout}
+
+// BuildResult is what gets POSTed to an apps onCompleteURL when one of its builds finishes
+type BuildResult struct {
+	App          string `json:"app"`
+	Token        string `json:"token"`
+	Group        string `json:"group"`
+	ExitCode     int    `json:"exitCode"`
+	WebStatusURL string `json:"webStatusURL"`
+}
+
+// onBuildComplete is listening on SignalBuildComplete for every app, it lets people know about builds without
+// needing any integrations
+func (a *app) onBuildComplete(event BuildCompleteEvent) {
+	var appConfig struct {
+		OnCompleteURL string `mapstructure:"onCompleteURL"`
+	}
+	if err := a.GlobalConfig(&appConfig); err != nil || appConfig.OnCompleteURL == "" {
+		return
+	}
+
+	build, err := a.GetBuild(event.Token)
+	if err != nil {
+		a.Logwarnf("Couldn't find build %s to send to onCompleteURL: %s", event.Token, err)
+		return
+	}
+
+	code, err := build.ExitCode()
+	if err != nil {
+		a.Logwarnf("Couldn't get exit code of build %s to send to onCompleteURL: %s", build.Token(), err)
+		return
+	}
+
+	result := BuildResult{
+		App:          a.Name(),
+		Token:        build.Token(),
+		Group:        build.Group(),
+		ExitCode:     code,
+		WebStatusURL: build.WebStatusURL(),
+	}
+	go a.postBuildResult(appConfig.OnCompleteURL, result)
+}
+
+func (a *app) postBuildResult(url string, result BuildResult) {
+	body, err := json.Marshal(&result)
+	if err != nil {
+		a.Logwarnf("Couldn't marshal result of build %s: %s", result.Token, err)
+		return
+	}
+
+	resp, err := onCompleteClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		a.Logwarnf("Couldn't send result of build %s to %s: %s", result.Token, url, err)
+		return
+	}
+	resp.Body.Close() //nolint (errcheck)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		a.Logwarnf("Sending result of build %s to %s got %s", result.Token, url, resp.Status)
+	}
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnBuildComplete(t *testing.T) {
+	assert := assert.New(t)
+
+	results := make(chan BuildResult, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := BuildResult{}
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		assert.NoError(json.NewDecoder(r.Body).Decode(&result))
+		results <- result
+	}))
+	defer server.Close()
+
+	a := NewTestApp("testapp").(*app)
+	b := newBuild(a, "testtoken", &BuildConfig{m: new(sync.RWMutex), Group: "testgroup"})
+	a.builds["testgroup"] = []Build{b}
+
+	// nothing is sent without an onCompleteURL
+	b.exitCode = 3
+	b.state.SetBuildState(buildStateFinished)
+	a.onBuildComplete(BuildCompleteEvent{BuildEvent: BuildEvent{App: "testapp", Token: "testtoken"}})
+
+	a.staticConfig = config{"onCompleteURL": server.URL}
+	a.onBuildComplete(BuildCompleteEvent{BuildEvent: BuildEvent{App: "testapp", Token: "missing"}})
+	a.onBuildComplete(BuildCompleteEvent{BuildEvent: BuildEvent{App: "testapp", Token: "testtoken"}})
+
+	select {
+	case result := <-results:
+		assert.Equal(BuildResult{
+			App:          "testapp",
+			Token:        "testtoken",
+			Group:        "testgroup",
+			ExitCode:     3,
+			WebStatusURL: b.WebStatusURL(),
+		}, result)
+	case <-time.After(5 * time.Second):
+		t.Fatal("build result was never sent")
+	}
+
+	select {
+	case result := <-results:
+		t.Fatalf("only one build result should be sent, got another for %s", result.Token)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// failing to send is only logged
+	a.postBuildResult("http://127.0.0.1:1/", BuildResult{Token: "testtoken"})
+}
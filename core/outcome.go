@@ -0,0 +1,72 @@
+package core
+
+// Outcome buckets how a build turned out, it is worked out from the builds exit code and FailureReason
+type Outcome int
+
+// Outcomes a build can have, see Build.Outcome
+const (
+	// OutcomePending is for builds that haven't finished
+	OutcomePending Outcome = iota
+	OutcomeSucceeded
+	// OutcomeFailed is for build runners that failed by themselves, or weren't there to run
+	OutcomeFailed
+	// OutcomeProvisionFailed is for builds that couldn't be provisioned, git problems or merge conflicts for example
+	OutcomeProvisionFailed
+	// OutcomeTimedOut is for builds that didn't finish within their deadline
+	OutcomeTimedOut
+	// OutcomeCancelled is for builds that were stopped, or killed by someone else
+	OutcomeCancelled
+	// OutcomeOutputLimit is for builds stopped for writing more than maxOutputBytes
+	OutcomeOutputLimit
+	// OutcomeInfrastructure is for builds ngbuild couldn't run or stop
+	OutcomeInfrastructure
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomePending:
+		return "Pending"
+	case OutcomeSucceeded:
+		return "Succeeded"
+	case OutcomeFailed:
+		return "Failed"
+	case OutcomeProvisionFailed:
+		return "Provisioning failed"
+	case OutcomeTimedOut:
+		return "Timed out"
+	case OutcomeCancelled:
+		return "Cancelled"
+	case OutcomeOutputLimit:
+		return "Too much output"
+	case OutcomeInfrastructure:
+		return "Infrastructure error"
+	default:
+		return "unknown"
+	}
+}
+
+// outcomeOf works out the Outcome of a build from whether it has stopped, its exit code and its FailureReason
+func outcomeOf(stopped bool, code int, reason string) Outcome {
+	if stopped == false {
+		return OutcomePending
+	}
+
+	switch reason {
+	case "":
+		if code == 0 {
+			return OutcomeSucceeded
+		}
+		return OutcomeFailed
+	case FailureReasonRunnerMissing, FailureReasonRunnerNotExecutable:
+		return OutcomeFailed
+	case FailureReasonProvisionFailed, FailureReasonProvisionTimeout:
+		return OutcomeProvisionFailed
+	case FailureReasonDeadline:
+		return OutcomeTimedOut
+	case FailureReasonStopped, FailureReasonKilled:
+		return OutcomeCancelled
+	case FailureReasonOutputLimit:
+		return OutcomeOutputLimit
+	}
+	return OutcomeInfrastructure
+}
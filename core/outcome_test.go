@@ -0,0 +1,44 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcomeOf(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(OutcomePending, outcomeOf(false, 0, ""))
+	assert.Equal(OutcomePending, outcomeOf(false, 1, FailureReasonDeadline), "nothing is final until the build stops")
+	assert.Equal(OutcomeSucceeded, outcomeOf(true, 0, ""))
+	assert.Equal(OutcomeFailed, outcomeOf(true, 1, ""))
+
+	for reason, outcome := range map[string]Outcome{
+		FailureReasonRunnerMissing:       OutcomeFailed,
+		FailureReasonRunnerNotExecutable: OutcomeFailed,
+		FailureReasonProvisionFailed:     OutcomeProvisionFailed,
+		FailureReasonProvisionTimeout:    OutcomeProvisionFailed,
+		FailureReasonDeadline:            OutcomeTimedOut,
+		FailureReasonStopped:             OutcomeCancelled,
+		FailureReasonKilled:              OutcomeCancelled,
+		FailureReasonOutputLimit:         OutcomeOutputLimit,
+		FailureReasonRunFailed:           OutcomeInfrastructure,
+		FailureReasonStopFailed:          OutcomeInfrastructure,
+	} {
+		assert.Equal(outcome, outcomeOf(true, ExitCodeNone, reason), reason)
+	}
+}
+
+func TestOutcomeString(t *testing.T) {
+	assert := assert.New(t)
+
+	seen := map[string]bool{}
+	for outcome := OutcomePending; outcome <= OutcomeInfrastructure; outcome++ {
+		assert.NotEqual("unknown", outcome.String())
+		assert.False(seen[outcome.String()], "%s is used twice", outcome)
+		seen[outcome.String()] = true
+	}
+	assert.Equal("Timed out", OutcomeTimedOut.String())
+	assert.Equal("unknown", Outcome(-1).String())
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+type provisionOutputKey struct{}
+
+// WithProvisionOutput returns ctx with w as its ProvisionOutput
+func WithProvisionOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, provisionOutputKey{}, w)
+}
+
+// ProvisionOutput is where providers can write how provisioning is going, a clones progress for example. It ends up
+// in the builds stderr, ahead of the build runners. Anything written to it outside of a build is thrown away
+func ProvisionOutput(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(provisionOutputKey{}).(io.Writer); ok {
+		return w
+	}
+	return ioutil.Discard
+}
+
+type provisionWaitingKey struct{}
+
+// withProvisionWaiting returns ctx with waiting as the flag WaitingToProvision sets
+func withProvisionWaiting(ctx context.Context, waiting *uint32) context.Context {
+	return context.WithValue(ctx, provisionWaitingKey{}, waiting)
+}
+
+// WaitingToProvision marks the build being provisioned with ctx as queued until done is called. Providers call it
+// when they have to wait before they can provision, for a clone slot for example, so the build shows where it is
+// in the queue
+func WaitingToProvision(ctx context.Context) (done func()) {
+	waiting, ok := ctx.Value(provisionWaitingKey{}).(*uint32)
+	if ok == false {
+		return func() {}
+	}
+
+	atomic.StoreUint32(waiting, 1)
+	return func() { atomic.StoreUint32(waiting, 0) }
+}
+
+// outputRelay is what a builds stderr pipe reads from, provisioning writes to it and then the build runners stderr
+// is copied into it, so the live output shows both
+type outputRelay struct {
+	*io.PipeReader
+	writer *io.PipeWriter
+
+	m      sync.Mutex
+	source io.Closer
+}
+
+func newOutputRelay() *outputRelay {
+	reader, writer := io.Pipe()
+	return &outputRelay{PipeReader: reader, writer: writer}
+}
+
+func (r *outputRelay) Write(p []byte) (int, error) {
+	return r.writer.Write(p)
+}
+
+// relay copies source into the relay until it is finished, then finishes the relay
+func (r *outputRelay) relay(source io.ReadCloser) {
+	r.m.Lock()
+	r.source = source
+	r.m.Unlock()
+
+	go func() {
+		io.Copy(r.writer, source) //nolint (errcheck)
+		r.finish()
+	}()
+}
+
+// finish ends the relay, readers get an EOF once they have read everything written before it
+func (r *outputRelay) finish() {
+	r.writer.Close() //nolint (errcheck)
+}
+
+// Close closes the source being relayed, as that is the pipe the relay stands in for, the relay finishes once the
+// copying stops. Before there's a source it closes the relay itself
+func (r *outputRelay) Close() error {
+	r.m.Lock()
+	source := r.source
+	r.m.Unlock()
+
+	if source != nil {
+		return source.Close()
+	}
+	return r.PipeReader.Close()
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// progressProvider is a scriptProvider that says how it's getting on
+type progressProvider struct {
+	scriptProvider
+	fail bool
+}
+
+func (p *progressProvider) ProvideFor(ctx context.Context, config *BuildConfig, directory string) error {
+	fmt.Fprint(ProvisionOutput(ctx), "provisioning 50%\rprovisioning 100%\n") //nolint (errcheck)
+	if p.fail {
+		return fmt.Errorf("provisioning went wrong")
+	}
+	return p.scriptProvider.ProvideFor(ctx, config, directory)
+}
+
+func TestProvisionOutput(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-provision")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	stderrOf := func(provider *progressProvider) string {
+		a := NewTestApp("provision", provider).(*app)
+		a.staticConfig = config{"buildLocation": filepath.Join(dir, "builds")}
+		defer a.Shutdown()
+
+		config := NewBuildConfig()
+		config.Deadline = time.Second * 10
+		token, err := a.NewBuild("group", config)
+		require.NoError(err)
+		build, err := a.GetBuild(token)
+		require.NoError(err)
+		_, err = build.Wait(context.Background())
+		require.NoError(err)
+
+		stderr, err := build.Stderr()
+		require.NoError(err)
+		output, err := ioutil.ReadAll(stderr)
+		require.NoError(err)
+		return string(output)
+	}
+
+	provider := &progressProvider{scriptProvider: scriptProvider{script: "#!/bin/sh\necho building >&2\n"}}
+	assert.Equal("provisioning 50%\rprovisioning 100%\nbuilding\n", stderrOf(provider), "provisioning comes before the build")
+
+	provider.fail = true
+	assert.Equal("provisioning 50%\rprovisioning 100%\n", stderrOf(provider), "builds that never ran still show it")
+
+	assert.Equal(ioutil.Discard, ProvisionOutput(context.Background()))
+}
+
+// waitingProvider is a scriptProvider that waits for release before it provisions, like a provider out of clone slots
+type waitingProvider struct {
+	scriptProvider
+	release chan struct{}
+}
+
+func (p *waitingProvider) ProvideFor(ctx context.Context, config *BuildConfig, directory string) error {
+	waited := WaitingToProvision(ctx)
+	<-p.release
+	waited()
+	return p.scriptProvider.ProvideFor(ctx, config, directory)
+}
+
+func TestWaitingToProvision(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-provision")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+
+	provider := &waitingProvider{scriptProvider: scriptProvider{script: "#!/bin/sh\n"}, release: make(chan struct{})}
+	a := NewTestApp("provision", provider).(*app)
+	a.staticConfig = config{"buildLocation": filepath.Join(dir, "builds")}
+	defer a.Shutdown()
+
+	config := NewBuildConfig()
+	config.Deadline = time.Second * 10
+	token, err := a.NewBuild("group", config)
+	require.NoError(err)
+	queued, err := a.GetBuild(token)
+	require.NoError(err)
+
+	for start := time.Now(); queued.(*build).isQueued() == false; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("the build was never queued")
+		}
+	}
+	position, length := queued.QueuePosition()
+	assert.Equal(1, position)
+	assert.Equal(1, length)
+
+	close(provider.release)
+	code, err := queued.Wait(context.Background())
+	require.NoError(err)
+	assert.Equal(0, code)
+	position, _ = queued.QueuePosition()
+	assert.Equal(0, position)
+
+	// outside of a build there's nothing to mark as waiting
+	WaitingToProvision(context.Background())()
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redacted is what a secret is replaced with in build output
+const redacted = "****"
+
+// minSecretLength stops something like "a" being registered and wiping out half of every log
+const minSecretLength = 4
+
+var (
+	secretsLock sync.RWMutex
+	secrets     = make(map[string]struct{})
+)
+
+// RegisterSecret will have value redacted from the output of every build from now on, integrations should
+// register any credentials they know about that a build could end up printing
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secrets[value] = struct{}{}
+}
+
+func registeredSecrets() []string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+
+	values := make([]string, 0, len(secrets))
+	for value := range secrets {
+		values = append(values, value)
+	}
+	return values
+}
+
+// redactor replaces secrets in a stream of output, it isn't safe to use from more than one goroutine
+type redactor struct {
+	secrets [][]byte
+	// pending is the end of the last chunk that could be the start of a secret, held back until we know
+	pending []byte
+}
+
+// newRedactor returns nil if there aren't any usable secrets, a nil redactor passes everything through
+func newRedactor(values []string) *redactor {
+	unique := make(map[string]struct{})
+	for _, value := range values {
+		if len(value) >= minSecretLength {
+			unique[value] = struct{}{}
+		}
+	}
+	if len(unique) == 0 {
+		return nil
+	}
+
+	r := &redactor{}
+	for value := range unique {
+		r.secrets = append(r.secrets, []byte(value))
+	}
+
+	// longest first so a secret that contains another is replaced whole
+	sort.Slice(r.secrets, func(i, j int) bool {
+		if len(r.secrets[i]) != len(r.secrets[j]) {
+			return len(r.secrets[i]) > len(r.secrets[j])
+		}
+		return bytes.Compare(r.secrets[i], r.secrets[j]) < 0
+	})
+
+	return r
+}
+
+func (r *redactor) replace(data []byte) []byte {
+	for _, secret := range r.secrets {
+		data = bytes.Replace(data, secret, []byte(redacted), -1)
+	}
+	return data
+}
+
+// partialSuffix is how many bytes at the end of data could be the start of a secret
+func (r *redactor) partialSuffix(data []byte) int {
+	longest := 0
+	for _, secret := range r.secrets {
+		for n := len(secret) - 1; n > longest; n-- {
+			if n <= len(data) && bytes.HasSuffix(data, secret[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// Redact returns data with any secrets replaced, if the end of data could be the start of a secret it is
+// held back and returned by a later call to Redact or Flush
+func (r *redactor) Redact(data []byte) []byte {
+	if r == nil {
+		return data
+	}
+
+	data = r.replace(append(r.pending, data...))
+	hold := r.partialSuffix(data)
+	r.pending = append([]byte{}, data[len(data)-hold:]...)
+
+	return data[:len(data)-hold]
+}
+
+// Flush returns whatever Redact has been holding back, call it once there is nothing left to read
+func (r *redactor) Flush() []byte {
+	if r == nil {
+		return nil
+	}
+
+	pending := r.pending
+	r.pending = nil
+	return pending
+}
+
+// RedactString is for one off strings, like the command line of a build
+func (r *redactor) RedactString(s string) string {
+	if r == nil {
+		return s
+	}
+
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, string(secret), redacted, -1)
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	assert := assert.New(t)
+
+	var r *redactor
+	assert.Nil(newRedactor([]string{"", "abc"}), "secrets that are too short are ignored")
+	assert.Equal("passes through", string(r.Redact([]byte("passes through"))))
+	assert.Empty(r.Flush())
+
+	r = newRedactor([]string{"supersecret", "secret"})
+	assert.Equal("a **** and a ****.", string(r.Redact([]byte("a supersecret and a secret."))))
+
+	// split across chunks, the start is held back until we know
+	assert.Equal("token: ", string(r.Redact([]byte("token: supe"))))
+	assert.Equal("", string(r.Redact([]byte("rsec"))))
+	assert.Equal("****\n", string(r.Redact([]byte("ret\n"))))
+
+	// held back but turned out not to be a secret
+	assert.Equal("almost ", string(r.Redact([]byte("almost sec"))))
+	assert.Equal("second\n", string(r.Redact([]byte("ond\n"))))
+
+	assert.Equal("the end ", string(r.Redact([]byte("the end secr"))))
+	assert.Equal("secr", string(r.Flush()))
+	assert.Empty(r.Flush())
+
+	assert.Equal("./build.sh --token=****", r.RedactString("./build.sh --token=supersecret"))
+}
+
+func TestRegisterSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	RegisterSecret("abc")
+	RegisterSecret("registeredsecret")
+	assert.NotContains(registeredSecrets(), "abc")
+	assert.Contains(registeredSecrets(), "registeredsecret")
+
+	config := NewBuildConfig()
+	config.Secrets = []string{"buildsecret"}
+	secrets := buildSecrets(config, map[string]string{"TOKEN": "envsecret"})
+	assert.Contains(secrets, "registeredsecret")
+	assert.Contains(secrets, "buildsecret")
+	assert.Contains(secrets, "envsecret")
+
+	marshalled, err := config.Marshal()
+	assert.NoError(err)
+	assert.NotContains(string(marshalled), "buildsecret", "secrets don't end up in buildconfig.json")
+
+	assert.Equal([]string{"A=1", "B=2"}, secretsEnv(map[string]string{"B": "2", "A": "1"}))
+}
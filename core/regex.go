@@ -9,27 +9,32 @@ var (
 	errNoMatch = errors.New("Could not match regexp")
 )
 
-// RegexpNamedGroupsMatch - will for a given regexp and search give you a a map of named groups to found values
+// RegexpNamedGroupsMatch - will for a given regexp and search give you a a map of named groups to found values.
+// Every named group is in the map, groups that didn't take part in the match are "". When a name is used by more
+// than one group the last of them that took part in the match wins, so `(?P<x>a)|(?P<x>b)` works as you'd hope.
+// Unnamed groups are left out, a pattern without named groups gives an empty map rather than nil
 func RegexpNamedGroupsMatch(pattern *regexp.Regexp, search string) (namedGroupMatch map[string]string, err error) {
-	if pattern.MatchString(search) == false {
+	indexes := pattern.FindStringSubmatchIndex(search)
+	if indexes == nil {
 		err = errNoMatch
 		return
 	}
+
 	namedGroupMatch = make(map[string]string)
-	groups := pattern.SubexpNames()
-	for _, group := range groups {
-		if group == "" {
+	for index, group := range pattern.SubexpNames() {
+		// the first is the entire match, which is never named
+		if index < 1 || group == "" {
 			continue
 		}
-		namedGroupMatch[group] = ""
-	}
 
-	for index, submatch := range pattern.FindStringSubmatch(search) {
-		// first returned value is just the entire string, which is totally useful. skip it.
-		if index < 1 {
+		start, end := indexes[index*2], indexes[index*2+1]
+		if start < 0 {
+			if _, ok := namedGroupMatch[group]; ok == false {
+				namedGroupMatch[group] = ""
+			}
 			continue
 		}
-		namedGroupMatch[groups[index]] = submatch
+		namedGroupMatch[group] = search[start:end]
 	}
 
 	return
@@ -32,11 +32,60 @@ func TestRegexpmatchNamedGroupsMatch(t *testing.T) {
 				"3": "3",
 			},
 		},
+		// unnamed groups aren't in the map
+		testregexpmatch{
+			pattern: regexp.MustCompile(`(\d)(?P<2>\d)(\d)`),
+			search:  "123",
+			result: map[string]string{
+				"2": "2",
+			},
+		},
+		// nor is anything from patterns without named groups, but it's still a map
+		testregexpmatch{
+			pattern: regexp.MustCompile(`/build/(\w+)`),
+			search:  "/build/started",
+			result:  map[string]string{},
+		},
+		// the last group with a name that took part in the match wins
+		testregexpmatch{
+			pattern: regexp.MustCompile(`(?P<x>a)(?P<x>b)`),
+			search:  "ab",
+			result: map[string]string{
+				"x": "b",
+			},
+		},
+		testregexpmatch{
+			pattern: regexp.MustCompile(`(?P<x>a)|(?P<x>b)`),
+			search:  "a",
+			result: map[string]string{
+				"x": "a",
+			},
+		},
+		testregexpmatch{
+			pattern: regexp.MustCompile(`(?P<x>a)|(?P<x>b)`),
+			search:  "b",
+			result: map[string]string{
+				"x": "b",
+			},
+		},
+		testregexpmatch{
+			pattern: regexp.MustCompile(`(?P<x>a)?(?P<x>b)?c`),
+			search:  "c",
+			result: map[string]string{
+				"x": "",
+			},
+		},
 	}
 
 	for _, testData := range testData {
 		match, err := RegexpNamedGroupsMatch(testData.pattern, testData.search)
 		assert.Nil(t, err)
-		assert.Equal(t, testData.result, match)
+		assert.Equal(t, testData.result, match, testData.pattern.String())
 	}
 }
+
+func TestRegexpNamedGroupsMatchNoMatch(t *testing.T) {
+	match, err := RegexpNamedGroupsMatch(regexp.MustCompile(`(?P<1>\d)`), "nope")
+	assert.Equal(t, errNoMatch, err)
+	assert.Nil(t, match)
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// buildConfigPath is where the config a build was made from is kept, it's in the cache directory like integration
+// caches so the janitor cleans it up along with them
+func buildConfigPath(cacheDirectory, appName, token string) string {
+	return filepath.Join(cacheDirectory, "builds", appName, token, "buildconfig.json")
+}
+
+// storeBuildConfig keeps serialized, the config build token was made from, for ReplayBuild
+func (a *app) storeBuildConfig(token string, serialized []byte) {
+	path := buildConfigPath(CacheDirectory(), a.Name(), token)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		a.Logwarnf("Couldn't store the config of build %s, it can't be replayed: %s", token, err)
+		return
+	}
+	if err := WriteFileAtomic(path, serialized, 0644); err != nil {
+		a.Logwarnf("Couldn't store the config of build %s, it can't be replayed: %s", token, err)
+	}
+}
+
+// ReplayBuild makes a new build from the config build token was made from. The config is stored when the build is
+// made, so builds can be replayed after they have been forgotten, or by another ngbuild sharing the cache directory.
+// Builds that are still around are replayed from their own config, the stored one doesn't have their secrets
+func (a *app) ReplayBuild(token string) (string, error) {
+	if a == nil {
+		return "", errors.New("a is nil")
+	}
+
+	stored, err := UnmarshalBuildConfig(buildConfigPath(CacheDirectory(), a.Name(), token))
+	if err != nil && os.IsNotExist(err) == false {
+		return "", fmt.Errorf("couldn't load the config of build %s: %s", token, err)
+	}
+
+	build, buildErr := a.GetBuild(token)
+	if buildErr != nil {
+		if stored == nil {
+			return "", ErrBuildNotFound
+		}
+		return a.NewBuild(stored.Group, stored)
+	}
+
+	config := build.Config().copy()
+	if stored != nil {
+		// what happened during the build isn't replayed, only the metadata it was made with
+		config.metadata = stored.metadata
+	}
+	return a.NewBuild(config.Group, config)
+}
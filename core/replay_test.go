@@ -0,0 +1,160 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayBuild(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-replay")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte(`{"cacheDirectory": "`+dir+`"}`), 0644))
+	defer useNGBuildDirectory(dir)()
+
+	a := NewTestApp("replay", &scriptProvider{script: "#!/bin/sh\necho built\n"}).(*app)
+	a.staticConfig = config{"buildLocation": filepath.Join(dir, "builds")}
+	defer a.Shutdown()
+
+	config := NewBuildConfig()
+	config.Title = "replay me"
+	config.Deadline = time.Second * 10
+	config.Group = "group"
+	config.SetMetadata("replay:Thing", "everything")
+
+	token, err := a.NewBuild("group", config)
+	require.NoError(err)
+	build, err := a.GetBuild(token)
+	require.NoError(err)
+	_, err = build.Wait(context.Background())
+	require.NoError(err)
+	_, err = os.Stat(buildConfigPath(dir, "replay", token))
+	require.NoError(err, "the config is stored when the build is made")
+
+	// what happened during the build isn't replayed
+	build.Config().SetMetadata(MetadataFailureReason, "it went wrong")
+
+	// the build is long gone, but its config isn't
+	a.m.Lock()
+	a.builds = make(map[string][]Build)
+	a.m.Unlock()
+
+	replayed, err := a.ReplayBuild(token)
+	require.NoError(err)
+	assert.NotEqual(token, replayed)
+	build, err = a.GetBuild(replayed)
+	require.NoError(err)
+	assert.Equal("replay me", build.Config().Title)
+	assert.Equal("group", build.Group())
+	assert.Equal("everything", build.Config().GetMetadata("replay:Thing"))
+	assert.Empty(build.Config().GetMetadata(MetadataFailureReason))
+	code, err := build.Wait(context.Background())
+	assert.NoError(err)
+	assert.Equal(0, code)
+
+	_, err = a.ReplayBuild("neverbuilt")
+	assert.Equal(ErrBuildNotFound, err)
+}
+
+func TestReplayBuildSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-replaysecrets")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte(`{"cacheDirectory": "`+dir+`"}`), 0644))
+	defer useNGBuildDirectory(dir)()
+
+	a := NewTestApp("replaysecrets", &scriptProvider{script: "#!/bin/sh\necho the password is hunter2\n"}).(*app)
+	a.staticConfig = config{"buildLocation": filepath.Join(dir, "builds")}
+	defer a.Shutdown()
+
+	output := func(token string) string {
+		build, err := a.GetBuild(token)
+		require.NoError(err)
+		_, err = build.Wait(context.Background())
+		require.NoError(err)
+		stdout, err := build.Stdout()
+		require.NoError(err)
+		raw, err := ioutil.ReadAll(stdout)
+		require.NoError(err)
+		return string(raw)
+	}
+
+	config := NewBuildConfig()
+	config.Deadline = time.Second * 10
+	config.Group = "group"
+	config.Secrets = []string{"hunter2"}
+	token, err := a.NewBuild("group", config)
+	require.NoError(err)
+	assert.NotContains(output(token), "hunter2")
+
+	replayed, err := a.ReplayBuild(token)
+	require.NoError(err)
+	assert.NotContains(output(replayed), "hunter2", "the builds secrets aren't stored, but replays still have them")
+}
+
+func TestNewFailedBuilds(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-replay")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ngbuild.json"), []byte(`{"cacheDirectory": "`+dir+`"}`), 0644))
+	defer useNGBuildDirectory(dir)()
+
+	a := NewTestApp("failed", &scriptProvider{script: "#!/bin/sh\nexit $1\n"}).(*app)
+	a.staticConfig = config{"buildLocation": filepath.Join(dir, "builds")}
+	defer a.Shutdown()
+
+	var builds []Build
+	for _, runner := range []struct{ commit, name, code string }{
+		{"abc", "passes", "0"},
+		{"abc", "fails", "1"},
+		{"def", "other", "1"},
+	} {
+		config := NewBuildConfig()
+		config.Deadline = time.Second * 10
+		config.Group = "group"
+		config.HeadHash = runner.commit
+		config.BuildRunnerArgs = []string{runner.code}
+		config.SetMetadata("test:Runner", runner.name)
+
+		token, err := a.NewBuild("group", config)
+		require.NoError(err)
+		build, err := a.GetBuild(token)
+		require.NoError(err)
+		_, err = build.Wait(context.Background())
+		require.NoError(err)
+		builds = append(builds, build)
+	}
+
+	// only the failed build of the same commit is replayed, whichever build asks
+	tokens, err := builds[0].NewFailedBuilds("test:Runner")
+	require.NoError(err)
+	require.Len(tokens, 1)
+	replayed, err := a.GetBuild(tokens[0])
+	require.NoError(err)
+	assert.Equal("fails", replayed.Config().GetMetadata("test:Runner"))
+	assert.Equal("abc", replayed.Config().HeadHash)
+
+	// the replay is the latest build for its label now, so it's what gets replayed once it fails too
+	code, err := replayed.Wait(context.Background())
+	require.NoError(err)
+	assert.Equal(1, code)
+	tokens, err = builds[1].NewFailedBuilds("test:Runner")
+	require.NoError(err)
+	assert.Len(tokens, 1)
+}
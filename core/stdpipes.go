@@ -5,16 +5,36 @@ package core
 // all of them contain all the data and will block their Reads as expected
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type stdreader struct {
 	parent   *stdpipes
 	position int
+	closed   uint32
+}
+
+func (s *stdreader) isClosed() bool {
+	return atomic.LoadUint32(&s.closed) > 0
+}
+
+// Close will stop the reader, a Read that is waiting on data will return io.EOF as will any future Reads
+func (s *stdreader) Close() error {
+	if s == nil {
+		return errors.New("stdreader is nil")
+	}
+	if s.parent == nil {
+		return errors.New("lost connection to std pipe")
+	}
+
+	s.parent.removeReader(s)
+	return nil
 }
 
 func (s *stdreader) Read(p []byte) (n int, err error) {
@@ -30,8 +50,12 @@ func (s *stdreader) Read(p []byte) (n int, err error) {
 		return 0, errors.New("p is too small to read any data")
 	}
 
-	cachedData, closed := s.parent.GetCache(s.position)
-	if len(cachedData) == 0 && closed == true {
+	if s.isClosed() {
+		return 0, io.EOF
+	}
+
+	cachedData, closed := s.parent.GetCache(s.position, s)
+	if s.isClosed() || (len(cachedData) == 0 && closed == true) {
 		return 0, io.EOF
 	}
 
@@ -40,6 +64,37 @@ func (s *stdreader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// maxLineLength is the longest line a stdlinereader will buffer, longer lines are returned in pieces
+const maxLineLength = 64 * 1024
+
+// stdlinereader reads whole lines from a stdpipes, it has its own position in the cache like stdreader
+type stdlinereader struct {
+	reader *bufio.Reader
+	closer io.Closer
+}
+
+// Close stops the underlying reader, see stdreader.Close
+func (l *stdlinereader) Close() error {
+	if l == nil {
+		return errors.New("stdlinereader is nil")
+	}
+	return l.closer.Close()
+}
+
+// ReadLine returns the next line without its \n or \r\n, a trailing line without a line ending is returned
+// before io.EOF. Lines longer than maxLineLength are split up over several calls
+func (l *stdlinereader) ReadLine() (string, error) {
+	if l == nil {
+		return "", errors.New("stdlinereader is nil")
+	}
+
+	line, _, err := l.reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
 type stdpipes struct {
 	m sync.RWMutex
 
@@ -49,17 +104,53 @@ type stdpipes struct {
 	readClosed uint64
 
 	cacheSize uint64
+	bytesRead uint64
+
+	// only readLoop touches rateSecond and rateBytes, peakRate is read from elsewhere so it's atomic
+	rateSecond int64
+	rateBytes  uint64
+	peakRate   uint64
+
+	// limit is how much will be cached, anything read after that is thrown away, 0 is unlimited
+	limit     uint64
+	overLimit bool
 
-	Done chan struct{}
+	// redactor takes secrets out of whatever is read before it is cached, only readLoop touches it
+	redactor *redactor
+
+	// readers that haven't been closed, guarded by readWait.L
+	readers map[*stdreader]struct{}
+
+	// Done is closed once the pipe has finished, see finish
+	Done     chan struct{}
+	doneOnce sync.Once
+	// OverLimit is closed once more than limit bytes have been read
+	OverLimit chan struct{}
 }
 
 // newStdpipes will return a new stdpipes structure to manage the given pipes
 func newStdpipes(readerPipe io.ReadCloser) *stdpipes {
+	return newLimitedStdpipes(readerPipe, 0)
+}
+
+// newLimitedStdpipes is newStdpipes that will stop caching after limit bytes, the pipe is still read from so
+// whatever is writing to it doesn't block
+func newLimitedStdpipes(readerPipe io.ReadCloser, limit uint64) *stdpipes {
+	return newRedactedStdpipes(readerPipe, limit, nil)
+}
+
+// newRedactedStdpipes is newLimitedStdpipes that replaces any of the given secrets before they are cached, so
+// nothing reading from the pipes ever sees them
+func newRedactedStdpipes(readerPipe io.ReadCloser, limit uint64, secrets []string) *stdpipes {
 	pipes := &stdpipes{
 		readWait: sync.NewCond(&sync.Mutex{}),
 		reader:   readerPipe,
+		limit:    limit,
+		readers:  make(map[*stdreader]struct{}),
+		redactor: newRedactor(secrets),
 
-		Done: make(chan struct{}, 1),
+		Done:      make(chan struct{}),
+		OverLimit: make(chan struct{}),
 	}
 
 	go pipes.readLoop()
@@ -67,6 +158,35 @@ func newStdpipes(readerPipe io.ReadCloser) *stdpipes {
 	return pipes
 }
 
+// PeakRate is the most bytes that have been read from the pipe in a single second
+func (p *stdpipes) PeakRate() uint64 {
+	return atomic.LoadUint64(&p.peakRate)
+}
+
+// trackRate is called by readLoop for every read, it keeps count of bytes per second so we know the peak
+func (p *stdpipes) trackRate(n int) {
+	now := time.Now().Unix()
+	if now != p.rateSecond {
+		p.rateSecond = now
+		p.rateBytes = 0
+	}
+
+	p.rateBytes += uint64(n)
+	if p.rateBytes > atomic.LoadUint64(&p.peakRate) {
+		atomic.StoreUint64(&p.peakRate, p.rateBytes)
+	}
+}
+
+// CacheSize is how many bytes are being held for readers
+func (p *stdpipes) CacheSize() uint64 {
+	return atomic.LoadUint64(&p.cacheSize)
+}
+
+// BytesRead is how many bytes have been read from the pipe, this is more than CacheSize once the limit is reached
+func (p *stdpipes) BytesRead() uint64 {
+	return atomic.LoadUint64(&p.bytesRead)
+}
+
 func (p *stdpipes) getclosed() bool {
 	return atomic.LoadUint64(&p.readClosed) > 0
 }
@@ -103,22 +223,45 @@ func (p *stdpipes) readLoop() {
 		var err error
 
 		if n, err = p.getpipe().Read(buf[:]); err != nil {
-			atomic.StoreUint64(&p.readClosed, 1)
 			if err != io.EOF {
 				logcritf("pipe read errored: %s", err)
 			}
 			shouldExit = true
 		}
 
+		p.trackRate(n)
+
 		p.m.Lock()
-		if err = writeall(p.getcache(), buf[:n]); err != nil {
-			atomic.StoreUint64(&p.readClosed, 1)
+		read := atomic.AddUint64(&p.bytesRead, uint64(n))
+		cache := p.redactor.Redact(buf[:n])
+		if shouldExit {
+			cache = append(cache, p.redactor.Flush()...)
+		}
+
+		// redacting can only shrink what's read, so the cache is kept to the limit rather than the pipe
+		if p.limit > 0 && read > p.limit {
+			if cached := atomic.LoadUint64(&p.cacheSize); cached >= p.limit {
+				cache = nil
+			} else if uint64(len(cache)) > p.limit-cached {
+				cache = cache[:p.limit-cached]
+			}
+			if p.overLimit == false {
+				p.overLimit = true
+				close(p.OverLimit)
+			}
+		}
+
+		if err = writeall(p.getcache(), cache); err != nil {
 			logcritf("pipe write errored: %s", err)
 
 			shouldExit = true
 		}
 
-		atomic.AddUint64(&p.cacheSize, uint64(n))
+		atomic.AddUint64(&p.cacheSize, uint64(len(cache)))
+		// readers stop once the read side is closed, so only say so after whatever was flushed is cached
+		if shouldExit {
+			atomic.StoreUint64(&p.readClosed, 1)
+		}
 		p.m.Unlock()
 
 		waiter := p.getwaiter()
@@ -126,14 +269,89 @@ func (p *stdpipes) readLoop() {
 	}
 
 	if p.getclosed() {
-		p.Done <- struct{}{}
+		p.finish()
 	}
 }
 
-// NewreaderReader will return an io.Reader that can read from the reader pipe
-func (p *stdpipes) NewReader() io.Reader {
-	reader := stdreader{parent: p}
-	return &reader
+// finish closes Done, it's safe to call more than once
+func (p *stdpipes) finish() {
+	p.doneOnce.Do(func() { close(p.Done) })
+}
+
+// NewReader will return an io.ReadCloser that can read from the reader pipe, close it if you stop reading
+// before the pipe is finished so it doesn't hang around
+func (p *stdpipes) NewReader() io.ReadCloser {
+	reader := &stdreader{parent: p}
+
+	p.readWait.L.Lock()
+	p.readers[reader] = struct{}{}
+	p.readWait.L.Unlock()
+
+	return reader
+}
+
+// Readers returns how many readers haven't been closed
+func (p *stdpipes) Readers() int {
+	p.readWait.L.Lock()
+	defer p.readWait.L.Unlock()
+
+	return len(p.readers)
+}
+
+func (p *stdpipes) removeReader(reader *stdreader) {
+	p.readWait.L.Lock()
+	defer p.readWait.L.Unlock()
+
+	atomic.StoreUint32(&reader.closed, 1)
+	delete(p.readers, reader)
+
+	// wake up anything waiting, the closed reader will notice and give up
+	p.readWait.Broadcast()
+}
+
+// NewLineReader will return a reader that gives you the pipe a line at a time
+func (p *stdpipes) NewLineReader() *stdlinereader {
+	reader := p.NewReader()
+	return &stdlinereader{reader: bufio.NewReaderSize(reader, maxLineLength), closer: reader}
+}
+
+// TailBytes returns a copy of the last n bytes that have been cached, it doesn't wait for the pipe to close. n less
+// than 1 gives you nothing
+func (p *stdpipes) TailBytes(n int) []byte {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	cache := p.getcache().Bytes()
+	if n < 1 {
+		return []byte{}
+	}
+	if n < len(cache) {
+		cache = cache[len(cache)-n:]
+	}
+	return append([]byte(nil), cache...)
+}
+
+// TailLines returns a copy of the last n lines that have been cached, asking for more lines than there are
+// gives you everything. A line ending at the very end of the output doesn't count as starting a new line
+func (p *stdpipes) TailLines(n int) []byte {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	cache := p.getcache().Bytes()
+	if n < 1 {
+		return []byte{}
+	}
+
+	end := len(cache)
+	if end > 0 && cache[end-1] == '\n' {
+		end--
+	}
+
+	start := end
+	for ; n > 0 && start >= 0; n-- {
+		start = bytes.LastIndexByte(cache[:start], '\n')
+	}
+	return append([]byte(nil), cache[start+1:]...)
 }
 
 // newdata will return new if there is any new activity
@@ -146,8 +364,8 @@ func (p *stdpipes) hasNewData(pipetype, oldlen int) bool {
 }
 
 // GetCache will return the cache of the given pipetype at the given
-// seek position, it will block if position == len(totalCache)
-func (p *stdpipes) GetCache(position int) (buf []byte, closed bool) {
+// seek position, it will block if position == len(totalCache) until there is more data or reader is closed
+func (p *stdpipes) GetCache(position int, reader *stdreader) (buf []byte, closed bool) {
 	defer func() {
 		p.m.Unlock()
 	}()
@@ -155,7 +373,7 @@ func (p *stdpipes) GetCache(position int) (buf []byte, closed bool) {
 	// if the current position is at the end of the cache and the input pipe isn't closed
 	// then we need to wait on new data.
 	p.readWait.L.Lock()
-	for uint64(position) >= atomic.LoadUint64(&p.cacheSize) && p.getclosed() == false {
+	for uint64(position) >= atomic.LoadUint64(&p.cacheSize) && p.getclosed() == false && reader.isClosed() == false {
 		p.readWait.Wait()
 	}
 	p.m.Lock()
@@ -176,5 +394,5 @@ func (p *stdpipes) GetCache(position int) (buf []byte, closed bool) {
 
 func (p *stdpipes) Close() {
 	p.reader.Close() //nolint (errcheck)
-	p.Done <- struct{}{}
+	p.finish()
 }
@@ -2,8 +2,11 @@ package core
 
 import (
 	"io"
+	"io/ioutil"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -109,3 +112,188 @@ func TestStdPipes(t *testing.T) {
 		assert.EqualError(err, io.EOF.Error())
 	})
 }
+
+func TestStdPipesLineReader(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan []byte)
+	stdoutmock := &mockReader{data: data}
+	stdoutmock.readFn = func(p []byte) (int, error) {
+		chunk, ok := <-data
+		if ok == false {
+			return 0, io.EOF
+		}
+		return copy(p, chunk), nil
+	}
+
+	piper := newStdpipes(stdoutmock)
+	lines := piper.NewLineReader()
+	raw := piper.NewReader()
+
+	longLine := strings.Repeat("x", maxLineLength+10)
+	go func() {
+		output := []byte("first line\nsecond line\r\n" + longLine + "\nno line ending")
+		// the pipe is read 1024 bytes at a time, so this splits lines up too
+		for len(output) > 0 {
+			n := 1000
+			if n > len(output) {
+				n = len(output)
+			}
+			data <- output[:n]
+			output = output[n:]
+		}
+		close(data)
+	}()
+
+	for _, expected := range []string{"first line", "second line", longLine[:maxLineLength], longLine[maxLineLength:], "no line ending"} {
+		line, err := lines.ReadLine()
+		assert.NoError(err)
+		assert.Equal(expected, line)
+	}
+	_, err := lines.ReadLine()
+	assert.Equal(io.EOF, err)
+
+	// raw readers still see everything
+	all, err := ioutil.ReadAll(raw)
+	assert.NoError(err)
+	assert.Equal("first line\nsecond line\r\n"+longLine+"\nno line ending", string(all))
+}
+
+func TestStdPipesTail(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan []byte)
+	stdoutmock := &mockReader{data: data}
+	stdoutmock.readFn = func(p []byte) (int, error) {
+		chunk, ok := <-data
+		if ok == false {
+			return 0, io.EOF
+		}
+		return copy(p, chunk), nil
+	}
+
+	piper := newStdpipes(stdoutmock)
+	data <- []byte("one\ntwo\nthree\n")
+	close(data)
+	<-piper.Done
+
+	assert.Equal("three\n", string(piper.TailLines(1)))
+	assert.Equal("two\nthree\n", string(piper.TailLines(2)))
+	assert.Equal("one\ntwo\nthree\n", string(piper.TailLines(3)))
+	assert.Equal("one\ntwo\nthree\n", string(piper.TailLines(100)), "asking for too many lines gives everything")
+	assert.Empty(piper.TailLines(0))
+
+	assert.Equal("ee\n", string(piper.TailBytes(3)))
+	assert.Equal("one\ntwo\nthree\n", string(piper.TailBytes(100)))
+	assert.Empty(piper.TailBytes(0))
+	assert.Empty(piper.TailBytes(-1))
+}
+
+func TestStdPipesRedacted(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan []byte)
+	stdoutmock := &mockReader{data: data}
+	stdoutmock.readFn = func(p []byte) (int, error) {
+		chunk, ok := <-data
+		if ok == false {
+			return 0, io.EOF
+		}
+		return copy(p, chunk), nil
+	}
+
+	piper := newRedactedStdpipes(stdoutmock, 0, []string{"hunter22"})
+	data <- []byte("password is hun")
+	data <- []byte("ter22\nnearly hunt")
+	close(data)
+	<-piper.Done
+
+	output, err := ioutil.ReadAll(piper.NewReader())
+	assert.NoError(err)
+	assert.Equal("password is ****\nnearly hunt", string(output))
+	assert.Equal(uint64(len(output)), piper.CacheSize())
+}
+
+func TestStdPipesRedactedFlushReachesReaders(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan []byte)
+	stdoutmock := &mockReader{data: data}
+	stdoutmock.readFn = func(p []byte) (int, error) {
+		chunk, ok := <-data
+		if ok == false {
+			return 0, io.EOF
+		}
+		return copy(p, chunk), nil
+	}
+
+	// readers already waiting when the pipe closes still get what the redactor held back
+	piper := newRedactedStdpipes(stdoutmock, 0, []string{"hunter22"})
+	output := make(chan string, 1)
+	go func() {
+		read, _ := ioutil.ReadAll(piper.NewReader())
+		output <- string(read)
+	}()
+	data <- []byte("held back hunt")
+	close(data)
+
+	assert.Equal("held back hunt", <-output)
+}
+
+func TestStdPipesCloseReader(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan []byte)
+	stdoutmock := &mockReader{data: data}
+	stdoutmock.readFn = func(p []byte) (int, error) {
+		chunk, ok := <-data
+		if ok == false {
+			return 0, io.EOF
+		}
+		return copy(p, chunk), nil
+	}
+
+	piper := newStdpipes(stdoutmock)
+	closing := piper.NewReader()
+	other := piper.NewReader()
+	assert.Equal(2, piper.Readers())
+
+	// both readers are blocked waiting on data that isn't coming
+	closingResult := make(chan error)
+	go func() {
+		_, err := closing.Read(make([]byte, 16))
+		closingResult <- err
+	}()
+	otherResult := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := other.Read(buf)
+		otherResult <- string(buf[:n])
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	assert.NoError(closing.Close())
+	select {
+	case err := <-closingResult:
+		assert.Equal(io.EOF, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("closing a reader didn't wake it up")
+	}
+	assert.Equal(1, piper.Readers())
+
+	_, err := closing.Read(make([]byte, 16))
+	assert.Equal(io.EOF, err)
+
+	// the other reader is still waiting and gets the data
+	data <- []byte("testmarker")
+	select {
+	case read := <-otherResult:
+		assert.Equal("testmarker", read)
+	case <-time.After(time.Second * 5):
+		t.Fatal("other reader never got the data")
+	}
+
+	close(data)
+	assert.NoError(other.Close())
+	assert.Equal(0, piper.Readers())
+}
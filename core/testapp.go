@@ -0,0 +1,16 @@
+package core
+
+// NewTestApp will return an in memory App that never reads config from disk, it has a working event bus
+// and keeps track of its builds just like a real app does.
+// This is the preferred fixture for integration tests, prefer it over mocks.App unless you need to set
+// expectations on the app itself. Any integrations given are used to provision builds, they are not attached.
+func NewTestApp(name string, integrations ...Integration) App {
+	return &app{
+		name:         name,
+		builds:       make(map[string][]Build),
+		bus:          newAppBus(),
+		integrations: integrations,
+		staticConfig: config{},
+		metrics:      newAppMetrics(),
+	}
+}
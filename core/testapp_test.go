@@ -0,0 +1,46 @@
+package core
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestApp(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	app := NewTestApp("testapp")
+	defer app.Shutdown()
+	assert.Equal("testapp", app.Name())
+	assert.Empty(app.AppLocation())
+
+	var globalConfig struct {
+		BuildLocation string `mapstructure:"buildLocation"`
+	}
+	require.NoError(app.GlobalConfig(&globalConfig))
+	assert.Equal(os.TempDir(), globalConfig.BuildLocation)
+
+	var integrationConfig struct {
+		Foo string
+	}
+	require.NoError(app.Config("testintegration", &integrationConfig))
+	assert.Empty(integrationConfig.Foo)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	handler := app.Listen(`test:(?P<value>\w+)`, func(values map[string]string) {
+		assert.Equal("foo", values["value"])
+		wg.Done()
+	})
+	app.SendEvent("test:foo")
+	wg.Wait()
+	app.RemoveEventHandler(handler)
+
+	_, err := app.GetBuild("notatoken")
+	assert.Error(err)
+	assert.Empty(app.GetBuildHistory("group"))
+}
@@ -0,0 +1,5 @@
+#!/bin/bash
+
+echo "token is $NGBUILD_TEST_TOKEN"
+
+>&2 echo "password is hunter22"
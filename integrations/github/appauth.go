@@ -0,0 +1,186 @@
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/watchly/ngbuild/core"
+)
+
+const (
+	authModeOAuth = "oauth"
+	authModeApp   = "app"
+
+	// appJWTLifetime is how long the JWTs we sign as the github app last, github won't take more than 10 minutes
+	appJWTLifetime = 9 * time.Minute
+	// installationTokenMargin is how long before github expires an installation token we get a new one
+	installationTokenMargin = 5 * time.Minute
+)
+
+// installationTokenSource makes installation tokens for a github app, each one is requested with a JWT signed by
+// the apps private key. Wrap it in oauth2.ReuseTokenSource so tokens are only made when the last one expires
+type installationTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+
+	baseURL string
+	client  *http.Client
+}
+
+func newInstallationTokenSource(appID, installationID int64, privateKeyPath string) (*installationTokenSource, error) {
+	if appID == 0 || installationID == 0 || privateKeyPath == "" {
+		return nil, errors.New("appID, installationID and privateKeyPath are all needed to authenticate as a github app")
+	}
+
+	data, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read private key %s: %s", privateKeyPath, err)
+	}
+
+	return &installationTokenSource{
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		baseURL:        "https://api.github.com/",
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// parsePrivateKey reads the PEM private key github gives out for apps, which is PKCS1, or a PKCS8 one
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if ok == false {
+		return nil, errors.New("private key isn't an RSA key")
+	}
+	return key, nil
+}
+
+// jwt returns a JWT that authenticates us as the github app itself, all it can do is make installation tokens
+func (ts *installationTokenSource) jwt(now time.Time) (string, error) {
+	encode := func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data), err
+	}
+
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	// iat is backdated a little in case our clock is ahead of githubs
+	claims, err := encode(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": ts.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := header + "." + claims
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Token makes a new installation token, it expires a little before github will expire it
+func (ts *installationTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := ts.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%sapp/installations/%d/access_tokens", ts.baseURL, ts.installationID)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint (errcheck)
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("github wouldn't make an installation token: %s", resp.Status)
+	}
+
+	var installationToken struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&installationToken); err != nil {
+		return nil, err
+	}
+	if installationToken.Token == "" {
+		return nil, errors.New("github sent an empty installation token")
+	}
+
+	// the token can see every repo the app is installed on, make sure it never shows up in build output
+	core.RegisterSecret(installationToken.Token)
+
+	return &oauth2.Token{
+		AccessToken: installationToken.Token,
+		TokenType:   "token",
+		Expiry:      installationToken.ExpiresAt.Add(-installationTokenMargin),
+	}, nil
+}
+
+// initAppClient authenticates as an installation of a github app, unlike oauth there is nobody to wait on
+func (g *Github) initAppClient() {
+	g.clientHasSet.L.Lock()
+	defer g.clientHasSet.L.Unlock()
+	g.needsClient = true
+
+	source, err := newInstallationTokenSource(g.globalConfig.AppID, g.globalConfig.InstallationID, g.globalConfig.PrivateKeyPath)
+	if err != nil {
+		logcritf("Couldn't authenticate as github app %d: %s", g.globalConfig.AppID, err)
+		return
+	}
+
+	// make the first token now, so bad config shows up at startup rather than on the first webhook
+	tokens := oauth2.ReuseTokenSource(nil, source)
+	if _, err := tokens.Token(); err != nil {
+		logcritf("Couldn't authenticate as installation %d of github app %d: %s", g.globalConfig.InstallationID, g.globalConfig.AppID, err)
+		return
+	}
+
+	g.setClientWith(oauth2.NewClient(oauth2.NoContext, tokens))
+	loginfof("Authenticated as installation %d of github app %d", g.globalConfig.InstallationID, g.globalConfig.AppID)
+}
@@ -0,0 +1,106 @@
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestInstallationTokenSource(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	keyFile, err := ioutil.TempFile("", "ngbuild-app-key")
+	require.NoError(err)
+	defer os.Remove(keyFile.Name()) //nolint (errcheck)
+	require.NoError(pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	require.NoError(keyFile.Close())
+
+	_, err = newInstallationTokenSource(3, 0, keyFile.Name())
+	assert.Error(err, "the installation is needed")
+
+	expiresIn := time.Hour
+	var issued int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("POST", r.Method)
+		assert.Equal("/app/installations/7/access_tokens", r.URL.Path)
+
+		// the JWT has to be signed by the apps key and say which app it is
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		require.Len(parts, 3)
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(err)
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+
+		claims := map[string]int64{}
+		data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(json.Unmarshal(data, &claims))
+		assert.Equal(int64(3), claims["iss"])
+		assert.True(claims["exp"]-claims["iat"] <= 10*60, "github won't take JWTs that last more than 10 minutes")
+
+		issued++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "installation-%d", "expires_at": "%s"}`, issued, time.Now().Add(expiresIn).Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	source, err := newInstallationTokenSource(3, 7, keyFile.Name())
+	require.NoError(err)
+	source.baseURL = server.URL + "/"
+	tokens := oauth2.ReuseTokenSource(nil, source)
+
+	token, err := tokens.Token()
+	require.NoError(err)
+	assert.Equal("installation-1", token.AccessToken)
+	assert.Equal("token", token.Type())
+	assert.True(token.Expiry.Before(time.Now().Add(expiresIn - installationTokenMargin + time.Second)))
+
+	token, err = tokens.Token()
+	require.NoError(err)
+	assert.Equal("installation-1", token.AccessToken, "tokens are reused until they're about to expire")
+
+	// a token github is about to expire is replaced before it does
+	expiresIn = installationTokenMargin / 2
+	tokens = oauth2.ReuseTokenSource(nil, source)
+	tokens.Token() //nolint (errcheck)
+	token, err = tokens.Token()
+	require.NoError(err)
+	assert.Equal("installation-3", token.AccessToken)
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(err)
+	parsed, err := parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	require.NoError(err)
+	assert.Equal(key.N, parsed.N)
+
+	_, err = parsePrivateKey([]byte("not a key"))
+	assert.Error(err)
+}
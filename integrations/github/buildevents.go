@@ -3,11 +3,183 @@ package github
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/google/go-github/github"
 	"github.com/watchly/ngbuild/core"
 )
 
+// statusContext is what statuses are grouped by on github, each build runner gets its own so they don't
+// overwrite each other
+func statusContext(appName, runner string) string {
+	hostname, _ := os.Hostname()
+	if runner != "" {
+		return fmt.Sprintf("%s/NGBuild/github/%s/%s", hostname, appName, runner)
+	}
+	return fmt.Sprintf("%s/NGBuild/github/%s", hostname, appName)
+}
+
+// summaryRunner is the status context the summary of a commits build runners is set under, next to theirs. It's
+// all green when they are, so it can be the one required status check however many build runners there are
+const summaryRunner = "summary"
+
+// metadataBuildRunners is set on builds made for one of several build runners, it is every build runner started for
+// the commit, comma separated, so the summary knows what it's waiting on
+const metadataBuildRunners = "github:BuildRunners"
+
+// statusTarget returns the owner, repo and commit that statuses for the build config should be set on
+func statusTarget(config *core.BuildConfig) (owner, repo, commit string) {
+	switch config.GetMetadata("github:BuildType") {
+	case "pullrequest":
+		return config.GetMetadata("github:BaseOwner"), config.GetMetadata("github:BaseRepo"), config.GetMetadata("github:HeadHash")
+	case "commit":
+		return config.GetMetadata("github:BranchBuildOwner"), config.GetMetadata("github:BranchBuildRepo"), config.GetMetadata("github:BranchBuildCommit")
+	}
+	return "", "", ""
+}
+
+// setWaitingStatus is for builds that are stuck waiting on other builds to finish cloning, we don't have the
+// build here, only its config
+func (g *Github) setWaitingStatus(config *core.BuildConfig) {
+	owner, repo, commit := statusTarget(config)
+	appName := config.GetMetadata("github:App")
+	if owner == "" || repo == "" || commit == "" || appName == "" {
+		return
+	}
+
+	context := statusContext(appName, config.GetMetadata("github:BuildRunner"))
+	g.setStatus(owner, repo, commit, context, "pending", "Waiting to provision")
+}
+
+// setDraftStatus is for draft pull requests that won't be built until they're ready for review, there is no build
+// at all for these
+func (g *Github) setDraftStatus(app *githubApp, pull *github.PullRequest) {
+	g.setStatus(*pull.Base.Repo.Owner.Login, *pull.Base.Repo.Name, *pull.Head.SHA, statusContext(app.app.Name(), ""),
+		"pending", "Draft, will build once ready for review")
+}
+
+// setSkippedStatuses is for build runners that weren't selected because nothing they build changed, github
+// has no neutral state for statuses so they're marked as succeeded
+func (g *Github) setSkippedStatuses(app *githubApp, owner, repo, commit string, selected []string) {
+	isSelected := make(map[string]bool)
+	for _, runner := range selected {
+		isSelected[runner] = true
+	}
+
+	for _, runner := range allBuildRunners(app.config.BuildRunners) {
+		if isSelected[runner] == false {
+			g.setStatus(owner, repo, commit, statusContext(app.app.Name(), runner), "success",
+				"No relevant changes, nothing to build")
+		}
+	}
+
+	// there won't be any builds to summarise
+	if len(selected) == 0 {
+		g.setStatus(owner, repo, commit, statusContext(app.app.Name(), summaryRunner), "success",
+			"No relevant changes, nothing to build")
+	}
+}
+
+// updateSummaryStatus sets the summary status for the commit the build is for, see summaryState
+func (g *Github) updateSummaryStatus(app core.App, build core.Build) {
+	owner, repo, commit := statusTarget(build.Config())
+	if build.Config().GetMetadata(metadataBuildRunners) == "" || owner == "" || repo == "" || commit == "" {
+		return
+	}
+
+	state, description := summaryState(app, build)
+	g.setStatus(owner, repo, commit, statusContext(app.Name(), summaryRunner), state, description)
+}
+
+// summaryState is the state of the commit the build is for, from the latest build of each of its build runners in
+// the builds group. It's pending until they have all finished, unless one of them failed. Builds that aren't for
+// one of several build runners are the whole commit, so it's their own state
+func summaryState(app core.App, build core.Build) (state, description string) {
+	runners := build.Config().GetMetadata(metadataBuildRunners)
+	if runners == "" {
+		return buildState(build)
+	}
+	owner, repo, commit := statusTarget(build.Config())
+
+	latest := make(map[string]core.Build)
+	for _, groupBuild := range app.GetBuildHistory(build.Config().Group) {
+		groupOwner, groupRepo, groupCommit := statusTarget(groupBuild.Config())
+		if groupOwner == owner && groupRepo == repo && groupCommit == commit {
+			latest[groupBuild.Config().GetMetadata("github:BuildRunner")] = groupBuild
+		}
+	}
+
+	var failed []string
+	finished := 0
+	expected := strings.Split(runners, ",")
+	for _, runner := range expected {
+		runnerBuild, ok := latest[runner]
+		if ok == false {
+			continue
+		}
+		switch state, _ := buildState(runnerBuild); state {
+		case "pending":
+		case "success":
+			finished++
+		default:
+			finished++
+			failed = append(failed, runner)
+		}
+	}
+
+	if len(failed) > 0 {
+		return "failure", fmt.Sprintf("%d of %d builds failed: %s", len(failed), len(expected), strings.Join(failed, ", "))
+	} else if finished < len(expected) {
+		return "pending", fmt.Sprintf("%d of %d builds finished", finished, len(expected))
+	}
+	return "success", fmt.Sprintf("All %d builds passed", len(expected))
+}
+
+// mergeOnPass merges the builds pull request once everything built for its head commit has passed, if that commit
+// was approved by someone that wanted it merged on passing
+// hold the g.m lock when you call this
+func (g *Github) mergeOnPass(app *githubApp, build core.Build) {
+	config := build.Config()
+	pullID := config.GetMetadata("github:PullRequestID")
+	approval, ok := g.approvals[pullID]
+	if config.GetMetadata("github:BuildType") != "pullrequest" || ok == false || approval.mergeOnPass == false {
+		return
+	}
+	if approval.commit != config.GetMetadata("github:HeadHash") {
+		loginfof("Not merging pull request %s, %s isn't the commit that was approved", pullID, config.GetMetadata("github:HeadHash"))
+		return
+	}
+	if state, _ := summaryState(app.app, build); state != "success" {
+		return
+	}
+
+	number, err := strconv.Atoi(config.GetMetadata("github:PullNumber"))
+	if err != nil {
+		logcritf("Couldn't merge pull request %s, it has no number", pullID)
+		return
+	}
+	owner, repo := config.GetMetadata("github:BaseOwner"), config.GetMetadata("github:BaseRepo")
+	message := fmt.Sprintf("Merged by ngbuild once %s passed", build.Token())
+	if _, _, err := g.client.PullRequests.Merge(owner, repo, number, message, nil); err != nil {
+		logcritf("Couldn't merge pull request %s: %s", pullID, err)
+		return
+	}
+	loginfof("Merged pull request %s", pullID)
+	delete(g.approvals, pullID)
+}
+
+func (g *Github) setStatus(owner, repo, commit, context, state, description string) {
+	_, _, err := g.client.Repositories.CreateStatus(owner, repo, commit, &github.RepoStatus{
+		State:       &state,
+		Description: &description,
+		Context:     &context,
+	})
+	if err != nil {
+		logcritf("Couldn't set status for %s/%s:%s, %s", owner, repo, commit, err)
+	}
+}
+
 func (g *Github) updateBuildStatus(app core.App, build core.Build) {
 	// update github status
 	buildToken := build.Token()
@@ -29,15 +201,49 @@ func (g *Github) updateBuildStatus(app core.App, build core.Build) {
 		return
 	}
 
-	var state string
-	var description string
+	state, description := buildState(build)
+	webStatusURL := build.WebStatusURL()
+	context := statusContext(app.Name(), build.Config().GetMetadata("github:BuildRunner"))
+	commitStatus := &github.RepoStatus{
+		State:       &state,
+		TargetURL:   &webStatusURL,
+		Description: &description,
+		Context:     &context,
+	}
+
+	owner, repo, commit := statusTarget(build.Config())
+	_, _, err := g.client.Repositories.CreateStatus(owner, repo, commit, commitStatus)
+	if err != nil {
+		logcritf("Couldn't set status for %s/%s:%s, %s", baseOwner, baseRepo, headCommit, err)
+	}
+
+	g.updateSummaryStatus(app, build)
+}
+
+// buildState returns the github status state for the build, and a description of it
+func buildState(build core.Build) (state, description string) {
 	if build.HasStopped() {
 		if code, err := build.ExitCode(); err != nil {
 			state = "error"
 			description = fmt.Sprintf("I am error")
 		} else if code != 0 {
+			outcome := build.Outcome()
 			state = "failure"
 			description = fmt.Sprintf("Failed with exit code: %d", code)
+			prefix := outcome.String()
+			if outcome == core.OutcomeProvisionFailed || outcome == core.OutcomeInfrastructure {
+				// not the builds fault, so it hasn't failed as such
+				state = "error"
+				prefix = "Error"
+			}
+			if reason := build.Config().GetMetadata(core.MetadataFailureReason); reason != "" {
+				description = fmt.Sprintf("%s, %s", prefix, reason)
+			}
+			if unverified := build.Config().GetMetadata(metadataUnverified); unverified != "" {
+				// refusing to build is on purpose, so it's a failure rather than an error
+				state = "failure"
+				description = fmt.Sprintf("Not built, %s", unverified)
+			}
 		} else {
 			state = "success"
 			description = fmt.Sprintf("Succeeded, well done you!")
@@ -45,44 +251,43 @@ func (g *Github) updateBuildStatus(app core.App, build core.Build) {
 	} else {
 		state = "pending"
 		description = fmt.Sprintf("Build started")
+		if position, length := build.QueuePosition(); position > 0 {
+			description = fmt.Sprintf("Queued (position %d of %d)", position, length)
+		}
 	}
+	return state, description
+}
 
-	webStatusURL := build.WebStatusURL()
-	hostname, _ := os.Hostname()
-	context := fmt.Sprintf("%s/NGBuild/github/%s", hostname, app.Name())
-	commitStatus := &github.RepoStatus{
-		State:       &state,
-		TargetURL:   &webStatusURL,
-		Description: &description,
-		Context:     &context,
-	}
+func (g *Github) onBuildStarted(event core.BuildEvent) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	loginfof("build started")
+	buildToken := event.Token
+	appName := event.App
+	app := g.apps[appName]
 
-	owner := ""
-	repo := ""
-	commit := ""
-	switch buildType {
-	case "pullrequest":
-		owner = baseOwner
-		repo = baseRepo
-		commit = headCommit
-	case "commit":
-		owner = branchBuildOwner
-		repo = branchBuildRepo
-		commit = branchBuildCommit
+	if app == nil {
+		logcritf("Couldn't find app `%s`", appName)
+		return
 	}
-	_, _, err := g.client.Repositories.CreateStatus(owner, repo, commit, commitStatus)
+
+	build, err := app.app.GetBuild(buildToken)
 	if err != nil {
-		logcritf("Couldn't set status for %s/%s:%s, %s", baseOwner, baseRepo, headCommit, err)
+		logcritf("Couldn't get build `%s`: %s", buildToken, err)
+		return
 	}
 
+	g.trackBuild(build)
+	g.updateBuildStatus(app.app, build)
 }
 
-func (g *Github) onBuildStarted(data map[string]string) {
-	g.m.Lock()
-	defer g.m.Unlock()
-	loginfof("build started")
-	buildToken := data["token"]
-	appName := data["app"]
+// onBuildRunning updates the status set by onBuildStarted, which may have said the build was queued
+func (g *Github) onBuildRunning(event core.BuildEvent) {
+	g.m.RLock()
+	defer g.m.RUnlock()
+
+	buildToken := event.Token
+	appName := event.App
 	app := g.apps[appName]
 
 	if app == nil {
@@ -96,16 +301,15 @@ func (g *Github) onBuildStarted(data map[string]string) {
 		return
 	}
 
-	g.trackBuild(build)
 	g.updateBuildStatus(app.app, build)
 }
 
-func (g *Github) onBuildFinished(data map[string]string) {
+func (g *Github) onBuildFinished(event core.BuildCompleteEvent) {
 	g.m.Lock()
 	defer g.m.Unlock()
 
-	buildToken := data["token"]
-	appName := data["app"]
+	buildToken := event.Token
+	appName := event.App
 	app := g.apps[appName]
 
 	if app == nil {
@@ -119,6 +323,12 @@ func (g *Github) onBuildFinished(data map[string]string) {
 		return
 	}
 
+	// a build stopped because its pull request went back to draft hasn't failed, leave the draft status alone
+	draft := g.isDraftBuild(app, build)
 	g.untrackBuild(build)
+	if draft {
+		return
+	}
 	g.updateBuildStatus(app.app, build)
+	g.mergeOnPass(app, build)
 }
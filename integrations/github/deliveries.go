@@ -0,0 +1,150 @@
+package github
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDeliveries is how many webhook deliveries are remembered, older ones are forgotten
+const maxDeliveries = 100
+
+// maxDecisionDetail stops one chatty decision from using up lots of memory
+const maxDecisionDetail = 500
+
+const (
+	outcomeBuilt   = "built"
+	outcomeIgnored = "ignored"
+	outcomeError   = "error"
+	// outcomeHandled is for events that changed something, but didn't need anything built
+	outcomeHandled = "handled"
+)
+
+// decision is what we did with a webhook, this is what github's delivery panel can't tell you
+type decision struct {
+	Outcome string `json:"outcome"`
+	Detail  string `json:"detail,omitempty"`
+
+	malformed bool // the event itself was no good, rather than us failing to do something with it
+}
+
+func newDecision(outcome, format string, args ...interface{}) decision {
+	detail := fmt.Sprintf(format, args...)
+	if len(detail) > maxDecisionDetail {
+		detail = detail[:maxDecisionDetail-3] + "..."
+	}
+	return decision{Outcome: outcome, Detail: detail}
+}
+
+func built(format string, args ...interface{}) decision {
+	return newDecision(outcomeBuilt, format, args...)
+}
+
+func ignored(format string, args ...interface{}) decision {
+	return newDecision(outcomeIgnored, format, args...)
+}
+
+func failed(format string, args ...interface{}) decision {
+	return newDecision(outcomeError, format, args...)
+}
+
+// malformed is failed for events that couldn't be parsed or are missing what we need, sending them again won't help
+func malformed(format string, args ...interface{}) decision {
+	d := newDecision(outcomeError, format, args...)
+	d.malformed = true
+	return d
+}
+
+func handled(format string, args ...interface{}) decision {
+	return newDecision(outcomeHandled, format, args...)
+}
+
+// statusCode is what github is told about the event, it shows up in its delivery panel. Only events that were
+// accepted or ignored are 202 Accepted
+func (d decision) statusCode() int {
+	switch {
+	case d.Outcome != outcomeError:
+		return http.StatusAccepted
+	case d.malformed:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// startedBuilds is the decision for having tried to start builds, if none started something went wrong
+func startedBuilds(tokens []string) decision {
+	if len(tokens) == 0 {
+		return failed("couldn't start a build")
+	}
+	return built("started %s", strings.Join(tokens, ", "))
+}
+
+// delivery is a webhook we received
+type delivery struct {
+	ID       string    `json:"id,omitempty"`
+	Event    string    `json:"event"`
+	App      string    `json:"app"`
+	Action   string    `json:"action,omitempty"`
+	Received time.Time `json:"received"`
+	decision
+}
+
+// deliveryLog remembers the last maxDeliveries webhook deliveries
+type deliveryLog struct {
+	m          sync.RWMutex
+	deliveries []delivery
+	next       int
+}
+
+func (l *deliveryLog) add(d delivery) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(l.deliveries) < maxDeliveries {
+		l.deliveries = append(l.deliveries, d)
+		return
+	}
+	l.deliveries[l.next] = d
+	l.next = (l.next + 1) % maxDeliveries
+}
+
+// list returns the deliveries, newest first
+func (l *deliveryLog) list() []delivery {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	list := make([]delivery, 0, len(l.deliveries))
+	for i := len(l.deliveries) - 1; i >= 0; i-- {
+		list = append(list, l.deliveries[(l.next+i)%len(l.deliveries)])
+	}
+	return list
+}
+
+// handleGithubDeliveries shows the deliveries we've received and what we did with them, it needs the
+// deliveriesToken from the github config as a bearer token or token parameter, without one it is turned off
+func (g *Github) handleGithubDeliveries(resp http.ResponseWriter, req *http.Request) {
+	g.m.RLock()
+	expected := g.globalConfig.DeliveriesToken
+	g.m.RUnlock()
+
+	if expected == "" {
+		http.Error(resp, "Set deliveriesToken in the github config to see webhook deliveries", http.StatusNotFound)
+		return
+	}
+
+	token := req.URL.Query().Get("token")
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		http.Error(resp, "Missing or incorrect deliveries token", http.StatusUnauthorized)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(g.deliveries.list()) //nolint (errcheck)
+}
@@ -0,0 +1,108 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/watchly/ngbuild/core"
+	"github.com/watchly/ngbuild/mocks"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	assert := assert.New(t)
+
+	log := &deliveryLog{}
+	assert.Empty(log.list())
+
+	for i := 0; i < maxDeliveries+10; i++ {
+		log.add(delivery{ID: fmt.Sprint(i)})
+	}
+
+	list := log.list()
+	assert.Len(list, maxDeliveries)
+	assert.Equal(fmt.Sprint(maxDeliveries+9), list[0].ID, "newest first")
+	assert.Equal("10", list[len(list)-1].ID, "the oldest are forgotten")
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newRegisteredGithub()
+	server := core.NewTestHTTPServer()
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	app.On("NewBuild", "master", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+	g.apps["testapp"] = &githubApp{
+		app:    app,
+		config: githubConfig{BuildBranches: []string{"master"}},
+	}
+
+	for _, push := range [][]byte{
+		pushEventBody("refs/heads/master", "deadbeef"),
+		pushEventBody("refs/heads/feature", "cafebabe"),
+	} {
+		resp, err := postWebhook(server.URL+"/cb/github/hook/testapp", "push", push)
+		require.NoError(err)
+		resp.Body.Close() //nolint (errcheck)
+	}
+	resp, err := postWebhook(server.URL+"/cb/github/hook/notanapp", "push", pushEventBody("refs/heads/master", "deadbeef"))
+	require.NoError(err)
+	resp.Body.Close() //nolint (errcheck)
+
+	get := func(url, authorization string) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		return resp
+	}
+	url := server.URL + "/cb/github/deliveries"
+
+	// there is no way in until a token is set
+	resp = get(url, "")
+	resp.Body.Close() //nolint (errcheck)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	g.globalConfig.DeliveriesToken = "sekrit"
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		resp = get(url, authorization)
+		resp.Body.Close() //nolint (errcheck)
+		assert.Equal(http.StatusUnauthorized, resp.StatusCode, authorization)
+	}
+
+	resp = get(url+"?token=sekrit", "")
+	resp.Body.Close() //nolint (errcheck)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = get(url, "Bearer sekrit")
+	defer resp.Body.Close() //nolint (errcheck)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	var deliveries []delivery
+	require.NoError(json.NewDecoder(resp.Body).Decode(&deliveries))
+	require.Len(deliveries, 3)
+
+	assert.Equal("notanapp", deliveries[0].App)
+	assert.Equal(outcomeError, deliveries[0].Outcome)
+
+	assert.Equal("push", deliveries[1].Event)
+	assert.Equal(outcomeIgnored, deliveries[1].Outcome)
+	assert.Equal("feature isn't in buildBranches", deliveries[1].Detail)
+
+	assert.Equal("testapp", deliveries[2].App)
+	assert.Equal(outcomeBuilt, deliveries[2].Outcome)
+	assert.Equal("started buildtoken", deliveries[2].Detail)
+	assert.False(deliveries[2].Received.IsZero())
+}
@@ -1,14 +1,18 @@
 package github
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
+	"syscall"
 
 	"github.com/watchly/ngbuild/core"
 )
 
-func (g *Github) cloneAndMerge(directory string, config *core.BuildConfig) error {
+func (g *Github) cloneAndMerge(ctx context.Context, directory string, config *core.BuildConfig) error {
 
 	baseBranch := config.BaseBranch
 	if baseBranch == "" {
@@ -25,27 +29,115 @@ func (g *Github) cloneAndMerge(directory string, config *core.BuildConfig) error
 			return errors.New("Config is missing a pull request number for a pull request type build")
 		}
 
-		script += fmt.Sprintf(`git clone -q %s "%s"; `, config.BaseRepo, directory)
+		// we merge the base commit recorded when the build was created rather than the tip of the base branch,
+		// that way rebuilding the same config always builds the same code
+		mergeWith := config.BaseHash
+		if mergeWith == "" {
+			mergeWith = "origin/" + baseBranch
+		}
+
+		var strategy string
+		var err error
+		if config.MergeStrategy == core.MergeStrategyProvider {
+			strategy, err = previewMergeScript(pullNumber, config.HeadHash, mergeWith)
+		} else {
+			strategy, err = mergeScript(config.MergeStrategy, config.HeadHash, mergeWith)
+		}
+		if err != nil {
+			return err
+		}
+
+		script += fmt.Sprintf(`git clone --progress %s "%s"; `, config.BaseRepo, directory)
 		script += fmt.Sprintf(`cd %s ; `, directory)
 		script += fmt.Sprintf(`git fetch origin pull/%s/head:pull-requestMerge ; `, pullNumber)
-		script += fmt.Sprintf(`git checkout -q -f %s ; `, config.HeadHash)
-		script += fmt.Sprintf(`git merge --no-edit %s ; `, config.BaseBranch)
+		script += strategy
 
 	} else if config.GetMetadata("github:BuildType") == "commit" {
 		if config.BaseRepo == "" || config.BaseHash == "" {
 			return errors.New("Config is not filled out properly")
 		}
 
-		script += fmt.Sprintf(`git clone -q --branch %s %s "%s"; `, baseBranch, config.BaseRepo, directory)
+		script += fmt.Sprintf(`git clone --progress --branch %s %s "%s"; `, baseBranch, config.BaseRepo, directory)
 		script += fmt.Sprintf(` cd %s ; `, directory)
 		script += fmt.Sprintf(`git checkout -q -f %s ; `, config.BaseHash)
 	}
 
-	cmd := exec.Command("/bin/sh", "-c", "-e", script)
-	output, err := cmd.Output()
+	// the context is cancelled when provisioning times out, which kills the clone rather than leaving it hung.
+	// everything git says goes to the builds output as it happens, so a big clone can be watched
+	var output bytes.Buffer
+	progress := core.ProvisionOutput(ctx)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", "-e", script)
+	// the same writer for both has exec write them from one pipe, rather than two goroutines at once
+	cmd.Stdout = io.MultiWriter(&output, progress)
+	cmd.Stderr = cmd.Stdout
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		logcritf("Cloning repo was cancelled: %s\nscript: %s", ctx.Err(), script)
+		return ctx.Err()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.Sys().(syscall.WaitStatus).ExitStatus() == mergeConflictExitCode {
+		logwarnf("Couldn't %s for %s: \noutput: %s", mergeDescription(config), config.Title, output.String())
+		return fmt.Errorf("couldn't %s, they conflict", mergeDescription(config))
+	}
 	if err != nil {
-		logcritf("Error cloning repo: \nscript: %s\nstdout: %s", script, string(output))
+		logcritf("Error cloning repo: \nscript: %s\noutput: %s", script, output.String())
 		return err
 	}
 	return nil
 }
+
+// mergeConflictExitCode is what the clone script exits with when the merge strategy fails, so that a change which
+// conflicts with its base can be told apart from git or github having problems
+const mergeConflictExitCode = 66
+
+// mergeScript checks out head and combines it with base using strategy, leaving the result in the working tree
+func mergeScript(strategy, head, base string) (string, error) {
+	onConflict := fmt.Sprintf(`exit %d`, mergeConflictExitCode)
+
+	switch strategy {
+	case core.MergeStrategyMerge, "":
+		return fmt.Sprintf(`git checkout -q -f %s ; git merge -q --no-edit %s || %s ; `, head, base, onConflict), nil
+	case core.MergeStrategySquash:
+		// squashed changes are left staged rather than committed, the build only needs the files
+		return fmt.Sprintf(`git checkout -q -f %s ; git merge -q --squash %s || %s ; `, base, head, onConflict), nil
+	case core.MergeStrategyRebase:
+		return fmt.Sprintf(`git checkout -q -f %s ; git rebase -q %s || %s ; `, head, base, onConflict), nil
+	case core.MergeStrategyHeadOnly:
+		return fmt.Sprintf(`git checkout -q -f %s ; `, head), nil
+	}
+	return "", fmt.Errorf("unknown merge strategy %q, use one of %s, %s, %s, %s or %s", strategy, core.MergeStrategyMerge,
+		core.MergeStrategySquash, core.MergeStrategyRebase, core.MergeStrategyHeadOnly, core.MergeStrategyProvider)
+}
+
+// previewMergeScript checks out the merge github made for the pull request. Github only makes one when the pull
+// request doesn't conflict, and only for the latest head, otherwise we merge it ourselves
+func previewMergeScript(pullNumber, head, base string) (string, error) {
+	fallback, err := mergeScript(core.MergeStrategyMerge, head, base)
+	if err != nil {
+		return "", err
+	}
+
+	script := fmt.Sprintf(`if git fetch -q origin pull/%s/merge:pull-requestPreview && `, pullNumber)
+	script += fmt.Sprintf(`[ "$(git rev-parse pull-requestPreview^2)" = "%s" ] ; then `, head)
+	script += `git checkout -q -f pull-requestPreview ; else `
+	script += `echo "Github has no merge for this head, merging it here" ; `
+	script += fallback
+	script += `fi ; `
+	return script, nil
+}
+
+// mergeDescription says what the merge strategy of a pull request build tried to do, for when it fails
+func mergeDescription(config *core.BuildConfig) string {
+	base := config.BaseHash
+	if base == "" {
+		base = config.BaseBranch
+	}
+
+	switch config.MergeStrategy {
+	case core.MergeStrategySquash:
+		return fmt.Sprintf("squash %s onto %s", config.HeadHash, base)
+	case core.MergeStrategyRebase:
+		return fmt.Sprintf("rebase %s onto %s", config.HeadHash, base)
+	}
+	return fmt.Sprintf("merge %s into %s", base, config.HeadHash)
+}
@@ -0,0 +1,234 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/watchly/ngbuild/core"
+)
+
+// fixtureRepo is a repo to clone pull requests from, master has base.txt and pull request 42 adds head.txt
+type fixtureRepo struct {
+	t   *testing.T
+	dir string
+
+	baseHash string
+	headHash string
+}
+
+func newFixtureRepo(t *testing.T, conflicting bool) *fixtureRepo {
+	dir, err := ioutil.TempDir("", "ngbuild-fixture")
+	require.NoError(t, err)
+	r := &fixtureRepo{t: t, dir: dir}
+
+	r.git("init", "-q")
+	r.git("checkout", "-q", "-b", "master")
+	r.commit("shared.txt", "shared\n")
+	r.git("checkout", "-q", "-b", "pull")
+	r.commit("head.txt", "head\n")
+	if conflicting {
+		r.commit("shared.txt", "changed by the pull request\n")
+	}
+	r.headHash = r.git("rev-parse", "HEAD")
+	r.git("update-ref", "refs/pull/42/head", r.headHash)
+
+	r.git("checkout", "-q", "master")
+	r.commit("base.txt", "base\n")
+	if conflicting {
+		r.commit("shared.txt", "changed on master\n")
+	}
+	r.baseHash = r.git("rev-parse", "HEAD")
+	return r
+}
+
+func (r *fixtureRepo) git(args ...string) string {
+	return runGit(r.t, r.dir, args...)
+}
+
+func (r *fixtureRepo) commit(file, contents string) {
+	require.NoError(r.t, ioutil.WriteFile(filepath.Join(r.dir, file), []byte(contents), 0644))
+	r.git("add", file)
+	r.git("commit", "-q", "-m", "change "+file)
+}
+
+func (r *fixtureRepo) config(strategy string) *core.BuildConfig {
+	config := core.NewBuildConfig()
+	config.Title = "fixture"
+	config.HeadRepo = r.dir
+	config.HeadHash = r.headHash
+	config.BaseRepo = r.dir
+	config.BaseBranch = "master"
+	config.BaseHash = r.baseHash
+	config.MergeStrategy = strategy
+	config.SetMetadata("github:BuildType", "pullrequest")
+	config.SetMetadata("github:PullNumber", "42")
+	return config
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, "git %s: %s", strings.Join(args, " "), output)
+	return strings.TrimSpace(string(output))
+}
+
+// setGitIdentity lets merges and rebases commit without relying on whoever runs the tests having git set up
+func setGitIdentity() func() {
+	vars := map[string]string{
+		"GIT_AUTHOR_NAME":     "ngbuild",
+		"GIT_AUTHOR_EMAIL":    "ngbuild@example.com",
+		"GIT_COMMITTER_NAME":  "ngbuild",
+		"GIT_COMMITTER_EMAIL": "ngbuild@example.com",
+	}
+	for name, value := range vars {
+		os.Setenv(name, value) //nolint (errcheck)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name) //nolint (errcheck)
+		}
+	}
+}
+
+func cloneFixture(t *testing.T, repo *fixtureRepo, strategy string) (string, error) {
+	parent, err := ioutil.TempDir("", "ngbuild-clone")
+	require.NoError(t, err)
+	directory := filepath.Join(parent, "build")
+	return directory, newTestGithub().cloneAndMerge(context.Background(), directory, repo.config(strategy))
+}
+
+func TestCloneAndMergeStrategies(t *testing.T) {
+	defer setGitIdentity()()
+	repo := newFixtureRepo(t, false)
+	defer os.RemoveAll(repo.dir) //nolint (errcheck)
+
+	tests := []struct {
+		strategy string
+		files    []string
+		check    func(assert *assert.Assertions, directory string)
+	}{
+		{core.MergeStrategyMerge, []string{"shared.txt", "head.txt", "base.txt"}, func(assert *assert.Assertions, directory string) {
+			parents := strings.Fields(runGit(t, directory, "log", "-1", "--format=%P"))
+			assert.Equal([]string{repo.headHash, repo.baseHash}, parents)
+		}},
+		// the default is merging, like builds from before there were strategies
+		{"", []string{"shared.txt", "head.txt", "base.txt"}, func(assert *assert.Assertions, directory string) {
+			assert.Len(strings.Fields(runGit(t, directory, "log", "-1", "--format=%P")), 2)
+		}},
+		{core.MergeStrategySquash, []string{"shared.txt", "head.txt", "base.txt"}, func(assert *assert.Assertions, directory string) {
+			assert.Equal(repo.baseHash, runGit(t, directory, "rev-parse", "HEAD"))
+			assert.Equal("head.txt", runGit(t, directory, "diff", "--cached", "--name-only"))
+		}},
+		{core.MergeStrategyRebase, []string{"shared.txt", "head.txt", "base.txt"}, func(assert *assert.Assertions, directory string) {
+			assert.Equal(repo.baseHash, runGit(t, directory, "rev-parse", "HEAD^"))
+			assert.Equal("change head.txt", runGit(t, directory, "log", "-1", "--format=%s"))
+		}},
+		{core.MergeStrategyHeadOnly, []string{"shared.txt", "head.txt"}, func(assert *assert.Assertions, directory string) {
+			assert.Equal(repo.headHash, runGit(t, directory, "rev-parse", "HEAD"))
+			_, err := os.Stat(filepath.Join(directory, "base.txt"))
+			assert.True(os.IsNotExist(err), "head-only builds don't get the base")
+		}},
+	}
+
+	for _, test := range tests {
+		assert := assert.New(t)
+		directory, err := cloneFixture(t, repo, test.strategy)
+		defer os.RemoveAll(filepath.Dir(directory)) //nolint (errcheck)
+		if assert.NoError(err, test.strategy) == false {
+			continue
+		}
+
+		for _, file := range test.files {
+			_, err := os.Stat(filepath.Join(directory, file))
+			assert.NoError(err, "%s should have %s", test.strategy, file)
+		}
+		test.check(assert, directory)
+	}
+}
+
+func TestCloneAndMergeConflicts(t *testing.T) {
+	assert := assert.New(t)
+	defer setGitIdentity()()
+	repo := newFixtureRepo(t, true)
+	defer os.RemoveAll(repo.dir) //nolint (errcheck)
+
+	for _, strategy := range []string{core.MergeStrategyMerge, core.MergeStrategySquash, core.MergeStrategyRebase} {
+		directory, err := cloneFixture(t, repo, strategy)
+		defer os.RemoveAll(filepath.Dir(directory)) //nolint (errcheck)
+		if assert.Error(err, strategy) {
+			assert.Contains(err.Error(), strategy)
+			assert.Contains(err.Error(), "they conflict")
+		}
+	}
+
+	// there's nothing to conflict with when only building the head
+	directory, err := cloneFixture(t, repo, core.MergeStrategyHeadOnly)
+	defer os.RemoveAll(filepath.Dir(directory)) //nolint (errcheck)
+	assert.NoError(err)
+}
+
+func TestCloneAndMergeProgress(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	defer setGitIdentity()()
+	repo := newFixtureRepo(t, false)
+	defer os.RemoveAll(repo.dir) //nolint (errcheck)
+
+	parent, err := ioutil.TempDir("", "ngbuild-clone")
+	require.NoError(err)
+	defer os.RemoveAll(parent) //nolint (errcheck)
+
+	var progress bytes.Buffer
+	ctx := core.WithProvisionOutput(context.Background(), &progress)
+	require.NoError(newTestGithub().cloneAndMerge(ctx, filepath.Join(parent, "build"), repo.config(core.MergeStrategyMerge)))
+	assert.Contains(progress.String(), "Cloning into", "the clone is streamed to the provision output")
+}
+
+func TestMergeScriptUnknownStrategy(t *testing.T) {
+	_, err := mergeScript("octopus", "head", "base")
+	assert.Error(t, err)
+}
+
+func TestCloneAndMergeProviderMerge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	defer setGitIdentity()()
+	repo := newFixtureRepo(t, false)
+	defer os.RemoveAll(repo.dir) //nolint (errcheck)
+
+	// github merges the head into the base, the other way around to us
+	repo.git("checkout", "-q", "--detach", repo.baseHash)
+	repo.git("merge", "-q", "--no-edit", repo.headHash)
+	preview := repo.git("rev-parse", "HEAD")
+	repo.git("checkout", "-q", "master")
+	repo.git("update-ref", "refs/pull/42/merge", preview)
+
+	directory, err := cloneFixture(t, repo, core.MergeStrategyProvider)
+	defer os.RemoveAll(filepath.Dir(directory)) //nolint (errcheck)
+	require.NoError(err)
+	assert.Equal(preview, runGit(t, directory, "rev-parse", "HEAD"))
+
+	// a merge that isn't of the head we're building is out of date, so we merge it ourselves
+	repo.git("update-ref", "refs/pull/42/merge", repo.baseHash)
+	directory, err = cloneFixture(t, repo, core.MergeStrategyProvider)
+	defer os.RemoveAll(filepath.Dir(directory)) //nolint (errcheck)
+	require.NoError(err)
+	assert.Equal([]string{repo.headHash, repo.baseHash}, strings.Fields(runGit(t, directory, "log", "-1", "--format=%P")))
+
+	// as we do when github has no merge at all, like when the pull request conflicts
+	repo.git("update-ref", "-d", "refs/pull/42/merge")
+	directory, err = cloneFixture(t, repo, core.MergeStrategyProvider)
+	defer os.RemoveAll(filepath.Dir(directory)) //nolint (errcheck)
+	require.NoError(err)
+	assert.Equal([]string{repo.headHash, repo.baseHash}, strings.Fields(runGit(t, directory, "log", "-1", "--format=%P")))
+}
@@ -5,11 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"golang.org/x/oauth2"
 	githubO2 "golang.org/x/oauth2/github"
@@ -18,18 +17,39 @@ import (
 	"github.com/watchly/ngbuild/core"
 )
 
-var oauth2State = fmt.Sprintf("%d%d%d", os.Getuid(), os.Getpid(), time.Now().Unix())
-
 type pullRequestStatus struct {
-	pull         *github.PullRequest
-	currentBuild string // build token
-	mergeOnPass  bool
+	pull          *github.PullRequest
+	currentBuilds []string // build tokens, there is one build per selected build runner
+	draft         bool
+}
+
+// pullRequestApproval is kept apart from pullRequestStatus, which goes as soon as a pull request stops building,
+// so it's still around when the build finishes
+type pullRequestApproval struct {
+	commit      string // the head commit that was approved, only builds of it can be merged
+	mergeOnPass bool
+}
+
+func (status pullRequestStatus) isBuilding(token string) bool {
+	for _, current := range status.currentBuilds {
+		if current == token {
+			return true
+		}
+	}
+	return false
 }
 
 type githubConfig struct {
 	ClientID     string `mapstructure:"clientID"`
 	ClientSecret string `mapstructure:"clientSecret"`
 
+	// AuthMode is "oauth" to act as whoever authenticates ngbuild, or "app" to act as an installation of a github
+	// app, which needs AppID, InstallationID and PrivateKeyPath, the apps PEM private key
+	AuthMode       string `mapstructure:"authMode"`
+	AppID          int64  `mapstructure:"appID"`
+	InstallationID int64  `mapstructure:"installationID"`
+	PrivateKeyPath string `mapstructure:"privateKeyPath"`
+
 	Owner           string   `mapstructure:"owner"`
 	Repo            string   `mapstructure:"repo"`
 	IgnoredBranches []string `mapstructure:"ignoredBranches"`
@@ -39,11 +59,53 @@ type githubConfig struct {
 	CancelOnNewCommit    bool     `mapstructure:"cancelOnNewCommit"`
 	MergeOnPass          bool     `mapstructure:"mergeOnPass"`
 	MergeOnPassAuthWords []string `mapstructure:"mergeOnPassAuthWords"`
+
+	// Approvers are the github users whose pull request reviews count, BuildOnApproval will hold off
+	// building pull requests until one of them approves
+	Approvers       []string `mapstructure:"approvers"`
+	BuildOnApproval bool     `mapstructure:"buildOnApproval"`
+
+	// BuildDrafts can be turned off so draft pull requests aren't built until they're ready for review,
+	// it defaults to true
+	BuildDrafts bool `mapstructure:"buildDrafts"`
+
+	// BuildRunners maps path globs to build runners, ** matches any number of directories. When set, one build is
+	// made for each build runner that has a glob matching a changed file, instead of one build with buildRunner
+	// Each gets its own status, and a summary status says whether they all passed
+	BuildRunners map[string]string `mapstructure:"buildRunners"`
+
+	// DeliveriesToken turns on /cb/github/deliveries, which shows recent webhooks and what we did with them. It has
+	// to be given as a bearer token or a token parameter
+	DeliveriesToken string `mapstructure:"deliveriesToken"`
+
+	// MaxConcurrentClones limits how many builds can be cloning at once, 0 is unlimited
+	MaxConcurrentClones int `mapstructure:"maxConcurrentClones"`
+
+	// DedupeCommitsMinutes stops a commit being built again within this many minutes, whether it came from a
+	// push or a pull request. 0 turns it off. Pull request builds merge in their base, so turning this on means
+	// a commit built as a push may not be built merged
+	DedupeCommitsMinutes int `mapstructure:"dedupeCommitsMinutes"`
+
+	// RequireVerifiedCommits refuses to build commits github hasn't verified the signature of
+	RequireVerifiedCommits bool `mapstructure:"requireVerifiedCommits"`
+	// TrustedSigners are the committer emails whose signed commits are built, when verified commits are required.
+	// Empty trusts anyone github can verify
+	TrustedSigners []string `mapstructure:"trustedSigners"`
 }
 
 type githubApp struct {
-	app    core.App
-	config githubConfig
+	app      core.App
+	config   githubConfig
+	handlers []core.EventHandler
+}
+
+func (app *githubApp) isApprover(user string) bool {
+	for _, approver := range app.config.Approvers {
+		if approver == user {
+			return true
+		}
+	}
+	return false
 }
 
 // Github ...
@@ -55,22 +117,48 @@ type Github struct {
 	client                 *github.Client
 	clientID, clientSecret string
 	clientHasSet           *sync.Cond
+	needsClient            bool // guarded by clientHasSet.L, set once we start waiting for authentication
 
 	trackedPullRequests map[string]pullRequestStatus
-	trackedBuilds       []core.Build
+	approvals           map[string]pullRequestApproval // pull request id -> approval, until changes are requested or pushed
+	trackedBuilds       map[string]core.Build          // build token -> build
+	recentCommits       recentCommits
+
+	cloneSemaphore semaphore
+
+	deliveries deliveryLog
+
+	// providerOnly is set by NewProvider, see there
+	providerOnly bool
 }
 
 // New ...
 func New() *Github {
-	g := &Github{
+	g := newGithub()
+	core.HandleFunc("/auth/github", g.handleGithubAuthRedirect)
+	core.HandleFunc("/cb/auth/github", g.handleGithubAuth)
+	core.HandleFunc("/cb/github/hook/", g.handleGithubEvent)
+	core.HandleFunc("/cb/github/deliveries", g.handleGithubDeliveries)
+	return g
+}
+
+// NewProvider is a Github that only clones builds, for running builds from the command line away from the server.
+// It never needs authenticating, and attaching it to apps sets up no deploy keys, webhooks or statuses
+func NewProvider() *Github {
+	g := newGithub()
+	g.providerOnly = true
+	return g
+}
+
+func newGithub() *Github {
+	return &Github{
 		clientHasSet:        sync.NewCond(&sync.Mutex{}),
 		apps:                make(map[string]*githubApp),
 		trackedPullRequests: make(map[string]pullRequestStatus),
+		approvals:           make(map[string]pullRequestApproval),
+		trackedBuilds:       make(map[string]core.Build),
+		recentCommits:       make(recentCommits),
 	}
-
-	http.HandleFunc("/cb/auth/github", g.handleGithubAuth)
-	http.HandleFunc("/cb/github/hook/", g.handleGithubEvent)
-	return g
 }
 
 // Identifier ...
@@ -83,18 +171,69 @@ func (g *Github) IsProvider(source string) bool {
 }
 
 // ProvideFor ...
-func (g *Github) ProvideFor(config *core.BuildConfig, directory string) error {
+func (g *Github) ProvideFor(ctx context.Context, config *core.BuildConfig, directory string) error {
+	g.m.RLock()
+	clones := g.cloneSemaphore
+	g.m.RUnlock()
+
+	waited := func() {}
+	if clones.full() {
+		loginfof("Too many clones in progress, waiting to provision %s", config.Title)
+		g.setWaitingStatus(config)
+		waited = core.WaitingToProvision(ctx)
+	}
+	err := clones.acquire(ctx)
+	waited()
+	if err != nil {
+		return err
+	}
+	defer clones.release()
+
+	// not being able to ask github is an error provisioning, only commits that really aren't verified are refused
+	unverified, err := g.verifyBuildCommit(config)
+	if err != nil {
+		return err
+	}
+	if unverified != "" {
+		config.SetMetadata(metadataUnverified, unverified)
+		return errors.New(unverified)
+	}
+
 	// FIXME, need to git checkout the given config
-	return g.cloneAndMerge(directory, config)
+	return g.cloneAndMerge(ctx, directory, config)
+}
+
+// alreadyAuthenticated is what anyone trying to authenticate us when we already are is told, anybody can get to
+// /auth/github so it must never replace the token we have
+const alreadyAuthenticated = "Already authenticated with github"
+
+// hasToken is true if we don't need authenticating, /auth/github is only for getting us a token when we have none
+func (g *Github) hasToken() bool {
+	return g.globalConfig.AuthMode == authModeApp || loadToken() != nil
+}
+
+// handleGithubAuthRedirect sends people off to github to authenticate, with a state that is only good for this once
+// and only from the browser it was given to
+func (g *Github) handleGithubAuthRedirect(resp http.ResponseWriter, req *http.Request) {
+	if g.hasToken() {
+		http.Error(resp, alreadyAuthenticated, http.StatusForbidden)
+		return
+	}
+
+	url := g.getOauthConfig().AuthCodeURL(core.StartOAuth(resp, "github"), oauth2.AccessTypeOffline)
+	http.Redirect(resp, req, url, http.StatusFound)
 }
 
 func (g *Github) handleGithubAuth(resp http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
-	state := q.Get("state")
-	if state != oauth2State {
+	if core.CheckOAuthCallback(resp, req, "github") == false {
 		resp.Write([]byte("OAuth2 state was incorrect, something bad happened between Github and us"))
 		return
 	}
+	if g.hasToken() {
+		http.Error(resp, alreadyAuthenticated, http.StatusForbidden)
+		return
+	}
 
 	code := q.Get("code")
 	cfg := g.getOauthConfig()
@@ -105,7 +244,7 @@ func (g *Github) handleGithubAuth(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	core.StoreCache("github:token", token.AccessToken)
+	storeToken(token)
 	g.setClient(token)
 
 	resp.Write([]byte("Thanks! you can close this tab now."))
@@ -121,36 +260,59 @@ func (g *Github) getOauthConfig() *oauth2.Config {
 }
 
 func (g *Github) setClient(token *oauth2.Token) {
-	ts := g.getOauthConfig().TokenSource(oauth2.NoContext, token)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	// the token can see every repo we can, make sure it never shows up in build output
+	core.RegisterSecret(token.AccessToken)
 
-	g.client = github.NewClient(tc)
+	tokens := newSavingTokenSource(g.getOauthConfig(), token, storeToken, g.reauthenticate)
+	g.setClientWith(newTokenClient(tokens))
+}
+
+// setClientWith makes the github client use httpClient, which has to take care of authenticating
+func (g *Github) setClientWith(httpClient *http.Client) {
+	g.client = github.NewClient(httpClient)
 	g.clientHasSet.Broadcast()
 }
 
 func (g *Github) acquireOauthToken() {
-	token := core.GetCache("github:token")
-
-	if token != "" {
-		oauth2Token := oauth2.Token{AccessToken: token}
-		g.setClient(&oauth2Token)
+	if token := loadToken(); token != nil {
+		g.setClient(token)
 		return
 	}
 
+	g.printAuthHelp()
+}
+
+// reauthenticate is for when our token has expired or been revoked and couldn't be refreshed
+func (g *Github) reauthenticate(err error) {
+	logcritf("Couldn't refresh the github token, ngbuild needs to be authenticated again: %s", err)
+	core.StoreCache(tokenCacheKey, "")
+	g.printAuthHelp()
+}
+
+func (g *Github) printAuthHelp() {
 	fmt.Println("")
 	fmt.Println("This app must be authenticated with github, please visit the following URL to authenticate this app")
-	fmt.Println(g.getOauthConfig().AuthCodeURL(oauth2State, oauth2.AccessTypeOffline))
+	fmt.Println(core.GetHTTPServerURL() + "/auth/github")
 	fmt.Println("")
 }
 
 func (g *Github) init(app core.App) {
 	if g.client == nil {
 		app.Config("github", &g.globalConfig)
-		if g.globalConfig.ClientID == "" || g.globalConfig.ClientSecret == "" {
+		core.RegisterSecret(g.globalConfig.ClientSecret)
+		if g.cloneSemaphore == nil {
+			g.cloneSemaphore = newSemaphore(g.globalConfig.MaxConcurrentClones)
+		}
+		if g.globalConfig.AuthMode == authModeApp {
+			g.initAppClient()
+		} else if g.globalConfig.AuthMode != "" && g.globalConfig.AuthMode != authModeOAuth {
+			logcritf("Unknown github authMode %s, it should be %s or %s", g.globalConfig.AuthMode, authModeOAuth, authModeApp)
+		} else if g.globalConfig.ClientID == "" || g.globalConfig.ClientSecret == "" {
 			fmt.Println("Invalid github configuration, missing ClientID/ClientSecret")
 		} else {
 
 			g.clientHasSet.L.Lock()
+			g.needsClient = true
 			g.acquireOauthToken()
 			for g.client == nil {
 				fmt.Println("Waiting for github authentication response...")
@@ -182,10 +344,17 @@ func (g *Github) init(app core.App) {
 func (g *Github) AttachToApp(app core.App) error {
 	g.m.Lock()
 	defer g.m.Unlock()
+	if g.providerOnly {
+		return nil
+	}
 	g.init(app)
+	if g.client == nil {
+		return errors.New("github isn't authenticated, check the github config")
+	}
 
 	appConfig := &githubApp{
-		app: app,
+		app:    app,
+		config: githubConfig{BuildDrafts: true},
 	}
 	app.Config("github", &appConfig.config)
 	g.apps[app.Name()] = appConfig
@@ -193,8 +362,28 @@ func (g *Github) AttachToApp(app core.App) error {
 	g.setupDeployKey(appConfig)
 	g.setupHooks(appConfig)
 
-	app.Listen(core.SignalBuildProvisioning, g.onBuildStarted)
-	app.Listen(core.SignalBuildComplete, g.onBuildFinished)
+	appConfig.handlers = append(appConfig.handlers,
+		core.OnBuildProvisioning(app, g.onBuildStarted),
+		core.OnBuildStarted(app, g.onBuildRunning),
+		core.OnBuildComplete(app, g.onBuildFinished),
+	)
+	return nil
+}
+
+// DetachFromApp ...
+func (g *Github) DetachFromApp(app core.App) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	appConfig, ok := g.apps[app.Name()]
+	if ok == false {
+		return nil
+	}
+
+	for _, handler := range appConfig.handlers {
+		app.RemoveEventHandler(handler)
+	}
+	delete(g.apps, app.Name())
 	return nil
 }
 
@@ -238,6 +427,7 @@ func (g *Github) setupHooks(appConfig *githubApp) {
 			"content_type": "json",
 		},
 		Events: []string{"pull_request",
+			"commit_comment",
 			"delete",
 			"issue_comment",
 			"pull_request_review",
@@ -253,42 +443,65 @@ func (g *Github) setupHooks(appConfig *githubApp) {
 
 }
 
+// Ready ...
+func (g *Github) Ready() error {
+	g.clientHasSet.L.Lock()
+	defer g.clientHasSet.L.Unlock()
+
+	if g.needsClient && g.client == nil {
+		return errors.New("Waiting for github authentication")
+	}
+	return nil
+}
+
 // Shutdown ...
 func (g *Github) Shutdown() {}
 
 // hold the g.m lock when you call this
 func (g *Github) trackBuild(build core.Build) {
-	for _, trackedBuild := range g.trackedBuilds {
-		if trackedBuild.Token() == build.Token() {
-			return
-		}
+	if _, ok := g.trackedBuilds[build.Token()]; ok {
+		return
 	}
 	build.Ref()
-	g.trackedBuilds = append(g.trackedBuilds, build)
+	g.trackedBuilds[build.Token()] = build
 }
 
 // hold the g.m.lock when you call this
 func (g *Github) untrackBuild(build core.Build) {
-	buildIndex := -1
-	for i, trackedBuild := range g.trackedBuilds {
-		if trackedBuild.Token() == build.Token() {
-			buildIndex = i
-			break
-		}
-	}
-
-	if buildIndex < 0 {
+	trackedBuild, ok := g.trackedBuilds[build.Token()]
+	if ok == false {
 		return
 	}
 
-	g.trackedBuilds[buildIndex].Unref()
-	g.trackedBuilds = append(g.trackedBuilds[:buildIndex], g.trackedBuilds[buildIndex+1:]...)
+	trackedBuild.Unref()
+	delete(g.trackedBuilds, build.Token())
+
+	// once every build for a pull request is done, it is no longer building anything
+	for pullID, status := range g.trackedPullRequests {
+		if status.isBuilding(build.Token()) == false {
+			continue
+		}
+
+		remaining := status.currentBuilds[:0:0]
+		for _, token := range status.currentBuilds {
+			if token != build.Token() {
+				remaining = append(remaining, token)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(g.trackedPullRequests, pullID)
+		} else {
+			status.currentBuilds = remaining
+			g.trackedPullRequests[pullID] = status
+		}
+	}
 }
 
-func (g *Github) trackPullRequest(app *githubApp, event *github.PullRequestEvent) {
+func (g *Github) trackPullRequest(app *githubApp, event *github.PullRequestEvent, draft bool) decision {
 	if event.PullRequest == nil {
 		logcritf("pull request is nil")
-		return
+		return malformed("pull request is missing")
 	}
 	pull := event.PullRequest
 	pullID := strconv.Itoa(*pull.ID)
@@ -302,51 +515,191 @@ func (g *Github) trackPullRequest(app *githubApp, event *github.PullRequestEvent
 	isCollaborator, _, err := g.client.Repositories.IsCollaborator(owner, repo, user)
 	if err != nil {
 		logcritf("Couldn't check collaborator status on %s: %s", pullID, err)
-		return
+		return failed("couldn't check collaborator status for %s: %s", user, err)
 	} else if isCollaborator == false {
 		logwarnf("Ignoring pull request %s, non collaborator: %s", pullID, user)
-		return
+		return ignored("%s isn't a collaborator", user)
 	}
 
-	g.m.Lock()
-	defer g.m.Unlock()
-
 	// check for ignored branches
 	for _, branchIgnore := range app.config.IgnoredBranches {
 		if branchIgnore == *pull.Base.Ref {
 			logwarnf("Ignoring pull request %s, is an ignored branch", pullID)
-			return
+			return ignored("%s is an ignored branch", branchIgnore)
 		}
 	}
 
+	g.m.Lock()
 	g.trackedPullRequests[pullID] = pullRequestStatus{
-		pull: pull,
+		pull:  pull,
+		draft: draft,
+	}
+	g.m.Unlock()
+
+	return g.buildPullRequest(app, pull)
+}
+
+// maxDescriptionLength is how much of a pull request body makes it into the github:Description metadata
+const maxDescriptionLength = 200
+
+var (
+	rePullRequestComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	rePullRequestHeading = regexp.MustCompile(`(?m)^\s*#{1,6}\s.*$`)
+)
+
+// pullRequestDescription is a short, single line version of a pull request body. Anything left in the body
+// from a pull request template, comments and section headings, is removed first so we get what was written
+func pullRequestDescription(body string) string {
+	body = rePullRequestComment.ReplaceAllString(body, "")
+	body = rePullRequestHeading.ReplaceAllString(body, "")
+
+	description := []rune(strings.Join(strings.Fields(body), " "))
+	if len(description) > maxDescriptionLength {
+		return strings.TrimSpace(string(description[:maxDescriptionLength-3])) + "..."
 	}
-	g.buildPullRequest(app, pull)
+	return string(description)
 }
 
-func (g *Github) buildPullRequest(app *githubApp, pull *github.PullRequest) {
+// buildPullRequest starts the builds for the head of the pull request, don't hold the g.m lock when you call this,
+// github is asked what changed and statuses are set without it
+func (g *Github) buildPullRequest(app *githubApp, pull *github.PullRequest) decision {
 	// for reference, head is the proposed branch, base is the branch to merge into
 	pullID := strconv.Itoa(*pull.ID)
 	loginfof("Building pull request: %s", pullID)
+
+	g.m.Lock()
 	status, ok := g.trackedPullRequests[pullID]
 	if ok == false {
-		status = pullRequestStatus{pull, "", false}
+		status = pullRequestStatus{pull: pull}
 		g.trackedPullRequests[pullID] = status
 	}
 
+	// only the commit that was approved is built, anything pushed after it needs approving again
+	approval, approved := g.approvals[pullID]
+	if app.config.BuildOnApproval && (approved == false || approval.commit != *pull.Head.SHA) {
+		g.m.Unlock()
+		loginfof("Not building pull request %s until it has been approved", pullID)
+		return ignored("waiting for approval")
+	}
+
+	if status.draft && app.config.BuildDrafts == false {
+		g.m.Unlock()
+		loginfof("Not building pull request %s until it is ready for review", pullID)
+		g.setDraftStatus(app, pull)
+		return ignored("waiting for the draft to be ready for review")
+	}
+
 	// we want to check to see if we are already building or already built this commit
-	// and we want to cancel the previous build
-	if build, _ := app.app.GetBuild(status.currentBuild); build != nil {
-		if build.Config().GetMetadata("github:HeadHash") == *pull.Head.SHA {
-			logwarnf("Already building/built this commit")
-			return
+	// and we want to cancel the previous builds
+	var previous []core.Build
+	for _, token := range status.currentBuilds {
+		if build, _ := app.app.GetBuild(token); build != nil {
+			if build.Config().GetMetadata("github:HeadHash") == *pull.Head.SHA {
+				g.m.Unlock()
+				logwarnf("Already building/built this commit")
+				return ignored("already building %s", *pull.Head.SHA)
+			}
+			previous = append(previous, build)
 		}
-
-		if app.config.CancelOnNewCommit {
+	}
+	if app.config.CancelOnNewCommit {
+		for _, build := range previous {
 			build.Stop()
 		}
 	}
+	status.currentBuilds = nil
+	g.trackedPullRequests[pullID] = status
+	g.m.Unlock()
+
+	owner, repo := *pull.Base.Repo.Owner.Login, *pull.Base.Repo.Name
+	runners := []string{""}
+	if len(app.config.BuildRunners) > 0 {
+		runners = g.pullRequestBuildRunners(app, pull)
+		g.setSkippedStatuses(app, owner, repo, *pull.Head.SHA, runners)
+		if len(runners) == 0 {
+			loginfof("Not building pull request %s, nothing changed matches buildRunners", pullID)
+			return ignored("nothing changed matches buildRunners")
+		}
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	// the pull request could have been closed while github told us what changed
+	status, ok = g.trackedPullRequests[pullID]
+	if ok == false {
+		loginfof("Not building pull request %s, it is no longer tracked", pullID)
+		return ignored("pull request isn't tracked")
+	}
+
+	var deduped []string
+	for _, runner := range runners {
+		if token, ok := g.recentlyBuilt(app, owner, repo, *pull.Head.SHA, runner); ok {
+			loginfof("Not building pull request %s, %s was already built by %s", pullID, *pull.Head.SHA, token)
+			deduped = append(deduped, token)
+			continue
+		}
+
+		buildConfig := pullRequestBuildConfig(app, pull)
+		if runner != "" {
+			buildConfig.BuildRunner = runner
+			buildConfig.SetMetadata("github:BuildRunner", runner)
+			buildConfig.SetMetadata(metadataBuildRunners, strings.Join(runners, ","))
+		}
+
+		buildToken, err := app.app.NewBuild(buildConfig.Group, buildConfig)
+		if err != nil {
+			logcritf("Couldn't start build for %d", *pull.ID)
+			continue
+		}
+
+		build, err := app.app.GetBuild(buildToken)
+		if err != nil || build == nil {
+			logcritf("Couldn't get build for %d", *pull.ID)
+			continue
+		}
+
+		status.currentBuilds = append(status.currentBuilds, buildToken)
+		g.trackedPullRequests[pullID] = status
+		g.addRecentlyBuilt(app, owner, repo, *pull.Head.SHA, runner, buildToken)
+		loginfof("started build: %s", buildToken)
+	}
+
+	if len(status.currentBuilds) == 0 && len(deduped) > 0 {
+		return ignored("%s was already built by %s", *pull.Head.SHA, strings.Join(deduped, ", "))
+	}
+	return startedBuilds(status.currentBuilds)
+}
+
+// pullRequestBuildRunners returns the build runners that need to run for the files changed in the pull request,
+// if we can't find out what changed they all do
+func (g *Github) pullRequestBuildRunners(app *githubApp, pull *github.PullRequest) []string {
+	var files []string
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := g.client.PullRequests.ListFiles(*pull.Base.Repo.Owner.Login, *pull.Base.Repo.Name, *pull.Number, opt)
+		if err != nil {
+			logwarnf("Couldn't list files changed in pull request %d, running every build runner: %s", *pull.ID, err)
+			return allBuildRunners(app.config.BuildRunners)
+		}
+
+		for _, file := range page {
+			if file.Filename != nil {
+				files = append(files, *file.Filename)
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return selectBuildRunners(app.config.BuildRunners, files)
+}
+
+func pullRequestBuildConfig(app *githubApp, pull *github.PullRequest) *core.BuildConfig {
+	pullID := strconv.Itoa(*pull.ID)
 
 	headBranch := *pull.Head.Ref
 	headCloneURL := *pull.Head.Repo.SSHURL
@@ -369,10 +722,11 @@ func (g *Github) buildPullRequest(app *githubApp, pull *github.PullRequest) {
 
 	buildConfig.BaseRepo = baseCloneURL
 	buildConfig.BaseBranch = baseBranch
-	buildConfig.BaseHash = ""
+	buildConfig.BaseHash = baseCommit
 
 	buildConfig.Group = pullID
 
+	buildConfig.SetMetadata("github:App", app.app.Name())
 	buildConfig.SetMetadata("github:BuildType", "pullrequest")
 	buildConfig.SetMetadata("github:PullRequestID", pullID)
 	buildConfig.SetMetadata("github:PullNumber", fmt.Sprintf("%d", *pull.Number))
@@ -382,73 +736,112 @@ func (g *Github) buildPullRequest(app *githubApp, pull *github.PullRequest) {
 	buildConfig.SetMetadata("github:BaseHash", baseCommit)
 	buildConfig.SetMetadata("github:BaseOwner", baseOwner)
 	buildConfig.SetMetadata("github:BaseRepo", baseRepo)
-
-	buildToken, err := app.app.NewBuild(buildConfig.Group, buildConfig)
-	if err != nil {
-		logcritf("Couldn't start build for %d", *pull.ID)
-		return
+	if pull.User != nil && pull.User.Login != nil {
+		buildConfig.SetMetadata("github:Author", *pull.User.Login)
 	}
-
-	build, err := app.app.GetBuild(buildToken)
-	if err != nil || build == nil {
-		logcritf("Couldn't get build for %d", *pull.ID)
-		return
+	if pull.Body != nil {
+		buildConfig.SetMetadata("github:Description", pullRequestDescription(*pull.Body))
 	}
 
-	status.currentBuild = buildToken
-	g.trackedPullRequests[pullID] = status
-	loginfof("started build: %s", buildToken)
+	return buildConfig
 }
 
-func (g *Github) updatePullRequest(app *githubApp, event *github.PullRequestEvent) {
+func (g *Github) updatePullRequest(app *githubApp, event *github.PullRequestEvent, draft bool) decision {
 	// this is called when there is a new commit on the pull request or something like that
 	pullID := strconv.Itoa(*event.PullRequest.ID)
 
-	g.m.RLock()
-	_, ok := g.trackedPullRequests[pullID]
-	g.m.RUnlock()
-
+	g.m.Lock()
+	status, ok := g.trackedPullRequests[pullID]
 	if ok == false {
+		g.m.Unlock()
 		logwarnf("event on unknown/ignored pull request: %s", pullID)
-		g.trackPullRequest(app, event)
-		return
+		return g.trackPullRequest(app, event, draft)
 	}
+	status.draft = draft
+	g.trackedPullRequests[pullID] = status
+	g.m.Unlock()
 
-	g.buildPullRequest(app, event.PullRequest)
+	return g.buildPullRequest(app, event.PullRequest)
 }
 
-func (g *Github) closedPullRequest(app *githubApp, event *github.PullRequestEvent) {
-	g.m.RLock()
-	defer g.m.RUnlock()
+// draftPullRequest is for pull requests that have gone back to being drafts, if drafts aren't built whatever was
+// building is stopped
+func (g *Github) draftPullRequest(app *githubApp, event *github.PullRequestEvent) decision {
+	g.m.Lock()
+	pullID := strconv.Itoa(*event.PullRequest.ID)
+	status, ok := g.trackedPullRequests[pullID]
+	if ok == false {
+		g.m.Unlock()
+		return ignored("pull request isn't tracked")
+	}
+	status.draft = true
+	g.trackedPullRequests[pullID] = status
+	g.m.Unlock()
+
+	if app.config.BuildDrafts {
+		return handled("marked as a draft, drafts are still built")
+	}
+
+	for _, token := range status.currentBuilds {
+		if build, _ := app.app.GetBuild(token); build != nil && build.HasStopped() == false {
+			loginfof("Stopping build %s, pull request %s is a draft again", build.Token(), pullID)
+			build.Stop() //nolint (errcheck)
+		}
+	}
+	g.setDraftStatus(app, event.PullRequest)
+	return handled("stopped building the draft")
+}
+
+// isDraftBuild is true if the build was for a pull request that has since gone back to being a draft, and drafts
+// aren't built
+// hold the g.m lock when you call this
+func (g *Github) isDraftBuild(app *githubApp, build core.Build) bool {
+	if app.config.BuildDrafts {
+		return false
+	}
+
+	for _, status := range g.trackedPullRequests {
+		if status.draft && status.isBuilding(build.Token()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Github) closedPullRequest(app *githubApp, event *github.PullRequestEvent) decision {
+	g.m.Lock()
+	defer g.m.Unlock()
 
 	pullID := strconv.Itoa(*event.PullRequest.ID)
+	delete(g.approvals, pullID)
 	status, ok := g.trackedPullRequests[pullID]
 	if ok == false {
-		return
+		return ignored("pull request isn't tracked")
 	}
 
-	if build, _ := app.app.GetBuild(status.currentBuild); build != nil {
-		if app.config.CancelOnNewCommit {
+	for _, token := range status.currentBuilds {
+		if build, _ := app.app.GetBuild(token); build != nil && app.config.CancelOnNewCommit {
 			build.Stop()
 		}
 	}
 	delete(g.trackedPullRequests, pullID)
+	return handled("stopped tracking the pull request")
 }
 
 func loginfof(str string, args ...interface{}) (ret string) {
 	ret = fmt.Sprintf("github-info: "+str+"\n", args...)
-	fmt.Printf(ret)
+	fmt.Print(ret)
 	return ret
 }
 
 func logwarnf(str string, args ...interface{}) (ret string) {
 	ret = fmt.Sprintf("github-warn: "+str+"\n", args...)
-	fmt.Printf(ret)
+	fmt.Print(ret)
 	return ret
 }
 
 func logcritf(str string, args ...interface{}) (ret string) {
 	ret = fmt.Sprintf("github-crit: "+str+"\n", args...)
-	fmt.Printf(ret)
+	fmt.Print(ret)
 	return ret
 }
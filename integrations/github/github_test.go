@@ -0,0 +1,1037 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/google/go-github/github"
+
+	"github.com/watchly/ngbuild/core"
+	"github.com/watchly/ngbuild/mocks"
+)
+
+// newTestGithub returns a Github without registering any http handlers
+func newTestGithub() *Github {
+	return &Github{
+		clientHasSet:        sync.NewCond(&sync.Mutex{}),
+		apps:                make(map[string]*githubApp),
+		trackedPullRequests: make(map[string]pullRequestStatus),
+		approvals:           make(map[string]pullRequestApproval),
+		trackedBuilds:       make(map[string]core.Build),
+		recentCommits:       make(recentCommits),
+	}
+}
+
+type githubAPI struct {
+	lastMethod string
+	lastPath   string
+	lastStatus github.RepoStatus
+	lastBody   []byte
+
+	requests  []string          // "METHOD /path" of every request made
+	notFound  map[string]bool   // paths that 404
+	responses map[string]string // bodies to respond to paths with, instead of {}
+}
+
+func (api *githubAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.lastMethod = r.Method
+	api.lastPath = r.URL.Path
+	api.requests = append(api.requests, r.Method+" "+r.URL.Path)
+	body, _ := ioutil.ReadAll(r.Body)
+	api.lastBody = body
+	json.Unmarshal(body, &api.lastStatus) //nolint (errcheck)
+
+	if api.notFound[r.URL.Path] {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Not Found"}`))
+		return
+	}
+	if response, ok := api.responses[r.URL.Path]; ok {
+		w.Write([]byte(response))
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+// newTestClient will point the given github at a fake api server
+func newTestClient(g *Github, api http.Handler) *httptest.Server {
+	server := httptest.NewServer(api)
+	g.client = github.NewClient(nil)
+	g.client.BaseURL, _ = url.Parse(server.URL + "/")
+	return server
+}
+
+func pullRequestFixture() *github.PullRequest {
+	pull := &github.PullRequest{}
+	json.Unmarshal([]byte(`{
+		"id": 87654321,
+		"number": 42,
+		"title": "Make everything better",
+		"html_url": "https://github.com/watchly/ngbuild/pull/42",
+		"user": { "login": "gopher" },
+		"body": "<!-- describe your change -->\n## Description\nMakes   everything\nbetter.\n",
+		"head": {
+			"ref": "feature",
+			"sha": "headsha",
+			"repo": {
+				"name": "ngbuild-fork",
+				"ssh_url": "git@github.com:gopher/ngbuild-fork.git",
+				"owner": { "login": "gopher" }
+			}
+		},
+		"base": {
+			"ref": "master",
+			"sha": "basesha",
+			"repo": {
+				"name": "ngbuild",
+				"ssh_url": "git@github.com:watchly/ngbuild.git",
+				"owner": { "login": "watchly" }
+			}
+		}
+	}`), pull) //nolint (errcheck)
+	return pull
+}
+
+var (
+	registeredGithubOnce sync.Once
+	registeredGithub     *Github
+)
+
+// newRegisteredGithub returns the Github whose handlers are registered on core.Mux(), with its state reset
+func newRegisteredGithub() *Github {
+	registeredGithubOnce.Do(func() {
+		registeredGithub = New()
+	})
+
+	registeredGithub.apps = make(map[string]*githubApp)
+	registeredGithub.trackedPullRequests = make(map[string]pullRequestStatus)
+	registeredGithub.approvals = make(map[string]pullRequestApproval)
+	registeredGithub.trackedBuilds = make(map[string]core.Build)
+	registeredGithub.recentCommits = make(recentCommits)
+	registeredGithub.deliveries = deliveryLog{}
+	registeredGithub.globalConfig = githubConfig{}
+	return registeredGithub
+}
+
+func pushEventBody(ref, commit string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"ref": "%s",
+		"compare": "https://github.com/watchly/ngbuild/compare/abc...def",
+		"head_commit": { "id": "%s" },
+		"repository": {
+			"name": "ngbuild",
+			"ssh_url": "git@github.com:watchly/ngbuild.git",
+			"owner": { "name": "watchly" }
+		}
+	}`, ref, commit))
+}
+
+func TestHandleGithubPushBuildBranches(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{
+		app:    app,
+		config: githubConfig{BuildBranches: []string{"master"}},
+	}
+
+	var buildConfig *core.BuildConfig
+	newBuildCall := app.On("NewBuild", "master", mock.AnythingOfType("*core.BuildConfig"))
+	newBuildCall.Return("buildtoken", nil)
+	newBuildCall.Run(func(args mock.Arguments) {
+		buildConfig = args.Get(1).(*core.BuildConfig)
+	})
+
+	// branches that aren't in buildBranches are ignored
+	g.handleGithubPush(ghApp, pushEventBody("refs/heads/feature", "deadbeef"))
+	assert.Nil(buildConfig)
+
+	g.handleGithubPush(ghApp, pushEventBody("refs/heads/master", "deadbeef"))
+	app.AssertExpectations(t)
+	assert.NotNil(buildConfig)
+	assert.Equal("master", buildConfig.Group)
+	assert.Equal("deadbeef", buildConfig.BaseHash)
+	assert.Equal("commit", buildConfig.GetMetadata("github:BuildType"))
+	assert.Equal("master", buildConfig.GetMetadata("github:BranchBuild"))
+	assert.Equal("ngbuild", buildConfig.GetMetadata("github:BranchBuildRepo"))
+	assert.Equal("watchly", buildConfig.GetMetadata("github:BranchBuildOwner"))
+	assert.Equal("deadbeef", buildConfig.GetMetadata("github:BranchBuildCommit"))
+
+	// once the build is tracked, the same commit shouldn't be built again
+	build := &mocks.Build{}
+	build.On("Token").Return("buildtoken")
+	build.On("Config").Return(buildConfig)
+	build.On("Ref").Return()
+	g.trackBuild(build)
+	assert.Len(g.trackedBuilds, 1)
+
+	buildConfig = nil
+	g.handleGithubPush(ghApp, pushEventBody("refs/heads/master", "deadbeef"))
+	assert.Nil(buildConfig)
+
+	// but a new commit on the same branch should
+	g.handleGithubPush(ghApp, pushEventBody("refs/heads/master", "cafebabe"))
+	assert.NotNil(buildConfig)
+	assert.Equal("cafebabe", buildConfig.GetMetadata("github:BranchBuildCommit"))
+}
+
+func TestWebhookPush(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newRegisteredGithub()
+	server := core.NewTestHTTPServer()
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	app.On("NewBuild", "master", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+	g.apps["testapp"] = &githubApp{
+		app:    app,
+		config: githubConfig{BuildBranches: []string{"master"}},
+	}
+
+	resp, err := postWebhook(server.URL+"/cb/github/hook/testapp", "push", pushEventBody("refs/heads/master", "deadbeef"))
+	require.NoError(err)
+	resp.Body.Close() //nolint (errcheck)
+
+	app.AssertExpectations(t)
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+}
+
+func postWebhook(url, eventType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-GitHub-Event", eventType)
+
+	return http.DefaultClient.Do(req)
+}
+
+func TestWebhookAppName(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newRegisteredGithub()
+	server := core.NewTestHTTPServer()
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	app.On("NewBuild", "master", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+	g.apps["testapp"] = &githubApp{
+		app:    app,
+		config: githubConfig{BuildBranches: []string{"master"}},
+	}
+
+	for path, expectedStatus := range map[string]int{
+		"/cb/github/hook/testapp":  http.StatusAccepted,
+		"/cb/github/hook/testapp/": http.StatusAccepted,
+		"/cb/github/hook/":         http.StatusBadRequest,
+		"/cb/github/hook/notanapp": http.StatusBadRequest,
+	} {
+		resp, err := postWebhook(server.URL+path, "push", pushEventBody("refs/heads/master", "deadbeef"))
+		require.NoError(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close() //nolint (errcheck)
+
+		assert.Equal(expectedStatus, resp.StatusCode, path)
+		if expectedStatus == http.StatusBadRequest {
+			assert.NotEmpty(body, path)
+		}
+	}
+	app.AssertNumberOfCalls(t, "NewBuild", 2)
+}
+
+func TestWebhookStatusCodes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newRegisteredGithub()
+	server := core.NewTestHTTPServer()
+	defer server.Close()
+
+	g.apps["testapp"] = &githubApp{app: &mocks.App{}}
+	url := server.URL + "/cb/github/hook/testapp"
+
+	for _, test := range []struct {
+		eventType      string
+		body           string
+		expectedStatus int
+	}{
+		{"ping", `{"zen": "Keep it logically awesome."}`, http.StatusAccepted},
+		{"", `{}`, http.StatusBadRequest},
+		{"push", `{"ref": `, http.StatusBadRequest},
+		{"push", `{"ref": 5}`, http.StatusBadRequest},
+		{"push", `{}`, http.StatusBadRequest},
+		{"pull_request", `{"action": "opened"}`, http.StatusBadRequest},
+		{"pull_request_review", `{"action": "submitted"}`, http.StatusBadRequest},
+		{"commit_comment", `{"action": "created"}`, http.StatusBadRequest},
+		{"gollum", `{}`, http.StatusNotImplemented},
+	} {
+		resp, err := postWebhook(url, test.eventType, []byte(test.body))
+		require.NoError(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close() //nolint (errcheck)
+
+		assert.Equal(test.expectedStatus, resp.StatusCode, test.eventType)
+		assert.NotEmpty(body, test.eventType)
+	}
+}
+
+func TestDecisionStatusCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(http.StatusAccepted, built("started buildtoken").statusCode())
+	assert.Equal(http.StatusAccepted, handled("approved").statusCode())
+	assert.Equal(http.StatusAccepted, ignored("nothing to do").statusCode())
+	assert.Equal(http.StatusBadRequest, malformed("couldn't parse event").statusCode())
+	assert.Equal(http.StatusInternalServerError, failed("couldn't start a build").statusCode())
+}
+
+func TestTrackUntrackBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+
+	build := &mocks.Build{}
+	build.On("Token").Return("buildtoken")
+	build.On("Ref").Return()
+	build.On("Unref").Return()
+
+	g.trackedPullRequests["1234"] = pullRequestStatus{currentBuilds: []string{"buildtoken"}}
+
+	g.trackBuild(build)
+	g.trackBuild(build)
+	assert.Len(g.trackedBuilds, 1)
+	build.AssertNumberOfCalls(t, "Ref", 1)
+
+	g.untrackBuild(build)
+	assert.Empty(g.trackedBuilds)
+	assert.Empty(g.trackedPullRequests)
+	build.AssertNumberOfCalls(t, "Unref", 1)
+
+	// pull requests building something else are left alone
+	g.trackedPullRequests["5678"] = pullRequestStatus{currentBuilds: []string{"someotherbuild"}}
+	g.trackBuild(build)
+	g.untrackBuild(build)
+	assert.Contains(g.trackedPullRequests, "5678")
+	build.AssertNumberOfCalls(t, "Unref", 2)
+
+	// untracking an untracked build is a no-op
+	g.untrackBuild(build)
+	build.AssertNumberOfCalls(t, "Unref", 2)
+
+	// pull requests with a build per runner are building until they've all finished
+	g.trackedPullRequests["1234"] = pullRequestStatus{currentBuilds: []string{"buildtoken", "someotherbuild"}}
+	g.trackBuild(build)
+	g.untrackBuild(build)
+	assert.Equal([]string{"someotherbuild"}, g.trackedPullRequests["1234"].currentBuilds)
+}
+
+func TestPullRequestBuildStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app}
+
+	var buildConfig *core.BuildConfig
+	newBuildCall := app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig"))
+	newBuildCall.Return("buildtoken", nil)
+	newBuildCall.Run(func(args mock.Arguments) {
+		buildConfig = args.Get(1).(*core.BuildConfig)
+	})
+
+	build := &mocks.Build{}
+	app.On("GetBuild", "").Return(nil, errors.New("no build"))
+	app.On("GetBuild", "buildtoken").Return(build, nil)
+
+	g.buildPullRequest(ghApp, pullRequestFixture())
+	require.NotNil(buildConfig)
+	assert.Equal("pullrequest", buildConfig.GetMetadata("github:BuildType"))
+	assert.Equal("headsha", buildConfig.HeadHash)
+	assert.Equal("basesha", buildConfig.BaseHash)
+	assert.Equal("gopher", buildConfig.GetMetadata("github:Author"))
+	assert.Equal("Makes everything better.", buildConfig.GetMetadata("github:Description"))
+	assert.Equal([]string{"buildtoken"}, g.trackedPullRequests["87654321"].currentBuilds)
+
+	build.On("Token").Return("buildtoken")
+	build.On("Config").Return(buildConfig)
+	hasStopped := build.On("HasStopped").Return(false)
+	build.On("WebStatusURL").Return("http://ngbuild/web/testapp/buildtoken/")
+	queuePosition := build.On("QueuePosition").Return(2, 3)
+
+	g.updateBuildStatus(app, build)
+	assert.Equal("POST", api.lastMethod)
+	assert.Equal("/repos/watchly/ngbuild/statuses/headsha", api.lastPath)
+	require.NotNil(api.lastStatus.State)
+	assert.Equal("pending", *api.lastStatus.State)
+	require.NotNil(api.lastStatus.Description)
+	assert.Equal("Queued (position 2 of 3)", *api.lastStatus.Description)
+
+	queuePosition.Return(0, 0)
+	g.updateBuildStatus(app, build)
+	assert.Equal("Build started", *api.lastStatus.Description)
+
+	hasStopped.Return(true)
+	build.On("ExitCode").Return(127, nil)
+	outcome := build.On("Outcome").Return(core.OutcomeFailed)
+	buildConfig.SetMetadata(core.MetadataFailureReason, "build runner build.sh not found in repo")
+	g.updateBuildStatus(app, build)
+	assert.Equal("failure", *api.lastStatus.State)
+	assert.Equal("Failed, build runner build.sh not found in repo", *api.lastStatus.Description)
+
+	outcome.Return(core.OutcomeTimedOut)
+	buildConfig.SetMetadata(core.MetadataFailureReason, "build didn't finish within its deadline of 30m0s")
+	g.updateBuildStatus(app, build)
+	assert.Equal("failure", *api.lastStatus.State)
+	assert.Equal("Timed out, build didn't finish within its deadline of 30m0s", *api.lastStatus.Description)
+
+	outcome.Return(core.OutcomeProvisionFailed)
+	buildConfig.SetMetadata(core.MetadataFailureReason, "provisioning failed: clone failed")
+	g.updateBuildStatus(app, build)
+	assert.Equal("error", *api.lastStatus.State, "ngbuild failing isn't the builds fault")
+	assert.Equal("Error, provisioning failed: clone failed", *api.lastStatus.Description)
+}
+
+func TestPullRequestBuildRunners(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{responses: map[string]string{
+		"/repos/watchly/ngbuild/pulls/42/files": `[{"filename": "frontend/app.js"}, {"filename": "README.md"}]`,
+	}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app, config: githubConfig{BuildRunners: map[string]string{
+		"frontend/**": "frontend.sh",
+		"backend/**":  "backend.sh",
+	}}}
+
+	var buildConfigs []*core.BuildConfig
+	app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil).Run(func(args mock.Arguments) {
+		buildConfigs = append(buildConfigs, args.Get(1).(*core.BuildConfig))
+	})
+	app.On("GetBuild", "buildtoken").Return(&mocks.Build{}, nil)
+
+	g.buildPullRequest(ghApp, pullRequestFixture())
+	require.Len(buildConfigs, 1)
+	assert.Equal("frontend.sh", buildConfigs[0].BuildRunner)
+	assert.Equal("frontend.sh", buildConfigs[0].GetMetadata("github:BuildRunner"))
+	assert.Equal([]string{"buildtoken"}, g.trackedPullRequests["87654321"].currentBuilds)
+
+	// the backend build runner wasn't needed, so its status says so
+	assert.Contains(api.requests, "POST /repos/watchly/ngbuild/statuses/headsha")
+	require.NotNil(api.lastStatus.Context)
+	assert.True(strings.HasSuffix(*api.lastStatus.Context, "/testapp/backend.sh"))
+	assert.Equal("success", *api.lastStatus.State)
+	assert.Equal("No relevant changes, nothing to build", *api.lastStatus.Description)
+
+	// when nothing matches there is nothing to build
+	g = newTestGithub()
+	api.requests = nil
+	api.responses["/repos/watchly/ngbuild/pulls/42/files"] = `[{"filename": "README.md"}]`
+	defer newTestClient(g, api).Close()
+	g.buildPullRequest(ghApp, pullRequestFixture())
+	assert.Len(buildConfigs, 1)
+	assert.Equal([]string{
+		"GET /repos/watchly/ngbuild/pulls/42/files",
+		"POST /repos/watchly/ngbuild/statuses/headsha",
+		"POST /repos/watchly/ngbuild/statuses/headsha",
+		"POST /repos/watchly/ngbuild/statuses/headsha",
+	}, api.requests)
+	assert.True(strings.HasSuffix(*api.lastStatus.Context, "/testapp/summary"), "the summary isn't left waiting")
+	assert.Equal("success", *api.lastStatus.State)
+}
+
+// lockCheckingAPI records the requests made while the g.m lock is held, github can be slow and everything else
+// waits on that lock
+type lockCheckingAPI struct {
+	*githubAPI
+	g      *Github
+	locked []string
+}
+
+func (api *lockCheckingAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if api.g.m.TryLock() {
+		api.g.m.Unlock()
+	} else {
+		api.locked = append(api.locked, r.Method+" "+r.URL.Path)
+	}
+	api.githubAPI.ServeHTTP(w, r)
+}
+
+func TestBuildPullRequestUnlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &lockCheckingAPI{g: g, githubAPI: &githubAPI{responses: map[string]string{
+		"/repos/watchly/ngbuild/pulls/42/files": `[{"filename": "frontend/app.js"}]`,
+	}}}
+	defer newTestClient(g, api).Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+	app.On("GetBuild", "buildtoken").Return(&mocks.Build{}, nil)
+	ghApp := &githubApp{app: app, config: githubConfig{BuildRunners: map[string]string{
+		"frontend/**": "frontend.sh",
+		"backend/**":  "backend.sh",
+	}}}
+
+	pull := pullRequestFixture()
+	g.trackedPullRequests["87654321"] = pullRequestStatus{pull: pull}
+	g.updatePullRequest(ghApp, &github.PullRequestEvent{PullRequest: pull}, false)
+	assert.Equal([]string{
+		"GET /repos/watchly/ngbuild/pulls/42/files",
+		"POST /repos/watchly/ngbuild/statuses/headsha",
+	}, api.requests)
+	assert.Empty(api.locked)
+	assert.Equal([]string{"buildtoken"}, g.trackedPullRequests["87654321"].currentBuilds)
+
+	// drafts set their status without it too, whether they're new or going back to being drafts
+	build := &mocks.Build{}
+	build.On("HasStopped").Return(false)
+	build.On("Token").Return("buildtoken")
+	build.On("Stop").Return(nil)
+	app = &mocks.App{}
+	app.On("Name").Return("testapp")
+	app.On("GetBuild", "buildtoken").Return(build, nil)
+	ghApp.app = app
+	api.requests = nil
+	g.draftPullRequest(ghApp, &github.PullRequestEvent{PullRequest: pull})
+	g.updatePullRequest(ghApp, &github.PullRequestEvent{PullRequest: pull}, true)
+	assert.Equal([]string{
+		"POST /repos/watchly/ngbuild/statuses/headsha",
+		"POST /repos/watchly/ngbuild/statuses/headsha",
+	}, api.requests)
+	assert.Empty(api.locked)
+	build.AssertNumberOfCalls(t, "Stop", 1)
+}
+
+// runnerBuild is a stopped build of the runner for headsha, or a running one if code is negative
+func runnerBuild(runner string, code int) *mocks.Build {
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	config := pullRequestBuildConfig(&githubApp{app: app}, pullRequestFixture())
+	config.SetMetadata("github:BuildRunner", runner)
+	config.SetMetadata(metadataBuildRunners, "backend.sh,frontend.sh")
+
+	build := &mocks.Build{}
+	build.On("Config").Return(config)
+	build.On("HasStopped").Return(code >= 0)
+	build.On("QueuePosition").Return(0, 0)
+	build.On("ExitCode").Return(code, nil)
+	build.On("Outcome").Return(core.OutcomeFailed)
+	return build
+}
+
+func TestSummaryStatus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	history := app.On("GetBuildHistory", "87654321")
+
+	summary := func(builds ...core.Build) (string, string) {
+		history.Return(builds)
+		api.lastStatus = github.RepoStatus{}
+		g.updateSummaryStatus(app, builds[0])
+		require.NotNil(api.lastStatus.Context)
+		assert.True(strings.HasSuffix(*api.lastStatus.Context, "/testapp/summary"))
+		assert.Equal("/repos/watchly/ngbuild/statuses/headsha", api.lastPath)
+		return *api.lastStatus.State, *api.lastStatus.Description
+	}
+
+	state, description := summary(runnerBuild("backend.sh", 0))
+	assert.Equal("pending", state, "frontend.sh hasn't even started")
+	assert.Equal("1 of 2 builds finished", description)
+
+	state, description = summary(runnerBuild("backend.sh", 0), runnerBuild("frontend.sh", -1))
+	assert.Equal("pending", state)
+
+	state, description = summary(runnerBuild("backend.sh", 0), runnerBuild("frontend.sh", 0))
+	assert.Equal("success", state)
+	assert.Equal("All 2 builds passed", description)
+
+	state, description = summary(runnerBuild("backend.sh", -1), runnerBuild("frontend.sh", 1))
+	assert.Equal("failure", state, "there's no passing once something has failed")
+	assert.Equal("1 of 2 builds failed: frontend.sh", description)
+
+	state, _ = summary(runnerBuild("backend.sh", 0), runnerBuild("frontend.sh", 1), runnerBuild("frontend.sh", 0))
+	assert.Equal("success", state, "only the latest build of each runner counts")
+
+	// builds without build runners have no summary
+	api.requests = nil
+	noRunners := &mocks.Build{}
+	noRunners.On("Config").Return(core.NewBuildConfig())
+	g.updateSummaryStatus(app, noRunners)
+	assert.Empty(api.requests)
+}
+
+func TestHandleGithubPushBuildRunners(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app, config: githubConfig{
+		BuildBranches: []string{"master"},
+		BuildRunners:  map[string]string{"frontend/**": "frontend.sh", "backend/**": "backend.sh"},
+	}}
+
+	var runners []string
+	app.On("NewBuild", "master", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil).Run(func(args mock.Arguments) {
+		runners = append(runners, args.Get(1).(*core.BuildConfig).GetMetadata("github:BuildRunner"))
+	})
+
+	body := map[string]interface{}{}
+	json.Unmarshal(pushEventBody("refs/heads/master", "deadbeef"), &body) //nolint (errcheck)
+	body["commits"] = []map[string]interface{}{
+		{"added": []string{"backend/new.go"}},
+		{"modified": []string{"docs/README.md"}},
+	}
+	raw, _ := json.Marshal(body)
+
+	g.handleGithubPush(ghApp, raw)
+	assert.Equal([]string{"backend.sh"}, runners)
+
+	// without the changed files, everything is built
+	runners = nil
+	g.handleGithubPush(ghApp, pushEventBody("refs/heads/master", "cafebabe"))
+	assert.Equal([]string{"backend.sh", "frontend.sh"}, runners)
+}
+
+func TestPullRequestDescription(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", pullRequestDescription(""))
+	assert.Equal("Fixes the thing", pullRequestDescription("Fixes the thing"))
+	assert.Equal("Fixes the thing. - [x] tested", pullRequestDescription(`<!--
+Thanks for the pull request!
+-->
+### What does this do?
+Fixes the thing.
+
+### Checklist
+- [x] tested
+`))
+
+	long := pullRequestDescription(strings.Repeat("word ", 100))
+	assert.Len(long, maxDescriptionLength)
+	assert.True(strings.HasSuffix(long, "wo..."))
+}
+
+func reviewEventBody(state, user string) []byte {
+	pull, _ := json.Marshal(pullRequestFixture())
+	return []byte(fmt.Sprintf(`{
+		"action": "submitted",
+		"review": { "state": "%s", "user": { "login": "%s" } },
+		"pull_request": %s
+	}`, state, user, pull))
+}
+
+func TestPullRequestReviewApproval(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{notFound: map[string]bool{}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{
+		app: app,
+		config: githubConfig{
+			Approvers:       []string{"maintainer"},
+			BuildOnApproval: true,
+			MergeOnPass:     true,
+		},
+	}
+
+	// nothing is built until the pull request has been approved
+	g.buildPullRequest(ghApp, pullRequestFixture())
+	assert.Empty(g.trackedPullRequests["87654321"].currentBuilds)
+
+	// reviews from people that aren't approvers are ignored
+	g.handleGithubPullRequestReviewEvent(ghApp, reviewEventBody("approved", "gopher"))
+	assert.NotContains(g.approvals, "87654321")
+
+	build := &mocks.Build{}
+	app.On("GetBuild", "").Return(nil, errors.New("no build"))
+	app.On("GetBuild", "buildtoken").Return(build, nil)
+	app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+
+	// approvals go through the same checks as pull request events, the author has to be a collaborator
+	api.notFound["/repos/watchly/ngbuild/collaborators/gopher"] = true
+	g.handleGithubPullRequestReviewEvent(ghApp, reviewEventBody("approved", "maintainer"))
+	app.AssertNumberOfCalls(t, "NewBuild", 0)
+	assert.Equal(pullRequestApproval{commit: "headsha", mergeOnPass: true}, g.approvals["87654321"])
+
+	delete(api.notFound, "/repos/watchly/ngbuild/collaborators/gopher")
+	g.handleGithubPullRequestReviewEvent(ghApp, reviewEventBody("approved", "maintainer"))
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+	assert.Equal([]string{"buildtoken"}, g.trackedPullRequests["87654321"].currentBuilds)
+
+	// a second approval doesn't build again
+	g.handleGithubPullRequestReviewEvent(ghApp, reviewEventBody("approved", "maintainer"))
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+
+	g.handleGithubPullRequestReviewEvent(ghApp, reviewEventBody("changes_requested", "maintainer"))
+	assert.NotContains(g.approvals, "87654321")
+	assert.Equal([]string{"buildtoken"}, g.trackedPullRequests["87654321"].currentBuilds)
+
+	// approving an older commit doesn't get the head built
+	g = newTestGithub()
+	defer newTestClient(g, api).Close()
+	g.approvals["87654321"] = pullRequestApproval{commit: "oldsha"}
+	g.buildPullRequest(ghApp, pullRequestFixture())
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+
+	// and new commits have to be approved again
+	g.approvals["87654321"] = pullRequestApproval{commit: "headsha"}
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("synchronize", false))
+	assert.NotContains(g.approvals, "87654321")
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+}
+
+func TestMergeOnPass(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app, config: githubConfig{MergeOnPass: true}}
+	g.apps["testapp"] = ghApp
+
+	build := runnerBuild("", 0)
+	build.Config().SetMetadata(metadataBuildRunners, "")
+	build.On("Token").Return("buildtoken")
+	build.On("WebStatusURL").Return("http://ngbuild/web/testapp/buildtoken/")
+	build.On("Unref").Return()
+	app.On("GetBuild", "buildtoken").Return(build, nil)
+	finished := core.BuildCompleteEvent{}
+	finished.App, finished.Token = "testapp", "buildtoken"
+
+	merges := func() int {
+		count := 0
+		for _, request := range api.requests {
+			if request == "PUT /repos/watchly/ngbuild/pulls/42/merge" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// not approved
+	g.onBuildFinished(finished)
+	assert.Equal(0, merges())
+
+	// approved, but not this commit
+	g.approvals["87654321"] = pullRequestApproval{commit: "othersha", mergeOnPass: true}
+	g.onBuildFinished(finished)
+	assert.Equal(0, merges())
+
+	// the approval outlives the pull request being tracked, and is used up by the merge
+	g.approvals["87654321"] = pullRequestApproval{commit: "headsha", mergeOnPass: true}
+	g.onBuildFinished(finished)
+	assert.Equal(1, merges())
+	assert.NotContains(g.approvals, "87654321")
+
+	// failed builds aren't merged
+	failed := runnerBuild("", 1)
+	failed.Config().SetMetadata(metadataBuildRunners, "")
+	failed.On("Token").Return("failedtoken")
+	failed.On("WebStatusURL").Return("")
+	failed.On("Unref").Return()
+	app.On("GetBuild", "failedtoken").Return(failed, nil)
+	g.approvals["87654321"] = pullRequestApproval{commit: "headsha", mergeOnPass: true}
+	finished.Token = "failedtoken"
+	g.onBuildFinished(finished)
+	assert.Equal(1, merges())
+}
+
+func pullRequestEventBody(action string, draft bool) []byte {
+	pull := map[string]interface{}{}
+	raw, _ := json.Marshal(pullRequestFixture())
+	json.Unmarshal(raw, &pull) //nolint (errcheck)
+	pull["draft"] = draft
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"action":       action,
+		"pull_request": pull,
+	})
+	return body
+}
+
+func TestDraftPullRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app, config: githubConfig{BuildDrafts: false}}
+
+	build := &mocks.Build{}
+	app.On("GetBuild", "").Return(nil, errors.New("no build"))
+	app.On("GetBuild", "buildtoken").Return(build, nil)
+	app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+
+	// drafts get a status saying why they aren't being built
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("opened", true))
+	app.AssertNumberOfCalls(t, "NewBuild", 0)
+	assert.True(g.trackedPullRequests["87654321"].draft)
+	assert.Equal("/repos/watchly/ngbuild/statuses/headsha", api.lastPath)
+	if assert.NotNil(api.lastStatus.Description) {
+		assert.Equal("Draft, will build once ready for review", *api.lastStatus.Description)
+	}
+
+	// more commits on a draft don't build either
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("synchronize", true))
+	app.AssertNumberOfCalls(t, "NewBuild", 0)
+
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("ready_for_review", false))
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+	assert.False(g.trackedPullRequests["87654321"].draft)
+	assert.Equal([]string{"buildtoken"}, g.trackedPullRequests["87654321"].currentBuilds)
+
+	// unless told otherwise, drafts are built like everything else
+	g = newTestGithub()
+	defer newTestClient(g, api).Close()
+	ghApp.config.BuildDrafts = true
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("opened", true))
+	app.AssertNumberOfCalls(t, "NewBuild", 2)
+}
+
+func TestConvertedToDraft(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app, config: githubConfig{BuildDrafts: false}}
+	g.apps["testapp"] = ghApp
+
+	build := &mocks.Build{}
+	build.On("Token").Return("buildtoken")
+	build.On("HasStopped").Return(false)
+	build.On("Stop").Return(nil)
+	build.On("Unref").Return()
+	app.On("GetBuild", "").Return(nil, errors.New("no build"))
+	app.On("GetBuild", "buildtoken").Return(build, nil)
+	app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig")).Return("buildtoken", nil)
+
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("opened", false))
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+	g.trackedBuilds["buildtoken"] = build
+
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("converted_to_draft", true))
+	build.AssertCalled(t, "Stop")
+	if assert.NotNil(api.lastStatus.Description) {
+		assert.Equal("Draft, will build once ready for review", *api.lastStatus.Description)
+	}
+
+	// the stopped build finishing doesn't mark the pull request as failed
+	requests := len(api.requests)
+	g.onBuildFinished(core.BuildCompleteEvent{BuildEvent: core.BuildEvent{App: "testapp", Token: "buildtoken"}})
+	assert.Len(api.requests, requests)
+	assert.Empty(g.trackedBuilds)
+
+	// teams that build drafts keep building them
+	ghApp.config.BuildDrafts = true
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("opened", false))
+	g.handleGithubPullRequest(ghApp, pullRequestEventBody("converted_to_draft", true))
+	build.AssertNumberOfCalls(t, "Stop", 1)
+}
+
+func commitCommentBody(body, user string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"action": "created",
+		"comment": {
+			"id": 123,
+			"commit_id": "deadbeef",
+			"body": "%s",
+			"user": { "login": "%s" }
+		},
+		"repository": {
+			"name": "ngbuild",
+			"owner": { "login": "watchly" }
+		}
+	}`, body, user))
+}
+
+func TestCommitCommentRebuild(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{notFound: map[string]bool{"/repos/watchly/ngbuild/collaborators/rando": true}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	buildConfig := core.NewBuildConfig()
+	buildConfig.SetMetadata("github:BuildType", "commit")
+	buildConfig.SetMetadata("github:BranchBuildOwner", "watchly")
+	buildConfig.SetMetadata("github:BranchBuildRepo", "ngbuild")
+	buildConfig.SetMetadata("github:BranchBuildCommit", "deadbeef")
+
+	build := &mocks.Build{}
+	build.On("Config").Return(buildConfig)
+	build.On("NewBuild").Return("newtoken", nil)
+
+	app := &mocks.App{}
+	app.On("GetBuildHistory", "master").Return([]core.Build{build})
+	ghApp := &githubApp{
+		app:    app,
+		config: githubConfig{BuildBranches: []string{"master"}},
+	}
+
+	// comments that aren't commands are ignored without asking github anything
+	g.handleGithubCommitComment(ghApp, commitCommentBody("nice commit", "gopher"))
+	assert.Empty(api.requests)
+	build.AssertNotCalled(t, "NewBuild")
+
+	// so are non collaborators
+	g.handleGithubCommitComment(ghApp, commitCommentBody("/rebuild", "rando"))
+	assert.Equal([]string{"GET /repos/watchly/ngbuild/collaborators/rando"}, api.requests)
+	build.AssertNotCalled(t, "NewBuild")
+
+	api.requests = nil
+	g.handleGithubCommitComment(ghApp, commitCommentBody("/rebuild", "gopher"))
+	build.AssertNumberOfCalls(t, "NewBuild", 1)
+	assert.Equal([]string{
+		"GET /repos/watchly/ngbuild/collaborators/gopher",
+		"POST /repos/watchly/ngbuild/comments/123/reactions",
+	}, api.requests)
+
+	// /rebuild failed only rebuilds the build runners that failed
+	rerunCall := build.On("NewFailedBuilds", "github:BuildRunner").Return([]string{"frontend"}, nil)
+	d := g.handleGithubCommitComment(ghApp, commitCommentBody("/rebuild failed", "gopher"))
+	assert.Equal("rebuilding deadbeef as frontend", d.Detail)
+	build.AssertNumberOfCalls(t, "NewBuild", 1)
+
+	rerunCall.Return(nil, nil)
+	d = g.handleGithubCommitComment(ghApp, commitCommentBody("/rebuild failed", "gopher"))
+	assert.Equal("no failed builds of deadbeef to rebuild", d.Detail)
+
+	// commits we never built can't be rebuilt
+	buildConfig.SetMetadata("github:BranchBuildCommit", "cafebabe")
+	g.handleGithubCommitComment(ghApp, commitCommentBody("/rebuild", "gopher"))
+	build.AssertNumberOfCalls(t, "NewBuild", 1)
+}
+
+func TestReady(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	assert.NoError(g.Ready(), "github isn't needed until an app uses it")
+
+	g.needsClient = true
+	assert.Error(g.Ready())
+
+	g.client = github.NewClient(nil)
+	assert.NoError(g.Ready())
+}
+
+func TestGithubAuthRedirect(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	g.globalConfig.AuthMode = authModeApp
+
+	// nobody gets to authenticate us when we don't need it
+	resp := httptest.NewRecorder()
+	g.handleGithubAuthRedirect(resp, httptest.NewRequest("GET", "/auth/github", nil))
+	assert.Equal(http.StatusForbidden, resp.Code)
+	assert.Empty(resp.Result().Cookies(), "no state is handed out")
+
+	// callbacks without the state cookie are turned away before anything is exchanged
+	state := core.NewOAuthState("github")
+	resp = httptest.NewRecorder()
+	g.handleGithubAuth(resp, httptest.NewRequest("GET", "/cb/auth/github?code=abc&state="+state, nil))
+	assert.Contains(resp.Body.String(), "OAuth2 state was incorrect")
+}
+
+func TestProviderOnlyAttach(t *testing.T) {
+	assert := assert.New(t)
+
+	// a provider is never authenticated, attaching it mustn't wait for that or touch github
+	g := NewProvider()
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	assert.NoError(g.AttachToApp(app))
+	assert.Nil(g.client)
+	assert.Empty(g.apps)
+	app.AssertNotCalled(t, "Config", mock.Anything, mock.Anything)
+	assert.NoError(g.DetachFromApp(app))
+}
+
+func TestSetupHooks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	g.setupHooks(&githubApp{app: app, config: githubConfig{Owner: "watchly", Repo: "ngbuild"}})
+	assert.Equal("POST /repos/watchly/ngbuild/hooks", api.requests[len(api.requests)-1])
+
+	var hook github.Hook
+	require.NoError(json.Unmarshal(api.lastBody, &hook))
+	for _, event := range []string{"pull_request", "pull_request_review", "push", "issue_comment", "commit_comment"} {
+		assert.Contains(hook.Events, event, "the handlers for %s events never run without it", event)
+	}
+}
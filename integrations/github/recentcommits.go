@@ -0,0 +1,56 @@
+package github
+
+import (
+	"fmt"
+	"time"
+)
+
+// recentCommits remembers the commits that were built recently and which build built them, so a commit that
+// shows up both as the head of a pull request and in a push is only built once, hold the g.m lock when you use it
+type recentCommits map[string]recentCommit
+
+type recentCommit struct {
+	token   string
+	expires time.Time
+}
+
+// commitKey is what recentCommits are looked up by, each build runner builds a commit separately
+func commitKey(appName, owner, repo, commit, runner string) string {
+	return fmt.Sprintf("%s:%s/%s@%s:%s", appName, owner, repo, commit, runner)
+}
+
+// find returns the token of the build of key if it hasn't expired, expired commits are forgotten
+func (rc recentCommits) find(key string, now time.Time) (token string, ok bool) {
+	for existing, commit := range rc {
+		if now.Before(commit.expires) == false {
+			delete(rc, existing)
+		}
+	}
+
+	commit, ok := rc[key]
+	return commit.token, ok
+}
+
+func (rc recentCommits) add(key, token string, expires time.Time) {
+	rc[key] = recentCommit{token: token, expires: expires}
+}
+
+// recentlyBuilt returns the token of a build of the commit with runner, if the app dedupes commits and one was
+// made within its window, hold the g.m lock when you call this
+func (g *Github) recentlyBuilt(app *githubApp, owner, repo, commit, runner string) (string, bool) {
+	if app.config.DedupeCommitsMinutes <= 0 {
+		return "", false
+	}
+
+	return g.recentCommits.find(commitKey(app.app.Name(), owner, repo, commit, runner), time.Now())
+}
+
+// hold the g.m lock when you call this
+func (g *Github) addRecentlyBuilt(app *githubApp, owner, repo, commit, runner, token string) {
+	if app.config.DedupeCommitsMinutes <= 0 {
+		return
+	}
+
+	window := time.Duration(app.config.DedupeCommitsMinutes) * time.Minute
+	g.recentCommits.add(commitKey(app.app.Name(), owner, repo, commit, runner), token, time.Now().Add(window))
+}
@@ -0,0 +1,74 @@
+package github
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/watchly/ngbuild/mocks"
+)
+
+func TestRecentCommits(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	rc := make(recentCommits)
+	rc.add("first", "token1", now.Add(time.Minute))
+	rc.add("second", "token2", now.Add(time.Hour))
+
+	token, ok := rc.find("first", now)
+	assert.True(ok)
+	assert.Equal("token1", token)
+
+	_, ok = rc.find("first", now.Add(time.Minute))
+	assert.False(ok, "commits are forgotten once they expire")
+	assert.Len(rc, 1)
+
+	_, ok = rc.find("missing", now)
+	assert.False(ok)
+}
+
+// a commit pushed to a build branch that is also the head of a pull request is only built once
+func TestDedupeCommitsAcrossPushAndPullRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{}
+	defer newTestClient(g, api).Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app, config: githubConfig{BuildBranches: []string{"feature"}, DedupeCommitsMinutes: 10}}
+
+	app.On("NewBuild", "feature", mock.AnythingOfType("*core.BuildConfig")).Return("pushtoken", nil).Once()
+	d := g.handleGithubPush(ghApp, pushEventBody("refs/heads/feature", "headsha"))
+	assert.Equal(outcomeBuilt, d.Outcome)
+
+	pull := pullRequestFixture()
+	d = g.buildPullRequest(ghApp, pull)
+	assert.Equal(outcomeIgnored, d.Outcome)
+	assert.Equal("headsha was already built by pushtoken", d.Detail)
+
+	// the push again, as if the pull request had been built first
+	d = g.handleGithubPush(ghApp, pushEventBody("refs/heads/feature", "headsha"))
+	assert.Equal(outcomeIgnored, d.Outcome)
+	app.AssertNumberOfCalls(t, "NewBuild", 1)
+
+	// once the window has passed the commit can be built again
+	for key, commit := range g.recentCommits {
+		commit.expires = time.Now()
+		g.recentCommits[key] = commit
+	}
+	app.On("NewBuild", "87654321", mock.AnythingOfType("*core.BuildConfig")).Return("pulltoken", nil)
+	app.On("GetBuild", "pulltoken").Return(&mocks.Build{}, nil)
+	d = g.buildPullRequest(ghApp, pull)
+	assert.Equal(outcomeBuilt, d.Outcome)
+
+	// without dedupeCommitsMinutes every trigger builds
+	ghApp.config.DedupeCommitsMinutes = 0
+	app.On("NewBuild", "feature", mock.AnythingOfType("*core.BuildConfig")).Return("pushtoken", nil)
+	d = g.handleGithubPush(ghApp, pushEventBody("refs/heads/feature", "headsha"))
+	assert.Equal(outcomeBuilt, d.Outcome)
+}
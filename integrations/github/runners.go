@@ -0,0 +1,69 @@
+package github
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// matchesPath is path.Match for whole paths, where a ** segment matches any number of directories
+func matchesPath(pattern, file string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(file, "/"))
+}
+
+func matchSegments(pattern, file []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(file); i++ {
+				if matchSegments(pattern[1:], file[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(file) == 0 {
+			return false
+		}
+		if matched, err := path.Match(pattern[0], file[0]); err != nil || matched == false {
+			return false
+		}
+		pattern, file = pattern[1:], file[1:]
+	}
+
+	return len(file) == 0
+}
+
+// selectBuildRunners returns the build runners, sorted, whose globs match any of the changed files
+func selectBuildRunners(runners map[string]string, files []string) []string {
+	selected := make(map[string]bool)
+	for pattern, runner := range runners {
+		for _, file := range files {
+			if matchesPath(pattern, file) {
+				selected[runner] = true
+				break
+			}
+		}
+	}
+
+	return sortedRunners(selected)
+}
+
+// allBuildRunners returns every build runner in runners, sorted, for when we don't know what changed
+func allBuildRunners(runners map[string]string) []string {
+	all := make(map[string]bool)
+	for _, runner := range runners {
+		all[runner] = true
+	}
+
+	return sortedRunners(all)
+}
+
+func sortedRunners(runners map[string]bool) []string {
+	sorted := make([]string, 0, len(runners))
+	for runner := range runners {
+		sorted = append(sorted, runner)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,46 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesPath(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []struct {
+		pattern, file string
+		matches       bool
+	}{
+		{"frontend/**", "frontend/src/app.js", true},
+		{"frontend/**", "frontend/index.html", true},
+		{"frontend/**", "backend/main.go", false},
+		{"frontend/**", "frontend-old/index.html", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "core/build.go", true},
+		{"**/*.go", "core/build.js", false},
+		{"docs/*.md", "docs/README.md", true},
+		{"docs/*.md", "docs/guide/README.md", false},
+		{"Makefile", "Makefile", true},
+		{"Makefile", "frontend/Makefile", false},
+	} {
+		assert.Equal(test.matches, matchesPath(test.pattern, test.file), "%s %s", test.pattern, test.file)
+	}
+}
+
+func TestSelectBuildRunners(t *testing.T) {
+	assert := assert.New(t)
+
+	runners := map[string]string{
+		"frontend/**": "frontend.sh",
+		"backend/**":  "backend.sh",
+		"shared/**":   "backend.sh",
+	}
+
+	assert.Equal([]string{"frontend.sh"}, selectBuildRunners(runners, []string{"frontend/app.js"}))
+	assert.Equal([]string{"backend.sh"}, selectBuildRunners(runners, []string{"shared/a.go", "backend/b.go"}))
+	assert.Equal([]string{"backend.sh", "frontend.sh"}, selectBuildRunners(runners, []string{"frontend/app.js", "backend/b.go"}))
+	assert.Empty(selectBuildRunners(runners, []string{"README.md"}))
+	assert.Equal([]string{"backend.sh", "frontend.sh"}, allBuildRunners(runners))
+}
@@ -0,0 +1,39 @@
+package github
+
+import "context"
+
+// semaphore limits how many of something can happen at once, a nil semaphore never blocks
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size < 1 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+// acquire will block until there is room or the context is done
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// full is only a hint, by the time you acquire it may have changed
+func (s semaphore) full() bool {
+	return s != nil && len(s) == cap(s)
+}
@@ -0,0 +1,32 @@
+package github
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSemaphore(t *testing.T) {
+	assert := assert.New(t)
+
+	unlimited := newSemaphore(0)
+	for i := 0; i < 10; i++ {
+		assert.NoError(unlimited.acquire(context.Background()))
+	}
+	assert.False(unlimited.full())
+
+	s := newSemaphore(2)
+	assert.NoError(s.acquire(context.Background()))
+	assert.False(s.full())
+	assert.NoError(s.acquire(context.Background()))
+	assert.True(s.full())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, s.acquire(ctx))
+
+	s.release()
+	assert.False(s.full())
+	assert.NoError(s.acquire(context.Background()))
+}
@@ -0,0 +1,129 @@
+package github
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/watchly/ngbuild/core"
+)
+
+// tokenCacheKey is where the oauth token is cached, older versions of ngbuild kept only the access token here
+const tokenCacheKey = "github:token"
+
+func encodeToken(token *oauth2.Token) string {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return token.AccessToken
+	}
+	return string(data)
+}
+
+// decodeToken reads a token made by encodeToken, or a bare access token from before we kept the whole thing
+func decodeToken(data string) *oauth2.Token {
+	if data == "" {
+		return nil
+	}
+
+	token := &oauth2.Token{}
+	if err := json.Unmarshal([]byte(data), token); err != nil || token.AccessToken == "" {
+		return &oauth2.Token{AccessToken: data}
+	}
+	return token
+}
+
+func storeToken(token *oauth2.Token) {
+	core.StoreCache(tokenCacheKey, encodeToken(token))
+}
+
+func loadToken() *oauth2.Token {
+	return decodeToken(core.GetCache(tokenCacheKey))
+}
+
+// savingTokenSource refreshes the token once it expires, saving each new token so restarting doesn't take us back
+// to an expired one. If refreshing fails there is nothing more we can do, we need to be authenticated again
+type savingTokenSource struct {
+	m      sync.Mutex
+	config *oauth2.Config
+	source oauth2.TokenSource
+	token  *oauth2.Token
+
+	save           func(*oauth2.Token)
+	reauthenticate func(error)
+	failed         bool // reauthenticate has been called, we don't need to ask more than once
+}
+
+func newSavingTokenSource(config *oauth2.Config, token *oauth2.Token, save func(*oauth2.Token), reauthenticate func(error)) *savingTokenSource {
+	return &savingTokenSource{
+		config:         config,
+		source:         config.TokenSource(oauth2.NoContext, token),
+		token:          token,
+		save:           save,
+		reauthenticate: reauthenticate,
+	}
+}
+
+func (ts *savingTokenSource) Token() (*oauth2.Token, error) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	token, err := ts.source.Token()
+	if err != nil {
+		if ts.failed == false {
+			ts.failed = true
+			ts.reauthenticate(err)
+		}
+		return nil, err
+	}
+
+	if ts.token == nil || token.AccessToken != ts.token.AccessToken {
+		// the token can see every repo we can, make sure it never shows up in build output
+		core.RegisterSecret(token.AccessToken)
+		ts.save(token)
+		ts.token = token
+	}
+	ts.failed = false
+	return token, nil
+}
+
+// expire makes the next Token call refresh, for when github rejects a token that we didn't think had expired
+func (ts *savingTokenSource) expire() {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	if ts.token == nil {
+		return
+	}
+
+	expired := *ts.token
+	expired.Expiry = time.Now().Add(-time.Minute)
+	ts.source = ts.config.TokenSource(oauth2.NoContext, &expired)
+}
+
+// unauthorizedTransport watches for github rejecting our token. The rejected request still fails, but the token is
+// refreshed for the next one
+type unauthorizedTransport struct {
+	base   http.RoundTripper
+	tokens *savingTokenSource
+}
+
+func (t *unauthorizedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		logwarnf("Github rejected our token for %s, it will be refreshed", req.URL.Path)
+		t.tokens.expire()
+	}
+	return resp, err
+}
+
+// newTokenClient returns an http client that authenticates with tokens and refreshes them as needed
+func newTokenClient(tokens *savingTokenSource) *http.Client {
+	return &http.Client{
+		Transport: &unauthorizedTransport{
+			base:   &oauth2.Transport{Source: tokens},
+			tokens: tokens,
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestDecodeToken(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(decodeToken(""))
+	assert.Equal(&oauth2.Token{AccessToken: "oldtoken"}, decodeToken("oldtoken"), "bare access tokens are still understood")
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	token := decodeToken(encodeToken(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}))
+	assert.Equal("access", token.AccessToken)
+	assert.Equal("refresh", token.RefreshToken)
+	assert.True(expiry.Equal(token.Expiry))
+}
+
+// tokenServer hands out access-1, access-2... on refresh, or fails while failing is set
+type tokenServer struct {
+	refreshes int
+	failing   bool
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.failing {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.refreshes++
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token": "access-%d", "token_type": "bearer", "refresh_token": "refresh", "expires_in": 3600}`, s.refreshes)
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tokens := &tokenServer{}
+	tokenServer := httptest.NewServer(tokens)
+	defer tokenServer.Close()
+
+	unauthorized := true
+	var authorization []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		if unauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer api.Close()
+
+	var saved []string
+	var reauthentications []error
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL}}
+	expired := &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	source := newSavingTokenSource(config, expired,
+		func(token *oauth2.Token) { saved = append(saved, token.AccessToken) },
+		func(err error) { reauthentications = append(reauthentications, err) })
+	client := newTokenClient(source)
+
+	// expired tokens are refreshed and saved before they're used
+	resp, err := client.Get(api.URL)
+	require.NoError(err)
+	resp.Body.Close() //nolint (errcheck)
+	assert.Equal([]string{"access-1"}, saved)
+	assert.Equal([]string{"Bearer access-1"}, authorization)
+
+	// github rejected that one, so the next request gets a new token
+	unauthorized = false
+	resp, err = client.Get(api.URL)
+	require.NoError(err)
+	resp.Body.Close() //nolint (errcheck)
+	assert.Equal([]string{"access-1", "access-2"}, saved)
+	assert.Equal("Bearer access-2", authorization[1])
+
+	// tokens that are fine aren't refreshed
+	resp, err = client.Get(api.URL)
+	require.NoError(err)
+	resp.Body.Close() //nolint (errcheck)
+	assert.Equal(2, tokens.refreshes)
+	assert.Empty(reauthentications)
+
+	// only when refreshing fails do we need to be authenticated again, and we only ask once
+	tokens.failing = true
+	source.expire()
+	_, err = client.Get(api.URL)
+	assert.Error(err)
+	_, err = client.Get(api.URL)
+	assert.Error(err)
+	assert.Len(reauthentications, 1)
+}
+
+func TestSavingTokenSourceWithoutRefreshToken(t *testing.T) {
+	assert := assert.New(t)
+
+	var reauthentications []error
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "http://127.0.0.1:0/"}}
+	source := newSavingTokenSource(config, &oauth2.Token{AccessToken: "forever"},
+		func(*oauth2.Token) { t.Error("nothing new to save") },
+		func(err error) { reauthentications = append(reauthentications, err) })
+
+	token, err := source.Token()
+	assert.NoError(err)
+	assert.Equal("forever", token.AccessToken)
+
+	// a token that never expires being rejected can't be refreshed, it was revoked
+	source.expire()
+	_, err = source.Token()
+	assert.Error(err)
+	assert.Equal([]error{errors.New("oauth2: token expired and refresh token is not set")}, reauthentications)
+}
@@ -0,0 +1,62 @@
+package github
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/watchly/ngbuild/core"
+)
+
+// metadataUnverified is set on builds that weren't built because their commit wasn't signed by a trusted signer,
+// it says why
+const metadataUnverified = "github:Unverified"
+
+// verifyCommit makes sure github verified the commits signature, and that it was signed by one of trusted, which are
+// committer emails. With nobody trusted any signature github verified will do. unverified says why the commit isn't
+// to be built, err is for when it couldn't be checked at all
+func (g *Github) verifyCommit(owner, repo, sha string, trusted []string) (unverified string, err error) {
+	commit, _, err := g.client.Git.GetCommit(owner, repo, sha)
+	if err != nil {
+		return "", fmt.Errorf("couldn't check the signature of %s: %s", sha, err)
+	}
+
+	verification := commit.Verification
+	if verification == nil || verification.Verified == nil || *verification.Verified == false {
+		reason := "unsigned"
+		if verification != nil && verification.Reason != nil {
+			reason = *verification.Reason
+		}
+		return fmt.Sprintf("commit %s isn't verified (%s)", sha, reason), nil
+	}
+
+	if len(trusted) == 0 {
+		return "", nil
+	}
+
+	signer := ""
+	if commit.Committer != nil && commit.Committer.Email != nil {
+		signer = *commit.Committer.Email
+	}
+	for _, email := range trusted {
+		if signer != "" && strings.EqualFold(email, signer) {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("commit %s is signed by %s, who isn't a trusted signer", sha, signer), nil
+}
+
+// verifyBuildCommit checks the commit the build is for, if its app has requireVerifiedCommits set, see verifyCommit
+func (g *Github) verifyBuildCommit(config *core.BuildConfig) (unverified string, err error) {
+	g.m.RLock()
+	app := g.apps[config.GetMetadata("github:App")]
+	g.m.RUnlock()
+	if app == nil || app.config.RequireVerifiedCommits == false {
+		return "", nil
+	}
+
+	owner, repo, commit := statusTarget(config)
+	if owner == "" || repo == "" || commit == "" {
+		return "", fmt.Errorf("don't know which commit to verify for %s", config.Title)
+	}
+	return g.verifyCommit(owner, repo, commit, app.config.TrustedSigners)
+}
@@ -0,0 +1,187 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/watchly/ngbuild/core"
+	"github.com/watchly/ngbuild/mocks"
+)
+
+const verifyCommitPath = "/repos/watchly/ngbuild/git/commits/headsha"
+
+func commitFixture(verified bool, reason, email string) string {
+	return fmt.Sprintf(`{
+		"sha": "headsha",
+		"committer": { "name": "Gopher", "email": "%s" },
+		"verification": { "verified": %t, "reason": "%s" }
+	}`, email, verified, reason)
+}
+
+func verifyConfig() *core.BuildConfig {
+	config := core.NewBuildConfig()
+	config.Title = "Make everything better"
+	config.SetMetadata("github:App", "testapp")
+	config.SetMetadata("github:BuildType", "pullrequest")
+	config.SetMetadata("github:BaseOwner", "watchly")
+	config.SetMetadata("github:BaseRepo", "ngbuild")
+	config.SetMetadata("github:HeadHash", "headsha")
+	return config
+}
+
+func TestVerifyCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{responses: map[string]string{}, notFound: map[string]bool{}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	tests := []struct {
+		commit  string
+		trusted []string
+		ok      bool
+	}{
+		{commitFixture(true, "valid", "gopher@example.com"), nil, true},
+		{commitFixture(true, "valid", "Gopher@Example.com"), []string{"gopher@example.com"}, true},
+		{commitFixture(true, "valid", "mallory@example.com"), []string{"gopher@example.com"}, false},
+		{commitFixture(false, "unsigned", "gopher@example.com"), nil, false},
+		{commitFixture(false, "bad_email", "gopher@example.com"), []string{"gopher@example.com"}, false},
+		{`{ "sha": "headsha" }`, nil, false},
+	}
+
+	for _, test := range tests {
+		api.responses[verifyCommitPath] = test.commit
+		unverified, err := g.verifyCommit("watchly", "ngbuild", "headsha", test.trusted)
+		assert.NoError(err)
+		assert.Equal(test.ok, unverified == "", "%s trusting %v: %s", test.commit, test.trusted, unverified)
+	}
+
+	api.responses[verifyCommitPath] = commitFixture(false, "bad_email", "gopher@example.com")
+	unverified, err := g.verifyCommit("watchly", "ngbuild", "headsha", nil)
+	assert.NoError(err)
+	assert.Contains(unverified, "bad_email")
+
+	// not being able to ask github isn't the same as the commit not being verified
+	api.notFound[verifyCommitPath] = true
+	unverified, err = g.verifyCommit("watchly", "ngbuild", "headsha", nil)
+	assert.Error(err)
+	assert.Empty(unverified)
+}
+
+func TestProvideForUnverifiedCommit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{responses: map[string]string{verifyCommitPath: commitFixture(false, "unsigned", "gopher@example.com")}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	g.apps["testapp"] = &githubApp{app: app, config: githubConfig{RequireVerifiedCommits: true}}
+
+	parent, err := ioutil.TempDir("", "ngbuild-verify")
+	require.NoError(err)
+	defer os.RemoveAll(parent) //nolint (errcheck)
+	directory := filepath.Join(parent, "build")
+
+	config := verifyConfig()
+	err = g.ProvideFor(context.Background(), config, directory)
+	require.Error(err)
+	assert.Contains(err.Error(), "isn't verified")
+	assert.Equal(err.Error(), config.GetMetadata(metadataUnverified))
+	_, err = os.Stat(directory)
+	assert.True(os.IsNotExist(err), "unverified commits aren't cloned")
+
+	// the status says why it wasn't built, rather than blaming provisioning
+	build := &mocks.Build{}
+	build.On("Token").Return("buildtoken")
+	build.On("Config").Return(config)
+	build.On("HasStopped").Return(true)
+	build.On("ExitCode").Return(1, nil)
+	build.On("Outcome").Return(core.OutcomeProvisionFailed)
+	build.On("WebStatusURL").Return("http://ngbuild/web/testapp/buildtoken/")
+	config.SetMetadata(core.MetadataFailureReason, "provisioning failed: "+err.Error())
+
+	g.updateBuildStatus(app, build)
+	require.NotNil(api.lastStatus.State)
+	assert.Equal("failure", *api.lastStatus.State)
+	require.NotNil(api.lastStatus.Description)
+	assert.Equal("Not built, commit headsha isn't verified (unsigned)", *api.lastStatus.Description)
+}
+
+func TestVerifyBuildCommitOptIn(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{responses: map[string]string{verifyCommitPath: commitFixture(true, "valid", "gopher@example.com")}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	ghApp := &githubApp{app: app}
+	g.apps["testapp"] = ghApp
+
+	// apps that haven't asked for verified commits don't even look
+	unverified, err := g.verifyBuildCommit(verifyConfig())
+	assert.NoError(err)
+	assert.Empty(unverified)
+	assert.Empty(api.requests)
+
+	ghApp.config.RequireVerifiedCommits = true
+	unverified, err = g.verifyBuildCommit(verifyConfig())
+	assert.NoError(err)
+	assert.Empty(unverified)
+	assert.Equal([]string{"GET " + verifyCommitPath}, api.requests)
+
+	ghApp.config.TrustedSigners = []string{"someoneelse@example.com"}
+	unverified, err = g.verifyBuildCommit(verifyConfig())
+	assert.NoError(err)
+	assert.Contains(unverified, "isn't a trusted signer")
+}
+
+func TestProvideForVerifyError(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	g := newTestGithub()
+	api := &githubAPI{notFound: map[string]bool{verifyCommitPath: true}}
+	server := newTestClient(g, api)
+	defer server.Close()
+
+	app := &mocks.App{}
+	app.On("Name").Return("testapp")
+	g.apps["testapp"] = &githubApp{app: app, config: githubConfig{RequireVerifiedCommits: true}}
+
+	config := verifyConfig()
+	err := g.ProvideFor(context.Background(), config, filepath.Join(os.TempDir(), "ngbuild-verify-error"))
+	require.Error(err)
+	assert.Contains(err.Error(), "couldn't check the signature")
+	assert.Empty(config.GetMetadata(metadataUnverified))
+
+	// github not answering is an error rather than the commit failing verification
+	build := &mocks.Build{}
+	build.On("Token").Return("buildtoken")
+	build.On("Config").Return(config)
+	build.On("HasStopped").Return(true)
+	build.On("ExitCode").Return(1, nil)
+	build.On("Outcome").Return(core.OutcomeProvisionFailed)
+	build.On("WebStatusURL").Return("http://ngbuild/web/testapp/buildtoken/")
+	config.SetMetadata(core.MetadataFailureReason, "provisioning failed: "+err.Error())
+
+	g.updateBuildStatus(app, build)
+	require.NotNil(api.lastStatus.State)
+	assert.Equal("error", *api.lastStatus.State)
+	require.NotNil(api.lastStatus.Description)
+	assert.Contains(*api.lastStatus.Description, "couldn't check the signature of headsha")
+}
@@ -5,98 +5,347 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/watchly/ngbuild/core"
 )
 
+var (
+	reGithubHook = regexp.MustCompile(`\/cb\/github\/hook\/(?P<appname>[a-zA-Z0-9_-]+)\/?$`)
+)
+
 func (g *Github) handleGithubEvent(resp http.ResponseWriter, req *http.Request) {
-	splits := strings.Split(req.URL.Path, "/")
-	appIndex := len(splits) - 1
+	d := delivery{
+		ID:       req.Header.Get("X-GitHub-Delivery"),
+		Event:    req.Header.Get("X-GitHub-Event"),
+		Received: time.Now().UTC(),
+	}
+	defer func() { g.deliveries.add(d) }()
 
-	appName := splits[appIndex]
+	data, err := core.RegexpNamedGroupsMatch(reGithubHook, req.URL.Path)
+	if err != nil {
+		logwarnf("Got webhook without an app name: %s", req.URL.Path)
+		d.decision = failed("no app name in %s", req.URL.Path)
+		http.Error(resp, "Webhook url is missing the app name, expected /cb/github/hook/<app>", http.StatusBadRequest)
+		return
+	}
+	appName := data["appname"]
+	d.App = appName
 
+	g.m.RLock()
 	app, ok := g.apps[appName]
+	g.m.RUnlock()
 	if ok == false {
 		logwarnf("Got unknown webhook app name: %s", appName)
+		d.decision = failed("unknown app")
+		http.Error(resp, fmt.Sprintf("Unknown app: %s", appName), http.StatusBadRequest)
 		return
 	}
 
-	eventType := req.Header.Get("X-GitHub-Event")
+	eventType := d.Event
 	if eventType == "" {
 		logwarnf("No event type specified in webhook")
+		d.decision = failed("missing X-GitHub-Event header")
+		http.Error(resp, "Missing X-GitHub-Event header", http.StatusBadRequest)
 		return
 	}
 
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		logcritf("Error decoding webhook %s:%s", req.URL.RawPath, err)
-		return
-	}
-	loginfof("Got webhook event: %s", eventType)
-
+	// the status codes and bodies we send back show up in the github "Recent Deliveries" panel
+	var handler func(*githubApp, []byte) decision
 	switch eventType {
+	case "ping":
+		handler = func(*githubApp, []byte) decision { return handled("pong") }
 	case "commit_comment":
-		g.handleGithubCommitComment(app, body)
+		handler = g.handleGithubCommitComment
 	case "delete":
-		g.handleGithubDelete(app, body)
+		handler = g.handleGithubDelete
 	case "pull_request":
-		g.handleGithubPullRequest(app, body)
+		handler = g.handleGithubPullRequest
 	case "issue_comment":
-		g.handleGithubIssueComment(app, body)
+		handler = g.handleGithubIssueComment
+	case "pull_request_review":
+		handler = g.handleGithubPullRequestReviewEvent
 	case "pull_request_review_comment":
-		g.handleGithubPullRequestReviewComment(app, body)
+		handler = g.handleGithubPullRequestReviewComment
 	case "push":
-		g.handleGithubPush(app, body)
+		handler = g.handleGithubPush
 
 	default:
 		logwarnf("Could not handle event type: %s", eventType)
+		d.decision = ignored("unsupported event type")
+		http.Error(resp, fmt.Sprintf("Unsupported event type: %s", eventType), http.StatusNotImplemented)
 		return
 	}
 
-	return
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logcritf("Error decoding webhook %s:%s", req.URL.RawPath, err)
+		d.decision = failed("couldn't read body: %s", err)
+		http.Error(resp, fmt.Sprintf("Couldn't read body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		logwarnf("Got malformed webhook event %s: %s", eventType, err)
+		d.decision = failed("malformed event: %s", err)
+		http.Error(resp, fmt.Sprintf("Malformed %s event: %s", eventType, err), http.StatusBadRequest)
+		return
+	}
+	loginfof("Got webhook event: %s", eventType)
+	d.Action = payload.Action
+
+	d.decision = handler(app, body)
+
+	switch status := d.decision.statusCode(); status {
+	case http.StatusAccepted:
+		resp.WriteHeader(status)
+		fmt.Fprintf(resp, "Accepted %s event for %s\n", eventType, appName)
+	default:
+		http.Error(resp, fmt.Sprintf("Couldn't handle %s event for %s: %s", eventType, appName, d.decision.Detail), status)
+	}
+}
+
+func (g *Github) handleGithubCommitComment(app *githubApp, body []byte) decision {
+	event := github.CommitCommentEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		logwarnf("Could not handle webhook: %s", err)
+		return malformed("couldn't parse event: %s", err)
+	}
+
+	comment := event.Comment
+	if comment == nil || comment.ID == nil || comment.CommitID == nil || comment.Body == nil ||
+		comment.User == nil || comment.User.Login == nil ||
+		event.Repo == nil || event.Repo.Name == nil || event.Repo.Owner == nil || event.Repo.Owner.Login == nil {
+		logwarnf("Commit comment is missing information")
+		return malformed("commit comment is missing information")
+	}
+
+	// "/rebuild failed" only rebuilds the build runners whose latest build of the commit failed
+	command := strings.TrimSpace(*comment.Body)
+	if command != "/rebuild" && command != "/rebuild failed" {
+		return ignored("comment isn't a command")
+	}
+
+	commit := *comment.CommitID
+	owner := *event.Repo.Owner.Login
+	repo := *event.Repo.Name
+	user := *comment.User.Login
+
+	// same as pull requests, only collaborators get to run things on our machine
+	isCollaborator, _, err := g.client.Repositories.IsCollaborator(owner, repo, user)
+	if err != nil {
+		logcritf("Couldn't check collaborator status for %s: %s", user, err)
+		return failed("couldn't check collaborator status for %s: %s", user, err)
+	} else if isCollaborator == false {
+		logwarnf("Ignoring /rebuild on %s, non collaborator: %s", commit, user)
+		return ignored("%s isn't a collaborator", user)
+	}
+
+	g.m.RLock()
+	build := g.findCommitBuild(app, owner, repo, commit)
+	g.m.RUnlock()
+
+	if build == nil {
+		logwarnf("Asked to rebuild %s/%s:%s, but no build exists for that commit", owner, repo, commit)
+		return ignored("no build of %s to rebuild", commit)
+	}
+
+	var tokens []string
+	if command == "/rebuild failed" {
+		tokens, err = build.NewFailedBuilds("github:BuildRunner")
+	} else {
+		var token string
+		token, err = build.NewBuild()
+		tokens = []string{token}
+	}
+	if err != nil {
+		logcritf("Couldn't rebuild %s/%s:%s: %s", owner, repo, commit, err)
+		return failed("couldn't rebuild %s: %s", commit, err)
+	} else if len(tokens) == 0 {
+		loginfof("Asked to rebuild the failed builds of %s/%s:%s, but none failed", owner, repo, commit)
+		return ignored("no failed builds of %s to rebuild", commit)
+	}
+	token := strings.Join(tokens, ",")
+	loginfof("rebuilding %s/%s:%s as %s", owner, repo, commit, token)
+
+	if _, _, err := g.client.Reactions.CreateCommentReaction(owner, repo, *comment.ID, "+1"); err != nil {
+		logwarnf("Couldn't react to commit comment %d: %s", *comment.ID, err)
+	}
+	return built("rebuilding %s as %s", commit, token)
+}
+
+// findCommitBuild will look for a branch build of the given commit, first in the builds we are tracking, then
+// in the history of the branches we build, hold the g.m lock when you call this
+func (g *Github) findCommitBuild(app *githubApp, owner, repo, commit string) core.Build {
+	isCommitBuild := func(build core.Build) bool {
+		config := build.Config()
+		return config.GetMetadata("github:BuildType") == "commit" &&
+			config.GetMetadata("github:BranchBuildOwner") == owner &&
+			config.GetMetadata("github:BranchBuildRepo") == repo &&
+			config.GetMetadata("github:BranchBuildCommit") == commit
+	}
+
+	for _, build := range g.trackedBuilds {
+		if isCommitBuild(build) {
+			return build
+		}
+	}
+
+	for _, branch := range app.config.BuildBranches {
+		for _, build := range app.app.GetBuildHistory(branch) {
+			if isCommitBuild(build) {
+				return build
+			}
+		}
+	}
+
+	return nil
 }
 
-func (g *Github) handleGithubCommitComment(app *githubApp, body []byte) {}
-func (g *Github) handleGithubDelete(app *githubApp, body []byte)        {}
+func (g *Github) handleGithubDelete(app *githubApp, body []byte) decision {
+	return ignored("nothing to do for deletes")
+}
 
-func (g *Github) handleGithubIssueComment(app *githubApp, body []byte) {}
+func (g *Github) handleGithubIssueComment(app *githubApp, body []byte) decision {
+	return ignored("nothing to do for issue comments")
+}
 
-func (g *Github) handleGithubPullRequest(app *githubApp, body []byte) {
+func (g *Github) handleGithubPullRequest(app *githubApp, body []byte) decision {
 	event := github.PullRequestEvent{}
 	if err := json.Unmarshal(body, &event); err != nil {
 		logwarnf("Could not handle webhook: %s", err)
-		return
+		return malformed("couldn't parse event: %s", err)
+	}
+	if event.Action == nil || event.PullRequest == nil {
+		return malformed("pull request event is missing information")
 	}
+
+	draft := isDraftPullRequest(body)
 	switch *event.Action {
 	case "opened":
 		loginfof("opened pull request")
-		g.trackPullRequest(app, &event)
+		return g.trackPullRequest(app, &event, draft)
 	case "synchronize":
 		loginfof("sync pull request")
-		g.updatePullRequest(app, &event)
+		// nobody has approved the new commits yet
+		g.m.Lock()
+		delete(g.approvals, strconv.Itoa(*event.PullRequest.ID))
+		g.m.Unlock()
+		return g.updatePullRequest(app, &event, draft)
+	case "ready_for_review":
+		loginfof("pull request ready for review")
+		return g.updatePullRequest(app, &event, false)
+	case "converted_to_draft":
+		loginfof("pull request converted to draft")
+		return g.draftPullRequest(app, &event)
 	case "closed":
 		loginfof("closed pull request")
-		g.closedPullRequest(app, &event)
+		return g.closedPullRequest(app, &event)
 	case "reopened":
 		loginfof("reopened pull request")
-		g.trackPullRequest(app, &event)
+		return g.trackPullRequest(app, &event, draft)
 	}
 
+	return ignored("nothing to do for %s pull requests", *event.Action)
+}
+
+// the vendored go-github doesn't know about draft pull requests yet
+type pullRequestDraftEvent struct {
+	PullRequest *struct {
+		Draft bool `json:"draft"`
+	} `json:"pull_request,omitempty"`
 }
 
-func (g *Github) handleGithubPullRequestReviewEvent(app *githubApp, body []byte) {
+func isDraftPullRequest(body []byte) bool {
+	event := pullRequestDraftEvent{}
+	if err := json.Unmarshal(body, &event); err != nil || event.PullRequest == nil {
+		return false
+	}
+	return event.PullRequest.Draft
+}
+
+// the vendored go-github doesn't know about pull request reviews yet
+type pullRequestReviewEvent struct {
+	Action *string `json:"action,omitempty"`
+	Review *struct {
+		State    *string      `json:"state,omitempty"`
+		User     *github.User `json:"user,omitempty"`
+		CommitID *string      `json:"commit_id,omitempty"`
+	} `json:"review,omitempty"`
+	PullRequest *github.PullRequest `json:"pull_request,omitempty"`
+}
+
+func (g *Github) handleGithubPullRequestReviewEvent(app *githubApp, body []byte) decision {
+	event := pullRequestReviewEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		logwarnf("Could not handle webhook: %s", err)
+		return malformed("couldn't parse event: %s", err)
+	}
+
+	if event.PullRequest == nil || event.Review == nil || event.Review.State == nil ||
+		event.Review.User == nil || event.Review.User.Login == nil {
+		logwarnf("Pull request review is missing information")
+		return malformed("pull request review is missing information")
+	}
+
+	pull := event.PullRequest
+	pullID := strconv.Itoa(*pull.ID)
+	user := *event.Review.User.Login
+	if app.isApprover(user) == false {
+		loginfof("Ignoring review on %s from %s, not an approver", pullID, user)
+		return ignored("%s isn't an approver", user)
+	}
+
+	commit := ""
+	if event.Review.CommitID != nil {
+		commit = *event.Review.CommitID
+	} else if pull.Head != nil && pull.Head.SHA != nil {
+		commit = *pull.Head.SHA
+	}
+
+	switch strings.ToLower(*event.Review.State) {
+	case "approved":
+		loginfof("Pull request %s approved by %s", pullID, user)
+		g.m.Lock()
+		g.approvals[pullID] = pullRequestApproval{commit: commit, mergeOnPass: app.config.MergeOnPass}
+		building := len(g.trackedPullRequests[pullID].currentBuilds) > 0
+		g.m.Unlock()
 
+		// it goes through the same checks as any other pull request event would
+		if app.config.BuildOnApproval && building == false {
+			return g.trackPullRequest(app, &github.PullRequestEvent{PullRequest: pull}, isDraftPullRequest(body))
+		}
+		return handled("approved by %s", user)
+	case "changes_requested":
+		loginfof("Changes requested on pull request %s by %s", pullID, user)
+		g.m.Lock()
+		delete(g.approvals, pullID)
+		g.m.Unlock()
+		return handled("changes requested by %s", user)
+	}
+
+	return ignored("nothing to do for %s reviews", *event.Review.State)
 }
 
-func (g *Github) handleGithubPullRequestReviewComment(app *githubApp, body []byte) {}
+func (g *Github) handleGithubPullRequestReviewComment(app *githubApp, body []byte) decision {
+	return ignored("nothing to do for review comments")
+}
 
-func (g *Github) handleGithubPush(app *githubApp, body []byte) {
+func (g *Github) handleGithubPush(app *githubApp, body []byte) decision {
 	event := github.WebHookPayload{} // badly named, is a new commit
 	if err := json.Unmarshal(body, &event); err != nil {
 		logwarnf("Could not handle webhook: %s", err)
-		return
+		return malformed("couldn't parse event: %s", err)
+	}
+	if event.Ref == nil {
+		return malformed("push event is missing its ref")
 	}
 
 	refs := strings.Split(*event.Ref, "/")
@@ -109,7 +358,7 @@ func (g *Github) handleGithubPush(app *githubApp, body []byte) {
 
 	if branch == "" {
 		logcritf("Branch is nil, something went wrong, ref=%s", *event.Ref)
-		return
+		return malformed("no branch in ref %s", *event.Ref)
 	}
 
 	commitHash := *event.HeadCommit.ID
@@ -128,7 +377,7 @@ func (g *Github) handleGithubPush(app *githubApp, body []byte) {
 	}
 	if foundBranch == false {
 		logwarnf("Branch %s is not buildBranch, add this branch to the buildBranches config to build this branch", branch)
-		return
+		return ignored("%s isn't in buildBranches", branch)
 	}
 
 	for _, build := range g.trackedBuilds {
@@ -137,29 +386,75 @@ func (g *Github) handleGithubPush(app *githubApp, body []byte) {
 			build.Config().GetMetadata("github:BranchBuildOwner") == owner &&
 			build.Config().GetMetadata("github:BranchBuildCommit") == commitHash {
 			// commit already tracked and building
-			return
+			return ignored("already building %s", commitHash)
 		}
 	}
 
 	// if we get here, we should build this commit, fo sho
-	buildConfig := core.NewBuildConfig()
-	buildConfig.Title = fmt.Sprintf("%s(%s):%s branch build", repoName, branch, commitHash)
-	buildConfig.URL = *event.Compare
-	buildConfig.BaseRepo = *event.Repo.SSHURL
-	buildConfig.BaseBranch = branch
-	buildConfig.BaseHash = commitHash
-	buildConfig.Group = branch
-
-	buildConfig.SetMetadata("github:BuildType", "commit")
-	buildConfig.SetMetadata("github:BranchBuild", branch)
-	buildConfig.SetMetadata("github:BranchBuildRepo", repoName)
-	buildConfig.SetMetadata("github:BranchBuildOwner", owner)
-	buildConfig.SetMetadata("github:BranchBuildCommit", commitHash)
-
-	_, err := app.app.NewBuild(buildConfig.Group, buildConfig)
-	if err != nil {
-		logcritf("Couldn't start build for %s(%s):%s", repoName, branch, commitHash)
-		return
+	runners := []string{""}
+	if len(app.config.BuildRunners) > 0 {
+		runners = allBuildRunners(app.config.BuildRunners)
+		if files := pushedFiles(&event); len(files) > 0 {
+			runners = selectBuildRunners(app.config.BuildRunners, files)
+		}
+		g.setSkippedStatuses(app, owner, repoName, commitHash, runners)
+		if len(runners) == 0 {
+			loginfof("Not building %s(%s):%s, nothing changed matches buildRunners", repoName, branch, commitHash)
+			return ignored("nothing changed matches buildRunners")
+		}
+	}
+
+	var tokens, deduped []string
+	for _, runner := range runners {
+		if token, ok := g.recentlyBuilt(app, owner, repoName, commitHash, runner); ok {
+			loginfof("Not building %s(%s):%s, it was already built by %s", repoName, branch, commitHash, token)
+			deduped = append(deduped, token)
+			continue
+		}
+
+		buildConfig := core.NewBuildConfig()
+		buildConfig.Title = fmt.Sprintf("%s(%s):%s branch build", repoName, branch, commitHash)
+		buildConfig.URL = *event.Compare
+		buildConfig.BaseRepo = *event.Repo.SSHURL
+		buildConfig.BaseBranch = branch
+		buildConfig.BaseHash = commitHash
+		buildConfig.Group = branch
+
+		buildConfig.SetMetadata("github:App", app.app.Name())
+		buildConfig.SetMetadata("github:BuildType", "commit")
+		buildConfig.SetMetadata("github:BranchBuild", branch)
+		buildConfig.SetMetadata("github:BranchBuildRepo", repoName)
+		buildConfig.SetMetadata("github:BranchBuildOwner", owner)
+		buildConfig.SetMetadata("github:BranchBuildCommit", commitHash)
+		if runner != "" {
+			buildConfig.BuildRunner = runner
+			buildConfig.SetMetadata("github:BuildRunner", runner)
+			buildConfig.SetMetadata(metadataBuildRunners, strings.Join(runners, ","))
+		}
+
+		token, err := app.app.NewBuild(buildConfig.Group, buildConfig)
+		if err != nil {
+			logcritf("Couldn't start build for %s(%s):%s", repoName, branch, commitHash)
+			continue
+		}
+		tokens = append(tokens, token)
+		g.addRecentlyBuilt(app, owner, repoName, commitHash, runner, token)
+		loginfof("started build: %s(%s):%s", repoName, branch, commitHash)
+	}
+
+	if len(tokens) == 0 && len(deduped) > 0 {
+		return ignored("%s was already built by %s", commitHash, strings.Join(deduped, ", "))
+	}
+	return startedBuilds(tokens)
+}
+
+// pushedFiles returns every file added, modified or removed by the commits in a push, github leaves these out
+// when there are too many commits so it may be empty
+func pushedFiles(event *github.WebHookPayload) (files []string) {
+	for _, commit := range event.Commits {
+		files = append(files, commit.Added...)
+		files = append(files, commit.Modified...)
+		files = append(files, commit.Removed...)
 	}
-	loginfof("started build: %s(%s):%s", repoName, branch, commitHash)
+	return files
 }
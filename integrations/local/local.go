@@ -0,0 +1,111 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/watchly/ngbuild/core"
+)
+
+// Local provides builds from a directory that is already on disk, HeadRepo is file:///path/to/directory.
+// The directory is copied into the workspace so the build can't touch the original
+type Local struct{}
+
+// New ...
+func New() *Local {
+	return &Local{}
+}
+
+// Identifier ...
+func (l *Local) Identifier() string { return "local" }
+
+// IsProvider is true for file:// repos, and for an empty one because local builds have nothing to merge into
+func (l *Local) IsProvider(source string) bool {
+	return strings.HasPrefix(source, core.LocalRepoScheme) || source == ""
+}
+
+// ProvideFor copies the directory in config.HeadRepo into directory
+func (l *Local) ProvideFor(ctx context.Context, config *core.BuildConfig, directory string) error {
+	if strings.HasPrefix(config.HeadRepo, core.LocalRepoScheme) == false {
+		return fmt.Errorf("%s isn't a local directory", config.HeadRepo)
+	}
+	if config.BaseRepo != "" && config.BaseRepo != config.HeadRepo {
+		return errors.New("local builds can't be merged into another repo")
+	}
+
+	source := strings.TrimPrefix(config.HeadRepo, core.LocalRepoScheme)
+	if info, err := os.Stat(source); err != nil {
+		return err
+	} else if info.IsDir() == false {
+		return fmt.Errorf("%s isn't a directory", source)
+	}
+
+	loginfof("Copying %s into %s", source, directory)
+	return copyDirectory(ctx, source, directory)
+}
+
+// copyDirectory copies everything in src into dst, keeping modes and symlinks as they are
+func copyDirectory(ctx context.Context, src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relative)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if err := core.CopyFile(path, target); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		}
+
+		// sockets, devices and the like don't belong in a build
+		logwarnf("Not copying %s, it isn't a regular file", path)
+		return nil
+	})
+}
+
+// AttachToApp ...
+func (l *Local) AttachToApp(app core.App) error { return nil }
+
+// DetachFromApp ...
+func (l *Local) DetachFromApp(app core.App) error { return nil }
+
+// Ready is always nil, there is nothing to wait on
+func (l *Local) Ready() error { return nil }
+
+// Shutdown ...
+func (l *Local) Shutdown() {}
+
+func loginfof(str string, args ...interface{}) (ret string) {
+	ret = fmt.Sprintf("local-info: "+str+"\n", args...)
+	fmt.Print(ret)
+	return ret
+}
+
+func logwarnf(str string, args ...interface{}) (ret string) {
+	ret = fmt.Sprintf("local-warn: "+str+"\n", args...)
+	fmt.Print(ret)
+	return ret
+}
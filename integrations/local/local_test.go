@@ -0,0 +1,85 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/watchly/ngbuild/core"
+)
+
+func TestIsProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	l := New()
+	assert.Equal("local", l.Identifier())
+	assert.True(l.IsProvider("file:///home/gopher/src/ngbuild"))
+	assert.True(l.IsProvider(""), "local builds don't have a base repo")
+	assert.False(l.IsProvider("git@github.com:watchly/ngbuild.git"))
+	assert.NoError(l.Ready())
+}
+
+func TestProvideFor(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	source, err := ioutil.TempDir("", "ngbuild-local-source")
+	require.NoError(err)
+	defer os.RemoveAll(source) //nolint (errcheck)
+	workspace, err := ioutil.TempDir("", "ngbuild-local-workspace")
+	require.NoError(err)
+	defer os.RemoveAll(workspace) //nolint (errcheck)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(source, "build.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(source, "sub", "dir"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(source, "sub", "dir", "file"), []byte("contents"), 0644))
+	require.NoError(os.Symlink("sub/dir/file", filepath.Join(source, "link")))
+
+	l := New()
+	config := core.NewBuildConfig()
+	config.HeadRepo = core.LocalRepoScheme + source
+	require.NoError(l.ProvideFor(context.Background(), config, workspace))
+
+	info, err := os.Stat(filepath.Join(workspace, "build.sh"))
+	require.NoError(err)
+	assert.Equal(os.FileMode(0755), info.Mode().Perm(), "the build runner is still executable")
+
+	contents, err := ioutil.ReadFile(filepath.Join(workspace, "sub", "dir", "file"))
+	require.NoError(err)
+	assert.Equal("contents", string(contents))
+
+	link, err := os.Readlink(filepath.Join(workspace, "link"))
+	require.NoError(err)
+	assert.Equal("sub/dir/file", link)
+
+	// the original is left alone
+	require.NoError(os.Remove(filepath.Join(workspace, "build.sh")))
+	_, err = os.Stat(filepath.Join(source, "build.sh"))
+	assert.NoError(err)
+}
+
+func TestProvideForErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	l := New()
+	config := core.NewBuildConfig()
+	config.HeadRepo = "git@github.com:watchly/ngbuild.git"
+	assert.Error(l.ProvideFor(context.Background(), config, os.TempDir()))
+
+	config.HeadRepo = core.LocalRepoScheme + "/does/not/exist"
+	assert.Error(l.ProvideFor(context.Background(), config, os.TempDir()))
+
+	config.HeadRepo = core.LocalRepoScheme + os.TempDir()
+	config.BaseRepo = "git@github.com:watchly/ngbuild.git"
+	assert.Error(l.ProvideFor(context.Background(), config, os.TempDir()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config.BaseRepo = ""
+	assert.Equal(context.Canceled, l.ProvideFor(ctx, config, os.TempDir()))
+}
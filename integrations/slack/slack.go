@@ -5,10 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
-	"time"
 
 	"golang.org/x/oauth2"
 	oslack "golang.org/x/oauth2/slack"
@@ -21,26 +19,36 @@ import (
 
 const (
 	actionValueRebuild = "rebuild"
-	colorSucceeded     = "#36a64f"
-	colorFailed        = "#bb2c32"
+	// actionValueRerunFailed only rebuilds the build runners that failed, for builds that are one of several
+	actionValueRerunFailed = "rerunfailed"
+	colorSucceeded         = "#36a64f"
+	colorFailed            = "#bb2c32"
+	// colorCancelled is for builds that were stopped, they didn't fail as such
+	colorCancelled = "#9e9e9e"
+	// colorError is for builds that couldn't be provisioned or run, that's not the change's fault
+	colorError = "#daa038"
 )
 
 var (
 	errNoClient  = errors.New("Slack client is not authenticated")
 	oauth2Scopes = []string{"incoming-webhook"}
-	oauth2State  = fmt.Sprintf("%d%d%d", os.Getuid(), os.Getpid(), time.Now().Unix())
 	silent       = false
+
+	// slack only wants these three escaped in message text
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
 )
 
 type (
 	//Slack ...
 	Slack struct {
+		core.BaseIntegration
+
 		m            sync.RWMutex
 		client       *slack.Client
 		clientID     string
 		clientSecret string
-		hostname     string
 		apps         []core.App
+		handlers     map[core.App]core.EventHandler
 	}
 
 	tokenCache struct {
@@ -64,8 +72,9 @@ type (
 // NewSlack ...
 func NewSlack() *Slack {
 	s := &Slack{}
-	http.HandleFunc("/cb/auth/slack", s.handleSlackAuth())
-	http.HandleFunc("/cb/slack", s.handleSlackAction())
+	core.HandleFunc("/auth/slack", s.handleSlackAuthRedirect())
+	core.HandleFunc("/cb/auth/slack", s.handleSlackAuth())
+	core.HandleFunc("/cb/slack", s.handleSlackAction())
 
 	core.RegisterIntegration(s)
 
@@ -77,16 +86,6 @@ func (s *Slack) Identifier() string {
 	return "slack"
 }
 
-// IsProvider ...
-func (s *Slack) IsProvider(string) bool {
-	return false
-}
-
-// ProvideFor ...
-func (s *Slack) ProvideFor(*core.BuildConfig, string) error {
-	return errors.New("Slack can't provide, man")
-}
-
 // AttachToApp ...
 func (s *Slack) AttachToApp(app core.App) error {
 	s.m.Lock()
@@ -102,34 +101,41 @@ func (s *Slack) AttachToApp(app core.App) error {
 		} else {
 			s.clientID = cfg.ClientID
 			s.clientSecret = cfg.ClientSecret
+			core.RegisterSecret(cfg.ClientSecret)
 			go s.loadToken()
 		}
-
-		var gcfg struct {
-			Hostname string `mapstructure:"hostname"`
-		}
-		app.GlobalConfig(&gcfg)
-		if gcfg.Hostname == "" {
-			printWarning("Global configuration for app `%s` does not have a hostname specified", app.Name())
-			return nil
-		} else {
-			s.hostname = gcfg.Hostname
-		}
 	}
 
-	app.Listen(core.SignalBuildComplete, s.onBuildComplete(app))
+	if s.handlers == nil {
+		s.handlers = make(map[core.App]core.EventHandler)
+	}
+	s.handlers[app] = core.OnBuildComplete(app, s.onBuildComplete(app))
 	s.apps = append(s.apps, app)
 	return nil
 }
 
-// Shutdown ...
-func (s *Slack) Shutdown() {
+// DetachFromApp ...
+func (s *Slack) DetachFromApp(app core.App) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if handler, ok := s.handlers[app]; ok {
+		app.RemoveEventHandler(handler)
+		delete(s.handlers, app)
+	}
 
+	for i, a := range s.apps {
+		if a == app {
+			s.apps = append(s.apps[:i], s.apps[i+1:]...)
+			break
+		}
+	}
+	return nil
 }
 
-func (s *Slack) onBuildComplete(app core.App) func(map[string]string) {
-	return func(values map[string]string) {
-		token := values["token"]
+func (s *Slack) onBuildComplete(app core.App) func(core.BuildCompleteEvent) {
+	return func(event core.BuildCompleteEvent) {
+		token := event.Token
 		if build, err := app.GetBuild(token); err != nil {
 			printWarning("Build %s does not exist: %s", token, err.Error())
 		} else {
@@ -203,13 +209,26 @@ func (s *Slack) getBaseMessageParams(app core.App, build core.Build, succeeded b
 	color := colorSucceeded
 	suffix := "passed"
 
+	outcome := build.Outcome()
 	if !succeeded {
 		color = colorFailed
-		suffix = "failed"
+		suffix = strings.ToLower(outcome.String())
+		switch outcome {
+		case core.OutcomeCancelled:
+			color = colorCancelled
+		case core.OutcomeProvisionFailed, core.OutcomeInfrastructure:
+			color = colorError
+		case core.OutcomePending, core.OutcomeSucceeded:
+			// the exit code says it failed even if the outcome doesn't
+			suffix = "failed"
+		}
 	}
 
 	cfg := build.Config()
-	pull := cfg.GetMetadata("github:PullNumber")
+	title := cfg.Title
+	if pull := cfg.GetMetadata("github:PullNumber"); pull != "" {
+		title = fmt.Sprintf("#%s - %s", pull, cfg.Title)
+	}
 
 	params := slack.PostMessageParameters{
 		Attachments: []slack.Attachment{
@@ -217,15 +236,26 @@ func (s *Slack) getBaseMessageParams(app core.App, build core.Build, succeeded b
 				AuthorName: app.Name(),
 				Color:      color,
 				CallbackID: build.Token(),
-				Fallback:   fmt.Sprintf("#%s - %s: %s", pull, cfg.Title, suffix),
-				Title:      fmt.Sprintf("#%s - %s", pull, cfg.Title),
+				Fallback:   fmt.Sprintf("%s: %s", title, suffix),
+				Title:      title,
 				TitleLink:  cfg.URL,
-				Text:       fmt.Sprintf("Build time: %dm%ds\n<%s|View build>", int64(build.BuildTime().Minutes()), int64(build.BuildTime().Seconds())%60, fmt.Sprintf("http://%s/web/%s/%s", s.hostname, app.Name(), build.Token())),
+				Text:       fmt.Sprintf("Build time: %dm%ds\n<%s|View build>", int64(build.BuildTime().Minutes()), int64(build.BuildTime().Seconds())%60, build.WebStatusURL()),
 				MarkdownIn: []string{"title", "text"},
 			},
 		},
 	}
 
+	if author := cfg.GetMetadata("github:Author"); author != "" {
+		params.Attachments[0].Text = fmt.Sprintf("Opened by %s\n%s", textEscaper.Replace(author), params.Attachments[0].Text)
+	}
+	if description := cfg.GetMetadata("github:Description"); description != "" {
+		params.Attachments[0].Text = fmt.Sprintf("%s\n%s", textEscaper.Replace(description), params.Attachments[0].Text)
+	}
+
+	if reason := cfg.GetMetadata(core.MetadataFailureReason); !succeeded && reason != "" {
+		params.Attachments[0].Text = fmt.Sprintf("*%s*, %s\n%s", outcome, reason, params.Attachments[0].Text)
+	}
+
 	if !succeeded {
 		params.Attachments[0].Actions = []slack.AttachmentAction{
 			slack.AttachmentAction{
@@ -236,6 +266,14 @@ func (s *Slack) getBaseMessageParams(app core.App, build core.Build, succeeded b
 				Value: actionValueRebuild,
 			},
 		}
+		if cfg.GetMetadata("github:BuildRunners") != "" {
+			params.Attachments[0].Actions = append(params.Attachments[0].Actions, slack.AttachmentAction{
+				Name:  "rerunfailed",
+				Text:  "Rerun failed",
+				Type:  "button",
+				Value: actionValueRerunFailed,
+			})
+		}
 	}
 
 	return &params
@@ -244,15 +282,32 @@ func (s *Slack) getBaseMessageParams(app core.App, build core.Build, succeeded b
 //
 // HTTP Callbacks
 //
+// handleSlackAuthRedirect sends people off to slack to authenticate, with a state that is only good for this once
+// and only from the browser it was given to. Anybody can get here, so it's only for when we have no token at all
+func (s *Slack) handleSlackAuthRedirect() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if core.GetCache("slack:token") != "" {
+			http.Error(w, "Already authenticated with Slack", http.StatusForbidden)
+			return
+		}
+
+		http.Redirect(w, r, s.getOAuth2Config().AuthCodeURL(core.StartOAuth(w, "slack")), http.StatusFound)
+	}
+}
+
 func (s *Slack) handleSlackAuth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
 
-		state := q.Get("state")
-		if state != oauth2State {
+		if core.CheckOAuthCallback(w, r, "slack") == false {
 			w.Write([]byte("OAuth2 `state` was incorrect, something bad happened between Slack and us"))
 			return
 		}
+		// never replace the token we have
+		if core.GetCache("slack:token") != "" {
+			http.Error(w, "Already authenticated with Slack", http.StatusForbidden)
+			return
+		}
 
 		code := q.Get("code")
 		cfg := s.getOAuth2Config()
@@ -290,15 +345,26 @@ func (s *Slack) handleSlackAction() http.HandlerFunc {
 		token := actionData.CallbackID
 
 		switch action.Value {
-		case actionValueRebuild:
+		case actionValueRebuild, actionValueRerunFailed:
 			text := fmt.Sprintf(":arrows_counterclockwise: _*%s* requested a rebuild_", actionData.User.Name)
 
-			if app, build := s.buildForToken(token); app != nil && build != nil {
-				if _, err := build.NewBuild(); err != nil {
-					text = fmt.Sprintf(":cry: Unable to start build: %s", err.Error())
-				}
+			var err error
+			if action.Value == actionValueRebuild {
+				_, err = s.replayBuild(token)
 			} else {
+				var tokens []string
+				tokens, err = s.rerunFailedBuilds(token)
+				if err == nil && len(tokens) == 0 {
+					text = fmt.Sprintf(":ok_hand: _*%s* asked to rerun the failed builds, but none of them failed_", actionData.User.Name)
+				} else {
+					text = fmt.Sprintf(":arrows_counterclockwise: _*%s* requested a rerun of the failed builds_", actionData.User.Name)
+				}
+			}
+
+			if err == core.ErrBuildNotFound {
 				text = fmt.Sprintf(":confused: No matching builds for token %s", token)
+			} else if err != nil {
+				text = fmt.Sprintf(":cry: Unable to start build: %s", err.Error())
 			}
 
 			// Update the existing message so people don't keep requesting rebuilds
@@ -328,17 +394,35 @@ func (s *Slack) handleSlackAction() http.HandlerFunc {
 //
 // Internal
 //
-func (s *Slack) buildForToken(token string) (core.App, core.Build) {
+// replayBuild replays the build token with whichever app made it, builds don't say which app they belong to so
+// each is tried in turn
+func (s *Slack) replayBuild(token string) (string, error) {
 	s.m.RLock()
-	defer s.m.RUnlock()
+	apps := append([]core.App{}, s.apps...)
+	s.m.RUnlock()
+
+	for _, a := range apps {
+		if newToken, err := a.ReplayBuild(token); err != core.ErrBuildNotFound {
+			return newToken, err
+		}
+	}
+
+	return "", core.ErrBuildNotFound
+}
 
-	for _, a := range s.apps {
-		if build, _ := a.GetBuild(token); build != nil {
-			return a, build
+// rerunFailedBuilds rebuilds the build runners that failed for the commit of build token, with whichever app made it
+func (s *Slack) rerunFailedBuilds(token string) ([]string, error) {
+	s.m.RLock()
+	apps := append([]core.App{}, s.apps...)
+	s.m.RUnlock()
+
+	for _, a := range apps {
+		if build, err := a.GetBuild(token); err == nil {
+			return build.NewFailedBuilds("github:BuildRunner")
 		}
 	}
 
-	return nil, nil
+	return nil, core.ErrBuildNotFound
 }
 
 func (s *Slack) loadToken() {
@@ -379,17 +463,15 @@ func (s *Slack) getOAuth2Config() *oauth2.Config {
 		ClientID:     s.clientID,
 		ClientSecret: s.clientSecret,
 		Endpoint:     oslack.Endpoint,
-		RedirectURL:  fmt.Sprintf("%s/cb/auth/slack", strings.Replace(core.GetHTTPServerURL(), "http://", "https://", 1)),
+		RedirectURL:  fmt.Sprintf("%s/cb/auth/slack", core.GetHTTPServerURL()),
 		Scopes:       oauth2Scopes,
 	}
 }
 
 func (s *Slack) printAuthHelp() {
-	cfg := s.getOAuth2Config()
-
 	fmt.Println("")
 	printInfo("This app must be authenticated, please visit the following URL to authenticate this app:")
-	fmt.Println(cfg.AuthCodeURL(oauth2State))
+	fmt.Println(core.GetHTTPServerURL() + "/auth/slack")
 	fmt.Println("")
 }
 
@@ -1,6 +1,7 @@
 package slack
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -41,7 +42,7 @@ func TestBasics(t *testing.T) {
 	s := Slack{}
 
 	assert.Equal("slack", s.Identifier())
-	assert.Error(s.ProvideFor(nil, "foo"))
+	assert.Error(s.ProvideFor(context.Background(), nil, "foo"))
 }
 
 func TestAttachToApp(t *testing.T) {
@@ -82,12 +83,12 @@ func TestSignal(t *testing.T) {
 		t := args[0].(string)
 		assert.Equal(token, t)
 	})
-	onBuildCompleteFunc(map[string]string{})
+	onBuildCompleteFunc(core.BuildCompleteEvent{})
 	app.AssertExpectations(t)
 
 	token = "213j1i2j3i1oj3ij13"
 
-	onBuildCompleteFunc(map[string]string{"token": token})
+	onBuildCompleteFunc(core.BuildCompleteEvent{BuildEvent: core.BuildEvent{Token: token}})
 	println("?")
 
 	build := &mocks.Build{}
@@ -98,7 +99,7 @@ func TestSignal(t *testing.T) {
 	getBuildCall.Return(build, nil)
 
 	exitCodeCall.Return(0, errors.New("Nope"))
-	onBuildCompleteFunc(map[string]string{"token": token})
+	onBuildCompleteFunc(core.BuildCompleteEvent{BuildEvent: core.BuildEvent{Token: token}})
 
 	// Rest of the tests will actually want to post something to slack
 
@@ -108,7 +109,9 @@ func TestSignal(t *testing.T) {
 	configCall.Return(nil)
 
 	build.On("Token").Return(token)
+	build.On("WebStatusURL").Return("https://ngbuild.example.com/ci/web/ngbuild/" + token + "/")
 	build.On("BuildTime").Return(654 * time.Second)
+	build.On("Outcome").Return(core.OutcomeFailed)
 
 	api := &slackAPI{}
 	server := httptest.NewServer(api)
@@ -118,7 +121,7 @@ func TestSignal(t *testing.T) {
 
 	// Successful
 	exitCodeCall.Return(0, nil)
-	onBuildCompleteFunc(map[string]string{"token": token})
+	onBuildCompleteFunc(core.BuildCompleteEvent{BuildEvent: core.BuildEvent{Token: token}})
 	assert.NoError(api.lastError)
 	assert.Len(api.lastAttachments, 1)
 	assert.Equal(api.lastAttachments[0].Color, colorSucceeded)
@@ -126,7 +129,7 @@ func TestSignal(t *testing.T) {
 	assert.Len(api.lastAttachments[0].Actions, 0)
 
 	exitCodeCall.Return(1, nil)
-	onBuildCompleteFunc(map[string]string{"token": token})
+	onBuildCompleteFunc(core.BuildCompleteEvent{BuildEvent: core.BuildEvent{Token: token}})
 	assert.NoError(api.lastError)
 	assert.Len(api.lastAttachments, 1)
 	assert.Equal(api.lastAttachments[0].Color, colorFailed)
@@ -195,9 +198,9 @@ func TestActionCallback(t *testing.T) {
 	}
 	acb.Actions[0].Value = actionValueRebuild
 
-	getBuildCall := app.On("GetBuild", mock.Anything)
-	getBuildCall.Return(nil, errors.New("icanseeitinyoureyes"))
-	getBuildCall.Run(func(args mock.Arguments) {
+	replayCall := app.On("ReplayBuild", mock.Anything)
+	replayCall.Return("", core.ErrBuildNotFound)
+	replayCall.Run(func(args mock.Arguments) {
 		t := args[0].(string)
 		assert.Equal(token, t)
 	})
@@ -213,12 +216,7 @@ func TestActionCallback(t *testing.T) {
 	assert.Len(params.Attachments, 2)
 	assert.Contains(params.Attachments[1].Text, "No matching")
 
-	build := &mocks.Build{}
-
-	getBuildCall.Return(build, nil)
-
-	newBuildCall := build.On("NewBuild")
-	newBuildCall.Return("", errors.New("icanseeitinyoursmile"))
+	replayCall.Return("", errors.New("icanseeitinyoursmile"))
 
 	res = httptest.NewRecorder()
 	handleSlackAction(res, req)
@@ -227,7 +225,7 @@ func TestActionCallback(t *testing.T) {
 	assert.Len(params.Attachments, 2)
 	assert.Contains(params.Attachments[1].Text, "Unable to start")
 
-	newBuildCall.Return("yourealliveeverwanted", nil)
+	replayCall.Return("yourealliveeverwanted", nil)
 
 	res = httptest.NewRecorder()
 	handleSlackAction(res, req)
@@ -236,4 +234,101 @@ func TestActionCallback(t *testing.T) {
 	assert.Len(params.Attachments, 2)
 	assert.Contains(params.Attachments[1].Text, "requested a rebuild")
 	assert.Contains(params.Attachments[1].Text, "Stevie Wonder")
+
+	// rerunning the failed builds only rebuilds what the build says failed
+	build := &mocks.Build{}
+	rerunCall := build.On("NewFailedBuilds", "github:BuildRunner").Return([]string{"frontend"}, nil)
+	app.On("GetBuild", token).Return(build, nil)
+	acb.Actions[0].Value = actionValueRerunFailed
+
+	data, _ = json.Marshal(&acb)
+	req.Form.Set("payload", string(data))
+	res = httptest.NewRecorder()
+	handleSlackAction(res, req)
+	assert.NoError(json.Unmarshal(res.Body.Bytes(), &params))
+	assert.Contains(params.Attachments[1].Text, "requested a rerun of the failed builds")
+	assert.Empty(params.Attachments[0].Actions)
+
+	rerunCall.Return(nil, nil)
+	res = httptest.NewRecorder()
+	handleSlackAction(res, req)
+	assert.NoError(json.Unmarshal(res.Body.Bytes(), &params))
+	assert.Contains(params.Attachments[1].Text, "none of them failed")
+}
+
+func TestMessageTitle(t *testing.T) {
+	assert := assert.New(t)
+
+	s := Slack{}
+
+	app := &mocks.App{}
+	app.On("Name").Return("ngbuild")
+
+	cfg := core.NewBuildConfig()
+	cfg.Title = "Make everything better"
+	cfg.SetMetadata("github:PullRequestID", "87654321")
+	cfg.SetMetadata("github:PullNumber", "42")
+
+	build := &mocks.Build{}
+	build.On("Config").Return(cfg)
+	build.On("Token").Return("token")
+	build.On("WebStatusURL").Return("https://ngbuild.example.com/ci/web/ngbuild/token/")
+	build.On("BuildTime").Return(time.Second)
+	build.On("Outcome").Return(core.OutcomeFailed)
+
+	params := s.getBaseMessageParams(app, build, false)
+	assert.Equal("#42 - Make everything better: failed", params.Attachments[0].Fallback)
+	assert.Equal("#42 - Make everything better", params.Attachments[0].Title)
+	assert.NotContains(params.Attachments[0].Text, "Opened by")
+	assert.Contains(params.Attachments[0].Text, "<https://ngbuild.example.com/ci/web/ngbuild/token/|View build>",
+		"the link is the builds own, so it has the servers scheme and base path")
+
+	cfg.SetMetadata("github:Author", "gopher")
+	cfg.SetMetadata("github:Description", "Makes <everything> better")
+	params = s.getBaseMessageParams(app, build, false)
+	assert.Contains(params.Attachments[0].Text, "Makes &lt;everything&gt; better\nOpened by gopher\n")
+
+	// builds that aren't pull requests don't get a number at all
+	cfg = core.NewBuildConfig()
+	cfg.Title = "master branch build"
+	build = &mocks.Build{}
+	build.On("Config").Return(cfg)
+	build.On("Token").Return("token")
+	build.On("WebStatusURL").Return("https://ngbuild.example.com/ci/web/ngbuild/token/")
+	build.On("BuildTime").Return(time.Second)
+	outcome := build.On("Outcome").Return(core.OutcomeSucceeded)
+
+	params = s.getBaseMessageParams(app, build, true)
+	assert.Equal("master branch build: passed", params.Attachments[0].Fallback)
+	assert.NotContains(params.Attachments[0].Text, "build runner")
+
+	// builds that failed for a known reason say why
+	outcome.Return(core.OutcomeFailed)
+	cfg.SetMetadata(core.MetadataFailureReason, "build runner build.sh not found in repo")
+	params = s.getBaseMessageParams(app, build, false)
+	assert.Contains(params.Attachments[0].Text, "*Failed*, build runner build.sh not found in repo\n")
+	assert.Equal(colorFailed, params.Attachments[0].Color)
+
+	// and builds that failed for reasons that aren't the changes fault look different
+	outcome.Return(core.OutcomeTimedOut)
+	cfg.SetMetadata(core.MetadataFailureReason, "build didn't finish within its deadline of 30m0s")
+	params = s.getBaseMessageParams(app, build, false)
+	assert.Equal("master branch build: timed out", params.Attachments[0].Fallback)
+	assert.Contains(params.Attachments[0].Text, "*Timed out*, build didn't finish within its deadline of 30m0s\n")
+
+	outcome.Return(core.OutcomeCancelled)
+	params = s.getBaseMessageParams(app, build, false)
+	assert.Equal(colorCancelled, params.Attachments[0].Color)
+
+	outcome.Return(core.OutcomeProvisionFailed)
+	params = s.getBaseMessageParams(app, build, false)
+	assert.Equal(colorError, params.Attachments[0].Color)
+	assert.Equal("master branch build: provisioning failed", params.Attachments[0].Fallback)
+	assert.Len(params.Attachments[0].Actions, 1)
+
+	// builds that are one of several build runners can rerun just the ones that failed
+	cfg.SetMetadata("github:BuildRunners", "backend.sh,frontend.sh")
+	params = s.getBaseMessageParams(app, build, false)
+	assert.Len(params.Attachments[0].Actions, 2)
+	assert.Equal(actionValueRerunFailed, params.Attachments[0].Actions[1].Value)
 }
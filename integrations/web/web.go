@@ -1,8 +1,8 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -12,6 +12,8 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,24 +23,26 @@ import (
 
 // Web ...
 type Web struct {
+	core.BaseIntegration
+
 	m sync.RWMutex
 
-	apps   map[string]core.App
-	builds map[string]core.Build
+	apps     map[string]core.App
+	handlers map[string][]core.EventHandler
+	builds   map[string]core.Build
 
-	logs  []string
-	stats map[string]int
+	logs []core.LogEntry
 }
 
 // NewWeb ...
 func NewWeb() *Web {
 	w := &Web{
-		apps:   make(map[string]core.App),
-		builds: make(map[string]core.Build),
-		stats:  make(map[string]int),
+		apps:     make(map[string]core.App),
+		handlers: make(map[string][]core.EventHandler),
+		builds:   make(map[string]core.Build),
 	}
 
-	http.HandleFunc("/web/", w.routeHTTP)
+	core.HandleFunc("/web/", w.routeHTTP)
 
 	fmt.Printf("Visit the webUI on %s/web/status\n", core.GetHTTPServerURL())
 	return w
@@ -74,14 +78,41 @@ func (w *Web) status(resp http.ResponseWriter, req *http.Request) {
 	output += `<pre>`
 
 	output += "Stats:\n"
-	for key, value := range w.stats {
-		output += fmt.Sprintf("\t%s: %d\n", key, value)
+	appNames := make([]string, 0, len(w.apps))
+	for appName := range w.apps {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+	for _, appName := range appNames {
+		metrics := w.apps[appName].Metrics()
+		output += fmt.Sprintf("\t%s:\n", html.EscapeString(appName))
+		output += fmt.Sprintf("\t\tbuilds started: %d, completed: %d, failed: %d, running: %d\n",
+			metrics.Started, metrics.Completed, metrics.Failed, metrics.Running)
+		output += fmt.Sprintf("\t\tbuild time average: %s, median: %s\n", metrics.AverageBuildTime, metrics.MedianBuildTime)
+
+		groups := make([]string, 0, len(metrics.Groups))
+		for group := range metrics.Groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			groupMetrics := metrics.Groups[group]
+			output += fmt.Sprintf("\t\t%s: started: %d, completed: %d, failed: %d\n", html.EscapeString(group),
+				groupMetrics.Started, groupMetrics.Completed, groupMetrics.Failed)
+		}
 	}
 
+	janitor := core.GetJanitorStats()
+	output += "\nJanitor:\n"
+	output += fmt.Sprintf("\tlast run: %s (took %s)\n", janitor.LastRun.Format(time.RFC1123), janitor.Duration)
+	output += fmt.Sprintf("\tnext run: %s\n", janitor.NextRun.Format(time.RFC1123))
+	output += fmt.Sprintf("\tremoved: %d\n\terrors: %d\n", janitor.Removed, janitor.Errors)
+
 	output += "\nLogs:\n"
 	for i := len(w.logs) - 1; i > 0; i-- {
 		log := w.logs[i]
-		output += html.EscapeString(log) + "\n"
+		output += html.EscapeString(fmt.Sprintf("[%s] %-4s %-12s %s", log.Time.Format("15:04:05"), log.Level, log.App,
+			strings.TrimRight(log.Message, "\n"))) + "\n"
 	}
 
 	output += "\nNeil didn't make this look nicer yet"
@@ -108,23 +139,18 @@ func (w *Web) rebuild(resp http.ResponseWriter, req *http.Request) {
 
 	appName := data["appname"]
 	buildToken := data["buildtoken"]
-	cacheDir := w.cacheDir(appName, buildToken)
 
 	if app, ok := w.apps[appName]; ok {
-		buildConfig, err := core.UnmarshalBuildConfig(filepath.Join(cacheDir, "buildconfig.json"))
-		if err != nil {
-			logwarnf("error deserializing build config: %s", err)
-			resp.WriteHeader(502)
+		token, err := app.ReplayBuild(buildToken)
+		if err == core.ErrBuildNotFound {
+			resp.WriteHeader(404)
 			return
-		}
-
-		token, err := app.NewBuild(buildConfig.Group, buildConfig)
-		if err != nil {
-			logcritf("error creating new build: %s", err)
+		} else if err != nil {
+			logcritf("error replaying build: %s", err)
 			resp.WriteHeader(502)
 			return
 		}
-		baseURL := fmt.Sprintf("/web/%s/%s/", appName, token)
+		baseURL := fmt.Sprintf("%s/web/%s/%s/", core.BasePath(), appName, token)
 
 		// I don't know how to do a redirect in this go api, all i have is http status and response writing
 		output := fmt.Sprintf(`<html><head></head><body><a href="%s">click here</a></body></html>`, baseURL)
@@ -169,6 +195,27 @@ func (w *Web) asciinemaFormat(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// outputStats writes the builds OutputStats as json, only builds the app still knows about have stats
+func (w *Web) outputStats(resp http.ResponseWriter, app core.App, buildToken string) {
+	build, err := app.GetBuild(buildToken)
+	if err != nil {
+		resp.WriteHeader(404)
+		return
+	}
+
+	jsonData, err := json.Marshal(build.OutputStats())
+	if err != nil {
+		resp.WriteHeader(500)
+		logcritf("Couldn't marshal output stats: %s", err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	if _, err := resp.Write(jsonData); err != nil {
+		logwarnf("Couldn't write all to resp: %s", err)
+	}
+}
+
 func (w *Web) buildStatus(resp http.ResponseWriter, req *http.Request) {
 	w.m.RLock()
 	defer w.m.RUnlock()
@@ -181,7 +228,7 @@ func (w *Web) buildStatus(resp http.ResponseWriter, req *http.Request) {
 	appName := data["appname"]
 	buildToken := data["buildtoken"]
 
-	baseURL := fmt.Sprintf("/web/%s/%s/", appName, buildToken)
+	baseURL := fmt.Sprintf("%s/web/%s/%s/", core.BasePath(), appName, buildToken)
 	action := data["action"]
 
 	if action == "rebuild" {
@@ -195,6 +242,35 @@ func (w *Web) buildStatus(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if action == "stats" {
+		w.outputStats(resp, app, buildToken)
+		return
+	}
+
+	// nothing has been written for builds that haven't started yet
+	workspacePath := ""
+	commandLine := ""
+	outcome := ""
+	var stats *core.OutputStats
+	if build, err := app.GetBuild(buildToken); err == nil {
+		if build.WaitingOnGroup() {
+			resp.Write([]byte(fmt.Sprintf("<html><body>Build is waiting for the builds ahead of it in %s</body></html>", html.EscapeString(build.Group()))))
+			return
+		}
+		if position, length := build.QueuePosition(); position > 0 {
+			resp.Write([]byte(fmt.Sprintf("<html><body>Build is queued (position %d of %d)</body></html>", position, length)))
+			return
+		}
+		workspacePath = build.WorkspacePath()
+		commandLine = build.CommandLine()
+		outcome = build.Outcome().String()
+		if reason := build.Config().GetMetadata(core.MetadataFailureReason); reason != "" {
+			outcome += ", " + reason
+		}
+		buildStats := build.OutputStats()
+		stats = &buildStats
+	}
+
 	cacheDir := w.cacheDir(appName, buildToken)
 
 	buildConfig, err := os.Open(filepath.Join(cacheDir, "buildconfig.json"))
@@ -525,6 +601,35 @@ func (w *Web) buildStatus(resp http.ResponseWriter, req *http.Request) {
 	output += fmt.Sprintf(`<small> [<a href="%s/rebuild">rebuild</a>]</small>`, baseURL)
 	output += `</h1>`
 
+	if outcome != "" {
+		output += fmt.Sprintf("<p><strong>%s</strong></p>", html.EscapeString(outcome))
+	}
+	if author := config.GetMetadata("github:Author"); author != "" {
+		output += fmt.Sprintf("<p>Opened by %s</p>", html.EscapeString(author))
+	}
+	if description := config.GetMetadata("github:Description"); description != "" {
+		output += fmt.Sprintf("<p>%s</p>", html.EscapeString(description))
+	}
+	if runner := config.GetMetadata("github:BuildRunner"); runner != "" {
+		output += fmt.Sprintf("<p>Build runner: <code>%s</code></p>", html.EscapeString(runner))
+	}
+	if provider := config.GetMetadata(core.MetadataProvider); provider != "" {
+		output += fmt.Sprintf("<p>Provisioned by %s</p>", html.EscapeString(provider))
+	}
+	if workspacePath != "" {
+		output += fmt.Sprintf("<p>Workspace: <code>%s</code></p>", html.EscapeString(workspacePath))
+	}
+	if commandLine == "" {
+		commandLine = config.GetMetadata(core.MetadataCommandLine)
+	}
+	if commandLine != "" {
+		output += fmt.Sprintf("<p>Command: <code>%s</code></p>", html.EscapeString(commandLine))
+	}
+	if stats != nil {
+		output += fmt.Sprintf("<p>Output: %d bytes stdout, %d bytes stderr, peak %d bytes/s over %s</p>",
+			stats.StdoutBytes, stats.StderrBytes, stats.PeakBytesPerSecond, stats.Duration)
+	}
+
 	output += "<H3>Replay:</H3>"
 	output += fmt.Sprintf(`<div class="crt"><asciinema-player src="%s.json" theme="axiom" autoplay="yes please" speed=1></asciinema-player></div>`, baseURL)
 
@@ -557,43 +662,161 @@ type asciinema struct {
 	Stdout   [][]interface{} `json:"stdout"`
 }
 
-func writeAsciinemaTo(path, title, buildRunner string, stdout io.Reader, stderr io.Reader) {
-	currentAsciinema := asciinema{
-		Version: 1,
-		Width:   120,
-		Height:  30,
-		Title:   title,
+// asciinemaV2Header is the first line of a v2 recording, every line after it is a [time, "o", data] event
+type asciinemaV2Header struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title"`
+}
+
+// asciinemaRecorder is what writeAsciinemaTo writes frames to
+type asciinemaRecorder interface {
+	// frame adds text to the recording delay after the previous frame
+	frame(delay time.Duration, text string)
+	// finish is called once the build has finished, trailing is how long it's been since the last frame
+	finish(trailing time.Duration)
+}
+
+// asciinemaV1Recorder writes the whole recording each frame, the bundled player only understands v1
+type asciinemaV1Recorder struct {
+	path      string
+	recording asciinema
+}
+
+func (r *asciinemaV1Recorder) frame(delay time.Duration, text string) {
+	r.recording.Stdout = append(r.recording.Stdout, []interface{}{delay.Seconds(), text})
+	r.recording.Duration += delay.Seconds()
+	r.write()
+}
+
+func (r *asciinemaV1Recorder) finish(trailing time.Duration) {
+	r.recording.Duration += trailing.Seconds()
+	r.write()
+}
+
+func (r *asciinemaV1Recorder) write() {
+	data, err := json.MarshalIndent(r.recording, "", "  ")
+	if err != nil {
+		logcritf("Could not write data to asciinema format: %s", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(r.path, data, 0666); err != nil {
+		logcritf("Could not write data to %s: %s", r.path, err)
+	}
+}
+
+// asciinemaV2Recorder appends each frame to the file as it comes in
+type asciinemaV2Recorder struct {
+	file    *os.File
+	elapsed time.Duration
+}
+
+func newAsciinemaV2Recorder(path, title string) (*asciinemaV2Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// first of all we want to pre-fill our stdout with some faked data to say ./build.sh
-	currentAsciinema.Stdout = append(currentAsciinema.Stdout, []interface{}{
-		0.0,
-		fmt.Sprintf("[%s]ngbuild@watchmen $ ", time.Now().UTC().Format("15:04:05")),
+	header, err := json.Marshal(asciinemaV2Header{
+		Version:   2,
+		Width:     120,
+		Height:    30,
+		Timestamp: time.Now().Unix(),
+		Title:     title,
 	})
+	if err == nil {
+		_, err = file.Write(append(header, '\n'))
+	}
+	if err != nil {
+		file.Close() //nolint (errcheck)
+		return nil, err
+	}
+
+	return &asciinemaV2Recorder{file: file}, nil
+}
+
+func (r *asciinemaV2Recorder) frame(delay time.Duration, text string) {
+	// v2 events are timed from the start of the recording rather than from the previous event
+	r.elapsed += delay
+	event, err := json.Marshal([]interface{}{r.elapsed.Seconds(), "o", text})
+	if err != nil {
+		logcritf("Could not write data to asciinema format: %s", err)
+		return
+	}
+
+	if _, err := r.file.Write(append(event, '\n')); err != nil {
+		logcritf("Could not write data to %s: %s", r.file.Name(), err)
+	}
+}
 
-	buildRunner = "./" + buildRunner
-	for i := range buildRunner {
-		text := string(buildRunner[i])
-		if i == len(buildRunner)-1 {
-			text += "\n"
+func (r *asciinemaV2Recorder) finish(trailing time.Duration) {
+	if err := r.file.Close(); err != nil {
+		logcritf("Could not close %s: %s", r.file.Name(), err)
+	}
+}
+
+// writeAsciinemaTo records stdout/stderr to path, version is the asciinema format to use, 1 or 2
+func writeAsciinemaTo(path, title, command string, typeCommand bool, version int, stdout io.Reader, stderr io.Reader) {
+	var recorder asciinemaRecorder
+	if version == 2 {
+		v2Recorder, err := newAsciinemaV2Recorder(path, title)
+		if err != nil {
+			logcritf("Could not start asciinema recording %s: %s", path, err)
+			return
 		}
+		recorder = v2Recorder
+	} else {
+		recorder = &asciinemaV1Recorder{
+			path: path,
+			recording: asciinema{
+				Version: 1,
+				Width:   120,
+				Height:  30,
+				Title:   title,
+			},
+		}
+	}
+
+	// pre-fill our stdout with some faked data to say ./build.sh, or whatever ran the build
+	if typeCommand {
+		recorder.frame(0, fmt.Sprintf("[%s]ngbuild@watchmen $ ", time.Now().UTC().Format("15:04:05")))
+		for i := range command {
+			text := string(command[i])
+			if i == len(command)-1 {
+				text += "\n"
+			}
 
-		currentAsciinema.Stdout = append(currentAsciinema.Stdout, []interface{}{
-			(rand.Float64() * 0.1) + 0.1,
-			string(text),
-		})
+			recorder.frame(time.Duration((rand.Float64()*0.1+0.1)*float64(time.Second)), text)
+		}
 	}
 
-	startTime := time.Now().UTC()
+	// each frame's delay is from the frame before it, the build starts running when we start reading
+	lastFrameTime := time.Now()
+	interleave(stdout, stderr, func(data []byte) {
+		now := time.Now()
+		recorder.frame(now.Sub(lastFrameTime), string(data))
+		lastFrameTime = now
+	})
 
+	// the build may have run on for a while without saying anything before it finished
+	recorder.finish(time.Since(lastFrameTime))
+}
+
+// interleave calls output with whatever stdout and stderr have to say in the order it arrives, until both are done
+func interleave(stdout io.Reader, stderr io.Reader, output func([]byte)) {
 	readAll := func(data chan<- []byte, reader io.Reader) {
 		basebuf := [1024]byte{}
 		for {
 			n, err := reader.Read(basebuf[:])
-			if n < 1 || err != nil {
+			if n > 0 {
+				data <- append([]byte(nil), basebuf[:n]...)
+			}
+			if err != nil {
 				break
 			}
-			data <- basebuf[:n]
 		}
 		close(data)
 	}
@@ -604,105 +827,83 @@ func writeAsciinemaTo(path, title, buildRunner string, stdout io.Reader, stderr
 	go readAll(stdoutC, stdout)
 	go readAll(stderrC, stderr)
 
-	stderrClosed := false
-	stdoutClosed := false
-
-	lastOutputTime := time.Now().UTC()
-	for stderrClosed == false && stdoutClosed == false {
+	for stdoutC != nil || stderrC != nil {
+		var data []byte
+		var ok bool
 		select {
-		case data, ok := <-stdoutC:
+		case data, ok = <-stdoutC:
 			if ok == false {
-				stdoutClosed = true
-			} else {
-				currentAsciinema.Stdout = append(currentAsciinema.Stdout, []interface{}{
-					time.Now().UTC().Sub(lastOutputTime).Seconds(),
-					string(data),
-				})
-				lastOutputTime = time.Now().UTC()
+				stdoutC = nil
+				continue
 			}
-		case data, ok := <-stderrC:
+		case data, ok = <-stderrC:
 			if ok == false {
-				stderrClosed = true
-			} else {
-				currentAsciinema.Stdout = append(currentAsciinema.Stdout, []interface{}{
-					time.Now().UTC().Sub(lastOutputTime).Seconds(),
-					string(data),
-				})
-				lastOutputTime = time.Now().UTC()
+				stderrC = nil
+				continue
 			}
 		}
-		currentAsciinema.Duration = time.Now().UTC().
-			Add(time.Second * 15).
-			Sub(startTime).Seconds()
-
-		// work around a bug in the current player, add an extra line before writing, then remove it
-		currentAsciinema.Stdout = append(currentAsciinema.Stdout, []interface{}{
-			(time.Now().UTC().Sub(lastOutputTime) + (time.Second * 2)).Seconds(),
-			string("[33m[end of message...]"),
-		})
-		data, err := json.MarshalIndent(currentAsciinema, "", "  ")
-		currentAsciinema.Stdout = currentAsciinema.Stdout[:len(currentAsciinema.Stdout)-1]
-		if err != nil {
-			logcritf("Could not write data to asciinema format: %s", err)
-			continue
-		}
 
-		err = ioutil.WriteFile(path, data, 0666)
-		if err != nil {
-			logcritf("Could not write data to %s: %s", path, err)
-		}
+		output(data)
 	}
 }
 
-func writeAll(writer io.Writer, buf []byte) error {
-	for len(buf) > 0 {
-		n, err := writer.Write(buf)
-		buf = buf[n:]
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+// OutputLogPath is where the combined stdout and stderr of a build is kept, it is written as the build runs
+func OutputLogPath(appName, buildToken string) string {
+	return filepath.Join(core.CacheDirectory(), "web", appName, buildToken, "output.log")
 }
 
-func writeTo(path string, reader io.Reader) {
-	file, err := os.Create(path)
-	file.Close()
+// ExitCodePath is written with the builds exit code once everything it output is in OutputLogPath
+func ExitCodePath(appName, buildToken string) string {
+	return filepath.Join(core.CacheDirectory(), "web", appName, buildToken, "exitcode")
+}
 
-	for err == nil {
-		var readBuf [1024 * 4]byte
-		var n int
-		n, err = reader.Read(readBuf[:])
+// writeCombinedTo writes stdout and stderr to the output log as they come, then the builds exit code once it has
+// finished, so whatever is following the log knows it's complete
+func writeCombinedTo(appName, buildToken string, build core.Build, stdout io.Reader, stderr io.Reader) {
+	writer, err := core.NewAppendWriter(OutputLogPath(appName, buildToken))
+	if err != nil {
+		logcritf("error creating %s: %s", OutputLogPath(appName, buildToken), err)
+		return
+	}
 
-		file, oerr := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
-		if oerr != nil {
-			logcritf("error opening %s: %s", path, err)
-			return
-		}
+	interleave(stdout, stderr, func(data []byte) {
+		writer.Write(data) //nolint (errcheck)
+	})
+	if err := writer.Close(); err != nil {
+		logcritf("error writing %s: %s", OutputLogPath(appName, buildToken), err)
+	}
 
-		if werr := writeAll(file, readBuf[:n]); werr != nil {
-			err = werr
-		}
+	code, err := build.Wait(context.Background())
+	if err != nil {
+		logcritf("Couldn't wait for build %s: %s", buildToken, err)
+		return
+	}
+	ioutil.WriteFile(ExitCodePath(appName, buildToken), []byte(strconv.Itoa(code)), 0664) //nolint (errcheck)
+}
 
-		file.Close()
+func writeTo(path string, reader io.Reader) {
+	// start from an empty file, AppendToFile would add onto whatever is there
+	if err := ioutil.WriteFile(path, nil, 0664); err != nil {
+		logcritf("error creating %s: %s", path, err)
+		return
 	}
 
-	if err != nil && err != io.EOF {
+	if err := core.AppendToFile(path, reader); err != nil {
 		logcritf("error writing %s: %s", path, err)
 	}
-
 }
 
-func (w *Web) startMonitorBuild(data map[string]string) {
-	w.m.Lock()
-	defer w.m.Unlock()
-	loginfof("Starting monitoring of %+v", data)
+// startMonitorBuild keeps a builds config and output in its cache directory, only tracking the build happens under
+// the lock so a slow disk doesn't hold up every other build starting
+func (w *Web) startMonitorBuild(event core.BuildEvent) {
+	loginfof("Starting monitoring of %+v", event)
 
-	appName := data["app"]
-	token := data["token"]
+	appName := event.App
+	token := event.Token
 
+	w.m.RLock()
 	app := w.apps[appName]
+	w.m.RUnlock()
 	if app == nil {
 		logcritf("no app for %s", appName)
 		return
@@ -713,8 +914,10 @@ func (w *Web) startMonitorBuild(data map[string]string) {
 		logcritf("No build for %s", token)
 		return
 	}
-	w.builds[token] = build
 	build.Ref()
+	w.m.Lock()
+	w.builds[token] = build
+	w.m.Unlock()
 
 	cacheDir := w.cacheDir(appName, token)
 
@@ -741,7 +944,7 @@ func (w *Web) startMonitorBuild(data map[string]string) {
 	go writeTo(filepath.Join(cacheDir, "stdout.log"), stdout)
 	go writeTo(filepath.Join(cacheDir, "stderr.log"), stderr)
 
-	// get new stdout/errs for asciinema
+	// and again for the combined log
 	stdout, err = build.Stdout()
 	if err != nil {
 		logcritf("Couldn't get build stdout: %s", err)
@@ -753,40 +956,62 @@ func (w *Web) startMonitorBuild(data map[string]string) {
 		logcritf("Couldn't get build stderr: %s", err)
 		return
 	}
-	go writeAsciinemaTo(filepath.Join(cacheDir, "asciinema.json"), fmt.Sprintf("%s::%s", appName, token), build.Config().BuildRunner, stdout, stderr)
+	os.Remove(ExitCodePath(appName, token)) //nolint (errcheck)
+	ioutil.WriteFile(OutputLogPath(appName, token), nil, 0664) //nolint (errcheck)
+	go writeCombinedTo(appName, token, build, stdout, stderr)
 
-	w.stats["tracked builds total"]++
-	w.stats[fmt.Sprintf("(%s)current tracked builds", appName)] = len(w.builds)
+	// get new stdout/errs for asciinema
+	stdout, err = build.Stdout()
+	if err != nil {
+		logcritf("Couldn't get build stdout: %s", err)
+		return
+	}
+
+	stderr, err = build.Stderr()
+	if err != nil {
+		logcritf("Couldn't get build stderr: %s", err)
+		return
+	}
+	command := build.Config().GetMetadata(core.MetadataCommand)
+	if command == "" {
+		command = "./" + build.Config().BuildRunner
+	}
+	webConfig := struct {
+		// AsciinemaTypeCommand starts recordings with the build command being typed in
+		AsciinemaTypeCommand bool `mapstructure:"asciinemaTypeCommand"`
+		// AsciinemaVersion is the recording format, 2 is newer but the player on the build page only plays 1
+		AsciinemaVersion int `mapstructure:"asciinemaVersion"`
+	}{AsciinemaTypeCommand: true, AsciinemaVersion: 1}
+	app.Config("web", &webConfig) //nolint (errcheck)
+	go writeAsciinemaTo(filepath.Join(cacheDir, "asciinema.json"), fmt.Sprintf("%s::%s", appName, token), command,
+		webConfig.AsciinemaTypeCommand, webConfig.AsciinemaVersion, stdout, stderr)
 }
 
-func (w *Web) endMonitorBuild(data map[string]string) {
+func (w *Web) endMonitorBuild(event core.BuildCompleteEvent) {
+	token := event.Token
+
 	w.m.Lock()
-	defer w.m.Unlock()
+	build, ok := w.builds[token]
+	delete(w.builds, token)
+	w.m.Unlock()
 
-	token := data["token"]
-	appName := data["app"]
-	if build, ok := w.builds[token]; ok {
+	// the last unref removes the builds workspace
+	if ok {
 		build.Unref()
 	}
-	delete(w.builds, token)
-
-	w.stats[fmt.Sprintf("(%s)current tracked builds", appName)] = len(w.builds)
 }
 
 func (w *Web) logger(data map[string]string) {
 	w.m.Lock()
 	defer w.m.Unlock()
 
-	logTime := time.Now().Format("15:04:05")
-	logType := data["logtype"]
-	logMessage := data["logmessage"]
-
-	if logType == "" || logMessage == "" {
+	log := core.LogEntryFromEvent(data)
+	if log.Level == "" || log.Message == "" {
 		logcritf("got broken log message")
 		return
 	}
 
-	w.logs = append(w.logs, fmt.Sprintf("[%s]%s: %s", logTime, logType, logMessage))
+	w.logs = append(w.logs, log)
 	if len(w.logs) > 1000 {
 		w.logs = w.logs[len(w.logs)-1000:]
 	}
@@ -795,26 +1020,32 @@ func (w *Web) logger(data map[string]string) {
 // Identifier ...
 func (w *Web) Identifier() string { return "Web" }
 
-// IsProvider ...
-func (w *Web) IsProvider(string) bool { return false }
-
-//ProvideFor ...
-func (w *Web) ProvideFor(*core.BuildConfig, string) error { return errors.New("Can not provide") }
-
 //AttachToApp ...
 func (w *Web) AttachToApp(app core.App) error {
 	w.m.Lock()
 	defer w.m.Unlock()
 
 	w.apps[app.Name()] = app
-	app.Listen(core.SignalBuildStarted, w.startMonitorBuild)
-	app.Listen(core.SignalBuildComplete, w.endMonitorBuild)
-	app.Listen(core.EventCoreLog, w.logger)
+	w.handlers[app.Name()] = []core.EventHandler{
+		core.OnBuildStarted(app, w.startMonitorBuild),
+		core.OnBuildComplete(app, w.endMonitorBuild),
+		app.Listen(core.EventCoreLog, w.logger),
+	}
 	return nil
 }
 
-//Shutdown ...
-func (w *Web) Shutdown() {}
+//DetachFromApp ...
+func (w *Web) DetachFromApp(app core.App) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for _, handler := range w.handlers[app.Name()] {
+		app.RemoveEventHandler(handler)
+	}
+	delete(w.handlers, app.Name())
+	delete(w.apps, app.Name())
+	return nil
+}
 
 func loginfof(str string, args ...interface{}) (ret string) {
 	ret = fmt.Sprintf("web-info: "+str+"\n", args...)
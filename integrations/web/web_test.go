@@ -0,0 +1,204 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/watchly/ngbuild/core"
+	"github.com/watchly/ngbuild/mocks"
+)
+
+// monitoredBuild is a build with no output, stall is called whenever its output is asked for
+func monitoredBuild(stall func()) *mocks.Build {
+	build := &mocks.Build{}
+	build.On("Ref").Return()
+	build.On("Unref").Return()
+	build.On("Config").Return(core.NewBuildConfig())
+	output := func() io.Reader {
+		stall()
+		return strings.NewReader("")
+	}
+	build.On("Stdout").Return(output, nil)
+	build.On("Stderr").Return(func() io.Reader { return strings.NewReader("") }, nil)
+	build.On("Wait", mock.Anything).Return(0, nil)
+	return build
+}
+
+func TestStartMonitorBuildConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	w := &Web{
+		apps:     make(map[string]core.App),
+		handlers: make(map[string][]core.EventHandler),
+		builds:   make(map[string]core.Build),
+	}
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	slow := monitoredBuild(func() {
+		once.Do(func() {
+			close(blocked)
+			<-release
+		})
+	})
+	fast := monitoredBuild(func() {})
+
+	app := &mocks.App{}
+	app.On("Config", "web", mock.Anything).Return(nil)
+	app.On("GetBuild", "slow").Return(slow, nil)
+	app.On("GetBuild", "fast").Return(fast, nil)
+	w.apps["webtest"] = app
+	defer os.RemoveAll(w.cacheDir("webtest", "slow")) //nolint (errcheck)
+	defer os.RemoveAll(w.cacheDir("webtest", "fast")) //nolint (errcheck)
+
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		w.startMonitorBuild(core.BuildEvent{App: "webtest", Token: "slow"})
+	}()
+	<-blocked
+
+	// the slow build is stuck getting its output, that mustn't stop the fast one being monitored
+	fastDone := make(chan struct{})
+	go func() {
+		defer close(fastDone)
+		w.startMonitorBuild(core.BuildEvent{App: "webtest", Token: "fast"})
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second * 5):
+		close(release)
+		t.Fatal("startMonitorBuild waited on another builds I/O")
+	}
+
+	// nor it finishing
+	w.endMonitorBuild(core.BuildCompleteEvent{BuildEvent: core.BuildEvent{Token: "fast"}})
+	fast.AssertCalled(t, "Unref")
+
+	close(release)
+	<-slowDone
+	<-fastDone
+
+	w.m.RLock()
+	assert.Len(w.builds, 1)
+	assert.NotNil(w.builds["slow"])
+	w.m.RUnlock()
+}
+
+// buildOutput returns a builds stdout and stderr, that say "building" then "warning" a little while apart
+func buildOutput() (stdout io.Reader, stderr io.Reader) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		stdoutWriter.Write([]byte("building\n")) //nolint (errcheck)
+		time.Sleep(time.Millisecond * 50)
+		stderrWriter.Write([]byte("warning\n")) //nolint (errcheck)
+		stdoutWriter.Close()                    //nolint (errcheck)
+		stderrWriter.Close()                    //nolint (errcheck)
+	}()
+	return stdoutReader, stderrReader
+}
+
+func TestWriteAsciinemaV1(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-asciinema")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	path := filepath.Join(dir, "asciinema.json")
+
+	stdout, stderr := buildOutput()
+	writeAsciinemaTo(path, "a build", "ab", true, 1, stdout, stderr)
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	var recording asciinema
+	require.NoError(json.Unmarshal(raw, &recording))
+
+	assert.Equal(1, recording.Version)
+	assert.Equal(120, recording.Width)
+	assert.Equal(30, recording.Height)
+	assert.Equal("a build", recording.Title)
+
+	// the prompt, the command typed out a character at a time, then the output
+	require.Len(recording.Stdout, 5)
+	texts := []string{}
+	total := 0.0
+	for _, frame := range recording.Stdout {
+		require.Len(frame, 2)
+		texts = append(texts, frame[1].(string))
+		total += frame[0].(float64)
+	}
+	assert.Contains(texts[0], "ngbuild@watchmen $ ")
+	assert.Equal([]string{"a", "b\n", "building\n", "warning\n"}, texts[1:])
+
+	assert.Equal(0.0, recording.Stdout[0][0])
+	for _, typed := range recording.Stdout[1:3] {
+		assert.True(typed[0].(float64) >= 0.1 && typed[0].(float64) <= 0.2, "typing takes 0.1-0.2s a character")
+	}
+	// each frames delay is from the frame before it
+	assert.True(recording.Stdout[3][0].(float64) >= 0.04, "building came 50ms after the build started")
+	assert.True(recording.Stdout[4][0].(float64) >= 0.04, "warning came 50ms after building")
+	assert.True(recording.Duration >= total, "the duration covers every frame")
+	assert.True(recording.Duration < total+1, "the build finished right after its last frame")
+}
+
+func TestWriteAsciinemaV2(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ngbuild-asciinema")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	path := filepath.Join(dir, "asciinema.cast")
+
+	start := time.Now().Unix()
+	stdout, stderr := buildOutput()
+	writeAsciinemaTo(path, "a build", "ab", false, 2, stdout, stderr)
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+
+	// a header, then an event for each frame
+	require.Len(lines, 3)
+	var header asciinemaV2Header
+	require.NoError(json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(2, header.Version)
+	assert.Equal(120, header.Width)
+	assert.Equal(30, header.Height)
+	assert.Equal("a build", header.Title)
+	assert.True(header.Timestamp >= start)
+
+	texts := []string{}
+	times := []float64{}
+	for _, line := range lines[1:] {
+		var event []interface{}
+		require.NoError(json.Unmarshal([]byte(line), &event))
+		require.Len(event, 3)
+		assert.Equal("o", event[1])
+		times = append(times, event[0].(float64))
+		texts = append(texts, event[2].(string))
+	}
+	assert.Equal([]string{"building\n", "warning\n"}, texts)
+
+	// v2 times are from the start of the recording, so they only go up
+	assert.True(sort.Float64sAreSorted(times))
+	assert.True(times[0] >= 0.04, "building came 50ms after the build started")
+	assert.True(times[1]-times[0] >= 0.04, "warning came 50ms after building")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/watchly/ngbuild/integrations/web"
+)
+
+// logPollInterval is how often a log being followed is checked for more output
+var logPollInterval = time.Millisecond * 250
+
+// runLogsCommand is `ngbuild logs <app> <token>`, it streams the output of a build the server is running or has run
+// to the terminal and returns the exit code of the build once it's finished. Ctrl-C stops following the build, the
+// build itself carries on
+func runLogsCommand(args []string) int {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ngbuild logs <app> <token>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args) //nolint (errcheck)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	appName, token := flags.Arg(0), flags.Arg(1)
+
+	logPath := web.OutputLogPath(appName, token)
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		// builds from before there was a combined log only have their stdout and stderr
+		stdoutPath := filepath.Join(filepath.Dir(logPath), "stdout.log")
+		stderrPath := filepath.Join(filepath.Dir(logPath), "stderr.log")
+		if err := copyFile(os.Stdout, stdoutPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't find any logs for build %s of %s\n", token, appName)
+			return 2
+		}
+		copyFile(os.Stderr, stderrPath) //nolint (errcheck)
+		return 0
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			close(stop)
+		}
+	}()
+
+	code, err := followLog(logPath, web.ExitCodePath(appName, token), os.Stdout, stop)
+	if err == errDetached {
+		fmt.Fprintf(os.Stderr, "\nStopped following build %s, it is still running\n", token)
+		return 130
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return code
+}
+
+// errDetached is from followLog when it was stopped before the build finished
+var errDetached = errors.New("stopped following the log")
+
+// followLog copies the log at logPath to out as it grows, until the exit code is written to exitPath, then returns
+// that exit code. Closing stop returns errDetached without waiting any longer
+func followLog(logPath, exitPath string, out io.Writer, stop <-chan struct{}) (int, error) {
+	log, err := os.Open(logPath)
+	if err != nil {
+		return 0, err
+	}
+	defer log.Close() //nolint (errcheck)
+
+	for {
+		// the exit code is written after all of the output, so it has to be checked before the last copy
+		exitCode, exitErr := ioutil.ReadFile(exitPath)
+
+		if _, err := io.Copy(out, log); err != nil {
+			return 0, err
+		}
+
+		if exitErr == nil {
+			code, err := strconv.Atoi(strings.TrimSpace(string(exitCode)))
+			if err != nil {
+				return 0, fmt.Errorf("%s doesn't have an exit code in it: %s", exitPath, err)
+			}
+			return code, nil
+		}
+
+		select {
+		case <-stop:
+			return 0, errDetached
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// copyFile copies the file at path to out
+func copyFile(out io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint (errcheck)
+
+	_, err = io.Copy(out, file)
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFollowLog(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(interval time.Duration) { logPollInterval = interval }(logPollInterval)
+	logPollInterval = time.Millisecond * 10
+
+	dir, err := ioutil.TempDir("", "ngbuild-logs")
+	require.NoError(err)
+	defer os.RemoveAll(dir) //nolint (errcheck)
+	logPath := filepath.Join(dir, "output.log")
+	exitPath := filepath.Join(dir, "exitcode")
+
+	// a finished build is replayed
+	require.NoError(ioutil.WriteFile(logPath, []byte("out\nerr\n"), 0664))
+	require.NoError(ioutil.WriteFile(exitPath, []byte("3"), 0664))
+	out := &bytes.Buffer{}
+	code, err := followLog(logPath, exitPath, out, nil)
+	require.NoError(err)
+	assert.Equal(3, code)
+	assert.Equal("out\nerr\n", out.String())
+
+	// a running build is followed until it finishes
+	require.NoError(os.Remove(exitPath))
+	require.NoError(ioutil.WriteFile(logPath, []byte("first\n"), 0664))
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0664)
+		if err == nil {
+			file.Write([]byte("second\n")) //nolint (errcheck)
+			file.Close()                   //nolint (errcheck)
+		}
+		ioutil.WriteFile(exitPath, []byte("0"), 0664) //nolint (errcheck)
+	}()
+	out.Reset()
+	code, err = followLog(logPath, exitPath, out, nil)
+	require.NoError(err)
+	assert.Equal(0, code)
+	assert.Equal("first\nsecond\n", out.String(), "output written before the exit code isn't missed")
+
+	// detaching leaves the build to it
+	require.NoError(os.Remove(exitPath))
+	stop := make(chan struct{})
+	close(stop)
+	_, err = followLog(logPath, exitPath, ioutil.Discard, stop)
+	assert.Equal(errDetached, err)
+
+	_, err = followLog(filepath.Join(dir, "missing.log"), exitPath, ioutil.Discard, nil)
+	assert.Error(err)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/watchly/ngbuild/core"
 	"github.com/watchly/ngbuild/integrations/github"
@@ -12,8 +13,21 @@ import (
 )
 
 func main() {
+	core.ConfigureLogging()
+
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		os.Exit(runBuildCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplayCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "logs" {
+		os.Exit(runLogsCommand(os.Args[2:]))
+	}
+
 	fmt.Println(",.-~*´¨¯¨`*·~-.¸-(_NGBuild_)-,.-~*´¨¯¨`*·~-.¸")
-	fmt.Println("   Building your dreams, one step at a time\n")
+	fmt.Println("   Building your dreams, one step at a time")
+	fmt.Println("")
 
 	httpDone := core.StartHTTPServer()
 
@@ -41,12 +55,31 @@ To create an app, create an apps/ directory in your ngbuild directory and create
 		fmt.Printf("    %s\n", app.Name())
 	}
 
+	core.StartJanitor()
+
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Kill, os.Interrupt)
+	signal.Notify(signals, os.Kill, os.Interrupt, syscall.SIGHUP)
+
+mainloop:
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				break mainloop
+			}
 
-	select {
-	case <-signals:
-	case <-httpDone:
+			fmt.Println("Reloading apps")
+			added, removed := core.ReloadApps()
+			for _, app := range added {
+				fmt.Printf("    + %s\n", app.Name())
+			}
+			for _, app := range removed {
+				fmt.Printf("    - %s\n", app.Name())
+			}
+			apps = core.GetApps()
+		case <-httpDone:
+			break mainloop
+		}
 	}
 
 	fmt.Println("Thank you for choosing ngbuild, goodbye.")
@@ -10,6 +10,38 @@ type App struct {
 	mock.Mock
 }
 
+// ActiveBuilds provides a mock function with given fields:
+func (_m *App) ActiveBuilds() []core.Build {
+	ret := _m.Called()
+
+	var r0 []core.Build
+	if rf, ok := ret.Get(0).(func() []core.Build); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]core.Build)
+		}
+	}
+
+	return r0
+}
+
+// AllBuilds provides a mock function with given fields:
+func (_m *App) AllBuilds() []core.Build {
+	ret := _m.Called()
+
+	var r0 []core.Build
+	if rf, ok := ret.Get(0).(func() []core.Build); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]core.Build)
+		}
+	}
+
+	return r0
+}
+
 // AppLocation provides a mock function with given fields:
 func (_m *App) AppLocation() string {
 	ret := _m.Called()
@@ -38,6 +70,36 @@ func (_m *App) Config(namespace string, conf interface{}) error {
 	return r0
 }
 
+// DefaultBuildConfig provides a mock function with given fields:
+func (_m *App) DefaultBuildConfig() *core.BuildConfig {
+	ret := _m.Called()
+
+	var r0 *core.BuildConfig
+	if rf, ok := ret.Get(0).(func() *core.BuildConfig); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*core.BuildConfig)
+		}
+	}
+
+	return r0
+}
+
+// DryRunBuild provides a mock function with given fields: group, config
+func (_m *App) DryRunBuild(group string, config *core.BuildConfig) error {
+	ret := _m.Called(group, config)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, *core.BuildConfig) error); ok {
+		r0 = rf(group, config)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // GetBuild provides a mock function with given fields: token
 func (_m *App) GetBuild(token string) (core.Build, error) {
 	ret := _m.Called(token)
@@ -105,6 +167,34 @@ func (_m *App) Listen(event string, listener func(map[string]string)) core.Event
 	return r0
 }
 
+// ListenGlob provides a mock function with given fields: pattern, listener
+func (_m *App) ListenGlob(pattern string, listener func(map[string]string)) core.EventHandler {
+	ret := _m.Called(pattern, listener)
+
+	var r0 core.EventHandler
+	if rf, ok := ret.Get(0).(func(string, func(map[string]string)) core.EventHandler); ok {
+		r0 = rf(pattern, listener)
+	} else {
+		r0 = ret.Get(0).(core.EventHandler)
+	}
+
+	return r0
+}
+
+// ListenOnce provides a mock function with given fields: event, listener
+func (_m *App) ListenOnce(event string, listener func(map[string]string)) core.EventHandler {
+	ret := _m.Called(event, listener)
+
+	var r0 core.EventHandler
+	if rf, ok := ret.Get(0).(func(string, func(map[string]string)) core.EventHandler); ok {
+		r0 = rf(event, listener)
+	} else {
+		r0 = ret.Get(0).(core.EventHandler)
+	}
+
+	return r0
+}
+
 // Logcritf provides a mock function with given fields: _a0, _a1
 func (_m *App) Logcritf(_a0 string, _a1 ...interface{}) {
 	_m.Called(_a0, _a1)
@@ -120,6 +210,20 @@ func (_m *App) Logwarnf(_a0 string, _a1 ...interface{}) {
 	_m.Called(_a0, _a1)
 }
 
+// Metrics provides a mock function with given fields:
+func (_m *App) Metrics() core.Metrics {
+	ret := _m.Called()
+
+	var r0 core.Metrics
+	if rf, ok := ret.Get(0).(func() core.Metrics); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(core.Metrics)
+	}
+
+	return r0
+}
+
 // Name provides a mock function with given fields:
 func (_m *App) Name() string {
 	ret := _m.Called()
@@ -155,6 +259,27 @@ func (_m *App) NewBuild(group string, config *core.BuildConfig) (string, error)
 	return r0, r1
 }
 
+// ReplayBuild provides a mock function with given fields: token
+func (_m *App) ReplayBuild(token string) (string, error) {
+	ret := _m.Called(token)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(token)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(token)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // RemoveEventHandler provides a mock function with given fields: _a0
 func (_m *App) RemoveEventHandler(_a0 core.EventHandler) {
 	_m.Called(_a0)
@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"context"
 	"io"
 
 	"github.com/stretchr/testify/mock"
@@ -46,6 +47,20 @@ func (_m *Build) BuildTime() time.Duration {
 	return r0
 }
 
+// CommandLine provides a mock function with given fields:
+func (_m *Build) CommandLine() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // Config provides a mock function with given fields:
 func (_m *Build) Config() *core.BuildConfig {
 	ret := _m.Called()
@@ -83,6 +98,20 @@ func (_m *Build) ExitCode() (int, error) {
 	return r0, r1
 }
 
+// FailureReason provides a mock function with given fields:
+func (_m *Build) FailureReason() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // Group provides a mock function with given fields:
 func (_m *Build) Group() string {
 	ret := _m.Called()
@@ -162,6 +191,106 @@ func (_m *Build) NewBuild() (string, error) {
 	return r0, r1
 }
 
+// NewFailedBuilds provides a mock function with given fields: label
+func (_m *Build) NewFailedBuilds(label string) ([]string, error) {
+	ret := _m.Called(label)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(string) []string); ok {
+		r0 = rf(label)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(label)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Outcome provides a mock function with given fields:
+func (_m *Build) Outcome() core.Outcome {
+	ret := _m.Called()
+
+	var r0 core.Outcome
+	if rf, ok := ret.Get(0).(func() core.Outcome); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(core.Outcome)
+	}
+
+	return r0
+}
+
+// OutputStats provides a mock function with given fields:
+func (_m *Build) OutputStats() core.OutputStats {
+	ret := _m.Called()
+
+	var r0 core.OutputStats
+	if rf, ok := ret.Get(0).(func() core.OutputStats); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(core.OutputStats)
+	}
+
+	return r0
+}
+
+// Provider provides a mock function with given fields:
+func (_m *Build) Provider() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
+// ProvisionTime provides a mock function with given fields:
+func (_m *Build) ProvisionTime() time.Duration {
+	ret := _m.Called()
+
+	var r0 time.Duration
+	if rf, ok := ret.Get(0).(func() time.Duration); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(time.Duration)
+	}
+
+	return r0
+}
+
+// QueuePosition provides a mock function with given fields:
+func (_m *Build) QueuePosition() (int, int) {
+	ret := _m.Called()
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func() int); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 int
+	if rf, ok := ret.Get(1).(func() int); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Get(1).(int)
+	}
+
+	return r0, r1
+}
+
 // Ref provides a mock function with given fields:
 func (_m *Build) Ref() {
 	_m.Called()
@@ -260,6 +389,41 @@ func (_m *Build) Unref() {
 	_m.Called()
 }
 
+// Wait provides a mock function with given fields: ctx
+func (_m *Build) Wait(ctx context.Context) (int, error) {
+	ret := _m.Called(ctx)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context) int); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// WaitingOnGroup provides a mock function with given fields:
+func (_m *Build) WaitingOnGroup() bool {
+	ret := _m.Called()
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func() bool); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
 // WebStatusURL provides a mock function with given fields:
 func (_m *Build) WebStatusURL() string {
 	ret := _m.Called()
@@ -273,3 +437,17 @@ func (_m *Build) WebStatusURL() string {
 
 	return r0
 }
+
+// WorkspacePath provides a mock function with given fields:
+func (_m *Build) WorkspacePath() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
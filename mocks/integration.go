@@ -1,5 +1,6 @@
 package mocks
 
+import "context"
 import "github.com/watchly/ngbuild/core"
 import "github.com/stretchr/testify/mock"
 
@@ -24,6 +25,20 @@ func (_m *Integration) AttachToApp(_a0 core.App) error {
 	return r0
 }
 
+// DetachFromApp provides a mock function with given fields: _a0
+func (_m *Integration) DetachFromApp(_a0 core.App) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(core.App) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Identifier provides a mock function with given fields:
 func (_m *Integration) Identifier() string {
 	ret := _m.Called()
@@ -52,13 +67,27 @@ func (_m *Integration) IsProvider(_a0 string) bool {
 	return r0
 }
 
-// ProvideFor provides a mock function with given fields: c, directory
-func (_m *Integration) ProvideFor(c *core.BuildConfig, directory string) error {
-	ret := _m.Called(c, directory)
+// ProvideFor provides a mock function with given fields: ctx, c, directory
+func (_m *Integration) ProvideFor(ctx context.Context, c *core.BuildConfig, directory string) error {
+	ret := _m.Called(ctx, c, directory)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*core.BuildConfig, string) error); ok {
-		r0 = rf(c, directory)
+	if rf, ok := ret.Get(0).(func(context.Context, *core.BuildConfig, string) error); ok {
+		r0 = rf(ctx, c, directory)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Ready provides a mock function with given fields:
+func (_m *Integration) Ready() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
 	} else {
 		r0 = ret.Error(0)
 	}
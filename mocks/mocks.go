@@ -0,0 +1,10 @@
+package mocks
+
+import "github.com/watchly/ngbuild/core"
+
+// these will stop compiling when the mocks fall behind the interfaces they mock, regenerate with mockery
+var (
+	_ core.App         = (*App)(nil)
+	_ core.Build       = (*Build)(nil)
+	_ core.Integration = (*Integration)(nil)
+)